@@ -68,6 +68,11 @@ type LocalClient struct {
 	// connecting to the GUI client variants.
 	UseSocketOnly bool
 
+	// AuthenticateWithFactotum, on Plan 9, authenticates with tailscaled
+	// using factotum(4) when connecting, as tailscaled requires when run
+	// with --socket-factotum. It's ignored elsewhere.
+	AuthenticateWithFactotum bool
+
 	// tsClient does HTTP requests to the local Tailscale daemon.
 	// It's lazily initialized on first use.
 	tsClient     *http.Client
@@ -103,6 +108,7 @@ func (lc *LocalClient) defaultDialer(ctx context.Context, network, addr string)
 		}
 	}
 	s := safesocket.DefaultConnectionStrategy(lc.socket())
+	s.AuthenticateWithFactotum = lc.AuthenticateWithFactotum
 	return safesocket.Connect(s)
 }
 
@@ -198,27 +204,37 @@ func SetVersionMismatchHandler(f func(clientVer, serverVer string)) {
 }
 
 func (lc *LocalClient) send(ctx context.Context, method, path string, wantStatus int, body io.Reader) ([]byte, error) {
+	slurp, _, err := lc.sendWithHeaders(ctx, method, path, wantStatus, body, nil)
+	return slurp, err
+}
+
+// sendWithHeaders is like send, but also sends the request headers h
+// and returns the response headers.
+func (lc *LocalClient) sendWithHeaders(ctx context.Context, method, path string, wantStatus int, body io.Reader, h http.Header) ([]byte, http.Header, error) {
 	if jr, ok := body.(jsonReader); ok && jr.err != nil {
-		return nil, jr.err // fail early if there was a JSON marshaling error
+		return nil, nil, jr.err // fail early if there was a JSON marshaling error
 	}
 	req, err := http.NewRequestWithContext(ctx, method, "http://"+apitype.LocalAPIHost+path, body)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	for k, vv := range h {
+		req.Header[k] = vv
 	}
 	res, err := lc.doLocalRequestNiceError(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer res.Body.Close()
 	slurp, err := io.ReadAll(res.Body)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if res.StatusCode != wantStatus {
 		err = fmt.Errorf("%v: %s", res.Status, bytes.TrimSpace(slurp))
-		return nil, bestError(err, slurp)
+		return nil, nil, bestError(err, slurp)
 	}
-	return slurp, nil
+	return slurp, res.Header, nil
 }
 
 func (lc *LocalClient) get200(ctx context.Context, path string) ([]byte, error) {
@@ -1078,8 +1094,16 @@ func (lc *LocalClient) NetworkLockSubmitRecoveryAUM(ctx context.Context, aum tka
 
 // SetServeConfig sets or replaces the serving settings.
 // If config is nil, settings are cleared and serving is disabled.
+//
+// If config.ETag is set, as it is by GetServeConfig, the update fails
+// with a 412 Precondition Failed error if the serve config has changed
+// since then.
 func (lc *LocalClient) SetServeConfig(ctx context.Context, config *ipn.ServeConfig) error {
-	_, err := lc.send(ctx, "POST", "/localapi/v0/serve-config", 200, jsonBody(config))
+	var h http.Header
+	if config != nil && config.ETag != "" {
+		h = http.Header{"If-Match": {config.ETag}}
+	}
+	_, _, err := lc.sendWithHeaders(ctx, "POST", "/localapi/v0/serve-config", 200, jsonBody(config), h)
 	if err != nil {
 		return fmt.Errorf("sending serve config: %w", err)
 	}
@@ -1117,15 +1141,53 @@ func (lc *LocalClient) StreamServe(ctx context.Context, hp ipn.ServeStreamReques
 	return res.Body, nil
 }
 
-// GetServeConfig return the current serve config.
+// GetCircuitBreakerStatus returns the circuit breaker state of the serve
+// Proxy backend at hostPort, which may be given in any form accepted as a
+// Proxy backend, such as "3000" or "localhost:3000".
+func (lc *LocalClient) GetCircuitBreakerStatus(ctx context.Context, hostPort string) (*ipn.CircuitStatus, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/serve-circuit-status?backend="+url.QueryEscape(hostPort))
+	if err != nil {
+		return nil, fmt.Errorf("getting circuit breaker status: %w", err)
+	}
+	return decodeJSON[*ipn.CircuitStatus](body)
+}
+
+// GetUpstreamPoolStats returns the connection pool statistics of the serve
+// Proxy backend at hostPort, which may be given in any form accepted as a
+// Proxy backend, such as "3000" or "localhost:3000".
+func (lc *LocalClient) GetUpstreamPoolStats(ctx context.Context, hostPort string) (*ipn.UpstreamPoolStats, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/serve-pool-stats?backend="+url.QueryEscape(hostPort))
+	if err != nil {
+		return nil, fmt.Errorf("getting upstream pool stats: %w", err)
+	}
+	return decodeJSON[*ipn.UpstreamPoolStats](body)
+}
+
+// ServeRequestsInFlight returns the number of requests being proxied to
+// the serve Proxy backend at hostPort, which may be given in any form
+// accepted as a Proxy backend, such as "3000" or "localhost:3000".
+func (lc *LocalClient) ServeRequestsInFlight(ctx context.Context, hostPort string) (int64, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/serve-in-flight?backend="+url.QueryEscape(hostPort))
+	if err != nil {
+		return 0, fmt.Errorf("getting in-flight requests: %w", err)
+	}
+	return decodeJSON[int64](body)
+}
+
+// GetServeConfig return the current serve config, with its ETag set.
 //
 // If the serve config is empty, it returns (nil, nil).
 func (lc *LocalClient) GetServeConfig(ctx context.Context) (*ipn.ServeConfig, error) {
-	body, err := lc.send(ctx, "GET", "/localapi/v0/serve-config", 200, nil)
+	body, h, err := lc.sendWithHeaders(ctx, "GET", "/localapi/v0/serve-config", 200, nil, nil)
 	if err != nil {
 		return nil, fmt.Errorf("getting serve config: %w", err)
 	}
-	return getServeConfigFromJSON(body)
+	sc, err := getServeConfigFromJSON(body)
+	if err != nil || sc == nil {
+		return sc, err
+	}
+	sc.ETag = h.Get("Etag")
+	return sc, nil
 }
 
 func getServeConfigFromJSON(body []byte) (sc *ipn.ServeConfig, err error) {
@@ -95,6 +95,9 @@ func Run(args []string) (err error) {
 
 	rootfs := newFlagSet("tailscale")
 	rootfs.StringVar(&rootArgs.socket, "socket", paths.DefaultTailscaledSocket(), "path to tailscaled socket")
+	if runtime.GOOS == "plan9" {
+		rootfs.BoolVar(&rootArgs.socketFactotum, "socket-factotum", false, "authenticate with tailscaled using factotum(4), for a tailscaled run with --socket-factotum")
+	}
 
 	rootCmd := &ffcli.Command{
 		Name:       "tailscale",
@@ -166,6 +169,7 @@ func Run(args []string) (err error) {
 	}
 
 	localClient.Socket = rootArgs.socket
+	localClient.AuthenticateWithFactotum = rootArgs.socketFactotum
 	rootfs.Visit(func(f *flag.Flag) {
 		if f.Name == "socket" {
 			localClient.UseSocketOnly = true
@@ -195,7 +199,8 @@ func fatalf(format string, a ...any) {
 var Fatalf func(format string, a ...any)
 
 var rootArgs struct {
-	socket string
+	socket         string
+	socketFactotum bool
 }
 
 // usageFuncNoDefaultValues is like usageFunc but doesn't print default values.
@@ -45,7 +45,7 @@ func newFunnelCommand(e *serveEnv) *ffcli.Command {
 		ShortHelp: "Turn on/off Funnel service",
 		ShortUsage: strings.Join([]string{
 			"funnel <serve-port> {on|off}",
-			"funnel status [--json]",
+			"funnel status [--json | --field <path>]",
 		}, "\n  "),
 		LongHelp: strings.Join([]string{
 			"Funnel allows you to publish a 'tailscale serve'",
@@ -63,6 +63,7 @@ func newFunnelCommand(e *serveEnv) *ffcli.Command {
 				ShortHelp: "show current serve/funnel status",
 				FlagSet: e.newFlags("funnel-status", func(fs *flag.FlagSet) {
 					fs.BoolVar(&e.json, "json", false, "output JSON")
+					fs.StringVar(&e.field, "field", "", fieldFlagHelp)
 				}),
 				UsageFunc: usageFunc,
 			},
@@ -124,10 +125,14 @@ func (e *serveEnv) runFunnel(ctx context.Context, args []string) error {
 		mak.Set(&sc.AllowFunnel, hp, true)
 	} else {
 		delete(sc.AllowFunnel, hp)
-		// clear map mostly for testing
+		delete(sc.FunnelPaths, hp)
+		// clear maps mostly for testing
 		if len(sc.AllowFunnel) == 0 {
 			sc.AllowFunnel = nil
 		}
+		if len(sc.FunnelPaths) == 0 {
+			sc.FunnelPaths = nil
+		}
 	}
 	if err := e.lc.SetServeConfig(ctx, sc); err != nil {
 		return err
@@ -153,13 +158,16 @@ func (e *serveEnv) verifyFunnelEnabled(ctx context.Context, st *ipnstate.Status,
 		return hasHTTPS && hasFunnel
 	}
 	if hasFunnelAttrs(st.Self.Capabilities) {
-		return nil // already enabled
+		// Already enabled, but the requested port may not be allowed.
+		return ipn.CheckFunnelPort(port, st.Self.Capabilities)
 	}
 	enableErr := e.enableFeatureInteractive(ctx, "funnel", hasFunnelAttrs)
-	st, statusErr := e.getLocalClientStatusWithoutPeers(ctx) // get updated status; interactive flow may block
-	switch {
-	case statusErr != nil:
+	newSt, statusErr := e.getLocalClientStatusWithoutPeers(ctx) // get updated status; interactive flow may block
+	if statusErr != nil {
 		return fmt.Errorf("getting client status: %w", statusErr)
+	}
+	*st = *newSt
+	switch {
 	case enableErr != nil:
 		// enableFeatureInteractive is a new flow behind a control server
 		// feature flag. If anything caused it to error, fallback to using
@@ -179,6 +187,21 @@ func (e *serveEnv) verifyFunnelEnabled(ctx context.Context, st *ipnstate.Status,
 	return nil
 }
 
+// funnelPorts are the ports that Funnel can be allowed on.
+var funnelPorts = []uint16{443, 8443, tcpServePort}
+
+// withFunnelPortHint returns err, from checking whether Funnel is
+// allowed on port, with a suggestion to use --port to serve on another
+// port if Funnel is allowed there instead.
+func withFunnelPortHint(err error, port uint16, nodeAttrs []string) error {
+	for _, p := range funnelPorts {
+		if p != port && ipn.CheckFunnelAccess(p, nodeAttrs) == nil {
+			return fmt.Errorf("%w; try --port %d", err, p)
+		}
+	}
+	return err
+}
+
 // printFunnelWarning prints a warning if the Funnel is on but there is no serve
 // config for its host:port.
 func printFunnelWarning(sc *ipn.ServeConfig) {
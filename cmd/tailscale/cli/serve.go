@@ -12,6 +12,7 @@
 	"io"
 	"log"
 	"net"
+	"net/netip"
 	"net/url"
 	"os"
 	"path"
@@ -22,12 +23,16 @@
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
+	xmaps "golang.org/x/exp/maps"
 	"tailscale.com/client/tailscale"
 	"tailscale.com/envknob"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/tailcfg"
 	"tailscale.com/util/mak"
 	"tailscale.com/version"
@@ -54,7 +59,7 @@ func newServeCommand(e *serveEnv) *ffcli.Command {
 			"serve https:<port> <mount-point> <source> [off]",
 			"serve tcp:<port> tcp://localhost:<local-port> [off]",
 			"serve tls-terminated-tcp:<port> tcp://localhost:<local-port> [off]",
-			"serve status [--json]",
+			"serve status [--json | --field <path>]",
 			"serve reset",
 		}, "\n  "),
 		LongHelp: strings.TrimSpace(`
@@ -106,6 +111,7 @@ func newServeCommand(e *serveEnv) *ffcli.Command {
 				ShortHelp: "show current serve/funnel status",
 				FlagSet: e.newFlags("serve-status", func(fs *flag.FlagSet) {
 					fs.BoolVar(&e.json, "json", false, "output JSON")
+					fs.StringVar(&e.field, "field", "", fieldFlagHelp)
 				}),
 				UsageFunc: usageFunc,
 			},
@@ -143,6 +149,7 @@ func (e *serveEnv) newFlags(name string, setup func(fs *flag.FlagSet)) *flag.Fla
 //
 // The purpose of this interface is to allow tests to provide a mock.
 type localServeClient interface {
+	Status(context.Context) (*ipnstate.Status, error)
 	StatusWithoutPeers(context.Context) (*ipnstate.Status, error)
 	GetServeConfig(context.Context) (*ipn.ServeConfig, error)
 	SetServeConfig(context.Context, *ipn.ServeConfig) error
@@ -150,6 +157,9 @@ type localServeClient interface {
 	WatchIPNBus(ctx context.Context, mask ipn.NotifyWatchOpt) (*tailscale.IPNBusWatcher, error)
 	IncrementCounter(ctx context.Context, name string, delta int) error
 	StreamServe(ctx context.Context, req ipn.ServeStreamRequest) (io.ReadCloser, error) // TODO: testing :)
+	GetCircuitBreakerStatus(ctx context.Context, hostPort string) (*ipn.CircuitStatus, error)
+	GetUpstreamPoolStats(ctx context.Context, hostPort string) (*ipn.UpstreamPoolStats, error)
+	ServeRequestsInFlight(ctx context.Context, hostPort string) (int64, error)
 }
 
 // serveEnv is the environment the serve command runs within. All I/O should be
@@ -160,13 +170,118 @@ type localServeClient interface {
 // It also contains the flags, as registered with newServeCommand.
 type serveEnv struct {
 	// flags
-	json bool // output JSON (status only for now)
+	json          bool   // output JSON (status only for now)
+	field         string // JSON path of the only status field to print
+	schemaVersion string // with status, print this version of the stable JSON schema
+	raw           bool   // with status, print the serve config as JSON as is
+
+	// flags for the serve/funnel dev command (see newServeDevCommand)
+	check                 bool          // validate only; don't change the serve config
+	timeout               time.Duration // stop serving after this long, if non-zero
+	reconnect             bool          // restart the serve stream if it's lost, such as when tailscaled restarts
+	protocol              string        // "http", or "tcp" to forward raw TCP connections
+	port                  uint          // port to serve on; 0 means the protocol's default
+	localPort             uint          // with protocol "tcp", the port to forward to
+	mockFile              string        // file of mock responses to serve instead of a backend
+	abTestBackend         string        // second backend for A/B testing, if non-empty
+	abTestPercentage      int           // percentage of clients sent to abTestBackend
+	abTestCookie          bool          // keep clients on a backend with a cookie, not their IP
+	onRequestLog          string        // command to pipe request logs to
+	logShipURL            string        // HTTP endpoint to POST batches of request logs to
+	logShipInterval       time.Duration // how often to ship request logs
+	logShipBatchSize      int           // most request logs to ship at once
+	logShipMaxBuffer      int           // most request logs to buffer before dropping them
+	accessLogExclude      pathPrefixes  // paths whose request logs aren't printed
+	geoIPDB               string        // table of networks to look up clients' locations in
+	funnelPaths           pathPrefixes  // path prefixes Funnel is limited to
+	slowRequestThreshold  time.Duration // how slow a backend response must be to log as slow
+	slowRequestSampleRate float64       // fraction of slow request logs to print
+	trace                 bool          // log the timings of each request to the backend
+	logResponseBytes      bool          // log the size of each response body at the end of its request
+	tracePropagate        bool          // send W3C traceparent headers to the backend
+	requestIDPropagate    bool          // give requests an X-Request-ID, sent back to clients
+	upstreamTLSMinVersion string        // minimum TLS version for HTTPS backends
+	upstreamTLSReneg      string        // whether HTTPS backends may renegotiate TLS
+	upstreamRootCA        string        // path to PEM CA bundle for HTTPS backends
+	upstreamSNI           string        // TLS server name for HTTPS backends
+	backendTLSFingerprint string        // pinned SHA-256 of HTTPS backends' certificate
+	bearerTokenFile       string        // path to bearer token to send to backends
+	signSecretFile        string        // path to secret to sign requests to backends with
+	oidcDiscovery         string        // OIDC provider to get backend tokens from
+	oidcClientID          string        // OIDC client ID for backend tokens
+	oidcClientSecretFile  string        // path to OIDC client secret for backend tokens
+	accessOIDCDiscovery   string        // OIDC provider whose JWTs clients must send
+	accessOIDCAudience    string        // audience those JWTs must be issued for
+	backendAuthType       string        // "oauth2", or empty
+	oauth2TokenURL        string        // OAuth 2.0 token endpoint for backend tokens
+	oauth2ClientID        string        // OAuth 2.0 client ID for backend tokens
+	oauth2ClientSecret    string        // path to OAuth 2.0 client secret for backend tokens
+	oauth2Scopes          string        // comma-separated scopes of backend tokens
+	rateLimitFile         string        // path to per-path rate limits JSON
+	upstreamProxyProtocol string        // PROXY protocol version to send to backends
+	backendKeepAlive      bool          // send TCP keep-alive probes to backends
+	upstreamTCPNoDelay    bool          // disable Nagle's algorithm on backend connections
+	noKeepaliveBackends   urlPrefixes   // backend URL prefixes not to reuse connections to
+	keepRequestIDHeaders  headerNames   // headers passed to backends unchanged, besides X-Request-ID
+	upstreamUserAgent     string        // User-Agent for backends, or "pass-through"
+	sessionHeaders        bool          // send X-Tailscale-Session and X-Tailscale-Edge-Region to backends
+	sessionLabel          string        // sent to backends in X-Tailscale-Session-Label
+	sanitizeHeaders       bool          // replace clients' X-Forwarded-For, X-Forwarded-Host and X-Real-IP
+	forwardedHeaders      string        // "xff", "rfc7239", "both" or "none"
+	stripHeaders          headerNames   // more request headers not to send to backends
+	skipListenCheck       bool          // don't warn if nothing is listening on the backend
+	waitForUpstream       time.Duration // how long to wait for the backend to be healthy
+	healthCheckPath       string        // path to GET to check the backend is healthy
+	preheatConns          int           // connections to open to the backend when serving starts
+	upstreamRequired      bool          // fail if the backend isn't healthy in time
+	templatePort          uint          // {{.Port}} for "apply"
+	backendHTTPVersion    string        // "1.1" or "2"
+	backendDisableHTTP2   bool          // alias for backendHTTPVersion "1.1"
+	upstreamReadTimeout   time.Duration // per-read timeout for backends
+	upstreamStallTimeout  time.Duration // how long a backend's response body may stall
+	maxResponseSize       int64         // largest backend response body in bytes, if non-zero
+	noSniff               bool          // send nosniff and don't guess a missing Content-Type
+	cacheControlOverride  string        // replaces backends' Cache-Control, if non-empty
+	stripPragma           bool          // remove backends' Pragma
+	iKnowWhatImDoing      bool          // confirms cacheControlOverride and stripPragma
+	compressionOffload    bool          // re-encode compressed backend responses for the client
+	classifyErrors        bool          // log the likely cause of failed backend requests
+	idempotencyCacheTTL   time.Duration // how long to keep responses to requests with an Idempotency-Key
+	systemdNotify         bool          // send READY=1 (and WATCHDOG=1) to systemd
+	circuitBreaker        int           // consecutive backend failures to open the circuit
+	circuitCooldown       time.Duration // how long the circuit stays open
+	circuitHalfOpen       int           // trial requests to let through a half-open circuit
+	maxConnections        int           // most requests proxied to the backend at once
+	maxQueueWait          time.Duration // how long requests over maxConnections wait
+	honorRetryAfter       bool          // retry backend 503s with Retry-After
+	maxRetryAfter         time.Duration // longest Retry-After wait before a retry
+	upstreamPoolStats     bool          // collect backend connection pool stats
+	poolStatsInterval     time.Duration // how often to print pool stats, if non-zero
+	connectionEvents      bool          // log backend connections being opened and closed
+	connectionLogFile     string        // file to append backend connection events to
+	debugConnStates       bool          // log backend connections' changes of state
+	debugLogFile          string        // file to append backend connection states to
+	upstreamFlushInterval time.Duration // how often to flush backend responses; 0 means each write
+	logLevel              serveLogLevel // which messages to print to stderr
+	configFile            string        // path to a file of flag settings
+	configWatchDir        string        // directory whose serve-config.json is the configFile, reloaded on changes
+	auditLog              string        // file to log changes to the serve config to
+	auditLogRotateSize    int64         // size in bytes to rotate auditLog at, if non-zero
+	auditTail             bool          // with "audit", keep printing new records
+	sessionID             string        // of the foreground Funnel session, once it's started
+	bannerFile            string        // template to print when serving starts
+	quiet                 bool          // don't print the default banner
 
 	lc localServeClient // localClient interface, specific to serve
 
+	// reloadHandler, if non-nil, returns the handler of a foreground
+	// serve as reconfigured on SIGHUP. It's set by runServeDev.
+	reloadHandler func() (*ipn.HTTPHandler, error)
+
 	// optional stuff for tests:
 	testFlagOut io.Writer
 	testStdout  io.Writer
+	testStderr  io.Writer
 }
 
 // getSelfDNSName returns the DNS name of the current node.
@@ -443,7 +558,7 @@ func (e *serveEnv) handleWebServeRemove(ctx context.Context, srvPort uint16, mou
 	}
 	// delete existing handler, then cascade delete if empty
 	delete(sc.Web[hp].Handlers, mount)
-	if len(sc.Web[hp].Handlers) == 0 {
+	if len(sc.Web[hp].Handlers) == 0 && len(sc.Web[hp].MethodHandlers) == 0 {
 		delete(sc.Web, hp)
 		delete(sc.TCP, srvPort)
 	}
@@ -530,6 +645,72 @@ func expandProxyTarget(source string) (string, error) {
 	return url, nil
 }
 
+// expandTailnetTarget returns the proxy URL for a serve target of the
+// form tailnet://host:port[/path], which proxies to a port of another node
+// in the tailnet over HTTP. host is the node's MagicDNS name, short or
+// fully qualified, its hostname, or one of its Tailscale IPs.
+func (e *serveEnv) expandTailnetTarget(ctx context.Context, target string) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", fmt.Errorf("parsing url: %w", err)
+	}
+	port, err := strconv.ParseUint(u.Port(), 10, 16)
+	if port == 0 || err != nil {
+		return "", fmt.Errorf("invalid port %q in %s", u.Port(), target)
+	}
+	ip, err := e.tailnetNodeIP(ctx, u.Hostname())
+	if err != nil {
+		return "", err
+	}
+	return "http://" + net.JoinHostPort(ip.String(), u.Port()) + u.Path, nil
+}
+
+// tailnetNodeIP returns the Tailscale IP of the node named host, preferring
+// IPv4, as described for expandTailnetTarget.
+func (e *serveEnv) tailnetNodeIP(ctx context.Context, host string) (netip.Addr, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if !tsaddr.IsTailscaleIP(ip) {
+			return netip.Addr{}, fmt.Errorf("%v is not a Tailscale IP", ip)
+		}
+		return ip, nil
+	}
+	st, err := e.lc.Status(ctx)
+	if err != nil {
+		return netip.Addr{}, fixTailscaledConnectError(err)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	var byDNS, byHostName []*ipnstate.PeerStatus
+	for _, ps := range st.Peer {
+		dnsName := strings.ToLower(strings.TrimSuffix(ps.DNSName, "."))
+		short, _, _ := strings.Cut(dnsName, ".")
+		switch {
+		case host == dnsName || host == short:
+			byDNS = append(byDNS, ps)
+		case strings.EqualFold(host, ps.HostName):
+			byHostName = append(byHostName, ps)
+		}
+	}
+	matches := byDNS
+	if len(matches) == 0 {
+		matches = byHostName
+	}
+	switch {
+	case len(matches) == 0:
+		return netip.Addr{}, fmt.Errorf("no node named %q in the tailnet", host)
+	case len(matches) > 1:
+		return netip.Addr{}, fmt.Errorf("more than one node is named %q; use its MagicDNS name or Tailscale IP", host)
+	case len(matches[0].TailscaleIPs) == 0:
+		return netip.Addr{}, fmt.Errorf("node %q has no Tailscale IPs", host)
+	}
+	ips := matches[0].TailscaleIPs
+	for _, ip := range ips {
+		if ip.Is4() {
+			return ip, nil
+		}
+	}
+	return ips[0], nil
+}
+
 // handleTCPServe handles the "tailscale serve tls-terminated-tcp:..." subcommand.
 // It configures the serve config to forward TCP connections to the
 // given source.
@@ -644,11 +825,28 @@ func (e *serveEnv) runServeStatus(ctx context.Context, args []string) error {
 	if err != nil {
 		return err
 	}
-	if e.json {
-		j, err := json.MarshalIndent(sc, "", "  ")
+	if e.raw && e.schemaVersion != "" {
+		return errors.New("--raw and --schema-version can't both be given")
+	}
+	if e.json || e.field != "" || e.raw || e.schemaVersion != "" {
+		var v any = sc
+		switch e.schemaVersion {
+		case "":
+		case ipn.ServeStatusSchemaV1:
+			v, err = e.serveStatusV1(ctx, sc)
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported --schema-version %q; must be %s", e.schemaVersion, ipn.ServeStatusSchemaV1)
+		}
+		j, err := json.MarshalIndent(v, "", "  ")
 		if err != nil {
 			return err
 		}
+		if e.field != "" {
+			return e.printStatusField(j)
+		}
 		j = append(j, '\n')
 		e.stdout().Write(j)
 		return nil
@@ -679,6 +877,104 @@ func (e *serveEnv) runServeStatus(ctx context.Context, args []string) error {
 	return nil
 }
 
+// serveStatusV1 returns the serve status for sc in version 1 of the
+// stable JSON schema.
+func (e *serveEnv) serveStatusV1(ctx context.Context, sc *ipn.ServeConfig) (*ipn.ServeStatusV1, error) {
+	st, err := e.getLocalClientStatusWithoutPeers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ss := &ipn.ServeStatusV1{
+		SchemaVersion: ipn.ServeStatusSchemaV1,
+		Version:       st.Version,
+		Handlers:      []ipn.ServeStatusV1Handler{},
+	}
+	if sc == nil {
+		return ss, nil
+	}
+	add := func(hp ipn.HostPort, mount, method string, h *ipn.HTTPHandler) error {
+		sh := ipn.ServeStatusV1Handler{
+			HostPort: hp,
+			Mount:    mount,
+			Method:   method,
+			Funnel:   sc.AllowFunnel[hp],
+		}
+		switch {
+		case h.Path != "":
+			sh.Type, sh.Target = "path", h.Path
+		case h.Proxy != "":
+			sh.Type, sh.Target = "proxy", h.Proxy
+			n, err := e.lc.ServeRequestsInFlight(ctx, h.Proxy)
+			if err != nil {
+				return err
+			}
+			sh.ActiveConnections = n
+		case h.Text != "":
+			sh.Type, sh.Target = "text", h.Text
+		}
+		ss.Handlers = append(ss.Handlers, sh)
+		return nil
+	}
+	hps := xmaps.Keys(sc.Web)
+	slices.Sort(hps)
+	for _, hp := range hps {
+		web := sc.Web[hp]
+		mounts := xmaps.Keys(web.Handlers)
+		slices.Sort(mounts)
+		for _, m := range mounts {
+			if err := add(hp, m, "", web.Handlers[m]); err != nil {
+				return nil, err
+			}
+		}
+		methods := xmaps.Keys(web.MethodHandlers)
+		slices.Sort(methods)
+		for _, m := range methods {
+			if err := add(hp, "", m, web.MethodHandlers[m]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	ports := xmaps.Keys(sc.TCP)
+	slices.Sort(ports)
+	dnsName := strings.TrimSuffix(st.Self.DNSName, ".")
+	for _, p := range ports {
+		h := sc.TCP[p]
+		if h.TCPForward == "" {
+			continue
+		}
+		hp := ipn.HostPort(net.JoinHostPort(dnsName, strconv.Itoa(int(p))))
+		ss.Handlers = append(ss.Handlers, ipn.ServeStatusV1Handler{
+			HostPort: hp,
+			Type:     "tcp",
+			Target:   h.TCPForward,
+			Funnel:   sc.AllowFunnel[hp],
+		})
+	}
+	return ss, nil
+}
+
+// fieldFlagHelp is the usage of the status --field flag.
+const fieldFlagHelp = `print only the field of the JSON status at this path, like .Web["foo.ts.net:443"].Handlers; strings are printed unquoted; exits 1 if there's no such field`
+
+// printStatusField prints the field at e.field in j, the JSON status.
+// Strings are printed as is, and other values as JSON.
+func (e *serveEnv) printStatusField(j []byte) error {
+	v, err := jsonField(j, e.field)
+	if err != nil {
+		return err
+	}
+	if s, ok := v.(string); ok {
+		fmt.Fprintln(e.stdout(), s)
+		return nil
+	}
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(e.stdout(), "%s\n", out)
+	return nil
+}
+
 func (e *serveEnv) stdout() io.Writer {
 	if e.testStdout != nil {
 		return e.testStdout
@@ -686,6 +982,31 @@ func (e *serveEnv) stdout() io.Writer {
 	return os.Stdout
 }
 
+// stderrMu serializes the writes of serveEnv.stderr, which are made from
+// the goroutines of a foreground serve as well as the main one.
+var stderrMu sync.Mutex
+
+// stderr returns a writer to stderr, or testStderr, whose writes are
+// serialized with stderrMu. Each message should be a single write.
+func (e *serveEnv) stderr() io.Writer {
+	w := io.Writer(os.Stderr)
+	if e.testStderr != nil {
+		w = e.testStderr
+	}
+	return lockedWriter{w}
+}
+
+// lockedWriter is an io.Writer that holds stderrMu while writing to w.
+type lockedWriter struct {
+	w io.Writer
+}
+
+func (lw lockedWriter) Write(p []byte) (int, error) {
+	stderrMu.Lock()
+	defer stderrMu.Unlock()
+	return lw.w.Write(p)
+}
+
 func printTCPStatusTree(ctx context.Context, sc *ipn.ServeConfig, st *ipnstate.Status) error {
 	dnsName := strings.TrimSuffix(st.Self.DNSName, ".")
 	for p, h := range sc.TCP {
@@ -742,18 +1063,6 @@ func (e *serveEnv) printWebStatusTree(sc *ipn.ServeConfig, hp ipn.HostPort) erro
 		printf("%s://%s%s (%s)\n", scheme, hostname, portPart, fStatus)
 	}
 	printf("%s://%s%s (%s)\n", scheme, host, portPart, fStatus)
-	srvTypeAndDesc := func(h *ipn.HTTPHandler) (string, string) {
-		switch {
-		case h.Path != "":
-			return "path", h.Path
-		case h.Proxy != "":
-			return "proxy", h.Proxy
-		case h.Text != "":
-			return "text", "\"" + elipticallyTruncate(h.Text, 20) + "\""
-		}
-		return "", ""
-	}
-
 	var mounts []string
 	for k := range sc.Web[hp].Handlers {
 		mounts = append(mounts, k)
@@ -761,17 +1070,41 @@ func (e *serveEnv) printWebStatusTree(sc *ipn.ServeConfig, hp ipn.HostPort) erro
 	sort.Slice(mounts, func(i, j int) bool {
 		return len(mounts[i]) < len(mounts[j])
 	})
-	maxLen := len(mounts[len(mounts)-1])
+	maxLen := 0
+	if len(mounts) > 0 {
+		maxLen = len(mounts[len(mounts)-1])
+	}
 
 	for _, m := range mounts {
 		h := sc.Web[hp].Handlers[m]
 		t, d := srvTypeAndDesc(h)
 		printf("%s %s%s %-5s %s\n", "|--", m, strings.Repeat(" ", maxLen-len(m)), t, d)
 	}
+	methods := xmaps.Keys(sc.Web[hp].MethodHandlers)
+	slices.Sort(methods)
+	for _, m := range methods {
+		h := sc.Web[hp].MethodHandlers[m]
+		t, d := srvTypeAndDesc(h)
+		printf("%s %s (%s requests) %-5s %s\n", "|--", "/", m, t, d)
+	}
 
 	return nil
 }
 
+// srvTypeAndDesc returns the type of h, like "proxy", and a short
+// description of what it serves, for printing.
+func srvTypeAndDesc(h *ipn.HTTPHandler) (string, string) {
+	switch {
+	case h.Path != "":
+		return "path", h.Path
+	case h.Proxy != "":
+		return "proxy", h.Proxy
+	case h.Text != "":
+		return "text", "\"" + elipticallyTruncate(h.Text, 20) + "\""
+	}
+	return "", ""
+}
+
 func elipticallyTruncate(s string, max int) string {
 	if len(s) <= max {
 		return s
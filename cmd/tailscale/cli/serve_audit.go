@@ -0,0 +1,320 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"tailscale.com/ipn"
+)
+
+// serveAuditTailInterval is how often "audit --tail" checks the audit
+// log for new records.
+const serveAuditTailInterval = time.Second
+
+// serveAuditDiffContext is how many unchanged lines are kept around the
+// changed ones in the diff of a serveAuditRecord.
+const serveAuditDiffContext = 3
+
+// The events of serveAuditRecords.
+const (
+	serveAuditSet         = "set"          // the CLI replaced the serve config
+	serveAuditStreamStart = "stream-start" // a foreground stream merged its config in
+	serveAuditStreamEnd   = "stream-end"   // a foreground stream ended, removing its config
+)
+
+// serveAuditRecord is a line of JSON in the --audit-log file, for a
+// change to the serve config made by the CLI.
+type serveAuditRecord struct {
+	Time      time.Time
+	User      string // the OS user who ran the CLI
+	Event     string // one of the serveAudit constants
+	SessionID string `json:",omitempty"` // of the foreground session that made the change, if any
+	Diff      string // of the indented JSON of the serve config before and after, from serveConfigDiff
+}
+
+// auditServeClient is a localServeClient that appends a serveAuditRecord
+// to e's --audit-log file, if set, after each change to the serve config.
+type auditServeClient struct {
+	localServeClient
+	e *serveEnv
+}
+
+func (c *auditServeClient) SetServeConfig(ctx context.Context, sc *ipn.ServeConfig) error {
+	path := c.e.auditLog
+	if path == "" {
+		return c.localServeClient.SetServeConfig(ctx, sc)
+	}
+	before, err := c.localServeClient.GetServeConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("getting serve config for --audit-log: %w", err)
+	}
+	// Make the change conditional on the config being the one just
+	// read, so that's the one recorded as replaced. If sc came with an
+	// ETag of its own, it's already conditional on an earlier read,
+	// which fails unless it's the same.
+	if sc != nil && sc.ETag == "" {
+		sc = sc.Clone()
+		sc.ETag = ipn.ServeConfigETag(ipn.ServeConfigView{})
+		if before != nil {
+			sc.ETag = before.ETag
+		}
+	}
+	if err := c.localServeClient.SetServeConfig(ctx, sc); err != nil {
+		return err
+	}
+	if err := c.e.recordServeAudit(serveAuditSet, before, sc); err != nil {
+		return fmt.Errorf("serve config changed, but writing --audit-log failed: %w", err)
+	}
+	return nil
+}
+
+// auditServeStream appends a record of a foreground stream starting or
+// ending, event, to the --audit-log file, if set, with the diff of the
+// config it merges into the serve config or removes from it.
+func (e *serveEnv) auditServeStream(event string, req ipn.ServeStreamRequest) {
+	if e.auditLog == "" {
+		return
+	}
+	var before, after *ipn.ServeConfig
+	if event == serveAuditStreamStart {
+		after = req.ServeConfig()
+	} else {
+		before = req.ServeConfig()
+	}
+	if err := e.recordServeAudit(event, before, after); err != nil {
+		e.logf(serveLogWarn, "writing --audit-log: %v", err)
+	}
+}
+
+// recordServeAudit appends a serveAuditRecord of event, changing the
+// serve config from before to after, to the --audit-log file.
+func (e *serveEnv) recordServeAudit(event string, before, after *ipn.ServeConfig) error {
+	return appendServeAudit(e.auditLog, e.auditLogRotateSize, serveAuditRecord{
+		Time:      time.Now(),
+		User:      auditUser(),
+		Event:     event,
+		SessionID: e.sessionID,
+		Diff:      serveConfigDiff(before, after),
+	})
+}
+
+// serveConfigDiff returns a line diff of the indented JSON of before
+// and after, either of which may be nil for no config: the removed lines
+// prefixed with "-", the added ones with "+", and serveAuditDiffContext
+// unchanged lines around them with " ". Runs of unchanged lines left out
+// are marked with "...". It returns "" if nothing changed.
+func serveConfigDiff(before, after *ipn.ServeConfig) string {
+	a, b := serveConfigLines(before), serveConfigLines(after)
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var lines []string
+	changed := false
+	for i, j := 0, 0; i < len(a) || j < len(b); {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, " "+a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, "-"+a[i])
+			changed = true
+			i++
+		default:
+			lines = append(lines, "+"+b[j])
+			changed = true
+			j++
+		}
+	}
+	if !changed {
+		return ""
+	}
+
+	var sb strings.Builder
+	skipped := false
+	for k, l := range lines {
+		near := false
+		for d := max(0, k-serveAuditDiffContext); d <= min(len(lines)-1, k+serveAuditDiffContext); d++ {
+			if lines[d][0] != ' ' {
+				near = true
+				break
+			}
+		}
+		if !near {
+			skipped = true
+			continue
+		}
+		if skipped {
+			sb.WriteString("...\n")
+			skipped = false
+		}
+		sb.WriteString(l)
+		sb.WriteByte('\n')
+	}
+	if skipped {
+		sb.WriteString("...\n")
+	}
+	return sb.String()
+}
+
+// serveConfigLines returns the lines of the indented JSON of sc, or
+// none if sc is nil.
+func serveConfigLines(sc *ipn.ServeConfig) []string {
+	if sc == nil {
+		return nil
+	}
+	j, err := json.MarshalIndent(sc, "", "  ")
+	if err != nil {
+		return []string{err.Error()}
+	}
+	return strings.Split(string(j), "\n")
+}
+
+// auditUser returns the name of the OS user running the CLI.
+func auditUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return fmt.Sprintf("uid %d", os.Getuid())
+}
+
+// appendServeAudit appends rec to the audit log at path. If that would
+// make the file larger than rotateSize, when it's non-zero, the file is
+// first renamed to path.1, replacing any older one.
+func appendServeAudit(path string, rotateSize int64, rec serveAuditRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if rotateSize > 0 {
+		if fi, err := os.Stat(path); err == nil && fi.Size() > 0 && fi.Size()+int64(len(line)) > rotateSize {
+			if err := os.Rename(path, path+".1"); err != nil {
+				return err
+			}
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(line)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func newServeAuditCommand(e *serveEnv, subcmd string) *ffcli.Command {
+	return &ffcli.Command{
+		Name:       "audit",
+		ShortUsage: fmt.Sprintf("%s audit --audit-log=<path> [--tail]", subcmd),
+		ShortHelp:  "view the changes to the serve config logged with --audit-log",
+		Exec:       e.runServeAudit,
+		FlagSet: e.newFlags("serve-audit", func(fs *flag.FlagSet) {
+			fs.StringVar(&e.auditLog, "audit-log", "", "the audit log file to view")
+			fs.BoolVar(&e.auditTail, "tail", false, "keep printing changes as they're logged, until interrupted")
+		}),
+		UsageFunc: usageFunc,
+	}
+}
+
+// runServeAudit is the entry point for "tailscale {serve,funnel} audit".
+// It prints the records of the audit log, and with --tail, those
+// appended later, following the log across rotations.
+func (e *serveEnv) runServeAudit(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return flag.ErrHelp
+	}
+	if e.auditLog == "" {
+		return errors.New("--audit-log is required")
+	}
+	f, err := os.Open(e.auditLog)
+	if err != nil {
+		return err
+	}
+	defer func() { f.Close() }()
+	r := bufio.NewReader(f)
+	var partial []byte
+	for {
+		line, err := r.ReadBytes('\n')
+		partial = append(partial, line...)
+		if err == nil {
+			e.printServeAuditRecord(partial)
+			partial = partial[:0]
+			continue
+		}
+		if err != io.EOF {
+			return err
+		}
+		if !e.auditTail {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(serveAuditTailInterval):
+		}
+		// Once the log is rotated, nothing more is written to the old
+		// file: start on the new one.
+		cur, err1 := f.Stat()
+		fi, err2 := os.Stat(e.auditLog)
+		if err1 != nil || err2 != nil || os.SameFile(cur, fi) {
+			continue
+		}
+		nf, err := os.Open(e.auditLog)
+		if err != nil {
+			continue
+		}
+		f.Close()
+		f = nf
+		r.Reset(f)
+		partial = partial[:0]
+	}
+}
+
+// printServeAuditRecord prints line, a serveAuditRecord, with its
+// time, event, user and session on a line before the diff.
+func (e *serveEnv) printServeAuditRecord(line []byte) {
+	var rec serveAuditRecord
+	if err := json.Unmarshal(line, &rec); err != nil {
+		fmt.Fprintf(e.stdout(), "%s", line)
+		return
+	}
+	fmt.Fprintf(e.stdout(), "%s %s by %s", rec.Time.Format(time.RFC3339), rec.Event, rec.User)
+	if rec.SessionID != "" {
+		fmt.Fprintf(e.stdout(), " (session %s)", rec.SessionID)
+	}
+	fmt.Fprintln(e.stdout())
+	if rec.Diff == "" {
+		fmt.Fprintln(e.stdout(), "  (no changes)")
+		return
+	}
+	fmt.Fprintln(e.stdout(), strings.TrimRight(rec.Diff, "\n"))
+}
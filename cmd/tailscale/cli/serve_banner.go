@@ -0,0 +1,64 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"text/template"
+)
+
+// serveBanner is the data for a --banner-file template.
+type serveBanner struct {
+	URL     string // served URL, like https://foo.ts.net
+	Port    uint16 // port of URL
+	Session string // Funnel session ID, or empty for serve
+}
+
+// printBanner prints to stderr that serving has started at info level:
+// the --banner-file executed as a text/template with b, or the default
+// banner if there's no --banner-file. If the banner file doesn't exist
+// or can't be executed, the default banner is printed instead. With
+// --quiet and no --banner-file, nothing is printed.
+func (e *serveEnv) printBanner(b serveBanner) {
+	if e.logLevel > serveLogInfo {
+		return
+	}
+	if e.bannerFile == "" {
+		if !e.quiet {
+			e.printDefaultBanner(b)
+		}
+		return
+	}
+	text, err := os.ReadFile(e.bannerFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		e.logf(serveLogDebug, "banner file %s doesn't exist; using the default banner", e.bannerFile)
+		e.printDefaultBanner(b)
+		return
+	}
+	var buf bytes.Buffer
+	if err == nil {
+		var tmpl *template.Template
+		tmpl, err = template.New(e.bannerFile).Option("missingkey=error").Parse(string(text))
+		if err == nil {
+			err = tmpl.Execute(&buf, b)
+		}
+	}
+	if err != nil {
+		e.logf(serveLogWarn, "banner file: %v; using the default banner", err)
+		e.printDefaultBanner(b)
+		return
+	}
+	if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	e.stderr().Write(buf.Bytes())
+}
+
+func (e *serveEnv) printDefaultBanner(b serveBanner) {
+	e.logf(serveLogInfo, "Serve started on %q.", b.URL)
+	e.logf(serveLogInfo, "Press Ctrl-C to stop.\n")
+}
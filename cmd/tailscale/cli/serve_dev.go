@@ -5,17 +5,33 @@
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"net"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
+	"golang.org/x/net/http/httpguts"
+	"tailscale.com/client/tailscale"
 	"tailscale.com/ipn"
+	"tailscale.com/logtail/backoff"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/systemd"
 )
 
 type execFunc func(ctx context.Context, args []string) error
@@ -31,6 +47,12 @@ type commandInfo struct {
 		LongHelp: strings.Join([]string{
 			"Serve lets you  share a local server securely within your tailnet.",
 			"To share a local server on the internet, use \"tailscale funnel\"",
+			"",
+			"<target> may be tailnet://<node>:<port> to proxy to a port of another",
+			"node in your tailnet, named by its MagicDNS name or Tailscale IP.",
+			"",
+			"With --protocol=tcp, raw TCP connections to port 10000, or --port, are",
+			"forwarded to <target> (a local port or host:port), or to --local-port.",
 		}, "\n"),
 	},
 	"funnel": {
@@ -38,6 +60,22 @@ type commandInfo struct {
 		LongHelp: strings.Join([]string{
 			"Funnel lets you share a local server on the internet using Tailscale.",
 			"To share only within your tailnet, use \"tailscale serve\"",
+			"",
+			"<target> may be tailnet://<node>:<port> to proxy to a port of another",
+			"node in your tailnet, named by its MagicDNS name or Tailscale IP.",
+			"",
+			"Funnel serves on port 443 unless --port is given; the ports Funnel is",
+			"allowed on, usually 443, 8443 and 10000, are set by the tailnet policy.",
+			"",
+			"With --protocol=tcp, raw TCP connections to port 10000, or --port, are",
+			"forwarded to <target> (a local port or host:port), or to --local-port,",
+			"for protocols other than HTTP, such as SSH or PostgreSQL.",
+			"",
+			"If <target> is omitted, it defaults to $TAILSCALE_FUNNEL_SOURCE (a URL or",
+			"host:port) or $TAILSCALE_FUNNEL_PORT (a local port), whichever is set.",
+			"",
+			"With --upstream-mock-file, responses from a JSON file are served instead",
+			"of proxying to a <target>, for trying out a config before the backend exists.",
 		}, "\n"),
 	},
 }
@@ -49,26 +87,131 @@ func newServeDevCommand(e *serveEnv, subcmd string) *ffcli.Command {
 	}
 
 	info := infoMap[subcmd]
+	if _, ok := e.lc.(*auditServeClient); !ok {
+		e.lc = &auditServeClient{localServeClient: e.lc, e: e}
+	}
 
-	return &ffcli.Command{
+	cmd := &ffcli.Command{
 		Name:      subcmd,
 		ShortHelp: info.ShortHelp,
 		ShortUsage: strings.Join([]string{
 			fmt.Sprintf("%s <target>", subcmd),
-			fmt.Sprintf("%s status [--json]", subcmd),
+			fmt.Sprintf("%s status [--json | --field <path>]", subcmd),
 			fmt.Sprintf("%s reset", subcmd),
+			fmt.Sprintf("%s list", subcmd),
+			fmt.Sprintf("%s delete <hostport> <mountpoint>", subcmd),
+			fmt.Sprintf("%s disable <hostport>", subcmd),
+			fmt.Sprintf("%s circuit-status [--json] <backend>", subcmd),
+			fmt.Sprintf("%s apply [--port=<port>] <template-file>", subcmd),
+			fmt.Sprintf("%s template validate <template-file>", subcmd),
 		}, "\n  "),
-		LongHelp:  info.LongHelp,
-		Exec:      e.runServeDev(subcmd == "funnel"),
+		LongHelp: info.LongHelp,
+		FlagSet: e.newFlags(subcmd, func(fs *flag.FlagSet) {
+			fs.BoolVar(&e.check, "check", false, "validate the serve config and check it against the current one, printing OK or the error, without changing anything")
+			fs.DurationVar(&e.timeout, "timeout", 0, "if non-zero, stop serving and clean up after this long")
+			fs.BoolVar(&e.reconnect, "reconnect", true, "if the connection to tailscaled is lost after serving starts, such as when it restarts, keep retrying with backoff and serve again once it's back")
+			fs.StringVar(&e.protocol, "protocol", "http", fmt.Sprintf("http, or tcp to forward raw TCP connections on port %d to the <target> (a port or host:port) instead of proxying HTTPS requests", tcpServePort))
+			fs.UintVar(&e.port, "port", 0, fmt.Sprintf("the port to serve on; defaults to 443, or %d with --protocol=tcp; Funnel is only allowed on the ports its node attribute grants, usually 443, 8443 and %d", tcpServePort, tcpServePort))
+			fs.UintVar(&e.localPort, "local-port", 0, "with --protocol=tcp, the local port to forward connections to, instead of giving a <target>")
+			fs.StringVar(&e.mockFile, "upstream-mock-file", "", `path to a JSON file of mock responses to serve instead of a <target>, for developing without a running backend: an array of {"method", "path", "status", "headers", "body"} objects, matched by method (any if empty) and the longest path prefix`)
+			fs.StringVar(&e.abTestBackend, "ab-test-backend-b", "", "a second backend (a port or URL, like <target>) to A/B test against the <target>, serving --ab-test-percentage percent of clients; each client sticks to one backend for the day, by its IP address")
+			fs.IntVar(&e.abTestPercentage, "ab-test-percentage", 50, "with --ab-test-backend-b, the percentage of clients (0 to 100) to send to it")
+			fs.BoolVar(&e.abTestCookie, "ab-test-cookie", false, "with --ab-test-backend-b, keep each client on its backend with a cookie rather than by its IP address, for clients behind shared addresses")
+			fs.StringVar(&e.configFile, "config", "", "path to a file of flag settings, one per line as \"name value\" or as a JSON object, for flags not given on the command line; the proxy settings are re-read from it, and the files they name, on SIGHUP")
+			fs.StringVar(&e.configWatchDir, "config-watch-dir", "", "directory whose "+serveConfigWatchFile+" file is the --config file, re-read whenever it changes as well as on SIGHUP, such as a Kubernetes ConfigMap volume")
+			fs.StringVar(&e.bannerFile, "banner-file", "", "path to a text/template file to print instead of the banner when serving starts, with {{.URL}}, {{.Port}} and {{.Session}} (the Funnel session ID); the default banner is printed if the file doesn't exist")
+			fs.BoolVar(&e.quiet, "quiet", false, "don't print the banner when serving starts, unless --banner-file is given")
+			fs.Var(&e.logLevel, "log-level", "which messages to print to stderr: debug (adds IPN notifications and the serve config), info, warn (only warnings and errors) or error (only errors)")
+			fs.StringVar(&e.onRequestLog, "on-request-log", "", "shell command to pipe each request log, as a line of JSON, to; restarted if it exits")
+			fs.StringVar(&e.logShipURL, "log-ship-url", "", "HTTP or HTTPS URL of a log aggregator, such as Loki or Splunk HEC, to POST request logs to, as JSON arrays of up to --log-ship-batch-size logs")
+			fs.DurationVar(&e.logShipInterval, "log-ship-interval", 5*time.Second, "with --log-ship-url, how often to ship request logs, if a batch doesn't fill up first")
+			fs.IntVar(&e.logShipBatchSize, "log-ship-batch-size", 100, "with --log-ship-url, the most request logs to ship in one POST")
+			fs.IntVar(&e.logShipMaxBuffer, "log-ship-max-buffer", 10000, "with --log-ship-url, the most request logs to hold while a POST is retried, before dropping new ones")
+			fs.DurationVar(&e.slowRequestThreshold, "slow-request-threshold", 0, "if non-zero, log requests again, marked Slow with their upstream latency, when the backend takes longer than this to start responding, and warn if more than 10% of requests are slow")
+			fs.Float64Var(&e.slowRequestSampleRate, "slow-request-sample-rate", 1, "with --slow-request-threshold, the fraction of slow requests to log, from 0 to 1, to avoid flooding the logs when the backend is slow for a while")
+			fs.BoolVar(&e.trace, "trace", false, "log each request again at its end with the timings of its request to the backend: DNS lookup, connect, TLS handshake, headers sent and first response byte")
+			fs.BoolVar(&e.logResponseBytes, "log-response-bytes", false, "log each request again at its end with the number of bytes of the response body sent to the client")
+			fs.BoolVar(&e.tracePropagate, "trace-propagate", false, "send a W3C traceparent header to the backend with each request, continuing the client's trace if it sent one, to correlate the backend's traces with the request logs")
+			fs.BoolVar(&e.requestIDPropagate, "upstream-request-id-propagate", false, "give each request an X-Request-ID, the client's if it sent one, else a new one, and send it to the backend, back to the client, including on errors, and in the request logs")
+			fs.Var(&e.accessLogExclude, "access-log-exclude-path", "path prefix, such as /health, of requests not to print request logs for, or send to --on-request-log; matched case-insensitively; may be repeated")
+			fs.StringVar(&e.auditLog, "audit-log", "", "file to append a line of JSON to for each change this command makes to the serve config, including starting and stopping a foreground session, with the time, the OS user, the foreground session, if any, and the changes; view it with the audit subcommand")
+			fs.Int64Var(&e.auditLogRotateSize, "audit-log-rotate-size", 0, "with --audit-log, if positive, the size in bytes the file may grow to before it's renamed with a .1 suffix, replacing the previous one, and a new one started")
+			fs.StringVar(&e.geoIPDB, "geoip-db", "", "path to a CSV file of network,country_code,city,asn_org lines, such as 203.0.113.0/24,NL,Amsterdam,Example Networks, to add the country, city and network operator of each request's client to the request logs from; reloaded when the file is replaced; logs are printed as they are while it doesn't exist")
+			fs.Var(&e.funnelPaths, "funnel-path", "with tailscale funnel, path prefix, such as /api/, to limit Funnel to; other requests from the internet get 404 Not Found, while the tailnet can still reach every path; may be repeated")
+			fs.BoolVar(&e.skipListenCheck, "skip-listen-check", false, "don't warn if nothing is listening on the target port")
+			fs.DurationVar(&e.waitForUpstream, "wait-for-upstream", 0, "if non-zero, wait up to this long before serving for the backend to answer a GET of --health-check-path with a 2xx status, polling every second")
+			fs.StringVar(&e.healthCheckPath, "health-check-path", "/", "with --wait-for-upstream, the path to GET from the backend; with --preheat-connections, the path to send HEAD requests for")
+			fs.IntVar(&e.preheatConns, "preheat-connections", 0, "if non-zero, open this many connections to the backend as soon as serving starts, by sending it HEAD requests for --health-check-path, so that the first requests don't wait for them")
+			fs.BoolVar(&e.upstreamRequired, "wait-for-upstream-required", false, "with --wait-for-upstream, fail rather than serve anyway if the backend isn't ready in time")
+			fs.StringVar(&e.upstreamTLSMinVersion, "upstream-tls-min-version", "tls12", "minimum TLS version to accept from an HTTPS backend: tls10, tls11, tls12 or tls13")
+			fs.StringVar(&e.upstreamTLSReneg, "upstream-tls-renegotiation", "none", "whether an HTTPS backend may renegotiate TLS 1.2, as some legacy servers require: none, once (per connection) or freely; renegotiation weakens TLS, so only allow it for backends that need it")
+			fs.StringVar(&e.upstreamRootCA, "upstream-root-ca", "", "path to a PEM file of CA certificates to trust for an HTTPS backend, instead of the system roots")
+			fs.StringVar(&e.upstreamSNI, "upstream-sni", "", "server name to send in the TLS handshake with an HTTPS backend, and to verify its certificate against, instead of the backend's host")
+			fs.StringVar(&e.backendTLSFingerprint, "backend-tls-fingerprint", "", "SHA-256 fingerprint, in hex, of the certificate an HTTPS backend must present; if set, only that certificate is accepted, even if self-signed")
+			fs.StringVar(&e.upstreamUserAgent, "upstream-user-agent", "pass-through", "User-Agent header to send to the backend, or pass-through to send the client's")
+			fs.BoolVar(&e.sessionHeaders, "inject-tailscale-session-header", true, "send the backend the Funnel session ID in X-Tailscale-Session and the Funnel ingress region in X-Tailscale-Edge-Region, to correlate its logs with the request logs")
+			fs.StringVar(&e.sessionLabel, "upstream-connection-label", "", "with tailscale funnel, a label of up to 64 letters and digits to send the backend in X-Tailscale-Session-Label, so that a backend shared by several Funnel sessions can tell their traffic apart")
+			fs.BoolVar(&e.sanitizeHeaders, "upstream-sanitize-headers", true, "replace the X-Forwarded-For, X-Forwarded-Host and X-Real-IP headers sent by the client with the values serve knows, rather than passing them on for the backend to trust; if false, the client's address is appended to X-Forwarded-For")
+			fs.StringVar(&e.forwardedHeaders, "upstream-forwarded-header", "both", "which headers to tell the backend about the client with: xff for X-Forwarded-For, X-Forwarded-Host, X-Forwarded-Proto and X-Real-IP, rfc7239 for the standard Forwarded header, both, or none")
+			fs.Var(&e.stripHeaders, "upstream-sanitize-headers-additional", "name of another request header not to send to the backend, such as one it trusts a proxy in front of it to set; may be repeated or comma-separated")
+			fs.StringVar(&e.rateLimitFile, "rate-limit-burst-file", "", "path to a JSON file of per-path rate limits, like {\"paths\": [{\"/api\": {\"rate\": 10, \"burst\": 5}}]}; changes take effect without restarting; tailscaled reads it, so only root can set it")
+			fs.StringVar(&e.upstreamProxyProtocol, "upstream-proxy-protocol", "", "if set, the PROXY protocol version (v1 or v2) to send to the backend with each client's address; backend connections are then not reused")
+			fs.BoolVar(&e.backendKeepAlive, "backend-keepalive-probe", false, "send TCP keep-alive probes every 15 seconds on idle backend connections, so ones that died silently, such as when dropped by a firewall, are closed instead of reused")
+			fs.BoolVar(&e.upstreamTCPNoDelay, "upstream-tcp-nodelay", false, "disable Nagle's algorithm (set TCP_NODELAY) on connections to the backend, so small writes, such as interactive WebSocket messages, aren't delayed")
+			fs.Var(&e.noKeepaliveBackends, "upstream-disable-keepalive-for", "prefix of backend URLs, such as http://127.0.0.1:9000, to open a new connection to for each request, for backends that mishandle HTTP keep-alive; matched against the target and --ab-test-backend-b, as in http://127.0.0.1:3000 for 3000; may be repeated")
+			fs.Var(&e.keepRequestIDHeaders, "upstream-keep-request-id", "name of a request header, such as X-Trace-ID or X-Correlation-ID, to pass to the backend exactly as the client sent it; may be repeated or comma-separated; X-Request-ID is always included")
+			fs.StringVar(&e.bearerTokenFile, "bearer-token-file", "", "path to a file holding a token to send to the backend as an \"Authorization: Bearer\" header; re-read on each request; tailscaled reads it, so only root can set it")
+			fs.StringVar(&e.signSecretFile, "upstream-sign-secret-file", "", "path to a file holding a secret to sign requests to the backend with, so it can check that they came through Tailscale; the X-Tailscale-Signature header is \"ts=<unix time>,v1=<hex HMAC-SHA256 of method, path and query, and time, each followed by a newline>\"; re-read on each request; tailscaled reads it, so only root can set it")
+			fs.StringVar(&e.oidcDiscovery, "upstream-auth-oidc-discovery", "", "URL of an OpenID Connect provider, or its discovery document, to get access tokens from with the client credentials grant and send to the backend as an \"Authorization: Bearer\" header")
+			fs.StringVar(&e.oidcClientID, "upstream-auth-oidc-client-id", "", "with --upstream-auth-oidc-discovery, the client ID to request tokens as")
+			fs.StringVar(&e.oidcClientSecretFile, "upstream-auth-oidc-client-secret-file", "", "with --upstream-auth-oidc-discovery, path to a file holding the client secret; re-read each time a token is requested; tailscaled reads it, so only root can set it")
+			fs.StringVar(&e.accessOIDCDiscovery, "access-control-oidc-discovery", "", "URL of an OpenID Connect provider, or its discovery document; requests must carry a JWT it signed in an \"Authorization: Bearer\" header, or get 401 Unauthorized")
+			fs.StringVar(&e.accessOIDCAudience, "access-control-oidc-audience", "", "with --access-control-oidc-discovery, the audience that JWTs must be issued for")
+			fs.StringVar(&e.backendAuthType, "backend-auth-type", "", "if oauth2, get access tokens from an OAuth 2.0 token endpoint with the client credentials grant, as set by the --backend-oauth2-* flags, and send them to the backend as an \"Authorization: Bearer\" header")
+			fs.StringVar(&e.oauth2TokenURL, "backend-oauth2-token-url", "", "with --backend-auth-type=oauth2, the URL of the token endpoint")
+			fs.StringVar(&e.oauth2ClientID, "backend-oauth2-client-id", "", "with --backend-auth-type=oauth2, the client ID to request tokens as")
+			fs.StringVar(&e.oauth2ClientSecret, "backend-oauth2-client-secret-file", "", "with --backend-auth-type=oauth2, path to a file holding the client secret; re-read each time a token is requested; tailscaled reads it, so only root can set it")
+			fs.StringVar(&e.oauth2Scopes, "backend-oauth2-scopes", "", "with --backend-auth-type=oauth2, comma-separated scopes to request")
+			fs.StringVar(&e.backendHTTPVersion, "backend-http-version", "2", "highest HTTP version to use to the backend: 1.1 or 2")
+			fs.DurationVar(&e.upstreamReadTimeout, "upstream-timeout-per-read", 0, "if non-zero, how long to wait for each read from the backend before dropping the connection")
+			fs.DurationVar(&e.upstreamStallTimeout, "upstream-per-byte-timeout", 0, "if non-zero, how long the backend's response body may go without sending any bytes before the response is cut off; unlike --upstream-timeout-per-read, it doesn't limit how long the backend takes to start responding")
+			fs.Int64Var(&e.maxResponseSize, "upstream-max-response-size", 0, "if non-zero, the largest response body in bytes to accept from the backend; larger responses fail with 502, or are cut off if the backend didn't send a Content-Length")
+			fs.BoolVar(&e.noSniff, "disable-content-sniffing", false, "set X-Content-Type-Options: nosniff on all responses, and don't guess a Content-Type for backend responses that have none; for APIs that always set Content-Type")
+			fs.StringVar(&e.cacheControlOverride, "override-cache-control", "", "if set, the Cache-Control header to send clients instead of the backend's, such as \"public, max-age=60\" to let an edge cache keep responses the backend marks no-store; requires --i-know-what-im-doing")
+			fs.BoolVar(&e.stripPragma, "strip-pragma", false, "remove the legacy Pragma header, such as \"Pragma: no-cache\", from the backend's responses; requires --i-know-what-im-doing")
+			fs.BoolVar(&e.iKnowWhatImDoing, "i-know-what-im-doing", false, "confirm --override-cache-control or --strip-pragma, which can make caches keep private or stale responses")
+			fs.BoolVar(&e.compressionOffload, "compression-offload", false, "decompress gzip or brotli responses from the backend for clients that don't accept them, and recompress with brotli for clients that do")
+			fs.BoolVar(&e.classifyErrors, "classify-upstream-errors", false, "log the likely cause of failed requests to the backend (backend not running, backend slow or network misconfiguration) on a second line after the request's, with a suggestion the first time each happens")
+			fs.DurationVar(&e.idempotencyCacheTTL, "idempotency-cache-ttl", 0, "if non-zero, keep the backend's responses to requests with an Idempotency-Key header for this long, answering retries with the same key from the cache instead of the backend")
+			fs.BoolVar(&e.systemdNotify, "systemd-notify", os.Getenv("NOTIFY_SOCKET") != "", "notify systemd when serving has started, and send watchdog keep-alives if enabled; defaults to true when run by systemd with Type=notify")
+			fs.BoolVar(&e.backendDisableHTTP2, "backend-disable-http2", false, "use HTTP/1.1 to the backend; same as --backend-http-version=1.1")
+			fs.IntVar(&e.circuitBreaker, "circuit-breaker", 0, "if non-zero, stop forwarding requests to the backend for a while after this many consecutive failures (connection errors or 5xx responses)")
+			fs.DurationVar(&e.upstreamFlushInterval, "upstream-flush-interval", 100*time.Millisecond, "how often to flush the backend's response to the client while copying it, or 0 to flush after each write; server-sent events are always flushed after each write")
+			fs.BoolVar(&e.upstreamPoolStats, "upstream-pool-stats", false, "collect statistics about the pool of connections to the backend, exported as client metrics")
+			fs.DurationVar(&e.poolStatsInterval, "pool-stats-interval", 0, "with --upstream-pool-stats, if non-zero, how often to print the pool statistics to stderr")
+			fs.BoolVar(&e.connectionEvents, "backend-connection-events", false, "log a CONNECTION_OPEN and CONNECTION_CLOSE event, with the backend's address and the connection's requests and bytes, for each connection to the backend; requires --connection-log-file")
+			fs.StringVar(&e.connectionLogFile, "connection-log-file", "", "with --backend-connection-events, the file to append the events to, as lines of JSON, instead of mixing them with the request logs")
+			fs.BoolVar(&e.debugConnStates, "debug-connection-states", false, "log each change of state of each connection to the backend, NEW, ACTIVE (sending a request), IDLE (back in the pool) and CLOSED, with its ID and the time, to --debug-log-file, for debugging exhaustion of the connection pool")
+			fs.StringVar(&e.debugLogFile, "debug-log-file", "", "with --debug-connection-states, the file to append the states to, as lines of JSON; required with it")
+			fs.DurationVar(&e.circuitCooldown, "circuit-breaker-cooldown", ipn.DefaultCircuitBreakerCooldown, "with --circuit-breaker, how long to wait before trying the backend again")
+			fs.IntVar(&e.circuitHalfOpen, "circuit-breaker-half-open-requests", 1, "with --circuit-breaker, how many trial requests to let through to the backend at once after the cooldown; the circuit closes once half of them, rounded up, succeed, and opens again if any fails")
+			fs.IntVar(&e.maxConnections, "max-connections", 0, "if non-zero, the most requests to proxy to the backend at once; more wait in a queue for up to --max-queue-wait, then get a 503; the active, queued and rejected counts are client metrics, serve_requests_*")
+			fs.DurationVar(&e.maxQueueWait, "max-queue-wait", 5*time.Second, "with --max-connections, how long a request may wait for one of them before getting a 503; 0 means not at all")
+			fs.BoolVar(&e.honorRetryAfter, "upstream-honor-retry-after", false, "when the backend responds with a 503 and a Retry-After header, wait as long as it asks, up to --upstream-max-retry-after, and retry the request, keeping the client waiting; requests with a body aren't retried")
+			fs.DurationVar(&e.maxRetryAfter, "upstream-max-retry-after", ipn.DefaultUpstreamMaxRetryAfter, "with --upstream-honor-retry-after, the longest to wait before a retry, however long the backend asks for")
+		}),
 		UsageFunc: usageFunc,
-		Subcommands: []*ffcli.Command{
+		Subcommands: append(append([]*ffcli.Command{
 			// TODO(tyler+marwan-at-work) Implement set, unset, and logs subcommands
 			{
 				Name:      "status",
 				Exec:      e.runServeStatus,
 				ShortHelp: "view current proxy configuration",
 				FlagSet: e.newFlags("serve-status", func(fs *flag.FlagSet) {
-					fs.BoolVar(&e.json, "json", false, "output JSON")
+					fs.BoolVar(&e.json, "json", false, "output JSON; the serve config as is, unless --schema-version is given")
+					fs.StringVar(&e.field, "field", "", fieldFlagHelp)
+					fs.StringVar(&e.schemaVersion, "schema-version", "", "output JSON in this version of the stable status schema, v1, with the handlers, their active connections and the tailscaled version; implies --json")
+					fs.BoolVar(&e.raw, "raw", false, "output the serve config as JSON as is, for debugging; its form can change between releases; implies --json")
 				}),
 				UsageFunc: usageFunc,
 			},
@@ -79,28 +222,152 @@ func newServeDevCommand(e *serveEnv, subcmd string) *ffcli.Command {
 				FlagSet:   e.newFlags("serve-reset", nil),
 				UsageFunc: usageFunc,
 			},
-		},
+			{
+				Name:       "circuit-status",
+				ShortUsage: fmt.Sprintf("%s circuit-status [--json] <backend>", subcmd),
+				ShortHelp:  "view the circuit breaker state of a backend",
+				Exec:       e.runServeCircuitStatus,
+				FlagSet: e.newFlags("serve-circuit-status", func(fs *flag.FlagSet) {
+					fs.BoolVar(&e.json, "json", false, "output JSON")
+				}),
+				UsageFunc: usageFunc,
+			},
+			newServeAuditCommand(e, subcmd),
+		}, newServeTemplateCommands(e, subcmd)...), newServeManageCommands(e, subcmd)...),
 	}
+	cmd.Exec = e.runServeDev(subcmd, cmd.FlagSet)
+	return cmd
 }
 
 // runServeDev is the entry point for the "tailscale {serve,funnel}" commands.
-func (e *serveEnv) runServeDev(funnel bool) execFunc {
-	return func(ctx context.Context, args []string) error {
-		ctx, cancel := signal.NotifyContext(ctx, os.Interrupt)
-		defer cancel()
+// fs is the command's flag set.
+func (e *serveEnv) runServeDev(subcmd string, fs *flag.FlagSet) execFunc {
+	funnel := subcmd == "funnel"
+	return func(parent context.Context, args []string) error {
+		ctx, received, stop := notifyStop(parent)
+		defer stop()
+		cmdline := flagsSet(fs)
+		if err := e.resolveConfigFile(); err != nil {
+			return err
+		}
+		if e.configFile != "" {
+			if err := e.applyServeConfigFile(fs, cmdline); err != nil {
+				return err
+			}
+		}
+		var tcp bool
+		switch e.protocol {
+		case "http":
+			if e.localPort != 0 {
+				return errors.New("--local-port requires --protocol=tcp")
+			}
+		case "tcp":
+			tcp = true
+			if e.localPort != 0 {
+				if len(args) != 0 {
+					return errors.New("--local-port can't be used with a <target>")
+				}
+				args = []string{strconv.FormatUint(uint64(e.localPort), 10)}
+			}
+			if e.waitForUpstream != 0 {
+				return errors.New("--wait-for-upstream requires --protocol=http")
+			}
+		default:
+			return fmt.Errorf("invalid --protocol %q; must be http or tcp", e.protocol)
+		}
+		if e.mockFile != "" {
+			if tcp {
+				return errors.New("--upstream-mock-file requires --protocol=http")
+			}
+			if len(args) != 0 {
+				return errors.New("--upstream-mock-file can't be used with a <target>")
+			}
+			target, stopMock, err := startMockBackend(e.mockFile)
+			if err != nil {
+				return err
+			}
+			defer stopMock()
+			args = []string{target}
+		}
+		if !tcp {
+			e.reloadHandler = func() (*ipn.HTTPHandler, error) {
+				return e.reloadedProxyHandler(subcmd, cmdline)
+			}
+		}
+		if funnel && len(args) == 0 {
+			target, err := funnelTargetFromEnv()
+			if err != nil {
+				return err
+			}
+			if target != "" {
+				args = []string{target}
+			}
+		}
 		if len(args) != 1 {
 			return flag.ErrHelp
 		}
+		if e.timeout < 0 {
+			return errors.New("--timeout must not be negative")
+		}
+		if e.waitForUpstream < 0 {
+			return errors.New("--wait-for-upstream must not be negative")
+		}
+		if e.slowRequestSampleRate < 0 || e.slowRequestSampleRate > 1 {
+			return errors.New("--slow-request-sample-rate must be between 0 and 1")
+		}
+		if !strings.HasPrefix(e.healthCheckPath, "/") {
+			return errors.New("--health-check-path must start with /")
+		}
+		if err := e.checkLogShipFlags(); err != nil {
+			return err
+		}
+		if len(e.funnelPaths) > 0 && !funnel {
+			return errors.New("--funnel-path is only for tailscale funnel")
+		}
+		if e.sessionLabel != "" {
+			if !funnel {
+				return errors.New("--upstream-connection-label is only for tailscale funnel")
+			}
+			if !e.sessionHeaders {
+				return errors.New("--upstream-connection-label requires --inject-tailscale-session-header")
+			}
+			if err := ipn.CheckSessionLabel(e.sessionLabel); err != nil {
+				return fmt.Errorf("--upstream-connection-label: %w", err)
+			}
+		}
 		var source string
+		tailnet := strings.HasPrefix(args[0], "tailnet://")
 		port64, err := strconv.ParseUint(args[0], 10, 16)
-		if err == nil {
+		switch {
+		case tcp:
+			source, err = expandTCPTarget(args[0])
+		case err == nil:
 			source = fmt.Sprintf("http://127.0.0.1:%d", port64)
-		} else {
+		case tailnet:
+			source, err = e.expandTailnetTarget(ctx, args[0])
+		default:
 			source, err = expandProxyTarget(args[0])
 		}
 		if err != nil {
 			return err
 		}
+		var h *ipn.HTTPHandler
+		if !tcp {
+			h, err = e.newProxyHandler()
+			if err != nil {
+				return err
+			}
+		}
+		servePort := uint16(443)
+		if tcp {
+			servePort = tcpServePort
+		}
+		if e.port != 0 {
+			if e.port > math.MaxUint16 {
+				return fmt.Errorf("invalid --port %d", e.port)
+			}
+			servePort = uint16(e.port)
+		}
 
 		st, err := e.getLocalClientStatusWithoutPeers(ctx)
 		if err != nil {
@@ -108,13 +375,50 @@ func (e *serveEnv) runServeDev(funnel bool) execFunc {
 		}
 
 		if funnel {
-			if err := e.verifyFunnelEnabled(ctx, st, 443); err != nil {
-				return err
+			if e.check {
+				// Don't prompt to enable Funnel; just report
+				// whether it's available.
+				err = ipn.CheckFunnelAccess(servePort, st.Self.Capabilities)
+			} else {
+				err = e.verifyFunnelEnabled(ctx, st, servePort)
+			}
+			if err != nil {
+				return withFunnelPortHint(err, servePort, st.Self.Capabilities)
 			}
 		}
 
 		dnsName := strings.TrimSuffix(st.Self.DNSName, ".")
-		hp := ipn.HostPort(dnsName + ":443") // TODO(marwan-at-work): support the 2 other ports
+		hp := ipn.HostPort(net.JoinHostPort(dnsName, strconv.Itoa(int(servePort))))
+		req := ipn.ServeStreamRequest{
+			Funnel:   funnel,
+			HostPort: hp,
+			Source:   source,
+			TCP:      tcp,
+		}
+		if !tcp {
+			req.MountPoint = "/" // TODO(marwan-at-work): support multiple mount points
+			req.Handler = h
+			req.FunnelPaths = e.funnelPaths
+			req.SessionLabel = e.sessionLabel
+		}
+		if funnel && tcp {
+			e.warnIfWellKnownTCPService(source)
+		}
+		if !e.skipListenCheck && e.waitForUpstream == 0 && !tailnet {
+			if tcp {
+				e.warnIfNotListening(ctx, "tcp://"+source, funnel)
+			} else {
+				e.warnIfNotListening(ctx, source, funnel)
+			}
+		}
+		if e.check {
+			return e.checkServeConfig(ctx, req.ServeConfig())
+		}
+		if e.waitForUpstream > 0 {
+			if err := e.awaitUpstream(ctx, source); err != nil {
+				return err
+			}
+		}
 
 		// In the streaming case, the process stays running in the
 		// foreground and prints out connections to the HostPort.
@@ -124,24 +428,853 @@ func (e *serveEnv) runServeDev(funnel bool) execFunc {
 		// the process's context is closed or the client turns off
 		// Tailscale.
 		// TODO(tyler+marwan-at-work) support flag to run in the background
-		return e.streamServe(ctx, ipn.ServeStreamRequest{
-			Funnel:     funnel,
-			HostPort:   hp,
-			Source:     source,
-			MountPoint: "/", // TODO(marwan-at-work): support multiple mount points
-		})
+		if e.timeout == 0 {
+			err := e.streamServeReconnecting(ctx, req)
+			if sig := received(); sig != nil {
+				if !tcp {
+					e.drainServe(parent, req.Source, sig)
+				}
+				return nil
+			}
+			return err
+		}
+
+		// Stop after the timeout, through the same cleanup path
+		// as Ctrl-C.
+		ctx, cancelTimeout := context.WithTimeout(ctx, e.timeout)
+		defer cancelTimeout()
+		warnIn, left := e.timeout-30*time.Second, 30*time.Second
+		if warnIn < 0 {
+			warnIn, left = 0, e.timeout
+		}
+		warnDone := make(chan struct{})
+		go func() {
+			defer close(warnDone)
+			t := time.NewTimer(warnIn)
+			defer t.Stop()
+			select {
+			case <-t.C:
+				e.logf(serveLogWarn, "stopping in %v (--timeout=%v).", left, e.timeout)
+			case <-ctx.Done():
+			}
+		}()
+		err = e.streamServeReconnecting(ctx, req)
+		cancelTimeout()
+		<-warnDone
+		if sig := received(); sig != nil {
+			if !tcp {
+				e.drainServe(parent, req.Source, sig)
+			}
+			return nil
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			e.logf(serveLogInfo, "Stopped after --timeout=%v.", e.timeout)
+			return nil
+		}
+		return err
+	}
+}
+
+// funnelTargetFromEnv returns the default <target> for "tailscale funnel"
+// from the TAILSCALE_FUNNEL_SOURCE or TAILSCALE_FUNNEL_PORT environment
+// variables, or "" if neither is set. It's only used when no target is
+// given on the command line.
+func funnelTargetFromEnv() (string, error) {
+	source, port := os.Getenv("TAILSCALE_FUNNEL_SOURCE"), os.Getenv("TAILSCALE_FUNNEL_PORT")
+	if source != "" && port != "" {
+		return "", errors.New("only one of TAILSCALE_FUNNEL_SOURCE and TAILSCALE_FUNNEL_PORT may be set")
+	}
+	if port != "" {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return "", fmt.Errorf("invalid TAILSCALE_FUNNEL_PORT %q; must be a port number", port)
+		}
+		return port, nil
+	}
+	return source, nil
+}
+
+// warnIfNotListening prints a warning if nothing accepts TCP connections
+// on the port of source, the URL of a local backend.
+func (e *serveEnv) warnIfNotListening(ctx context.Context, source string, funnel bool) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", u.Host)
+	if err == nil {
+		c.Close()
+		return
+	}
+	what := "Serve"
+	if funnel {
+		what = "Funnel"
+	}
+	if u.Scheme == "tcp" {
+		e.logf(serveLogWarn, "nothing appears to be listening on :%s. %s will close connections until a service starts.", u.Port(), what)
+		return
+	}
+	e.logf(serveLogWarn, "nothing appears to be listening on :%s. %s will return 502 until a service starts.", u.Port(), what)
+}
+
+// checkServeConfig validates sc and checks that it can be merged into
+// the current serve config without conflicts. It prints "OK" if so,
+// and doesn't change the current config either way.
+func (e *serveEnv) checkServeConfig(ctx context.Context, sc *ipn.ServeConfig) error {
+	if err := ipn.ValidateServeConfig(sc); err != nil {
+		return err
+	}
+	cur, err := e.lc.GetServeConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("getting current serve config: %w", err)
+	}
+	if _, err := cur.Merge(sc); err != nil {
+		return err
+	}
+	fmt.Fprintln(e.stdout(), "OK")
+	return nil
+}
+
+// newProxyHandler returns the settings for the HTTPHandler that proxies
+// to the serve source, as configured by the command-line flags.
+func (e *serveEnv) newProxyHandler() (*ipn.HTTPHandler, error) {
+	if _, err := ipn.ParseTLSVersion(e.upstreamTLSMinVersion); err != nil {
+		return nil, err
+	}
+	h := &ipn.HTTPHandler{
+		TLSMinVersion:  e.upstreamTLSMinVersion,
+		UpstreamTLSSNI: e.upstreamSNI,
+		ForceHTTP1:     e.backendDisableHTTP2,
+	}
+	if _, err := ipn.ParseTLSRenegotiation(e.upstreamTLSReneg); err != nil {
+		return nil, fmt.Errorf("--upstream-tls-renegotiation: %w", err)
+	}
+	if e.upstreamTLSReneg != "none" {
+		h.TLSRenegotiation = e.upstreamTLSReneg
+	}
+	if e.upstreamTLSReneg == "freely" {
+		e.logf(serveLogWarn, "--upstream-tls-renegotiation=freely lets the backend renegotiate TLS any number of times on a connection. Renegotiation has been the source of serious TLS vulnerabilities; only use it for a trusted legacy backend that can't work with --upstream-tls-renegotiation=once.")
+	}
+	if e.abTestBackend != "" {
+		b := e.abTestBackend
+		if port, err := strconv.ParseUint(b, 10, 16); err == nil {
+			b = fmt.Sprintf("http://127.0.0.1:%d", port)
+		} else if b, err = expandProxyTarget(b); err != nil {
+			return nil, fmt.Errorf("--ab-test-backend-b: %w", err)
+		}
+		if e.abTestPercentage < 0 || e.abTestPercentage > 100 {
+			return nil, errors.New("--ab-test-percentage must be between 0 and 100")
+		}
+		h.ABTestBackend = b
+		h.ABTestPercentage = e.abTestPercentage
+		h.ABTestCookie = e.abTestCookie
+	} else if e.abTestCookie {
+		return nil, errors.New("--ab-test-cookie requires --ab-test-backend-b")
+	}
+	if e.upstreamReadTimeout < 0 {
+		return nil, errors.New("--upstream-timeout-per-read must not be negative")
+	}
+	h.UpstreamReadTimeout = e.upstreamReadTimeout
+	if e.upstreamStallTimeout < 0 {
+		return nil, errors.New("--upstream-per-byte-timeout must not be negative")
+	}
+	h.UpstreamStallTimeout = e.upstreamStallTimeout
+	if e.maxResponseSize < 0 {
+		return nil, errors.New("--upstream-max-response-size must not be negative")
+	}
+	h.MaxResponseBytes = e.maxResponseSize
+	h.NoSniff = e.noSniff
+	if (e.cacheControlOverride != "" || e.stripPragma) && !e.iKnowWhatImDoing {
+		return nil, errors.New("--override-cache-control and --strip-pragma can make caches keep responses meant for one client or not to be kept at all; add --i-know-what-im-doing to use them")
+	}
+	if !httpguts.ValidHeaderFieldValue(e.cacheControlOverride) {
+		return nil, fmt.Errorf("invalid --override-cache-control %q", e.cacheControlOverride)
+	}
+	h.CacheControlOverride = e.cacheControlOverride
+	h.StripPragma = e.stripPragma
+	h.CompressionOffload = e.compressionOffload
+	if e.preheatConns < 0 {
+		return nil, errors.New("--preheat-connections must not be negative")
+	}
+	if e.preheatConns > 0 {
+		h.PreheatConnections = e.preheatConns
+		h.PreheatPath = e.healthCheckPath
+	}
+	h.ClassifyUpstreamErrors = e.classifyErrors
+	if e.idempotencyCacheTTL < 0 {
+		return nil, errors.New("--idempotency-cache-ttl must not be negative")
+	}
+	h.IdempotencyCacheTTL = e.idempotencyCacheTTL
+	if e.slowRequestThreshold < 0 {
+		return nil, errors.New("--slow-request-threshold must not be negative")
+	}
+	h.SlowRequestThreshold = e.slowRequestThreshold
+	h.TraceRequests = e.trace
+	h.LogResponseBodyBytes = e.logResponseBytes
+	h.PropagateTraceParent = e.tracePropagate
+	h.PropagateRequestID = e.requestIDPropagate
+	if e.circuitBreaker < 0 {
+		return nil, errors.New("--circuit-breaker must not be negative")
+	}
+	if e.circuitCooldown <= 0 {
+		return nil, errors.New("--circuit-breaker-cooldown must be positive")
+	}
+	switch {
+	case e.upstreamFlushInterval < 0:
+		return nil, errors.New("--upstream-flush-interval must not be negative")
+	case e.upstreamFlushInterval == 0:
+		h.UpstreamFlushInterval = -1 // flush after each write
+	default:
+		h.UpstreamFlushInterval = e.upstreamFlushInterval
+	}
+	if e.poolStatsInterval < 0 {
+		return nil, errors.New("--pool-stats-interval must not be negative")
+	}
+	if e.poolStatsInterval > 0 && !e.upstreamPoolStats {
+		return nil, errors.New("--pool-stats-interval requires --upstream-pool-stats")
+	}
+	h.CollectPoolStats = e.upstreamPoolStats
+	if e.connectionEvents && e.connectionLogFile == "" {
+		return nil, errors.New("--backend-connection-events requires --connection-log-file")
+	}
+	if e.connectionLogFile != "" && !e.connectionEvents {
+		return nil, errors.New("--connection-log-file requires --backend-connection-events")
+	}
+	h.ConnectionEvents = e.connectionEvents
+	if e.debugConnStates && e.debugLogFile == "" {
+		return nil, errors.New("--debug-connection-states requires --debug-log-file")
+	}
+	h.ConnectionStates = e.debugConnStates
+	h.UpstreamKeepAliveProbe = e.backendKeepAlive
+	h.UpstreamTCPNoDelay = e.upstreamTCPNoDelay
+	h.NoKeepaliveBackends = e.noKeepaliveBackends
+	if e.circuitHalfOpen < 1 {
+		return nil, errors.New("--circuit-breaker-half-open-requests must be at least 1")
+	}
+	if e.circuitBreaker > 0 {
+		h.CircuitBreakerFailures = e.circuitBreaker
+		h.CircuitBreakerCooldown = e.circuitCooldown
+		if e.circuitHalfOpen > 1 {
+			h.CircuitBreakerHalfOpenRequests = e.circuitHalfOpen
+		}
+	}
+	if e.maxConnections < 0 {
+		return nil, errors.New("--max-connections must not be negative")
+	}
+	if e.maxQueueWait < 0 {
+		return nil, errors.New("--max-queue-wait must not be negative")
+	}
+	if e.maxConnections > 0 {
+		h.MaxConcurrentRequests = e.maxConnections
+		h.MaxQueueWait = e.maxQueueWait
+	}
+	if e.honorRetryAfter {
+		if e.maxRetryAfter <= 0 {
+			return nil, errors.New("--upstream-max-retry-after must be positive")
+		}
+		h.UpstreamHonorRetryAfter = true
+		h.UpstreamMaxRetryAfter = e.maxRetryAfter
+	}
+	switch e.backendHTTPVersion {
+	case "2":
+	case "1.1":
+		h.ForceHTTP1 = true
+	default:
+		return nil, fmt.Errorf("invalid --backend-http-version %q; must be 1.1 or 2", e.backendHTTPVersion)
+	}
+	if e.upstreamUserAgent != "pass-through" {
+		if e.upstreamUserAgent == "" {
+			return nil, errors.New("--upstream-user-agent must not be empty; use pass-through to send the client's User-Agent")
+		}
+		h.UpstreamUserAgent = e.upstreamUserAgent
+	}
+	h.NoSessionHeaders = !e.sessionHeaders
+	h.KeepForwardedHeaders = !e.sanitizeHeaders
+	switch e.forwardedHeaders {
+	case "xff":
+	case "rfc7239", "both", "none":
+		h.ForwardedHeaders = e.forwardedHeaders
+	default:
+		return nil, fmt.Errorf("invalid --upstream-forwarded-header %q; must be rfc7239, xff, both or none", e.forwardedHeaders)
+	}
+	if e.bearerTokenFile != "" {
+		// The file is read by tailscaled, which may not share our
+		// working directory.
+		f, err := filepath.Abs(e.bearerTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(f); err != nil {
+			return nil, fmt.Errorf("bearer token file: %w", err)
+		}
+		h.BearerTokenFile = f
+	}
+	if e.signSecretFile != "" {
+		// The file is read by tailscaled, which may not share our
+		// working directory.
+		f, err := filepath.Abs(e.signSecretFile)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(f); err != nil {
+			return nil, fmt.Errorf("request signing secret file: %w", err)
+		}
+		h.RequestSigningSecretFile = f
+	}
+	if e.oidcDiscovery != "" || e.oidcClientID != "" || e.oidcClientSecretFile != "" {
+		a, err := e.oidcUpstreamAuth()
+		if err != nil {
+			return nil, err
+		}
+		h.OIDCUpstreamAuth = a
+	}
+	if e.accessOIDCDiscovery != "" || e.accessOIDCAudience != "" {
+		a, err := e.oidcAccessControl()
+		if err != nil {
+			return nil, err
+		}
+		h.OIDCAccessControl = a
+	}
+	if e.backendAuthType != "" || e.oauth2TokenURL != "" || e.oauth2ClientID != "" || e.oauth2ClientSecret != "" || e.oauth2Scopes != "" {
+		c, err := e.oauth2ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		h.OAuth2Config = c
+	}
+	if e.rateLimitFile != "" {
+		f, err := filepath.Abs(e.rateLimitFile)
+		if err != nil {
+			return nil, err
+		}
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("rate limit file: %w", err)
+		}
+		if _, err := ipn.ParseRateLimits(b); err != nil {
+			return nil, fmt.Errorf("%s: %w", e.rateLimitFile, err)
+		}
+		h.RateLimitFile = f
 	}
+	h.PassThroughHeaders = []string{"X-Request-ID"}
+	for _, k := range e.keepRequestIDHeaders {
+		if !slices.ContainsFunc(h.PassThroughHeaders, func(s string) bool { return strings.EqualFold(s, k) }) {
+			h.PassThroughHeaders = append(h.PassThroughHeaders, k)
+		}
+	}
+	for _, k := range e.stripHeaders {
+		if slices.ContainsFunc(h.PassThroughHeaders, func(s string) bool { return strings.EqualFold(s, k) }) {
+			return nil, fmt.Errorf("--upstream-sanitize-headers-additional %q is passed through by --upstream-keep-request-id", k)
+		}
+		h.StripRequestHeaders = append(h.StripRequestHeaders, k)
+	}
+	switch e.upstreamProxyProtocol {
+	case "", "v1", "v2":
+		h.UpstreamProxyProtocol = e.upstreamProxyProtocol
+	default:
+		return nil, fmt.Errorf("invalid --upstream-proxy-protocol %q; must be v1 or v2", e.upstreamProxyProtocol)
+	}
+	if e.upstreamRootCA != "" {
+		pem, err := os.ReadFile(e.upstreamRootCA)
+		if err != nil {
+			return nil, fmt.Errorf("reading upstream root CA: %w", err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid PEM certificates found in %s", e.upstreamRootCA)
+		}
+		h.UpstreamRootCA = string(pem)
+	}
+	if fp := e.backendTLSFingerprint; fp != "" {
+		// Accept the colon-separated form printed by openssl.
+		fp = strings.ToLower(strings.ReplaceAll(fp, ":", ""))
+		if b, err := hex.DecodeString(fp); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid --backend-tls-fingerprint %q; must be the SHA-256 hash of a certificate in hex", e.backendTLSFingerprint)
+		}
+		h.TLSCertFingerprint = fp
+	}
+	return h, nil
+}
+
+// pathPrefixes is a flag.Value for a repeatable flag naming URL path
+// prefixes.
+type pathPrefixes []string
+
+func (f *pathPrefixes) String() string { return strings.Join(*f, ",") }
+
+func (f *pathPrefixes) Set(s string) error {
+	if !strings.HasPrefix(s, "/") {
+		return fmt.Errorf("path %q must start with /", s)
+	}
+	*f = append(*f, s)
+	return nil
+}
+
+// urlPrefixes is a flag.Value for a repeatable flag naming backend URL
+// prefixes.
+type urlPrefixes []string
+
+func (f *urlPrefixes) String() string { return strings.Join(*f, ",") }
+
+func (f *urlPrefixes) Set(s string) error {
+	if !strings.HasPrefix(s, "http://") && !strings.HasPrefix(s, "https://") {
+		return fmt.Errorf("URL prefix %q must start with http:// or https://", s)
+	}
+	*f = append(*f, s)
+	return nil
+}
+
+// oidcUpstreamAuth returns the OIDCUpstreamAuth set by the
+// --upstream-auth-oidc-* flags.
+func (e *serveEnv) oidcUpstreamAuth() (*ipn.OIDCUpstreamAuth, error) {
+	if e.oidcDiscovery == "" || e.oidcClientID == "" || e.oidcClientSecretFile == "" {
+		return nil, errors.New("--upstream-auth-oidc-discovery, --upstream-auth-oidc-client-id and --upstream-auth-oidc-client-secret-file must be given together")
+	}
+	if e.bearerTokenFile != "" {
+		return nil, errors.New("--bearer-token-file can't be used with --upstream-auth-oidc-discovery")
+	}
+	discoveryURL, err := oidcDiscoveryURL("upstream-auth-oidc-discovery", e.oidcDiscovery)
+	if err != nil {
+		return nil, err
+	}
+	// The file is read by tailscaled, which may not share our working
+	// directory.
+	f, err := filepath.Abs(e.oidcClientSecretFile)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(f); err != nil {
+		return nil, fmt.Errorf("OIDC client secret file: %w", err)
+	}
+	return &ipn.OIDCUpstreamAuth{
+		DiscoveryURL:     discoveryURL,
+		ClientID:         e.oidcClientID,
+		ClientSecretFile: f,
+	}, nil
+}
+
+// oidcAccessControl returns the OIDCAccessControl set by the
+// --access-control-oidc-* flags.
+func (e *serveEnv) oidcAccessControl() (*ipn.OIDCAccessControl, error) {
+	if e.accessOIDCDiscovery == "" || e.accessOIDCAudience == "" {
+		return nil, errors.New("--access-control-oidc-discovery and --access-control-oidc-audience must be given together")
+	}
+	discoveryURL, err := oidcDiscoveryURL("access-control-oidc-discovery", e.accessOIDCDiscovery)
+	if err != nil {
+		return nil, err
+	}
+	return &ipn.OIDCAccessControl{
+		DiscoveryURL: discoveryURL,
+		Audience:     e.accessOIDCAudience,
+	}, nil
+}
+
+// oidcDiscoveryURL returns the URL of the discovery document of the
+// OpenID Connect provider given by the flag name as s, which is either
+// that URL or the provider's issuer URL.
+func oidcDiscoveryURL(name, s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return "", fmt.Errorf("invalid --%s %q; must be an http or https URL", name, s)
+	}
+	if !strings.Contains(u.Path, "/.well-known/") {
+		// An issuer URL; see OpenID Connect Discovery 1.0, section 4.
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/.well-known/openid-configuration"
+	}
+	return u.String(), nil
+}
+
+// oauth2ClientConfig returns the OAuth2ClientConfig set by the
+// --backend-auth-type and --backend-oauth2-* flags.
+func (e *serveEnv) oauth2ClientConfig() (*ipn.OAuth2ClientConfig, error) {
+	if e.backendAuthType != "oauth2" {
+		return nil, fmt.Errorf("invalid --backend-auth-type %q; must be oauth2", e.backendAuthType)
+	}
+	if e.oauth2TokenURL == "" || e.oauth2ClientID == "" || e.oauth2ClientSecret == "" {
+		return nil, errors.New("--backend-auth-type=oauth2 requires --backend-oauth2-token-url, --backend-oauth2-client-id and --backend-oauth2-client-secret-file")
+	}
+	if e.bearerTokenFile != "" || e.oidcDiscovery != "" {
+		return nil, errors.New("--backend-auth-type=oauth2 can't be used with --bearer-token-file or --upstream-auth-oidc-discovery")
+	}
+	u, err := url.Parse(e.oauth2TokenURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("invalid --backend-oauth2-token-url %q; must be an http or https URL", e.oauth2TokenURL)
+	}
+	// The file is read by tailscaled, which may not share our working
+	// directory.
+	f, err := filepath.Abs(e.oauth2ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(f); err != nil {
+		return nil, fmt.Errorf("OAuth 2.0 client secret file: %w", err)
+	}
+	c := &ipn.OAuth2ClientConfig{
+		TokenURL:         e.oauth2TokenURL,
+		ClientID:         e.oauth2ClientID,
+		ClientSecretFile: f,
+	}
+	for _, s := range strings.Split(e.oauth2Scopes, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			c.Scopes = append(c.Scopes, s)
+		}
+	}
+	return c, nil
+}
+
+// headerNames is a flag.Value for a flag naming HTTP headers, which
+// may be repeated or given a comma-separated list.
+type headerNames []string
+
+func (f *headerNames) String() string { return strings.Join(*f, ",") }
+
+func (f *headerNames) Set(s string) error {
+	for _, k := range strings.Split(s, ",") {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			return errors.New("header name must not be empty")
+		}
+		*f = append(*f, k)
+	}
+	return nil
+}
+
+// runServeCircuitStatus is the entry point for the "tailscale {serve,funnel}
+// circuit-status" subcommand, which prints the circuit breaker state of the
+// backend given as its argument (in any form accepted as a serve target,
+// such as "3000" or "localhost:3000").
+func (e *serveEnv) runServeCircuitStatus(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return flag.ErrHelp
+	}
+	st, err := e.lc.GetCircuitBreakerStatus(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if e.json {
+		j, err := json.MarshalIndent(st, "", "  ")
+		if err != nil {
+			return err
+		}
+		j = append(j, '\n')
+		e.stdout().Write(j)
+		return nil
+	}
+	w := e.stdout()
+	fmt.Fprintf(w, "Backend:       %s\n", st.Backend)
+	fmt.Fprintf(w, "State:         %s\n", st.State)
+	fmt.Fprintf(w, "Failures:      %d\n", st.Failures)
+	if !st.LastFailure.IsZero() {
+		fmt.Fprintf(w, "Last failure:  %s\n", st.LastFailure.Format(time.RFC3339))
+	}
+	if !st.RecoveryTime.IsZero() {
+		fmt.Fprintf(w, "Recovery:      %s (in %v)\n", st.RecoveryTime.Format(time.RFC3339), time.Until(st.RecoveryTime).Round(time.Second))
+	}
+	return nil
+}
+
+// errServeStreamLost is returned by streamServe, possibly wrapped, when
+// the stream from tailscaled ends after serving has started.
+var errServeStreamLost = errors.New("lost connection to the Tailscale daemon")
+
+// streamServeReconnecting calls streamServe and, with --reconnect, calls
+// it again with backoff each time the stream is lost after serving has
+// started, such as when tailscaled restarts, until ctx is done. Starting
+// a new stream re-applies req's serve config, which tailscaled drops with
+// the old one, and fetches the new session.
+//
+// Errors starting the first stream are returned as is, as they're more
+// likely a problem with the config than with tailscaled.
+func (e *serveEnv) streamServeReconnecting(ctx context.Context, req ipn.ServeStreamRequest) error {
+	err := e.streamServe(ctx, req)
+	if !e.reconnect {
+		return err
+	}
+	bo := backoff.NewBackoff("serve-reconnect", logger.Discard, 30*time.Second)
+	attempt := 0
+	for ctx.Err() == nil {
+		if errors.Is(err, errServeStreamLost) {
+			// Serving had started, so start counting again.
+			attempt = 0
+			bo.BackOff(ctx, nil)
+			e.logf(serveLogWarn, "%v", err)
+		} else if attempt == 0 {
+			return err
+		} else {
+			e.logf(serveLogDebug, "reconnecting: %v", err)
+		}
+		bo.BackOff(ctx, err)
+		if ctx.Err() != nil {
+			break
+		}
+		attempt++
+		e.logf(serveLogInfo, "Reconnecting to Tailscale daemon... (attempt %d)", attempt)
+		err = e.streamServe(ctx, req)
+	}
+	return err
 }
 
 func (e *serveEnv) streamServe(ctx context.Context, req ipn.ServeStreamRequest) error {
+	var watcher *tailscale.IPNBusWatcher
+	if req.Funnel {
+		// Subscribe to the IPN bus before starting the stream so that
+		// the FunnelStarted event can't be missed.
+		watchCtx, cancelWatch := context.WithCancel(ctx)
+		defer cancelWatch()
+		w, err := e.lc.WatchIPNBus(watchCtx, 0)
+		if err != nil {
+			return fmt.Errorf("watching IPN bus: %w", err)
+		}
+		defer w.Close()
+		watcher = w
+	}
+
+	if e.logLevel <= serveLogDebug {
+		e.logServeConfig("serve config to add", req.ServeConfig())
+		watchCtx, cancelWatch := context.WithCancel(ctx)
+		watchDone := make(chan struct{})
+		go func() {
+			defer close(watchDone)
+			e.logIPNNotifications(watchCtx)
+		}()
+		defer func() {
+			cancelWatch()
+			<-watchDone
+		}()
+	}
+
 	stream, err := e.lc.StreamServe(ctx, req)
 	if err != nil {
 		return err
 	}
 	defer stream.Close()
 
-	fmt.Fprintf(os.Stderr, "Serve started on \"https://%s\".\n", strings.TrimSuffix(string(req.HostPort), ":443"))
-	fmt.Fprintf(os.Stderr, "Press Ctrl-C to stop.\n\n")
-	_, err = io.Copy(os.Stdout, stream)
-	return err
+	var out io.Writer = os.Stdout
+	if e.onRequestLog != "" {
+		hook := newRequestLogHook(e.onRequestLog, func(format string, args ...any) {
+			e.logf(serveLogWarn, format, args...)
+		})
+		hookCtx, cancelHook := context.WithCancel(ctx)
+		hookDone := make(chan struct{})
+		go func() {
+			defer close(hookDone)
+			hook.run(hookCtx)
+		}()
+		defer func() {
+			cancelHook()
+			<-hookDone
+		}()
+		out = io.MultiWriter(out, hook)
+	}
+	var connLog *os.File
+	if e.connectionLogFile != "" {
+		connLog, err = os.OpenFile(e.connectionLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return fmt.Errorf("opening --connection-log-file: %w", err)
+		}
+		defer connLog.Close()
+	}
+	var debugLog *os.File
+	if e.debugConnStates {
+		debugLog, err = os.OpenFile(e.debugLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return fmt.Errorf("opening --debug-log-file: %w", err)
+		}
+		defer debugLog.Close()
+	}
+	if e.logShipURL != "" {
+		shipper := newRequestLogShipper(e.logShipURL, e.logShipInterval, e.logShipBatchSize, e.logShipMaxBuffer, func(format string, args ...any) {
+			e.logf(serveLogWarn, format, args...)
+		})
+		shipCtx, cancelShip := context.WithCancel(ctx)
+		shipDone := make(chan struct{})
+		go func() {
+			defer close(shipDone)
+			shipper.run(shipCtx)
+		}()
+		defer func() {
+			cancelShip()
+			<-shipDone
+		}()
+		out = io.MultiWriter(out, shipper)
+	}
+	if e.geoIPDB != "" {
+		out = newGeoIPEnricher(out, e.geoIPDB, func(format string, args ...any) {
+			e.logf(serveLogWarn, format, args...)
+		})
+	}
+	if len(e.accessLogExclude) > 0 || e.slowRequestThreshold > 0 || connLog != nil || debugLog != nil || e.classifyErrors || e.preheatConns > 0 {
+		f := newRequestLogFilter(out, e.accessLogExclude)
+		if connLog != nil {
+			f.connLog = connLog
+		}
+		if debugLog != nil {
+			f.stateLog = debugLog
+		}
+		f.warnError = func(class string) {
+			e.logf(serveLogWarn, "%s", upstreamErrorSuggestion(class))
+		}
+		f.preheated = func(log ipn.PreheatLog) {
+			if log.Conns < e.preheatConns && log.Err != "" {
+				e.logf(serveLogWarn, "Pre-warmed %d of %d connections to upstream: %s", log.Conns, e.preheatConns, log.Err)
+				return
+			}
+			e.logf(serveLogInfo, "Pre-warmed %d connections to upstream", log.Conns)
+		}
+		f.slowSampleRate = e.slowRequestSampleRate
+		f.warnSlow = func(slow, total int) {
+			e.logf(serveLogWarn, "%d of the last %d requests took longer than --slow-request-threshold=%v to start responding.", slow, total, e.slowRequestThreshold)
+		}
+		out = f
+	}
+
+	copyDone := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(out, stream)
+		copyDone <- err
+	}()
+
+	banner := serveBanner{
+		URL: "https://" + strings.TrimSuffix(string(req.HostPort), ":443"),
+	}
+	if req.TCP {
+		banner.URL = "tcp://" + string(req.HostPort)
+	}
+	banner.Port, _ = req.HostPort.Port()
+	if watcher != nil {
+		type result struct {
+			ev  *ipn.FunnelStartedEvent
+			err error
+		}
+		started := make(chan result, 1)
+		go func() {
+			ev, err := waitFunnelStarted(watcher, req.HostPort)
+			started <- result{ev, err}
+		}()
+		select {
+		case r := <-started:
+			if r.err != nil {
+				return fmt.Errorf("waiting for Funnel to start: %w", r.err)
+			}
+			banner.Session = r.ev.SessionID
+			e.sessionID = r.ev.SessionID
+			watcher.Close()
+		case err := <-copyDone:
+			if err == nil {
+				err = errors.New("stream closed before Funnel started")
+			}
+			return err
+		}
+	}
+
+	e.auditServeStream(serveAuditStreamStart, req)
+	defer func() {
+		// req may have been reloaded since it started.
+		e.auditServeStream(serveAuditStreamEnd, req)
+		e.sessionID = ""
+	}()
+
+	e.printBanner(banner)
+	if e.systemdNotify {
+		systemd.Ready()
+		if d := systemd.WatchdogInterval(); d > 0 {
+			go sendSystemdWatchdog(ctx, d/2)
+		}
+	}
+	if e.poolStatsInterval > 0 {
+		statsCtx, cancelStats := context.WithCancel(ctx)
+		statsDone := make(chan struct{})
+		go func() {
+			defer close(statsDone)
+			e.printPoolStats(statsCtx, req.Source, e.poolStatsInterval)
+		}()
+		defer func() {
+			cancelStats()
+			<-statsDone
+		}()
+	}
+
+	hup := make(chan os.Signal, 1)
+	if sighup != nil && e.reloadHandler != nil {
+		signal.Notify(hup, sighup)
+		defer signal.Stop(hup)
+	}
+	var configChanged <-chan struct{}
+	if e.configWatchDir != "" && e.reloadHandler != nil {
+		var err error
+		configChanged, err = e.watchServeConfigDir(ctx)
+		if err != nil {
+			return fmt.Errorf("watching --config-watch-dir: %w", err)
+		}
+	}
+	for {
+		select {
+		case err := <-copyDone:
+			if ctx.Err() != nil {
+				return err
+			}
+			if err == nil {
+				return errServeStreamLost
+			}
+			return fmt.Errorf("%w: %w", errServeStreamLost, err)
+		case <-hup:
+		case <-configChanged:
+		}
+		if err := e.reloadServe(ctx, &req); err != nil {
+			e.logf(serveLogError, "Reloading configuration: %v; keeping the previous configuration.", err)
+		}
+	}
+}
+
+// printPoolStats prints the connection pool statistics of backend to
+// stderr every interval until ctx is done.
+func (e *serveEnv) printPoolStats(ctx context.Context, backend string, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		st, err := e.lc.GetUpstreamPoolStats(ctx, backend)
+		if err != nil {
+			if ctx.Err() == nil {
+				e.logf(serveLogWarn, "pool stats: %v", err)
+			}
+			continue
+		}
+		e.logf(serveLogInfo, "pool stats for %s: active=%d idle=%d waits=%d wait-time=%v",
+			st.Backend, st.Active, st.Idle, st.WaitCount, st.WaitDuration.Round(time.Millisecond))
+	}
+}
+
+// sendSystemdWatchdog sends a systemd watchdog keep-alive every
+// interval until ctx is done.
+func sendSystemdWatchdog(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		systemd.Watchdog()
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// waitFunnelStarted blocks until w reports that the local backend has
+// started a foreground Funnel session for hp, and returns the event.
+func waitFunnelStarted(w *tailscale.IPNBusWatcher, hp ipn.HostPort) (*ipn.FunnelStartedEvent, error) {
+	for {
+		n, err := w.Next()
+		if err != nil {
+			return nil, err
+		}
+		if fs := n.FunnelStarted; fs != nil && fs.HostPort == hp {
+			return fs, nil
+		}
+	}
 }
@@ -0,0 +1,101 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseFieldPath splits a --field path into the object keys and array
+// indexes it selects. Keys are given in dot notation, as in .Web, or in
+// brackets, quoted or not, as in ["foo.ts.net:443"] or [443]. Array
+// indexes are given in brackets, as in [0]. The path "." selects the
+// whole value.
+func parseFieldPath(path string) ([]string, error) {
+	if path == "." {
+		return nil, nil
+	}
+	var keys []string
+	for rest := path; rest != ""; {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			i := strings.IndexAny(rest, ".[")
+			if i < 0 {
+				i = len(rest)
+			}
+			if i == 0 {
+				return nil, fmt.Errorf("invalid field path %q: empty name", path)
+			}
+			keys = append(keys, rest[:i])
+			rest = rest[i:]
+		case '[':
+			rest = rest[1:]
+			var key string
+			if strings.HasPrefix(rest, `"`) {
+				q, err := strconv.QuotedPrefix(rest)
+				if err != nil {
+					return nil, fmt.Errorf("invalid field path %q: %w", path, err)
+				}
+				key, _ = strconv.Unquote(q)
+				rest = rest[len(q):]
+			} else {
+				i := strings.IndexByte(rest, ']')
+				if i < 0 {
+					return nil, fmt.Errorf("invalid field path %q: missing ]", path)
+				}
+				key, rest = rest[:i], rest[i:]
+			}
+			if !strings.HasPrefix(rest, "]") {
+				return nil, fmt.Errorf("invalid field path %q: missing ]", path)
+			}
+			keys = append(keys, key)
+			rest = rest[1:]
+		default:
+			return nil, fmt.Errorf("invalid field path %q: want . or [ at %q", path, rest)
+		}
+	}
+	return keys, nil
+}
+
+// jsonField returns the value at path, as parsed by parseFieldPath, in
+// the JSON document j. It returns an error if there's no such field.
+func jsonField(j []byte, path string) (any, error) {
+	keys, err := parseFieldPath(path)
+	if err != nil {
+		return nil, err
+	}
+	var v any
+	if err := json.Unmarshal(j, &v); err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		var ok bool
+		switch vv := v.(type) {
+		case map[string]any:
+			v, ok = vv[k]
+		case []any:
+			n, err := strconv.Atoi(k)
+			if ok = err == nil && n >= 0 && n < len(vv); ok {
+				v = vv[n]
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("field %s not found", fieldPathString(keys[:i+1]))
+		}
+	}
+	return v, nil
+}
+
+// fieldPathString formats keys as a path in bracket notation.
+func fieldPathString(keys []string) string {
+	var sb strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&sb, "[%q]", k)
+	}
+	return sb.String()
+}
@@ -0,0 +1,231 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/netip"
+	"os"
+	"sort"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/lru"
+)
+
+const (
+	// geoIPCacheSize is the most client addresses whose locations a
+	// geoIPEnricher keeps.
+	geoIPCacheSize = 10000
+
+	// geoIPCheckInterval is how often a geoIPEnricher checks whether
+	// its table file has been replaced.
+	geoIPCheckInterval = 10 * time.Second
+)
+
+// geoIPLocation is where a client address is, as listed in a --geoip-db
+// table. Any of the fields may be empty.
+type geoIPLocation struct {
+	CountryCode string `json:",omitempty"`
+	CityName    string `json:",omitempty"`
+	ASNOrg      string `json:",omitempty"`
+}
+
+// geoIPTable is the contents of a --geoip-db file: a CSV file of
+// network,country_code,city,asn_org records, such as
+//
+//	203.0.113.0/24,NL,Amsterdam,Example Networks B.V.
+//
+// as can be exported from a GeoIP database ahead of time. The trailing
+// fields may be left out, lines starting with # are comments, and a
+// first record starting with "network" is a header. An address is in
+// the most specific network that contains it.
+type geoIPTable struct {
+	bits     []int // the distinct prefix lengths of the networks, longest first
+	networks map[netip.Prefix]geoIPLocation
+}
+
+// parseGeoIPTable parses a --geoip-db file from r.
+func parseGeoIPTable(r io.Reader) (*geoIPTable, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	t := &geoIPTable{networks: map[netip.Prefix]geoIPLocation{}}
+	seenBits := map[int]bool{}
+	for first := true; ; first = false {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if first && rec[0] == "network" {
+			continue
+		}
+		line, _ := cr.FieldPos(0)
+		if len(rec) > 4 {
+			return nil, fmt.Errorf("line %d: got %d fields; want at most 4", line, len(rec))
+		}
+		pfx, err := netip.ParsePrefix(rec[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		pfx = pfx.Masked()
+		rec = append(rec, "", "", "")
+		t.networks[pfx] = geoIPLocation{CountryCode: rec[1], CityName: rec[2], ASNOrg: rec[3]}
+		if !seenBits[pfx.Bits()] {
+			seenBits[pfx.Bits()] = true
+			t.bits = append(t.bits, pfx.Bits())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(t.bits)))
+	return t, nil
+}
+
+// lookup returns the location of the most specific network in t that
+// contains addr, and whether there is one.
+func (t *geoIPTable) lookup(addr netip.Addr) (geoIPLocation, bool) {
+	for _, bits := range t.bits {
+		pfx, err := addr.Prefix(bits)
+		if err != nil {
+			continue // longer than addr
+		}
+		if loc, ok := t.networks[pfx]; ok {
+			return loc, true
+		}
+	}
+	return geoIPLocation{}, false
+}
+
+// geoIPEnricher is an io.Writer that writes each newline-terminated
+// FunnelRequestLog written to it to w, with the CountryCode, CityName
+// and ASNOrg of its client filled in from the geoIPTable at path, as set
+// by --geoip-db. Logs are written unchanged while the file doesn't
+// exist. The file is reloaded when its modification time changes, such
+// as when it's replaced by an update.
+type geoIPEnricher struct {
+	w    io.Writer
+	path string
+	logf logger.Logf
+	now  func() time.Time // time.Now except in tests
+
+	table   *geoIPTable // or nil if the file couldn't be loaded
+	modTime time.Time   // of the file when it was last loaded, or zero
+	checked time.Time   // when the file was last checked
+	cache   lru.Cache[netip.Addr, geoIPLocation]
+
+	lineWriter // calls writeLine
+}
+
+func newGeoIPEnricher(w io.Writer, path string, logf logger.Logf) *geoIPEnricher {
+	e := &geoIPEnricher{
+		w:     w,
+		path:  path,
+		logf:  logf,
+		now:   time.Now,
+		cache: lru.Cache[netip.Addr, geoIPLocation]{MaxEntries: geoIPCacheSize},
+	}
+	e.onLine = e.writeLine
+	return e
+}
+
+// writeLine writes line to e.w, enriched.
+func (e *geoIPEnricher) writeLine(line []byte) error {
+	_, err := e.w.Write(e.enrich(line))
+	return err
+}
+
+// enrich returns line with the client's location added, if it's a
+// FunnelRequestLog with a client address the table has. The fields are
+// added to the end of the JSON object, rather than by re-encoding the
+// log, so that fields this version of the CLI doesn't know about are
+// kept.
+func (e *geoIPEnricher) enrich(line []byte) []byte {
+	var log ipn.FunnelRequestLog
+	if json.Unmarshal(line, &log) != nil || !log.SrcAddr.IsValid() {
+		return line
+	}
+	obj := bytes.TrimRight(line, " \t\r\n")
+	if !bytes.HasSuffix(obj, []byte("}")) {
+		return line
+	}
+	loc, ok := e.lookup(log.SrcAddr.Addr().Unmap())
+	if !ok {
+		return line
+	}
+	fields, err := json.Marshal(loc)
+	if err != nil || string(fields) == "{}" {
+		return line
+	}
+	// {"A":1} and {"B":2} make {"A":1,"B":2}.
+	out := append(bytes.Clone(obj[:len(obj)-1]), ',')
+	out = append(out, fields[1:]...)
+	return append(out, '\n')
+}
+
+// lookup returns the location of addr, and whether the table has it.
+func (e *geoIPEnricher) lookup(addr netip.Addr) (geoIPLocation, bool) {
+	if now := e.now(); now.Sub(e.checked) >= geoIPCheckInterval {
+		e.checked = now
+		e.reload()
+	}
+	if e.table == nil {
+		return geoIPLocation{}, false
+	}
+	if loc, ok := e.cache.GetOk(addr); ok {
+		return loc, true
+	}
+	loc, ok := e.table.lookup(addr)
+	if !ok {
+		return geoIPLocation{}, false
+	}
+	e.cache.Set(addr, loc)
+	return loc, true
+}
+
+// reload loads the table file if it's changed since it was last loaded,
+// or drops the table if the file is gone. A file that can't be loaded
+// isn't tried again until it changes.
+func (e *geoIPEnricher) reload() {
+	fi, err := os.Stat(e.path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			e.logf("--geoip-db: %v", err)
+		}
+		e.drop()
+		return
+	}
+	if fi.ModTime().Equal(e.modTime) {
+		return
+	}
+	e.drop()
+	e.modTime = fi.ModTime()
+	f, err := os.Open(e.path)
+	if err != nil {
+		e.logf("--geoip-db: %v", err)
+		return
+	}
+	defer f.Close()
+	t, err := parseGeoIPTable(f)
+	if err != nil {
+		e.logf("--geoip-db: %s: %v", e.path, err)
+		return
+	}
+	e.table = t
+}
+
+// drop forgets the table, if it's loaded, and its lookups.
+func (e *geoIPEnricher) drop() {
+	e.table = nil
+	e.modTime = time.Time{}
+	e.cache = lru.Cache[netip.Addr, geoIPLocation]{MaxEntries: geoIPCacheSize}
+}
@@ -0,0 +1,91 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// serveLogLevel is the verbosity of the messages a foreground serve
+// prints to stderr, as set by --log-level. The zero value is info.
+// It implements flag.Value.
+type serveLogLevel int
+
+const (
+	serveLogDebug serveLogLevel = iota - 1
+	serveLogInfo
+	serveLogWarn
+	serveLogError
+)
+
+var serveLogLevelNames = map[serveLogLevel]string{
+	serveLogDebug: "debug",
+	serveLogInfo:  "info",
+	serveLogWarn:  "warn",
+	serveLogError: "error",
+}
+
+func (l serveLogLevel) String() string { return serveLogLevelNames[l] }
+
+// Set implements flag.Value.
+func (l *serveLogLevel) Set(s string) error {
+	for lvl, name := range serveLogLevelNames {
+		if s == name {
+			*l = lvl
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid log level %q; must be debug, info, warn or error", s)
+}
+
+// logf prints a message to stderr if lvl is at least the --log-level.
+// Messages at serveLogWarn are prefixed with "Warning: ". A trailing
+// newline is added.
+func (e *serveEnv) logf(lvl serveLogLevel, format string, args ...any) {
+	if lvl < e.logLevel {
+		return
+	}
+	switch lvl {
+	case serveLogDebug:
+		format = "debug: " + format
+	case serveLogWarn:
+		format = "Warning: " + format
+	}
+	fmt.Fprintf(e.stderr(), format+"\n", args...)
+}
+
+// logServeConfig logs sc at debug level.
+func (e *serveEnv) logServeConfig(what string, sc any) {
+	if e.logLevel > serveLogDebug {
+		return
+	}
+	j, err := json.Marshal(sc)
+	if err != nil {
+		e.logf(serveLogDebug, "%s: %v", what, err)
+		return
+	}
+	e.logf(serveLogDebug, "%s: %s", what, j)
+}
+
+// logIPNNotifications logs every IPN bus notification at debug level
+// until ctx is done.
+func (e *serveEnv) logIPNNotifications(ctx context.Context) {
+	w, err := e.lc.WatchIPNBus(ctx, 0)
+	if err != nil {
+		if ctx.Err() == nil {
+			e.logf(serveLogDebug, "watching IPN bus: %v", err)
+		}
+		return
+	}
+	defer w.Close()
+	for {
+		n, err := w.Next()
+		if err != nil {
+			return
+		}
+		e.logf(serveLogDebug, "IPN notification: %v", n)
+	}
+}
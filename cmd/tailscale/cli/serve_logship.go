@@ -0,0 +1,165 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"tailscale.com/logtail/backoff"
+	"tailscale.com/types/logger"
+)
+
+// logShipFinalFlushTimeout is how long the last batch of request logs
+// may take to ship once serving stops.
+const logShipFinalFlushTimeout = 5 * time.Second
+
+// checkLogShipFlags validates the --log-ship-* flags.
+func (e *serveEnv) checkLogShipFlags() error {
+	if e.logShipURL == "" {
+		return nil
+	}
+	u, err := url.Parse(e.logShipURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid --log-ship-url %q; must be an http or https URL", e.logShipURL)
+	}
+	if e.logShipInterval <= 0 {
+		return errors.New("--log-ship-interval must be positive")
+	}
+	if e.logShipBatchSize <= 0 {
+		return errors.New("--log-ship-batch-size must be positive")
+	}
+	if e.logShipMaxBuffer < e.logShipBatchSize {
+		return errors.New("--log-ship-max-buffer must be at least --log-ship-batch-size")
+	}
+	return nil
+}
+
+// requestLogShipper is an io.Writer that ships each newline-terminated
+// FunnelRequestLog written to it to an HTTP endpoint, as set by
+// --log-ship-url. Logs are POSTed as a JSON array, in batches of up to
+// batchSize, at least every interval.
+//
+// Writes never block: logs wait in a buffer of up to maxBuffer entries
+// while a batch is being shipped, retried with backoff if the POST
+// fails. Once the buffer is full, further logs are dropped.
+type requestLogShipper struct {
+	url       string
+	interval  time.Duration
+	batchSize int
+	client    *http.Client
+	logf      logger.Logf
+	lines     chan []byte
+
+	lineWriter // calls queueLine
+
+	dropped bool // whether a line has been dropped since the last warning; only used by queueLine
+}
+
+func newRequestLogShipper(url string, interval time.Duration, batchSize, maxBuffer int, logf logger.Logf) *requestLogShipper {
+	s := &requestLogShipper{
+		url:       url,
+		interval:  interval,
+		batchSize: batchSize,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		logf:      logf,
+		lines:     make(chan []byte, maxBuffer),
+	}
+	s.onLine = s.queueLine
+	return s
+}
+
+// queueLine queues line to be shipped, if it's JSON, unless the buffer
+// is full.
+func (s *requestLogShipper) queueLine(line []byte) error {
+	line = bytes.TrimSpace(line)
+	if !json.Valid(line) {
+		return nil
+	}
+	select {
+	case s.lines <- bytes.Clone(line):
+		s.dropped = false
+	default:
+		if !s.dropped {
+			s.logf("warning: --log-ship-max-buffer is full; dropping request logs")
+		}
+		s.dropped = true
+	}
+	return nil
+}
+
+// run ships batches of logs until ctx is done, then makes one last
+// attempt to ship what's left.
+func (s *requestLogShipper) run(ctx context.Context) {
+	tick := time.NewTicker(s.interval)
+	defer tick.Stop()
+	bo := backoff.NewBackoff("log-ship", s.logf, 30*time.Second)
+	bo.LogLongerThan = time.Minute // failures are logged below
+
+	var batch []json.RawMessage
+	ship := func() {
+		for len(batch) > 0 && ctx.Err() == nil {
+			err := s.post(ctx, batch)
+			if err == nil {
+				batch = batch[:0]
+			} else if ctx.Err() == nil {
+				s.logf("log-ship: %v; retrying", err)
+			}
+			bo.BackOff(ctx, err)
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			for len(s.lines) > 0 {
+				batch = append(batch, <-s.lines)
+			}
+			if len(batch) > 0 {
+				flushCtx, cancel := context.WithTimeout(context.Background(), logShipFinalFlushTimeout)
+				if err := s.post(flushCtx, batch); err != nil {
+					s.logf("log-ship: dropping %d request logs: %v", len(batch), err)
+				}
+				cancel()
+			}
+			return
+		case line := <-s.lines:
+			batch = append(batch, line)
+			if len(batch) >= s.batchSize {
+				ship()
+			}
+		case <-tick.C:
+			ship()
+		}
+	}
+}
+
+// post POSTs batch to s.url as a JSON array.
+func (s *requestLogShipper) post(ctx context.Context, batch []json.RawMessage) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 1<<20))
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("POST %s: %s", s.url, res.Status)
+	}
+	return nil
+}
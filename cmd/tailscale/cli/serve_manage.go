@@ -0,0 +1,188 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	xmaps "golang.org/x/exp/maps"
+	"tailscale.com/ipn"
+)
+
+func newServeManageCommands(e *serveEnv, subcmd string) []*ffcli.Command {
+	return []*ffcli.Command{
+		{
+			Name:       "list",
+			ShortUsage: fmt.Sprintf("%s list", subcmd),
+			ShortHelp:  "list the handlers in the serve config, one per line",
+			Exec:       e.runServeList,
+			FlagSet:    e.newFlags("serve-list", nil),
+			UsageFunc:  usageFunc,
+		},
+		{
+			Name:       "delete",
+			ShortUsage: fmt.Sprintf("%s delete <hostport> <mountpoint>", subcmd),
+			ShortHelp:  "remove one handler from the serve config",
+			Exec:       e.runServeDelete,
+			FlagSet:    e.newFlags("serve-delete", nil),
+			UsageFunc:  usageFunc,
+		},
+		{
+			Name:       "disable",
+			ShortUsage: fmt.Sprintf("%s disable <hostport>", subcmd),
+			ShortHelp:  "turn Funnel off for a host:port, still serving it on the tailnet",
+			Exec:       e.runServeDisable,
+			FlagSet:    e.newFlags("serve-disable", nil),
+			UsageFunc:  usageFunc,
+		},
+	}
+}
+
+// runServeList is the entry point for "tailscale {serve,funnel} list".
+// It prints a line for each web handler and TCP forwarder in the serve
+// config, with its host:port, mount point, whether Funnel is on, and
+// what it serves.
+func (e *serveEnv) runServeList(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return flag.ErrHelp
+	}
+	sc, err := e.lc.GetServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if sc == nil || (len(sc.TCP) == 0 && len(sc.Web) == 0) {
+		fmt.Fprintln(e.stdout(), "No serve config")
+		return nil
+	}
+	funnelStatus := func(hp ipn.HostPort) string {
+		if !sc.AllowFunnel[hp] {
+			return "off"
+		}
+		if paths := sc.FunnelPaths[hp]; len(paths) > 0 {
+			return "on (" + strings.Join(paths, ",") + ")"
+		}
+		return "on"
+	}
+	tw := tabwriter.NewWriter(e.stdout(), 0, 2, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOSTPORT\tMOUNT\tFUNNEL\tTARGET")
+	hps := xmaps.Keys(sc.Web)
+	slices.Sort(hps)
+	for _, hp := range hps {
+		web := sc.Web[hp]
+		mounts := xmaps.Keys(web.Handlers)
+		slices.Sort(mounts)
+		for _, m := range mounts {
+			t, d := srvTypeAndDesc(web.Handlers[m])
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s %s\n", hp, m, funnelStatus(hp), t, d)
+		}
+		methods := xmaps.Keys(web.MethodHandlers)
+		slices.Sort(methods)
+		for _, m := range methods {
+			t, d := srvTypeAndDesc(web.MethodHandlers[m])
+			fmt.Fprintf(tw, "%s\t/ (%s requests)\t%s\t%s %s\n", hp, m, funnelStatus(hp), t, d)
+		}
+	}
+	if sc.IsTCPForwardingAny() {
+		dnsName, err := e.getSelfDNSName(ctx)
+		if err != nil {
+			return err
+		}
+		ports := xmaps.Keys(sc.TCP)
+		slices.Sort(ports)
+		for _, p := range ports {
+			h := sc.TCP[p]
+			if h.TCPForward == "" {
+				continue
+			}
+			hp := ipn.HostPort(net.JoinHostPort(dnsName, strconv.Itoa(int(p))))
+			fmt.Fprintf(tw, "%s\t-\t%s\ttcp %s\n", hp, funnelStatus(hp), h.TCPForward)
+		}
+	}
+	return tw.Flush()
+}
+
+// runServeDelete is the entry point for "tailscale {serve,funnel} delete".
+// It removes the web handler at the given host:port and mount point,
+// and the host:port's TCP and Funnel settings too if that was its last
+// handler, leaving the rest of the serve config alone.
+func (e *serveEnv) runServeDelete(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return flag.ErrHelp
+	}
+	hp := ipn.HostPort(args[0])
+	port, err := hp.Port()
+	if err != nil {
+		return fmt.Errorf("invalid <hostport> %q: %w", args[0], err)
+	}
+	mount, err := cleanMountPoint(args[1])
+	if err != nil {
+		return err
+	}
+	sc, err := e.lc.GetServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if sc == nil || !sc.WebHandlerExists(hp, mount) {
+		return fmt.Errorf("no handler for %s%s", hp, mount)
+	}
+	delete(sc.Web[hp].Handlers, mount)
+	if len(sc.Web[hp].Handlers) == 0 && len(sc.Web[hp].MethodHandlers) == 0 {
+		delete(sc.Web, hp)
+		delete(sc.TCP, port)
+		delete(sc.AllowFunnel, hp)
+		delete(sc.FunnelPaths, hp)
+	}
+	// clear empty maps mostly for testing
+	if len(sc.Web) == 0 {
+		sc.Web = nil
+	}
+	if len(sc.TCP) == 0 {
+		sc.TCP = nil
+	}
+	if len(sc.AllowFunnel) == 0 {
+		sc.AllowFunnel = nil
+	}
+	if len(sc.FunnelPaths) == 0 {
+		sc.FunnelPaths = nil
+	}
+	return e.lc.SetServeConfig(ctx, sc)
+}
+
+// runServeDisable is the entry point for "tailscale {serve,funnel} disable".
+// It turns Funnel off for the given host:port, keeping its handlers so
+// that it's still served within the tailnet.
+func (e *serveEnv) runServeDisable(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return flag.ErrHelp
+	}
+	hp := ipn.HostPort(args[0])
+	if _, err := hp.Port(); err != nil {
+		return fmt.Errorf("invalid <hostport> %q: %w", args[0], err)
+	}
+	sc, err := e.lc.GetServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if sc == nil || !sc.AllowFunnel[hp] {
+		return fmt.Errorf("Funnel is not on for %s", hp)
+	}
+	delete(sc.AllowFunnel, hp)
+	delete(sc.FunnelPaths, hp)
+	// clear maps mostly for testing
+	if len(sc.AllowFunnel) == 0 {
+		sc.AllowFunnel = nil
+	}
+	if len(sc.FunnelPaths) == 0 {
+		sc.FunnelPaths = nil
+	}
+	return e.lc.SetServeConfig(ctx, sc)
+}
@@ -0,0 +1,126 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// mockResponse is a response served by the mock backend of
+// --upstream-mock-file.
+type mockResponse struct {
+	Method  string            `json:"method"` // or empty to match any method
+	Path    string            `json:"path"`   // path prefix to match
+	Status  int               `json:"status"` // or zero for 200
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+// loadMockResponses reads the JSON array of mock responses in file.
+func loadMockResponses(file string) ([]mockResponse, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var mocks []mockResponse
+	if err := json.Unmarshal(b, &mocks); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", file, err)
+	}
+	if len(mocks) == 0 {
+		return nil, fmt.Errorf("%s has no mock responses", file)
+	}
+	for i, m := range mocks {
+		if !strings.HasPrefix(m.Path, "/") {
+			return nil, fmt.Errorf("%s: mock %d: path %q must start with /", file, i, m.Path)
+		}
+		if m.Status != 0 && (m.Status < 100 || m.Status > 599) {
+			return nil, fmt.Errorf("%s: mock %d: invalid status %d", file, i, m.Status)
+		}
+	}
+	return mocks, nil
+}
+
+// mockBackend is an http.Handler that serves mock responses, for
+// developing serve and Funnel configs without a running backend.
+type mockBackend []mockResponse
+
+// match returns the mock response for r: the one with the longest path
+// prefix of r's path whose method, if any, is r's.
+func (mb mockBackend) match(r *http.Request) (*mockResponse, bool) {
+	var best *mockResponse
+	for i := range mb {
+		m := &mb[i]
+		if m.Method != "" && !strings.EqualFold(m.Method, r.Method) {
+			continue
+		}
+		if !strings.HasPrefix(r.URL.Path, m.Path) {
+			continue
+		}
+		if best == nil || len(m.Path) > len(best.Path) {
+			best = m
+		}
+	}
+	return best, best != nil
+}
+
+func (mb mockBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m, ok := mb.match(r)
+	if !ok {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "no mock response for %s %s; the mocks are:\n", r.Method, r.URL.Path)
+		for _, m := range mb {
+			method := m.Method
+			if method == "" {
+				method = "*"
+			}
+			fmt.Fprintf(w, "  %s %s\n", method, m.Path)
+		}
+		return
+	}
+	for k, v := range m.Headers {
+		w.Header().Set(k, v)
+	}
+	status := m.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	io.WriteString(w, m.Body)
+}
+
+// startMockBackend starts a mock backend on localhost serving the
+// responses in file, and returns its URL to use as the serve target.
+// The backend runs until stop is called.
+func startMockBackend(file string) (target string, stop func(), err error) {
+	mocks, err := loadMockResponses(file)
+	if err != nil {
+		return "", nil, err
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	srv := &http.Server{Handler: mockBackend(mocks)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Fprintf(os.Stderr, "mock backend: %v\n", err)
+		}
+	}()
+	stop = func() {
+		srv.Shutdown(context.Background())
+		<-done
+	}
+	return "http://" + ln.Addr().String(), stop, nil
+}
@@ -0,0 +1,221 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"tailscale.com/ipn"
+)
+
+// serveFlagSetting is the value of a flag, as given on the command line
+// or in a --config file.
+type serveFlagSetting struct {
+	name, value string
+}
+
+// flagsSet returns the flags that have been set in fs.
+func flagsSet(fs *flag.FlagSet) []serveFlagSetting {
+	var set []serveFlagSetting
+	fs.Visit(func(f *flag.Flag) {
+		set = append(set, serveFlagSetting{f.Name, f.Value.String()})
+	})
+	return set
+}
+
+// readServeConfigFile reads the flag settings in a --config file: one per
+// line, as the flag name and its value separated by whitespace. A boolean
+// flag may be given without a value. Blank lines and lines starting with
+// # are ignored. The file may instead be a JSON object of flag names to
+// values, which are strings, numbers or booleans.
+func readServeConfigFile(file string) ([]serveFlagSetting, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		return parseServeConfigJSON(b)
+	}
+	var set []serveFlagSetting
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; sc.Scan(); line++ {
+		s := strings.TrimSpace(sc.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		name, value, _ := strings.Cut(s, " ")
+		name = strings.TrimLeft(name, "-")
+		set = append(set, serveFlagSetting{name, strings.TrimSpace(value)})
+	}
+	return set, sc.Err()
+}
+
+// parseServeConfigJSON parses a --config file that's a JSON object of
+// flag settings. They're returned sorted by name.
+func parseServeConfigJSON(b []byte) ([]serveFlagSetting, error) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	var set []serveFlagSetting
+	for name, raw := range m {
+		var v any
+		d := json.NewDecoder(bytes.NewReader(raw))
+		d.UseNumber()
+		if err := d.Decode(&v); err != nil {
+			return nil, err
+		}
+		var value string
+		switch v := v.(type) {
+		case string:
+			value = v
+		case json.Number:
+			value = v.String()
+		case bool:
+			value = strconv.FormatBool(v)
+		default:
+			return nil, fmt.Errorf("value of %q must be a string, number or boolean", name)
+		}
+		set = append(set, serveFlagSetting{strings.TrimLeft(name, "-"), value})
+	}
+	slices.SortFunc(set, func(a, b serveFlagSetting) int { return strings.Compare(a.name, b.name) })
+	return set, nil
+}
+
+// applyServeConfigFile sets the flags in fs from e.configFile, except for
+// those in cmdline, which were given on the command line and take
+// precedence.
+func (e *serveEnv) applyServeConfigFile(fs *flag.FlagSet, cmdline []serveFlagSetting) error {
+	set, err := readServeConfigFile(e.configFile)
+	if err != nil {
+		return fmt.Errorf("reading --config file: %w", err)
+	}
+	given := make(map[string]bool)
+	for _, s := range cmdline {
+		given[s.name] = true
+	}
+	for _, s := range set {
+		f := fs.Lookup(s.name)
+		switch {
+		case f == nil:
+			return fmt.Errorf("%s: unknown flag %q", e.configFile, s.name)
+		case s.name == "config" || s.name == "config-watch-dir":
+			return fmt.Errorf("%s: --%s can't be set in a config file", e.configFile, s.name)
+		case given[s.name]:
+			continue
+		}
+		if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && bf.IsBoolFlag() && s.value == "" {
+			s.value = "true"
+		}
+		if err := fs.Set(s.name, s.value); err != nil {
+			return fmt.Errorf("%s: invalid value %q for flag %s: %w", e.configFile, s.value, s.name, err)
+		}
+	}
+	return nil
+}
+
+// reloadedProxyHandler returns the settings for the HTTPHandler that
+// proxies to the serve source, as configured by the command-line flags in
+// cmdline and the --config file as it is now. Files the settings refer
+// to, such as --upstream-root-ca, are re-read too.
+func (e *serveEnv) reloadedProxyHandler(subcmd string, cmdline []serveFlagSetting) (*ipn.HTTPHandler, error) {
+	re := &serveEnv{
+		lc:          e.lc,
+		testFlagOut: e.testFlagOut,
+		testStdout:  e.testStdout,
+		testStderr:  e.testStderr,
+	}
+	fs := newServeDevCommand(re, subcmd).FlagSet
+	for _, s := range cmdline {
+		if err := fs.Set(s.name, s.value); err != nil {
+			return nil, err
+		}
+	}
+	if err := re.resolveConfigFile(); err != nil {
+		return nil, err
+	}
+	if re.configFile != "" {
+		if err := re.applyServeConfigFile(fs, cmdline); err != nil {
+			return nil, err
+		}
+	}
+	return re.newProxyHandler()
+}
+
+// reloadServe replaces the handler of the foreground serve req with the
+// one returned by e.reloadHandler, after a SIGHUP. The rest of the serve
+// config is left alone, and tailscaled keeps serving the requests in
+// flight with the old handler. If the new handler is invalid or conflicts
+// with the current config, the old one is kept.
+func (e *serveEnv) reloadServe(ctx context.Context, req *ipn.ServeStreamRequest) error {
+	h, err := e.reloadHandler()
+	if err != nil {
+		return err
+	}
+	next := *req
+	next.Handler = h
+	n := handlerChanges(req.Handler, h)
+	if n == 0 {
+		e.logf(serveLogInfo, "Configuration reloaded: 0 changes")
+		return nil
+	}
+	nextSC := next.ServeConfig()
+	if err := ipn.ValidateServeConfig(nextSC); err != nil {
+		return err
+	}
+
+	cur, err := e.lc.GetServeConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("getting current serve config: %w", err)
+	}
+	if !cur.WebHandlerExists(req.HostPort, req.MountPoint) {
+		return errors.New("serve config no longer has this handler")
+	}
+	delete(cur.Web[req.HostPort].Handlers, req.MountPoint)
+	sc, err := cur.Merge(nextSC)
+	if err != nil {
+		return err
+	}
+	e.logServeConfig("reloaded serve config", sc)
+	if err := e.lc.SetServeConfig(ctx, sc); err != nil {
+		return fmt.Errorf("setting serve config: %w", err)
+	}
+	*req = next
+	e.logf(serveLogInfo, "Configuration reloaded: %d changes", n)
+	return nil
+}
+
+// handlerChanges returns the number of settings that differ between a
+// and b.
+func handlerChanges(a, b *ipn.HTTPHandler) int {
+	fields := func(h *ipn.HTTPHandler) map[string]json.RawMessage {
+		var m map[string]json.RawMessage
+		j, _ := json.Marshal(h)
+		json.Unmarshal(j, &m)
+		return m
+	}
+	am, bm := fields(a), fields(b)
+	n := 0
+	for k, v := range am {
+		if !bytes.Equal(v, bm[k]) {
+			n++
+		}
+	}
+	for k := range bm {
+		if _, ok := am[k]; !ok {
+			n++
+		}
+	}
+	return n
+}
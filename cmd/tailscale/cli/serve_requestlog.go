@@ -0,0 +1,318 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/logtail/backoff"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/mak"
+)
+
+// lineWriter is an io.Writer that calls onLine with each
+// newline-terminated line written to it, newline included, holding on to
+// the data after the last newline until the rest of its line arrives. It
+// stops at the first error from onLine, which Write returns. The line
+// passed to onLine is only valid until it returns.
+//
+// It's embedded by the io.Writers of foreground serve's request logs,
+// which are written a log at a time but may get one in pieces.
+type lineWriter struct {
+	onLine func(line []byte) error
+
+	mu      sync.Mutex
+	partial []byte // data written after the last newline
+}
+
+// Write implements io.Writer.
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.partial = append(lw.partial, p...)
+	for {
+		i := bytes.IndexByte(lw.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := lw.partial[:i+1]
+		lw.partial = lw.partial[i+1:]
+		if err := lw.onLine(line); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// slowRequestWarnMin is the number of requests requestLogFilter counts
+// before warning that too many of them are slow.
+const slowRequestWarnMin = 20
+
+// requestLogFilter is an io.Writer that writes each newline-terminated
+// FunnelRequestLog written to it to w, unless it's for a request whose
+// path starts with one of exclude, as set by --access-log-exclude-path.
+// Paths are matched case-insensitively.
+//
+// Of the logs for slow requests, as set by --slow-request-threshold, it
+// only writes a sampled fraction, and it calls warnSlow if more than a
+// tenth of the requests since the last warning were slow.
+//
+// Logs of backend connection events, as set by
+// --backend-connection-events, are written to connLog instead, and those
+// of their changes of state, as set by --debug-connection-states, to
+// stateLog.
+//
+// It calls warnError the first time it sees a log of a failed request
+// with each ErrorClass, as set by --classify-upstream-errors, and passes
+// logs of opening connections for --preheat-connections to preheated
+// instead of writing them.
+type requestLogFilter struct {
+	w        io.Writer
+	connLog  io.Writer // or nil to drop connection events
+	stateLog io.Writer // or nil to drop connection states
+	exclude  []string  // lowercase path prefixes
+
+	slowSampleRate float64               // fraction of slow request logs to write
+	warnSlow       func(slow, total int) // or nil to not warn
+	rand           func() float64        // for sampling; rand.Float64 except in tests
+	slow, total    int                   // requests since the last warning
+
+	warnError    func(class string) // or nil to not warn
+	errorClasses map[string]bool    // ErrorClasses seen
+
+	preheated func(ipn.PreheatLog) // or nil to drop preheat logs
+
+	lineWriter // calls writeLine
+}
+
+func newRequestLogFilter(w io.Writer, exclude []string) *requestLogFilter {
+	f := &requestLogFilter{w: w, slowSampleRate: 1, rand: rand.Float64}
+	f.onLine = f.writeLine
+	for _, p := range exclude {
+		f.exclude = append(f.exclude, strings.ToLower(p))
+	}
+	return f
+}
+
+// writeLine writes line to its dest, if any.
+func (f *requestLogFilter) writeLine(line []byte) error {
+	w := f.dest(line)
+	if w == nil {
+		return nil
+	}
+	_, err := w.Write(line)
+	return err
+}
+
+// dest returns the writer that line should be written to, or nil if it
+// should be dropped, counting the requests and slow requests it logs.
+// Lines that aren't a FunnelRequestLog are always written to f.w.
+func (f *requestLogFilter) dest(line []byte) io.Writer {
+	var log ipn.FunnelRequestLog
+	if json.Unmarshal(line, &log) != nil {
+		return f.w
+	}
+	if c := log.UpstreamConn; c != nil {
+		switch c.Event {
+		case ipn.UpstreamConnOpen, ipn.UpstreamConnClose:
+			return f.connLog
+		}
+		return f.stateLog
+	}
+	if log.Preheat != nil {
+		if f.preheated != nil {
+			f.preheated(*log.Preheat)
+		}
+		return nil
+	}
+	if f.excluded(log.Path) {
+		return nil
+	}
+	switch {
+	case log.ErrorClass != "":
+		if f.warnError != nil && !f.errorClasses[log.ErrorClass] {
+			mak.Set(&f.errorClasses, log.ErrorClass, true)
+			f.warnError(log.ErrorClass)
+		}
+	case log.Slow:
+		f.slow++
+		if f.warnSlow != nil && f.total >= slowRequestWarnMin && f.slow*10 > f.total {
+			f.warnSlow(f.slow, f.total)
+			f.slow, f.total = 0, 0
+		}
+		if f.rand() >= f.slowSampleRate {
+			return nil
+		}
+	case log.WebSocket == nil && log.Trace == nil && log.ResponseBodyBytes == 0:
+		f.total++
+	}
+	return f.w
+}
+
+// upstreamErrorSuggestion returns a suggestion for fixing failed requests
+// to the backend with the given FunnelRequestLog.ErrorClass.
+func upstreamErrorSuggestion(class string) string {
+	switch class {
+	case ipn.UpstreamErrorNotRunning:
+		return "requests are failing because the backend refused the connection (backend not running). Check that it's running and listening on the port being served."
+	case ipn.UpstreamErrorSlow:
+		return "requests are failing because the backend timed out (backend slow). Check whether it's overloaded or stuck, or raise --upstream-timeout-per-read if it's just slow."
+	case ipn.UpstreamErrorNetwork:
+		return "requests are failing because there's no route to the backend (network misconfiguration). Check that its host is up and reachable from this machine."
+	}
+	return fmt.Sprintf("requests to the backend are failing (%s).", class)
+}
+
+// excluded reports whether path is excluded from the request logs.
+func (f *requestLogFilter) excluded(path string) bool {
+	if path == "" {
+		return false
+	}
+	path = strings.ToLower(path)
+	for _, p := range f.exclude {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestLogHookStallWarning is how long a write to the on-request-log
+// command may block before we warn that it isn't reading its input.
+// It's a var for testing.
+var requestLogHookStallWarning = 10 * time.Second
+
+// requestLogHookExitGrace is how long the on-request-log command has to
+// exit once its input is closed before it's killed. It's a var for
+// testing.
+var requestLogHookExitGrace = 5 * time.Second
+
+// requestLogHook is an io.Writer that sends each newline-terminated
+// FunnelRequestLog written to it to the stdin of a long-running command,
+// as set by --on-request-log. The command is restarted with backoff if
+// it exits.
+//
+// Writes never block: if the command falls too far behind, log lines
+// are dropped rather than holding up the request log stream.
+type requestLogHook struct {
+	command string
+	logf    logger.Logf
+	lines   chan []byte
+
+	lineWriter // calls queueLine
+
+	mu      sync.Mutex
+	dropped bool // whether a line has been dropped since the last warning
+}
+
+func newRequestLogHook(command string, logf logger.Logf) *requestLogHook {
+	h := &requestLogHook{
+		command: command,
+		logf:    logf,
+		lines:   make(chan []byte, 1024),
+	}
+	h.onLine = h.queueLine
+	return h
+}
+
+// queueLine queues line to be fed to the command, unless it's too far
+// behind.
+func (h *requestLogHook) queueLine(line []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	select {
+	case h.lines <- bytes.Clone(line):
+	default:
+		if !h.dropped {
+			h.logf("warning: on-request-log command is falling behind; dropping request logs")
+		}
+		h.dropped = true
+	}
+	return nil
+}
+
+// run runs the command until ctx is done, feeding it lines written to h.
+func (h *requestLogHook) run(ctx context.Context) {
+	bo := backoff.NewBackoff("on-request-log", h.logf, 30*time.Second)
+	bo.LogLongerThan = time.Minute // restarts are logged below
+	for ctx.Err() == nil {
+		err := h.runOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			h.logf("on-request-log: %v; restarting", err)
+		}
+		bo.BackOff(ctx, err)
+	}
+}
+
+// runOnce starts the command and feeds it lines until it exits or
+// ctx is done. It only returns nil if ctx is done.
+func (h *requestLogHook) runOnce(ctx context.Context) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("cmd.exe", "/C", h.command)
+	case "plan9":
+		cmd = exec.Command("/bin/rc", "-c", h.command)
+	default:
+		cmd = exec.Command("/bin/sh", "-c", h.command)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Closing stdin lets the command finish up and exit, but
+			// one that ignores its input is killed after a while.
+			stdin.Close()
+			select {
+			case <-exited:
+			case <-time.After(requestLogHookExitGrace):
+				h.logf("on-request-log command didn't exit; killing it")
+				cmd.Process.Kill()
+				<-exited
+			}
+			return nil
+		case err := <-exited:
+			if err == nil {
+				err = errors.New("command exited")
+			}
+			return err
+		case line := <-h.lines:
+			warn := time.AfterFunc(requestLogHookStallWarning, func() {
+				h.logf("warning: on-request-log command is not consuming input")
+			})
+			_, err := stdin.Write(line)
+			warn.Stop()
+			if err != nil {
+				return fmt.Errorf("writing to command: %w", err)
+			}
+			h.mu.Lock()
+			h.dropped = false
+			h.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// serveDrainTimeout is how long a foreground serve stopped by SIGTERM
+// waits for in-flight requests to finish. It's a var for testing.
+var serveDrainTimeout = 30 * time.Second
+
+// serveDrainPollInterval is how often drainServe checks for in-flight
+// requests. It's a var for testing.
+var serveDrainPollInterval = 100 * time.Millisecond
+
+// notifyStop returns a copy of ctx that's canceled on SIGINT (Ctrl-C)
+// or SIGTERM, and a func that reports which of the two was received, or
+// nil if neither was. The returned stop func must be called to release
+// the signal handlers.
+func notifyStop(ctx context.Context) (_ context.Context, received func() os.Signal, stop context.CancelFunc) {
+	intCtx, stopInt := signal.NotifyContext(ctx, os.Interrupt)
+	termCtx, cancelTerm := context.WithCancel(intCtx)
+
+	// SIGTERM gets its own handler, rather than being passed to
+	// NotifyContext with SIGINT, so that we know which one stopped us.
+	var gotTerm atomic.Bool
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-term:
+			gotTerm.Store(true)
+			cancelTerm()
+		case <-termCtx.Done():
+		}
+	}()
+
+	received = func() os.Signal {
+		switch {
+		case gotTerm.Load():
+			return syscall.SIGTERM
+		case intCtx.Err() != nil && ctx.Err() == nil:
+			return os.Interrupt
+		}
+		return nil
+	}
+	stop = func() {
+		signal.Stop(term)
+		cancelTerm()
+		stopInt()
+	}
+	return termCtx, received, stop
+}
+
+// drainServe waits for the requests still being proxied to backend to
+// finish after a foreground serve was stopped by sig. New requests are
+// refused as soon as the serve stream closes, but tailscaled finishes
+// those already in flight, and the backend shouldn't be stopped before
+// they do.
+//
+// After SIGTERM, as sent by service managers, it waits at most
+// serveDrainTimeout. After SIGINT, it waits until the requests finish or
+// a second Ctrl-C.
+func (e *serveEnv) drainServe(ctx context.Context, backend string, sig os.Signal) {
+	force := make(chan os.Signal, 1)
+	signal.Notify(force, os.Interrupt)
+	defer signal.Stop(force)
+
+	var timeout <-chan time.Time
+	if sig == syscall.SIGTERM {
+		e.logf(serveLogInfo, "Received SIGTERM; stopped accepting connections, draining in-flight requests for up to %v.", serveDrainTimeout)
+		t := time.NewTimer(serveDrainTimeout)
+		defer t.Stop()
+		timeout = t.C
+	} else {
+		e.logf(serveLogInfo, "Received interrupt; stopped accepting connections, draining in-flight requests.")
+		e.logf(serveLogInfo, "Press Ctrl-C again to force quit.")
+	}
+
+	tick := time.NewTicker(serveDrainPollInterval)
+	defer tick.Stop()
+	for {
+		n, err := e.lc.ServeRequestsInFlight(ctx, backend)
+		if err != nil {
+			e.logf(serveLogWarn, "can't drain: %v", err)
+			return
+		}
+		if n == 0 {
+			e.logf(serveLogInfo, "Drained; shutting down.")
+			return
+		}
+		select {
+		case <-tick.C:
+		case <-timeout:
+			e.logf(serveLogWarn, "drain timed out after %v with %d requests in flight; shutting down.", serveDrainTimeout, n)
+			return
+		case <-force:
+			e.logf(serveLogWarn, "forced quit with %d requests in flight.", n)
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
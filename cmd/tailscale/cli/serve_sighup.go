@@ -0,0 +1,14 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !js
+
+package cli
+
+import (
+	"os"
+	"syscall"
+)
+
+// sighup is the signal that reloads a foreground serve's config.
+var sighup os.Signal = syscall.SIGHUP
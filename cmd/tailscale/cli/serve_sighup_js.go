@@ -0,0 +1,10 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import "os"
+
+// sighup is nil, as there's no SIGHUP on js to reload a foreground
+// serve's config.
+var sighup os.Signal
@@ -0,0 +1,62 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// tcpServePort is the port that serve and funnel forward raw TCP
+// connections on with --protocol=tcp. It's one of the ports Funnel
+// allows by default.
+const tcpServePort = 10000
+
+// wellKnownTCPServices names the services usually found on a port, for
+// warning before funneling them.
+var wellKnownTCPServices = map[uint16]string{
+	22:    "SSH",
+	23:    "Telnet",
+	1433:  "SQL Server",
+	3306:  "MySQL",
+	3389:  "Remote Desktop",
+	5432:  "PostgreSQL",
+	5900:  "VNC",
+	6379:  "Redis",
+	9200:  "Elasticsearch",
+	11211: "memcached",
+	27017: "MongoDB",
+}
+
+// expandTCPTarget returns the host:port to forward TCP connections to
+// for target, which is a port on localhost or a host:port.
+func expandTCPTarget(target string) (string, error) {
+	if port, err := strconv.ParseUint(target, 10, 16); err == nil {
+		if port == 0 {
+			return "", fmt.Errorf("invalid port %q", target)
+		}
+		return net.JoinHostPort("127.0.0.1", target), nil
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || host == "" || strings.Contains(target, "/") {
+		return "", fmt.Errorf("invalid TCP target %q; must be a port or host:port", target)
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return "", fmt.Errorf("invalid port %q in TCP target %q", port, target)
+	}
+	return target, nil
+}
+
+// warnIfWellKnownTCPService warns that funneling the service at addr,
+// a host:port, is dangerous if it's the usual port of a service like
+// SSH or a database, which is often unprotected or brute-forced.
+func (e *serveEnv) warnIfWellKnownTCPService(addr string) {
+	_, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.ParseUint(port, 10, 16)
+	if name, ok := wellKnownTCPServices[uint16(p)]; ok {
+		e.logf(serveLogWarn, "exposing %s publicly without additional auth is dangerous.", name)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"sigs.k8s.io/yaml"
+	"tailscale.com/ipn"
+)
+
+// serveTemplateVars are the variables available to serve config
+// templates, as in {{.NodeName}}.
+type serveTemplateVars struct {
+	NodeName string // this node's MagicDNS name, without the trailing dot
+	Hostname string // this node's OS hostname
+	Port     uint16 // the port to serve on, from --port
+}
+
+// exampleServeTemplateVars are used to render templates for validation,
+// where no particular node is involved.
+var exampleServeTemplateVars = serveTemplateVars{
+	NodeName: "node.example.ts.net",
+	Hostname: "node",
+	Port:     443,
+}
+
+func newServeTemplateCommands(e *serveEnv, subcmd string) []*ffcli.Command {
+	return []*ffcli.Command{
+		{
+			Name:       "apply",
+			ShortUsage: fmt.Sprintf("%s apply [--port=<port>] <template-file>", subcmd),
+			ShortHelp:  "replace the serve config with one rendered from a template",
+			LongHelp: strings.TrimSpace(`
+The template file is a YAML (or JSON) ServeConfig, as printed by
+"tailscale serve status --json", that may use the following variables:
+
+  {{.NodeName}}  this node's MagicDNS name, e.g. node.example.ts.net
+  {{.Hostname}}  this node's hostname
+  {{.Port}}      the value of --port
+
+Templates use Go's text/template syntax.
+`),
+			Exec: e.runServeApply,
+			FlagSet: e.newFlags("serve-apply", func(fs *flag.FlagSet) {
+				fs.UintVar(&e.templatePort, "port", 443, "value of {{.Port}} in the template")
+			}),
+			UsageFunc: usageFunc,
+		},
+		{
+			Name:       "template",
+			ShortUsage: fmt.Sprintf("%s template validate <template-file>", subcmd),
+			ShortHelp:  "work with serve config templates",
+			Exec:       func(context.Context, []string) error { return flag.ErrHelp },
+			UsageFunc:  usageFunc,
+			Subcommands: []*ffcli.Command{
+				{
+					Name:       "validate",
+					ShortUsage: fmt.Sprintf("%s template validate <template-file>", subcmd),
+					ShortHelp:  "check a serve config template, printing OK or the error",
+					Exec:       e.runServeTemplateValidate,
+					FlagSet:    e.newFlags("serve-template-validate", nil),
+					UsageFunc:  usageFunc,
+				},
+			},
+		},
+	}
+}
+
+// runServeApply is the entry point for "tailscale {serve,funnel} apply".
+func (e *serveEnv) runServeApply(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return flag.ErrHelp
+	}
+	if e.templatePort == 0 || e.templatePort > 65535 {
+		return fmt.Errorf("invalid --port %d", e.templatePort)
+	}
+	src, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	st, err := e.getLocalClientStatusWithoutPeers(ctx)
+	if err != nil {
+		return fmt.Errorf("getting client status: %w", err)
+	}
+	sc, err := renderServeTemplate(args[0], string(src), serveTemplateVars{
+		NodeName: strings.TrimSuffix(st.Self.DNSName, "."),
+		Hostname: st.Self.HostName,
+		Port:     uint16(e.templatePort),
+	})
+	if err != nil {
+		return err
+	}
+	for hp, on := range sc.AllowFunnel {
+		if !on {
+			continue
+		}
+		port, err := hp.Port()
+		if err != nil {
+			return err
+		}
+		if err := ipn.CheckFunnelAccess(port, st.Self.Capabilities); err != nil {
+			return err
+		}
+	}
+	return e.lc.SetServeConfig(ctx, sc)
+}
+
+// runServeTemplateValidate is the entry point for
+// "tailscale {serve,funnel} template validate".
+func (e *serveEnv) runServeTemplateValidate(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return flag.ErrHelp
+	}
+	src, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	if _, err := renderServeTemplate(args[0], string(src), exampleServeTemplateVars); err != nil {
+		return err
+	}
+	fmt.Fprintln(e.stdout(), "OK")
+	return nil
+}
+
+// renderServeTemplate renders the serve config template src, named
+// name, with vars and returns the resulting ServeConfig. It returns an
+// error if the template or its output is invalid.
+func renderServeTemplate(name, src string, vars serveTemplateVars) (*ipn.ServeConfig, error) {
+	tmpl, err := template.New(name).Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, vars); err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(buf.Bytes())) == 0 {
+		return nil, errors.New(name + ": empty serve config")
+	}
+	sc := new(ipn.ServeConfig)
+	if err := yaml.UnmarshalStrict(buf.Bytes(), sc); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if err := ipn.ValidateServeConfig(sc); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return sc, nil
+}
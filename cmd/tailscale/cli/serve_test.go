@@ -6,22 +6,31 @@
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"reflect"
 	"runtime"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"tailscale.com/client/tailscale"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 )
 
@@ -749,185 +758,2364 @@ type step struct {
 	}
 }
 
-func TestVerifyFunnelEnabled(t *testing.T) {
-	lc := &fakeLocalServeClient{}
-	var stdout bytes.Buffer
-	var flagOut bytes.Buffer
-	e := &serveEnv{
-		lc:          lc,
-		testFlagOut: &flagOut,
-		testStdout:  &stdout,
+func TestServeDevCheck(t *testing.T) {
+	existing := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: "http://127.0.0.1:4000", TLSMinVersion: "tls12", UpstreamFlushInterval: 100 * time.Millisecond, PassThroughHeaders: []string{"X-Request-ID"}, ForwardedHeaders: "both"},
+			}},
+		},
+	}
+	tests := []struct {
+		name    string
+		config  *ipn.ServeConfig // current config
+		args    []string
+		wantErr string
+	}{
+		{name: "empty", args: []string{"--check", "3000"}},
+		{name: "same-backend", config: existing, args: []string{"--check", "4000"}},
+		{name: "conflict", config: existing, args: []string{"--check", "3000"}, wantErr: "conflicting handlers for foo.test.ts.net:443/"},
+		{name: "invalid", args: []string{"--check", "--upstream-timeout-per-read=-1s", "3000"}, wantErr: "--upstream-timeout-per-read must not be negative"},
+		{name: "per-byte-timeout", args: []string{"--check", "--upstream-per-byte-timeout=30s", "3000"}},
+		{name: "per-byte-timeout-invalid", args: []string{"--check", "--upstream-per-byte-timeout=-1s", "3000"}, wantErr: "--upstream-per-byte-timeout must not be negative"},
+		{name: "max-response-size", args: []string{"--check", "--upstream-max-response-size=1048576", "3000"}},
+		{name: "max-response-size-negative", args: []string{"--check", "--upstream-max-response-size=-1", "3000"}, wantErr: "--upstream-max-response-size must not be negative"},
+		{name: "disable-content-sniffing", args: []string{"--check", "--disable-content-sniffing", "3000"}},
+		{name: "compression-offload", args: []string{"--check", "--compression-offload", "3000"}},
+		{name: "preheat-connections", args: []string{"--check", "--preheat-connections=4", "--health-check-path=/healthz", "3000"}},
+		{name: "preheat-connections-negative", args: []string{"--check", "--preheat-connections=-1", "3000"}, wantErr: "--preheat-connections must not be negative"},
+		{name: "classify-upstream-errors", args: []string{"--check", "--classify-upstream-errors", "3000"}},
+		{name: "idempotency-cache", args: []string{"--check", "--idempotency-cache-ttl=24h", "3000"}},
+		{name: "idempotency-cache-negative", args: []string{"--check", "--idempotency-cache-ttl=-1s", "3000"}, wantErr: "--idempotency-cache-ttl must not be negative"},
+		{name: "ab-test", args: []string{"--check", "--ab-test-backend-b=3001", "--ab-test-percentage=10", "--ab-test-cookie", "3000"}},
+		{name: "ab-test-url", args: []string{"--check", "--ab-test-backend-b=https://localhost:3001", "3000"}},
+		{name: "ab-test-bad-backend", args: []string{"--check", "--ab-test-backend-b=ftp://localhost:3001", "3000"}, wantErr: "--ab-test-backend-b: must be a URL starting with http://, https://, or https+insecure://"},
+		{name: "ab-test-bad-percentage", args: []string{"--check", "--ab-test-backend-b=3001", "--ab-test-percentage=101", "3000"}, wantErr: "--ab-test-percentage must be between 0 and 100"},
+		{name: "ab-test-cookie-no-backend", args: []string{"--check", "--ab-test-cookie", "3000"}, wantErr: "--ab-test-cookie requires --ab-test-backend-b"},
+		{name: "no-session-headers", args: []string{"--check", "--inject-tailscale-session-header=false", "3000"}},
+		{name: "session-headers-pass-through", args: []string{"--check", "--upstream-keep-request-id=X-Tailscale-Session", "3000"}, wantErr: `foo.test.ts.net:443/: header "X-Tailscale-Session" is set by serve and can't be passed through`},
+		{name: "sanitize-headers", args: []string{"--check", "--upstream-sanitize-headers=false", "--upstream-sanitize-headers-additional=X-Client-Cert,X-Client-DN", "3000"}},
+		{name: "sanitize-headers-pass-through", args: []string{"--check", "--upstream-sanitize-headers-additional=x-request-id", "3000"}, wantErr: `--upstream-sanitize-headers-additional "x-request-id" is passed through by --upstream-keep-request-id`},
+		{name: "sanitize-headers-invalid", args: []string{"--check", "--upstream-sanitize-headers-additional=X Cert", "3000"}, wantErr: `foo.test.ts.net:443/: invalid header name "X Cert"`},
+		{name: "forwarded-header", args: []string{"--check", "--upstream-forwarded-header=rfc7239", "3000"}},
+		{name: "forwarded-header-invalid", args: []string{"--check", "--upstream-forwarded-header=x-forwarded", "3000"}, wantErr: `invalid --upstream-forwarded-header "x-forwarded"; must be rfc7239, xff, both or none`},
+		{name: "circuit-breaker-half-open", args: []string{"--check", "--circuit-breaker=5", "--circuit-breaker-half-open-requests=4", "3000"}},
+		{name: "circuit-breaker-half-open-zero", args: []string{"--check", "--circuit-breaker=5", "--circuit-breaker-half-open-requests=0", "3000"}, wantErr: "--circuit-breaker-half-open-requests must be at least 1"},
+		{name: "max-connections", args: []string{"--check", "--max-connections=100", "--max-queue-wait=1s", "3000"}},
+		{name: "max-connections-negative", args: []string{"--check", "--max-connections=-1", "3000"}, wantErr: "--max-connections must not be negative"},
+		{name: "max-queue-wait-negative", args: []string{"--check", "--max-connections=100", "--max-queue-wait=-1s", "3000"}, wantErr: "--max-queue-wait must not be negative"},
+		{name: "upstream-honor-retry-after", args: []string{"--check", "--upstream-honor-retry-after", "--upstream-max-retry-after=1m", "3000"}},
+		{name: "upstream-max-retry-after-zero", args: []string{"--check", "--upstream-honor-retry-after", "--upstream-max-retry-after=0", "3000"}, wantErr: "--upstream-max-retry-after must be positive"},
+		{name: "trace", args: []string{"--check", "--trace", "--trace-propagate", "3000"}},
+		{name: "log-response-bytes", args: []string{"--check", "--log-response-bytes", "3000"}},
+		{name: "connection-events", args: []string{"--check", "--backend-connection-events", "--connection-log-file=conns.log", "3000"}},
+		{name: "connection-events-no-file", args: []string{"--check", "--backend-connection-events", "3000"}, wantErr: "--backend-connection-events requires --connection-log-file"},
+		{name: "connection-log-file-no-events", args: []string{"--check", "--connection-log-file=conns.log", "3000"}, wantErr: "--connection-log-file requires --backend-connection-events"},
+		{name: "debug-connection-states", args: []string{"--check", "--debug-connection-states", "--debug-log-file=states.log", "3000"}},
+		{name: "debug-connection-states-no-file", args: []string{"--check", "--debug-connection-states", "3000"}, wantErr: "--debug-connection-states requires --debug-log-file"},
+		{name: "log-ship", args: []string{"--check", "--log-ship-url=https://logs.example.com/ingest", "--log-ship-batch-size=10", "3000"}},
+		{name: "log-ship-url", args: []string{"--check", "--log-ship-url=logs.example.com", "3000"}, wantErr: `invalid --log-ship-url "logs.example.com"; must be an http or https URL`},
+		{name: "log-ship-interval", args: []string{"--check", "--log-ship-url=http://127.0.0.1:3100", "--log-ship-interval=0", "3000"}, wantErr: "--log-ship-interval must be positive"},
+		{name: "log-ship-batch-size", args: []string{"--check", "--log-ship-url=http://127.0.0.1:3100", "--log-ship-batch-size=0", "3000"}, wantErr: "--log-ship-batch-size must be positive"},
+		{name: "log-ship-max-buffer", args: []string{"--check", "--log-ship-url=http://127.0.0.1:3100", "--log-ship-max-buffer=10", "3000"}, wantErr: "--log-ship-max-buffer must be at least --log-ship-batch-size"},
+		{name: "funnel-path-serve", args: []string{"--check", "--funnel-path=/api/", "3000"}, wantErr: "--funnel-path is only for tailscale funnel"},
+		{name: "connection-label-serve", args: []string{"--check", "--upstream-connection-label=tenant1", "3000"}, wantErr: "--upstream-connection-label is only for tailscale funnel"},
+		{name: "sign-secret-file-missing", args: []string{"--check", "--upstream-sign-secret-file=/does/not/exist", "3000"}, wantErr: "request signing secret file: stat /does/not/exist: no such file or directory"},
+		{name: "tls-renegotiation", args: []string{"--check", "--upstream-tls-renegotiation=once", "3000"}},
+		{name: "tls-renegotiation-invalid", args: []string{"--check", "--upstream-tls-renegotiation=always", "3000"}, wantErr: `--upstream-tls-renegotiation: invalid TLS renegotiation "always"; must be none, once or freely`},
+		{name: "slow-request", args: []string{"--check", "--slow-request-threshold=2s", "--slow-request-sample-rate=0.1", "3000"}},
+		{name: "slow-request-negative", args: []string{"--check", "--slow-request-threshold=-2s", "3000"}, wantErr: "--slow-request-threshold must not be negative"},
+		{name: "slow-request-sample-rate", args: []string{"--check", "--slow-request-sample-rate=1.5", "3000"}, wantErr: "--slow-request-sample-rate must be between 0 and 1"},
+		{name: "upstream-request-id-propagate", args: []string{"--check", "--upstream-request-id-propagate", "3000"}},
+		{name: "override-cache-control", args: []string{"--check", "--override-cache-control=public, max-age=60", "--strip-pragma", "--i-know-what-im-doing", "3000"}},
+		{name: "override-cache-control-unconfirmed", args: []string{"--check", "--override-cache-control=public, max-age=60", "3000"}, wantErr: "--override-cache-control and --strip-pragma can make caches keep responses meant for one client or not to be kept at all; add --i-know-what-im-doing to use them"},
+		{name: "strip-pragma-unconfirmed", args: []string{"--check", "--strip-pragma", "3000"}, wantErr: "--override-cache-control and --strip-pragma can make caches keep responses meant for one client or not to be kept at all; add --i-know-what-im-doing to use them"},
+		{name: "override-cache-control-invalid", args: []string{"--check", "--override-cache-control=max-age=60\nPragma: no-cache", "--i-know-what-im-doing", "3000"}, wantErr: `invalid --override-cache-control "max-age=60\nPragma: no-cache"`},
+		{name: "keep-request-id-default", config: existing, args: []string{"--check", "--upstream-keep-request-id=x-request-id", "4000"}},
+		{name: "keep-request-id-conflict", config: existing, args: []string{"--check", "--upstream-keep-request-id=X-Trace-ID", "4000"}, wantErr: "conflicting handlers for foo.test.ts.net:443/"},
+		{name: "keep-request-id-invalid", args: []string{"--check", "--upstream-keep-request-id=Tailscale-User-Login", "3000"}, wantErr: `foo.test.ts.net:443/: header "Tailscale-User-Login" is set by serve and can't be passed through`},
+		{name: "tls-fingerprint", args: []string{"--check", "--backend-tls-fingerprint=" + strings.Repeat("AB:", 31) + "AB", "https://localhost:3000"}},
+		{name: "tls-fingerprint-invalid", args: []string{"--check", "--backend-tls-fingerprint=abcd", "https://localhost:3000"}, wantErr: `invalid --backend-tls-fingerprint "abcd"; must be the SHA-256 hash of a certificate in hex`},
+		{name: "keepalive-probe", args: []string{"--check", "--backend-keepalive-probe", "3000"}},
+		{name: "tcp-nodelay", args: []string{"--check", "--upstream-tcp-nodelay", "3000"}},
+		{name: "disable-keepalive-for", args: []string{"--check", "--upstream-disable-keepalive-for=http://127.0.0.1:9000", "--upstream-disable-keepalive-for=https://php.", "3000"}},
+		{name: "disable-keepalive-for-invalid", args: []string{"--check", "--upstream-disable-keepalive-for=127.0.0.1:9000", "3000"}, wantErr: `error parsing commandline arguments: invalid value "127.0.0.1:9000" for flag -upstream-disable-keepalive-for: URL prefix "127.0.0.1:9000" must start with http:// or https://`},
+		{name: "access-log-exclude", args: []string{"--check", "--access-log-exclude-path=/health", "--access-log-exclude-path=/ping", "3000"}},
+		{name: "access-log-exclude-invalid", args: []string{"--check", "--access-log-exclude-path=health", "3000"}, wantErr: `error parsing commandline arguments: invalid value "health" for flag -access-log-exclude-path: path "health" must start with /`},
+		{name: "reset", config: existing, args: []string{"reset", "--check"}, wantErr: "error parsing commandline arguments: flag provided but not defined: -check"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lc := &fakeLocalServeClient{config: tt.config.Clone()}
+			var stdout, flagOut bytes.Buffer
+			e := &serveEnv{
+				lc:          lc,
+				testFlagOut: &flagOut,
+				testStdout:  &stdout,
+			}
+			cmd := newServeDevCommand(e, "serve")
+			err := cmd.ParseAndRun(context.Background(), tt.args)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v; want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if got := stdout.String(); got != "OK\n" {
+				t.Errorf("got output %q; want OK", got)
+			}
+			if lc.setCount != 0 {
+				t.Errorf("--check changed the serve config %d times", lc.setCount)
+			}
+		})
 	}
+}
 
+func TestFunnelDevTCP(t *testing.T) {
+	st := &ipnstate.Status{
+		BackendState: ipn.Running.String(),
+		Self: &ipnstate.PeerStatus{
+			DNSName:      "foo.test.ts.net",
+			Capabilities: []string{tailcfg.CapabilityHTTPS, tailcfg.NodeAttrFunnel, tailcfg.CapabilityFunnelPorts + "?ports=443,10000"},
+		},
+	}
 	tests := []struct {
-		name string
-		// queryFeatureResponse is the mock response desired from the
-		// call made to lc.QueryFeature by verifyFunnelEnabled.
-		queryFeatureResponse mockQueryFeatureResponse
-		caps                 []string // optionally set at fakeStatus.Capabilities
-		wantErr              string
-		wantPanic            string
+		name     string
+		ports    string // allowed Funnel ports, if not 443,10000
+		args     []string
+		wantErr  string
+		wantWarn string // in stderr
+	}{
+		{name: "local-port", args: []string{"--protocol=tcp", "--local-port=5432"}, wantWarn: "Warning: exposing PostgreSQL publicly without additional auth is dangerous.\n"},
+		{name: "target-port", args: []string{"--protocol=tcp", "22"}, wantWarn: "Warning: exposing SSH publicly without additional auth is dangerous.\n"},
+		{name: "target-host-port", args: []string{"--protocol=tcp", "localhost:7000"}},
+		{name: "port-not-allowed", ports: "443", args: []string{"--protocol=tcp", "--local-port=7000"}, wantErr: "port 10000 is not allowed for funnel; allowed ports are: 443; try --port 443"},
+		{name: "local-port-and-target", args: []string{"--protocol=tcp", "--local-port=5432", "5432"}, wantErr: "--local-port can't be used with a <target>"},
+		{name: "local-port-http", args: []string{"--local-port=5432"}, wantErr: "--local-port requires --protocol=tcp"},
+		{name: "url-target", args: []string{"--protocol=tcp", "http://localhost:7000"}, wantErr: `invalid TCP target "http://localhost:7000"; must be a port or host:port`},
+		{name: "bad-protocol", args: []string{"--protocol=udp", "7000"}, wantErr: `invalid --protocol "udp"; must be http or tcp`},
+		{name: "wait-for-upstream", args: []string{"--protocol=tcp", "--wait-for-upstream=5s", "7000"}, wantErr: "--wait-for-upstream requires --protocol=http"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := st
+			if tt.ports != "" {
+				st = &ipnstate.Status{
+					BackendState: st.BackendState,
+					Self: &ipnstate.PeerStatus{
+						DNSName:      st.Self.DNSName,
+						Capabilities: []string{tailcfg.CapabilityHTTPS, tailcfg.NodeAttrFunnel, tailcfg.CapabilityFunnelPorts + "?ports=" + tt.ports},
+					},
+				}
+			}
+			lc := &fakeLocalServeClient{config: new(ipn.ServeConfig), status: st}
+			var stdout, stderr, flagOut bytes.Buffer
+			e := &serveEnv{
+				lc:          lc,
+				testFlagOut: &flagOut,
+				testStdout:  &stdout,
+				testStderr:  &stderr,
+			}
+			cmd := newServeDevCommand(e, "funnel")
+			args := append([]string{"--check", "--skip-listen-check"}, tt.args...)
+			err := cmd.ParseAndRun(context.Background(), args)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v; want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := stdout.String(); got != "OK\n" {
+				t.Errorf("got output %q; want OK", got)
+			}
+			if got := stderr.String(); got != tt.wantWarn {
+				t.Errorf("got stderr %q; want %q", got, tt.wantWarn)
+			}
+		})
+	}
+}
+
+func TestFunnelDevPorts(t *testing.T) {
+	const (
+		https  = tailcfg.CapabilityHTTPS
+		funnel = tailcfg.NodeAttrFunnel
+		ports  = tailcfg.CapabilityFunnelPorts + "?ports="
+	)
+	tests := []struct {
+		name    string
+		caps    []string
+		args    []string
+		verify  bool // run without --check, so verifyFunnelEnabled is used
+		wantErr string
 	}{
+		{name: "443", caps: []string{https, funnel, ports + "443"}, args: []string{"3000"}},
+		{name: "8443", caps: []string{https, funnel, ports + "8443"}, args: []string{"--port=8443", "3000"}},
+		{name: "range", caps: []string{https, funnel, ports + "8000-9000"}, args: []string{"--port=8443", "3000"}},
+		{name: "tcp-443", caps: []string{https, funnel, ports + "443"}, args: []string{"--protocol=tcp", "--port=443", "7000"}},
 		{
-			name:                 "enabled",
-			queryFeatureResponse: mockQueryFeatureResponse{resp: &tailcfg.QueryFeatureResponse{Complete: true}, err: nil},
-			wantErr:              "", // no error, success
+			name:    "suggest-8443",
+			caps:    []string{https, funnel, ports + "8443"},
+			args:    []string{"3000"},
+			wantErr: "port 443 is not allowed for funnel; allowed ports are: 8443; try --port 8443",
 		},
 		{
-			name:                 "fallback-to-non-interactive-flow",
-			queryFeatureResponse: mockQueryFeatureResponse{resp: nil, err: errors.New("not-allowed")},
-			wantErr:              "Funnel not available; HTTPS must be enabled. See https://tailscale.com/s/https.",
+			name:    "suggest-8443-verify",
+			caps:    []string{https, funnel, ports + "8443"},
+			args:    []string{"3000"},
+			verify:  true,
+			wantErr: "port 443 is not allowed for funnel; allowed ports are: 8443; try --port 8443",
 		},
 		{
-			name:                 "fallback-flow-missing-acl-rule",
-			queryFeatureResponse: mockQueryFeatureResponse{resp: nil, err: errors.New("not-allowed")},
-			caps:                 []string{tailcfg.CapabilityHTTPS},
-			wantErr:              `Funnel not available; "funnel" node attribute not set. See https://tailscale.com/s/no-funnel.`,
+			name:    "suggest-443",
+			caps:    []string{https, funnel, ports + "443,10000"},
+			args:    []string{"--port=8443", "3000"},
+			verify:  true,
+			wantErr: "port 8443 is not allowed for funnel; allowed ports are: 443,10000; try --port 443",
 		},
 		{
-			name:                 "fallback-flow-enabled",
-			queryFeatureResponse: mockQueryFeatureResponse{resp: nil, err: errors.New("not-allowed")},
-			caps:                 []string{tailcfg.CapabilityHTTPS, tailcfg.NodeAttrFunnel},
-			wantErr:              "", // no error, success
+			name:    "no-funnel-port-allowed",
+			caps:    []string{https, funnel, ports + "22"},
+			args:    []string{"3000"},
+			verify:  true,
+			wantErr: "port 443 is not allowed for funnel; allowed ports are: 22",
 		},
 		{
-			name: "not-allowed-to-enable",
-			queryFeatureResponse: mockQueryFeatureResponse{resp: &tailcfg.QueryFeatureResponse{
-				Complete:   false,
-				Text:       "You don't have permission to enable this feature.",
-				ShouldWait: false,
-			}, err: nil},
-			wantErr:   "",
-			wantPanic: "unexpected call to os.Exit(0) during test", // os.Exit(0) should be called to end process
+			name:    "no-ports-attr",
+			caps:    []string{https, funnel},
+			args:    []string{"3000"},
+			verify:  true,
+			wantErr: "port 443 is not allowed for funnel",
+		},
+		{
+			name:    "no-https",
+			caps:    []string{funnel, ports + "443,8443"},
+			args:    []string{"3000"},
+			wantErr: "Funnel not available; HTTPS must be enabled. See https://tailscale.com/s/https.",
+		},
+		{
+			name:    "no-funnel-attr",
+			caps:    []string{https, ports + "443,8443"},
+			args:    []string{"--port=8443", "3000"},
+			wantErr: `Funnel not available; "funnel" node attribute not set. See https://tailscale.com/s/no-funnel.`,
+		},
+		{
+			name:    "invalid-port",
+			caps:    []string{https, funnel, ports + "443"},
+			args:    []string{"--port=70000", "3000"},
+			wantErr: "invalid --port 70000",
 		},
 	}
-
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			ctx := context.Background()
-			lc.setQueryFeatureResponse(tt.queryFeatureResponse)
-
-			if tt.caps != nil {
-				oldCaps := fakeStatus.Self.Capabilities
-				defer func() { fakeStatus.Self.Capabilities = oldCaps }() // reset after test
-				fakeStatus.Self.Capabilities = tt.caps
+			st := &ipnstate.Status{
+				BackendState: ipn.Running.String(),
+				Self: &ipnstate.PeerStatus{
+					DNSName:      "foo.test.ts.net",
+					Capabilities: tt.caps,
+				},
+			}
+			lc := &fakeLocalServeClient{config: new(ipn.ServeConfig), status: st}
+			var stdout, stderr, flagOut bytes.Buffer
+			e := &serveEnv{
+				lc:          lc,
+				testFlagOut: &flagOut,
+				testStdout:  &stdout,
+				testStderr:  &stderr,
+			}
+			cmd := newServeDevCommand(e, "funnel")
+			args := []string{"--skip-listen-check"}
+			if !tt.verify {
+				args = append(args, "--check")
+			}
+			err := cmd.ParseAndRun(context.Background(), append(args, tt.args...))
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v; want %q", err, tt.wantErr)
+				}
+				return
 			}
-			st, err := e.getLocalClientStatusWithoutPeers(ctx)
 			if err != nil {
 				t.Fatal(err)
 			}
+			if got := stdout.String(); got != "OK\n" {
+				t.Errorf("got output %q; want OK", got)
+			}
+		})
+	}
+}
 
-			defer func() {
-				r := recover()
-				var gotPanic string
-				if r != nil {
-					gotPanic = fmt.Sprint(r)
+func TestServeManage(t *testing.T) {
+	existing := func() *ipn.ServeConfig {
+		return &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{
+				443:  {HTTPS: true},
+				8443: {HTTPS: true},
+				5432: {TCPForward: "127.0.0.1:5432"},
+			},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/":    {Proxy: "http://127.0.0.1:3000"},
+					"/api": {Proxy: "http://127.0.0.1:4000"},
+				}},
+				"foo.test.ts.net:8443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Text: "hello"},
+				}},
+			},
+			AllowFunnel: map[ipn.HostPort]bool{
+				"foo.test.ts.net:443":  true,
+				"foo.test.ts.net:8443": true,
+			},
+			FunnelPaths: map[ipn.HostPort][]string{
+				"foo.test.ts.net:8443": {"/pub/"},
+			},
+		}
+	}
+	tests := []struct {
+		name       string
+		args       []string
+		want       *ipn.ServeConfig // config after, if changed
+		wantOut    string
+		wantErr    string
+		emptyStart bool // start with no serve config
+	}{
+		{
+			name: "list",
+			args: []string{"list"},
+			wantOut: "" +
+				"HOSTPORT              MOUNT  FUNNEL      TARGET\n" +
+				"foo.test.ts.net:443   /      on          proxy http://127.0.0.1:3000\n" +
+				"foo.test.ts.net:443   /api   on          proxy http://127.0.0.1:4000\n" +
+				"foo.test.ts.net:8443  /      on (/pub/)  text \"hello\"\n" +
+				"foo.test.ts.net:5432  -      off         tcp 127.0.0.1:5432\n",
+		},
+		{
+			name:       "list-empty",
+			args:       []string{"list"},
+			emptyStart: true,
+			wantOut:    "No serve config\n",
+		},
+		{
+			name: "delete",
+			args: []string{"delete", "foo.test.ts.net:443", "/api"},
+			want: func() *ipn.ServeConfig {
+				sc := existing()
+				delete(sc.Web["foo.test.ts.net:443"].Handlers, "/api")
+				return sc
+			}(),
+		},
+		{
+			name: "delete-last",
+			args: []string{"delete", "foo.test.ts.net:8443", "/"},
+			want: func() *ipn.ServeConfig {
+				sc := existing()
+				delete(sc.TCP, 8443)
+				delete(sc.Web, "foo.test.ts.net:8443")
+				delete(sc.AllowFunnel, "foo.test.ts.net:8443")
+				sc.FunnelPaths = nil
+				return sc
+			}(),
+		},
+		{
+			name:    "delete-missing",
+			args:    []string{"delete", "foo.test.ts.net:443", "/nope"},
+			wantErr: "no handler for foo.test.ts.net:443/nope",
+		},
+		{
+			name:    "delete-bad-hostport",
+			args:    []string{"delete", "foo.test.ts.net", "/"},
+			wantErr: `invalid <hostport> "foo.test.ts.net": address foo.test.ts.net: missing port in address`,
+		},
+		{
+			name:    "delete-usage",
+			args:    []string{"delete", "foo.test.ts.net:443"},
+			wantErr: flag.ErrHelp.Error(),
+		},
+		{
+			name: "disable",
+			args: []string{"disable", "foo.test.ts.net:8443"},
+			want: func() *ipn.ServeConfig {
+				sc := existing()
+				delete(sc.AllowFunnel, "foo.test.ts.net:8443")
+				sc.FunnelPaths = nil
+				return sc
+			}(),
+		},
+		{
+			name:    "disable-not-on",
+			args:    []string{"disable", "foo.test.ts.net:5432"},
+			wantErr: "Funnel is not on for foo.test.ts.net:5432",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lc := &fakeLocalServeClient{config: existing()}
+			if tt.emptyStart {
+				lc.config = nil
+			}
+			var stdout, flagOut bytes.Buffer
+			e := &serveEnv{
+				lc:          lc,
+				testFlagOut: &flagOut,
+				testStdout:  &stdout,
+			}
+			cmd := newServeDevCommand(e, "serve")
+			err := cmd.ParseAndRun(context.Background(), tt.args)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v; want %q", err, tt.wantErr)
 				}
-				if gotPanic != tt.wantPanic {
-					t.Errorf("wrong panic; got=%s, want=%s", gotPanic, tt.wantPanic)
+				if lc.setCount != 0 {
+					t.Errorf("serve config changed %d times after error", lc.setCount)
 				}
-			}()
-			gotErr := e.verifyFunnelEnabled(ctx, st, 443)
-			var got string
-			if gotErr != nil {
-				got = gotErr.Error()
+				return
 			}
-			if got != tt.wantErr {
-				t.Errorf("wrong error; got=%s, want=%s", gotErr, tt.wantErr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := stdout.String(); got != tt.wantOut {
+				t.Errorf("got output:\n%s\nwant:\n%s", got, tt.wantOut)
+			}
+			if tt.want == nil {
+				if lc.setCount != 0 {
+					t.Errorf("serve config changed %d times; want unchanged", lc.setCount)
+				}
+				return
+			}
+			if !reflect.DeepEqual(lc.config, tt.want) {
+				gotj, _ := json.Marshal(lc.config)
+				wantj, _ := json.Marshal(tt.want)
+				t.Errorf("got config %s; want %s", gotj, wantj)
 			}
 		})
 	}
 }
 
-// fakeLocalServeClient is a fake tailscale.LocalClient for tests.
-// It's not a full implementation, just enough to test the serve command.
-//
-// The fake client is stateful, and is used to test manipulating
-// ServeConfig state. This implementation cannot be used concurrently.
-type fakeLocalServeClient struct {
-	config               *ipn.ServeConfig
-	setCount             int                       // counts calls to SetServeConfig
-	queryFeatureResponse *mockQueryFeatureResponse // mock response to QueryFeature calls
-}
-
-// fakeStatus is a fake ipnstate.Status value for tests.
-// It's not a full implementation, just enough to test the serve command.
-//
-// It returns a state that's running, with a fake DNSName and the Funnel
-// node attribute capability.
-var fakeStatus = &ipnstate.Status{
-	BackendState: ipn.Running.String(),
-	Self: &ipnstate.PeerStatus{
-		DNSName:      "foo.test.ts.net",
-		Capabilities: []string{tailcfg.NodeAttrFunnel, tailcfg.CapabilityFunnelPorts + "?ports=443,8443"},
-	},
-}
+func TestServeAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	lc := &fakeLocalServeClient{config: &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":    {Proxy: "http://127.0.0.1:3000"},
+				"/api": {Proxy: "http://127.0.0.1:4000"},
+			}},
+		},
+		AllowFunnel: map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+	}}
+	run := func(args ...string) string {
+		t.Helper()
+		var stdout, flagOut bytes.Buffer
+		e := &serveEnv{lc: lc, testFlagOut: &flagOut, testStdout: &stdout}
+		if err := newServeDevCommand(e, "funnel").ParseAndRun(context.Background(), args); err != nil {
+			t.Fatal(err)
+		}
+		return stdout.String()
+	}
+	readRecords := func(path string) []serveAuditRecord {
+		t.Helper()
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var recs []serveAuditRecord
+		for _, line := range strings.SplitAfter(string(b), "\n") {
+			if line == "" {
+				continue
+			}
+			var rec serveAuditRecord
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				t.Fatalf("%s: %v", path, err)
+			}
+			recs = append(recs, rec)
+		}
+		return recs
+	}
 
-func (lc *fakeLocalServeClient) StatusWithoutPeers(ctx context.Context) (*ipnstate.Status, error) {
-	return fakeStatus, nil
-}
+	run("--audit-log="+path, "delete", "foo.test.ts.net:443", "/api")
+	// With the second record, the log would be larger than this, so
+	// it's rotated first.
+	run("--audit-log="+path, "--audit-log-rotate-size=100", "disable", "foo.test.ts.net:443")
+	if lc.setCount != 2 {
+		t.Fatalf("serve config changed %d times; want 2", lc.setCount)
+	}
+	old, cur := readRecords(path+".1"), readRecords(path)
+	if len(old) != 1 || len(cur) != 1 {
+		t.Fatalf("got %d rotated and %d current records; want 1 and 1", len(old), len(cur))
+	}
+	for _, rec := range []serveAuditRecord{old[0], cur[0]} {
+		if rec.Time.IsZero() || rec.User == "" || rec.SessionID != "" {
+			t.Errorf("got record %+v; want a time and user, but no session", rec)
+		}
+	}
+	// changed returns the lines of diff that are removed or added,
+	// without the unchanged ones around them.
+	changed := func(diff string) string {
+		var lines []string
+		for _, l := range strings.Split(diff, "\n") {
+			if strings.HasPrefix(l, "-") || strings.HasPrefix(l, "+") {
+				lines = append(lines, strings.Join(strings.Fields(l), " "))
+			}
+		}
+		return strings.Join(lines, "\n")
+	}
+	if got, want := changed(old[0].Diff), `- },
+- "/api": {
+- "Proxy": "http://127.0.0.1:4000"`; got != want {
+		t.Errorf("diff of deleting /api changed %q; want %q", got, want)
+	}
+	if got, want := changed(cur[0].Diff), `- },
+- "AllowFunnel": {
+- "foo.test.ts.net:443": true`; got != want {
+		t.Errorf("diff of disabling Funnel changed %q; want %q", got, want)
+	}
+	for _, rec := range []serveAuditRecord{old[0], cur[0]} {
+		if rec.Event != serveAuditSet {
+			t.Errorf("got event %q; want %q", rec.Event, serveAuditSet)
+		}
+	}
 
-func (lc *fakeLocalServeClient) GetServeConfig(ctx context.Context) (*ipn.ServeConfig, error) {
-	return lc.config.Clone(), nil
-}
+	out := run("audit", "--audit-log="+path)
+	want := cur[0].Time.Format(time.RFC3339) + " set by " + cur[0].User + "\n" + strings.TrimRight(cur[0].Diff, "\n") + "\n"
+	if out != want {
+		t.Errorf("got audit output:\n%s\nwant:\n%s", out, want)
+	}
 
-func (lc *fakeLocalServeClient) SetServeConfig(ctx context.Context, config *ipn.ServeConfig) error {
-	lc.setCount += 1
-	lc.config = config.Clone()
-	return nil
-}
+	// A change made against a config that has since changed fails,
+	// and isn't logged.
+	stale, err := lc.GetServeConfig(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc.config.TCP[8443] = &ipn.TCPPortHandler{HTTPS: true}
+	e := &serveEnv{auditLog: path}
+	c := &auditServeClient{localServeClient: lc, e: e}
+	if err := c.SetServeConfig(context.Background(), stale); err == nil {
+		t.Error("SetServeConfig with a stale ETag succeeded")
+	}
+	if recs := readRecords(path); len(recs) != 1 {
+		t.Errorf("got %d records after a failed change; want 1", len(recs))
+	}
 
-type mockQueryFeatureResponse struct {
-	resp *tailcfg.QueryFeatureResponse
-	err  error
+	// A foreground stream logs the config it adds when it starts, and
+	// removes when it ends.
+	streamPath := filepath.Join(t.TempDir(), "stream.log")
+	var stdout, flagOut bytes.Buffer
+	e = &serveEnv{lc: &fakeLocalServeClient{}, testFlagOut: &flagOut, testStdout: &stdout, testStderr: io.Discard}
+	if err := newServeDevCommand(e, "serve").ParseAndRun(context.Background(), []string{"--audit-log=" + streamPath, "--timeout=50ms", "--skip-listen-check", "3000"}); err != nil {
+		t.Fatal(err)
+	}
+	recs := readRecords(streamPath)
+	if len(recs) != 2 || recs[0].Event != serveAuditStreamStart || recs[1].Event != serveAuditStreamEnd {
+		t.Fatalf("got stream records %+v; want a start and an end", recs)
+	}
+	for i, op := range []string{"+", "-"} {
+		for _, l := range strings.Split(strings.TrimSuffix(recs[i].Diff, "\n"), "\n") {
+			if !strings.HasPrefix(l, op) {
+				t.Errorf("%s diff line %q doesn't start with %q", recs[i].Event, l, op)
+			}
+		}
+		if !strings.Contains(recs[i].Diff, `"Proxy": "http://127.0.0.1:3000"`) {
+			t.Errorf("%s diff doesn't have the stream's handler:\n%s", recs[i].Event, recs[i].Diff)
+		}
+	}
 }
 
-func (lc *fakeLocalServeClient) setQueryFeatureResponse(resp mockQueryFeatureResponse) {
-	lc.queryFeatureResponse = &resp
+func TestExpandTCPTarget(t *testing.T) {
+	tests := []struct {
+		target  string
+		want    string
+		wantErr bool
+	}{
+		{target: "5432", want: "127.0.0.1:5432"},
+		{target: "db.internal:5432", want: "db.internal:5432"},
+		{target: "[::1]:22", want: "[::1]:22"},
+		{target: "0", wantErr: true},
+		{target: "localhost", wantErr: true},
+		{target: ":5432", wantErr: true},
+		{target: "localhost:0", wantErr: true},
+		{target: "tcp://localhost:5432", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := expandTCPTarget(tt.target)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("expandTCPTarget(%q) = %q, %v; want %q, error %v", tt.target, got, err, tt.want, tt.wantErr)
+		}
+	}
 }
 
-func (lc *fakeLocalServeClient) QueryFeature(ctx context.Context, feature string) (*tailcfg.QueryFeatureResponse, error) {
-	if resp := lc.queryFeatureResponse; resp != nil {
-		// If we're testing QueryFeature, use the response value set for the test.
-		return resp.resp, resp.err
+func TestFunnelDevEnvTarget(t *testing.T) {
+	existing := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: "http://127.0.0.1:4000", TLSMinVersion: "tls12", UpstreamFlushInterval: 100 * time.Millisecond, PassThroughHeaders: []string{"X-Request-ID"}, ForwardedHeaders: "both"},
+			}},
+		},
+	}
+	st := &ipnstate.Status{
+		BackendState: ipn.Running.String(),
+		Self: &ipnstate.PeerStatus{
+			DNSName:      "foo.test.ts.net",
+			Capabilities: []string{tailcfg.CapabilityHTTPS, tailcfg.NodeAttrFunnel, tailcfg.CapabilityFunnelPorts + "?ports=443"},
+		},
+	}
+	tests := []struct {
+		name    string
+		source  string // TAILSCALE_FUNNEL_SOURCE
+		port    string // TAILSCALE_FUNNEL_PORT
+		args    []string
+		wantErr string // or "help" for flag.ErrHelp
+	}{
+		{name: "port", port: "4000"},
+		{name: "port-conflict", port: "3000", wantErr: "conflicting handlers for foo.test.ts.net:443/"},
+		{name: "source", source: "http://127.0.0.1:4000"},
+		{name: "source-host-port", source: "localhost:4000"},
+		{name: "arg-overrides-env", port: "3000", args: []string{"4000"}},
+		{name: "both", source: "http://127.0.0.1:4000", port: "4000", wantErr: "only one of TAILSCALE_FUNNEL_SOURCE and TAILSCALE_FUNNEL_PORT may be set"},
+		{name: "both-with-arg", source: "http://127.0.0.1:3000", port: "3000", args: []string{"4000"}},
+		{name: "bad-port", port: "http", wantErr: `invalid TAILSCALE_FUNNEL_PORT "http"; must be a port number`},
+		{name: "bad-port-with-arg", port: "http", args: []string{"4000"}},
+		{name: "none", wantErr: "help"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TAILSCALE_FUNNEL_SOURCE", tt.source)
+			t.Setenv("TAILSCALE_FUNNEL_PORT", tt.port)
+			var stdout, flagOut bytes.Buffer
+			e := &serveEnv{
+				lc:          &fakeLocalServeClient{config: existing.Clone(), status: st},
+				testFlagOut: &flagOut,
+				testStdout:  &stdout,
+			}
+			cmd := newServeDevCommand(e, "funnel")
+			args := append([]string{"--check", "--skip-listen-check"}, tt.args...)
+			err := cmd.ParseAndRun(context.Background(), args)
+			switch {
+			case tt.wantErr == "help":
+				if !errors.Is(err, flag.ErrHelp) {
+					t.Fatalf("got error %v; want flag.ErrHelp", err)
+				}
+			case tt.wantErr != "":
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v; want %q", err, tt.wantErr)
+				}
+			case err != nil:
+				t.Fatal(err)
+			}
+		})
 	}
-	return &tailcfg.QueryFeatureResponse{Complete: true}, nil // fallback to already enabled
 }
 
-func (lc *fakeLocalServeClient) WatchIPNBus(ctx context.Context, mask ipn.NotifyWatchOpt) (*tailscale.IPNBusWatcher, error) {
-	return nil, nil // unused in tests
-}
+func TestServeDevListenCheck(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := fmt.Sprint(ln.Addr().(*net.TCPAddr).Port)
+	wantWarning := "Warning: nothing appears to be listening on :" + port + ". Serve will return 502 until a service starts.\n"
 
-func (lc *fakeLocalServeClient) IncrementCounter(ctx context.Context, name string, delta int) error {
+	run := func(args ...string) string {
+		var stdout, stderr, flagOut bytes.Buffer
+		e := &serveEnv{
+			lc:          &fakeLocalServeClient{},
+			testFlagOut: &flagOut,
+			testStdout:  &stdout,
+			testStderr:  &stderr,
+		}
+		// Use --check so that the command returns rather than
+		// streaming.
+		cmd := newServeDevCommand(e, "serve")
+		if err := cmd.ParseAndRun(context.Background(), append([]string{"--check"}, args...)); err != nil {
+			t.Fatal(err)
+		}
+		return stderr.String()
+	}
+
+	if got := run(port); got != "" {
+		t.Errorf("listening: got warning %q; want none", got)
+	}
+	ln.Close()
+	if got := run(port); got != wantWarning {
+		t.Errorf("not listening: got warning %q; want %q", got, wantWarning)
+	}
+	if got := run("--skip-listen-check", port); got != "" {
+		t.Errorf("--skip-listen-check: got warning %q; want none", got)
+	}
+}
+
+func TestServeTemplate(t *testing.T) {
+	const tmpl = `
+TCP:
+  "{{.Port}}":
+    HTTPS: true
+Web:
+  "{{.NodeName}}:{{.Port}}":
+    Handlers:
+      /:
+        Proxy: http://127.0.0.1:3000
+      /host:
+        Text: "served by {{.Hostname}}"
+`
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		f := filepath.Join(dir, name)
+		if err := os.WriteFile(f, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	good := write("good.yaml", tmpl)
+
+	lc := &fakeLocalServeClient{}
+	var stdout, flagOut bytes.Buffer
+	e := &serveEnv{
+		lc:          lc,
+		testFlagOut: &flagOut,
+		testStdout:  &stdout,
+	}
+	cmd := newServeDevCommand(e, "funnel")
+	if err := cmd.ParseAndRun(context.Background(), []string{"apply", "--port=8443", good}); err != nil {
+		t.Fatal(err)
+	}
+	want := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{8443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"foo.test.ts.net:8443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":     {Proxy: "http://127.0.0.1:3000"},
+				"/host": {Text: "served by "}, // fakeStatus has no HostName
+			}},
+		},
+	}
+	if !reflect.DeepEqual(lc.config, want) {
+		t.Errorf("apply: got config %v; want %v", logger.AsJSON(lc.config), logger.AsJSON(want))
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr string // substring
+	}{
+		{"good", tmpl, ""},
+		{"bad-syntax", "Web: {{.NodeName", "unclosed action"},
+		{"unknown-var", "Web: {{.Tailnet}}", "can't evaluate field Tailnet"},
+		{"unknown-field", "Webb: {}", `unknown field "Webb"`},
+		{"invalid-config", "Web:\n  \"{{.NodeName}}:{{.Port}}\": {}", "port 443 is not served as HTTP or HTTPS"},
+		{"empty", "\n", "empty serve config"},
+	}
+	for _, tt := range tests {
+		stdout.Reset()
+		f := write(tt.name+".yaml", tt.content)
+		cmd := newServeDevCommand(e, "funnel")
+		err := cmd.ParseAndRun(context.Background(), []string{"template", "validate", f})
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			} else if stdout.String() != "OK\n" {
+				t.Errorf("%s: got output %q; want OK", tt.name, stdout.String())
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got error %v; want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestServeDevTimeout(t *testing.T) {
+	const (
+		banner  = "Serve started on \"https://foo.test.ts.net\".\nPress Ctrl-C to stop.\n\n"
+		warning = "Warning: stopping in 100ms (--timeout=100ms).\n"
+		stopped = "Stopped after --timeout=100ms.\n"
+	)
+	tests := []struct {
+		logLevel string
+		want     string // stderr
+	}{
+		{"info", banner + warning + stopped},
+		{"warn", warning},
+		{"error", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.logLevel, func(t *testing.T) {
+			var stdout, stderr, flagOut bytes.Buffer
+			e := &serveEnv{
+				lc:          &fakeLocalServeClient{},
+				testFlagOut: &flagOut,
+				testStdout:  &stdout,
+				testStderr:  &stderr,
+			}
+			cmd := newServeDevCommand(e, "serve")
+			start := time.Now()
+			if err := cmd.ParseAndRun(context.Background(), []string{"--timeout=100ms", "--skip-listen-check", "--log-level=" + tt.logLevel, "3000"}); err != nil {
+				t.Fatal(err)
+			}
+			if d := time.Since(start); d > 10*time.Second {
+				t.Errorf("took %v to stop; want about 100ms", d)
+			}
+			if got := stderr.String(); got != tt.want {
+				t.Errorf("got stderr %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// lockedBuffer is a bytes.Buffer that's safe for concurrent writes.
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestServeDevPoolStats(t *testing.T) {
+	var stdout, flagOut bytes.Buffer
+	var stderr lockedBuffer // written by both the pool stats and --timeout goroutines
+	e := &serveEnv{
+		lc:          &fakeLocalServeClient{},
+		testFlagOut: &flagOut,
+		testStdout:  &stdout,
+		testStderr:  &stderr,
+	}
+	cmd := newServeDevCommand(e, "serve")
+	if err := cmd.ParseAndRun(context.Background(), []string{"--timeout=200ms", "--skip-listen-check", "--upstream-pool-stats", "--pool-stats-interval=10ms", "3000"}); err != nil {
+		t.Fatal(err)
+	}
+	want := "pool stats for http://127.0.0.1:3000: active=1 idle=2 waits=3 wait-time=40ms\n"
+	if got := stderr.String(); !strings.Contains(got, want) {
+		t.Errorf("got stderr %q; want it to contain %q", got, want)
+	}
+
+	e = &serveEnv{lc: &fakeLocalServeClient{}, testFlagOut: &flagOut, testStdout: &stdout}
+	cmd = newServeDevCommand(e, "serve")
+	err := cmd.ParseAndRun(context.Background(), []string{"--pool-stats-interval=10ms", "3000"})
+	if want := "--pool-stats-interval requires --upstream-pool-stats"; err == nil || err.Error() != want {
+		t.Errorf("got error %v; want %q", err, want)
+	}
+}
+
+func TestServeDevReconnect(t *testing.T) {
+	const (
+		banner    = "Serve started on \"https://foo.test.ts.net\".\nPress Ctrl-C to stop.\n\n"
+		lost      = "Warning: lost connection to the Tailscale daemon\n"
+		reconnect = "Reconnecting to Tailscale daemon... (attempt %d)\n"
+	)
+	var stdout, flagOut bytes.Buffer
+	var stderr lockedBuffer // written by both the reconnect and --timeout goroutines
+	lc := &fakeLocalServeClient{restarting: true}
+	e := &serveEnv{
+		lc:          lc,
+		testFlagOut: &flagOut,
+		testStdout:  &stdout,
+		testStderr:  &stderr,
+	}
+	cmd := newServeDevCommand(e, "serve")
+	if err := cmd.ParseAndRun(context.Background(), []string{"--timeout=500ms", "--skip-listen-check", "3000"}); err != nil {
+		t.Fatal(err)
+	}
+	// The first stream ends, the second fails to start while
+	// tailscaled is down, and the third serves until the timeout.
+	if lc.streamCount != 3 {
+		t.Errorf("got %d calls to StreamServe; want 3", lc.streamCount)
+	}
+	got := stderr.String()
+	for _, want := range []string{lost, fmt.Sprintf(reconnect, 1), fmt.Sprintf(reconnect, 2) + banner} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got stderr %q; want it to contain %q", got, want)
+		}
+	}
+
+	lc = &fakeLocalServeClient{restarting: true}
+	e = &serveEnv{lc: lc, testFlagOut: &flagOut, testStdout: &stdout, testStderr: &stderr}
+	cmd = newServeDevCommand(e, "serve")
+	err := cmd.ParseAndRun(context.Background(), []string{"--reconnect=false", "--skip-listen-check", "3000"})
+	if !errors.Is(err, errServeStreamLost) {
+		t.Errorf("with --reconnect=false, got error %v; want %v", err, errServeStreamLost)
+	}
+	if lc.streamCount != 1 {
+		t.Errorf("with --reconnect=false, got %d calls to StreamServe; want 1", lc.streamCount)
+	}
+}
+
+func TestServeCircuitStatus(t *testing.T) {
+	lastFailure := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+	lc := &fakeLocalServeClient{
+		circuitStatus: &ipn.CircuitStatus{
+			Backend:     "http://127.0.0.1:3000",
+			State:       ipn.CircuitHalfOpen,
+			Failures:    5,
+			LastFailure: lastFailure,
+		},
+	}
+	run := func(args ...string) string {
+		t.Helper()
+		var stdout, flagOut bytes.Buffer
+		e := &serveEnv{lc: lc, testFlagOut: &flagOut, testStdout: &stdout}
+		cmd := newServeDevCommand(e, "serve")
+		if err := cmd.ParseAndRun(context.Background(), append([]string{"circuit-status"}, args...)); err != nil {
+			t.Fatal(err)
+		}
+		return stdout.String()
+	}
+
+	want := `Backend:       http://127.0.0.1:3000
+State:         half-open
+Failures:      5
+Last failure:  2023-09-01T12:00:00Z
+`
+	if got := run("3000"); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	var st ipn.CircuitStatus
+	if err := json.Unmarshal([]byte(run("--json", "3000")), &st); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&st, lc.circuitStatus) {
+		t.Errorf("got JSON status %+v; want %+v", st, lc.circuitStatus)
+	}
+}
+
+func TestVerifyFunnelEnabled(t *testing.T) {
+	lc := &fakeLocalServeClient{}
+	var stdout bytes.Buffer
+	var flagOut bytes.Buffer
+	e := &serveEnv{
+		lc:          lc,
+		testFlagOut: &flagOut,
+		testStdout:  &stdout,
+	}
+
+	tests := []struct {
+		name string
+		// queryFeatureResponse is the mock response desired from the
+		// call made to lc.QueryFeature by verifyFunnelEnabled.
+		queryFeatureResponse mockQueryFeatureResponse
+		caps                 []string // optionally set at fakeStatus.Capabilities
+		wantErr              string
+		wantPanic            string
+	}{
+		{
+			name:                 "enabled",
+			queryFeatureResponse: mockQueryFeatureResponse{resp: &tailcfg.QueryFeatureResponse{Complete: true}, err: nil},
+			wantErr:              "", // no error, success
+		},
+		{
+			name:                 "fallback-to-non-interactive-flow",
+			queryFeatureResponse: mockQueryFeatureResponse{resp: nil, err: errors.New("not-allowed")},
+			wantErr:              "Funnel not available; HTTPS must be enabled. See https://tailscale.com/s/https.",
+		},
+		{
+			name:                 "fallback-flow-missing-acl-rule",
+			queryFeatureResponse: mockQueryFeatureResponse{resp: nil, err: errors.New("not-allowed")},
+			caps:                 []string{tailcfg.CapabilityHTTPS},
+			wantErr:              `Funnel not available; "funnel" node attribute not set. See https://tailscale.com/s/no-funnel.`,
+		},
+		{
+			name:                 "fallback-flow-enabled",
+			queryFeatureResponse: mockQueryFeatureResponse{resp: nil, err: errors.New("not-allowed")},
+			caps:                 []string{tailcfg.CapabilityHTTPS, tailcfg.NodeAttrFunnel, tailcfg.CapabilityFunnelPorts + "?ports=443"},
+			wantErr:              "", // no error, success
+		},
+		{
+			name:                 "enabled-port-not-allowed",
+			queryFeatureResponse: mockQueryFeatureResponse{resp: nil, err: errors.New("not-allowed")},
+			caps:                 []string{tailcfg.CapabilityHTTPS, tailcfg.NodeAttrFunnel, tailcfg.CapabilityFunnelPorts + "?ports=8443"},
+			wantErr:              "port 443 is not allowed for funnel; allowed ports are: 8443",
+		},
+		{
+			name: "not-allowed-to-enable",
+			queryFeatureResponse: mockQueryFeatureResponse{resp: &tailcfg.QueryFeatureResponse{
+				Complete:   false,
+				Text:       "You don't have permission to enable this feature.",
+				ShouldWait: false,
+			}, err: nil},
+			wantErr:   "",
+			wantPanic: "unexpected call to os.Exit(0) during test", // os.Exit(0) should be called to end process
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			lc.setQueryFeatureResponse(tt.queryFeatureResponse)
+
+			if tt.caps != nil {
+				oldCaps := fakeStatus.Self.Capabilities
+				defer func() { fakeStatus.Self.Capabilities = oldCaps }() // reset after test
+				fakeStatus.Self.Capabilities = tt.caps
+			}
+			st, err := e.getLocalClientStatusWithoutPeers(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer func() {
+				r := recover()
+				var gotPanic string
+				if r != nil {
+					gotPanic = fmt.Sprint(r)
+				}
+				if gotPanic != tt.wantPanic {
+					t.Errorf("wrong panic; got=%s, want=%s", gotPanic, tt.wantPanic)
+				}
+			}()
+			gotErr := e.verifyFunnelEnabled(ctx, st, 443)
+			var got string
+			if gotErr != nil {
+				got = gotErr.Error()
+			}
+			if got != tt.wantErr {
+				t.Errorf("wrong error; got=%s, want=%s", gotErr, tt.wantErr)
+			}
+		})
+	}
+}
+
+// fakeLocalServeClient is a fake tailscale.LocalClient for tests.
+// It's not a full implementation, just enough to test the serve command.
+//
+// The fake client is stateful, and is used to test manipulating
+// ServeConfig state. This implementation cannot be used concurrently.
+type fakeLocalServeClient struct {
+	config               *ipn.ServeConfig
+	setCount             int                       // counts calls to SetServeConfig
+	queryFeatureResponse *mockQueryFeatureResponse // mock response to QueryFeature calls
+	circuitStatus        *ipn.CircuitStatus        // returned by GetCircuitBreakerStatus
+	inFlight             []int64                   // returned in turn by ServeRequestsInFlight; the last repeats
+	status               *ipnstate.Status          // returned by Status and StatusWithoutPeers, or fakeStatus if nil
+	restarting           bool                      // end the first stream at once and fail the next StreamServe, like a tailscaled restart
+	streamCount          int                       // counts calls to StreamServe
+}
+
+// fakeStatus is a fake ipnstate.Status value for tests.
+// It's not a full implementation, just enough to test the serve command.
+//
+// It returns a state that's running, with a fake DNSName and the Funnel
+// node attribute capability.
+var fakeStatus = &ipnstate.Status{
+	BackendState: ipn.Running.String(),
+	Self: &ipnstate.PeerStatus{
+		DNSName:      "foo.test.ts.net",
+		Capabilities: []string{tailcfg.NodeAttrFunnel, tailcfg.CapabilityFunnelPorts + "?ports=443,8443"},
+	},
+}
+
+func (lc *fakeLocalServeClient) Status(ctx context.Context) (*ipnstate.Status, error) {
+	return lc.StatusWithoutPeers(ctx)
+}
+
+func (lc *fakeLocalServeClient) StatusWithoutPeers(ctx context.Context) (*ipnstate.Status, error) {
+	if lc.status != nil {
+		return lc.status, nil
+	}
+	return fakeStatus, nil
+}
+
+func (lc *fakeLocalServeClient) GetServeConfig(ctx context.Context) (*ipn.ServeConfig, error) {
+	sc := lc.config.Clone()
+	if sc != nil {
+		sc.ETag = ipn.ServeConfigETag(lc.config.View())
+	}
+	return sc, nil
+}
+
+func (lc *fakeLocalServeClient) SetServeConfig(ctx context.Context, config *ipn.ServeConfig) error {
+	if config != nil && config.ETag != "" && config.ETag != ipn.ServeConfigETag(lc.config.View()) {
+		return errors.New("412 Precondition Failed: etag mismatch")
+	}
+	lc.setCount += 1
+	lc.config = config.Clone()
+	if lc.config != nil {
+		lc.config.ETag = "" // as tailscaled doesn't store it
+	}
+	return nil
+}
+
+type mockQueryFeatureResponse struct {
+	resp *tailcfg.QueryFeatureResponse
+	err  error
+}
+
+func (lc *fakeLocalServeClient) setQueryFeatureResponse(resp mockQueryFeatureResponse) {
+	lc.queryFeatureResponse = &resp
+}
+
+func (lc *fakeLocalServeClient) QueryFeature(ctx context.Context, feature string) (*tailcfg.QueryFeatureResponse, error) {
+	if resp := lc.queryFeatureResponse; resp != nil {
+		// If we're testing QueryFeature, use the response value set for the test.
+		return resp.resp, resp.err
+	}
+	return &tailcfg.QueryFeatureResponse{Complete: true}, nil // fallback to already enabled
+}
+
+func (lc *fakeLocalServeClient) WatchIPNBus(ctx context.Context, mask ipn.NotifyWatchOpt) (*tailscale.IPNBusWatcher, error) {
+	return nil, nil // unused in tests
+}
+
+func (lc *fakeLocalServeClient) IncrementCounter(ctx context.Context, name string, delta int) error {
 	return nil // unused in tests
 }
 
-func (lc *fakeLocalServeClient) StreamServe(ctx context.Context, req ipn.ServeStreamRequest) (io.ReadCloser, error) {
-	// TODO: testing :)
-	return nil, nil
+func (lc *fakeLocalServeClient) StreamServe(ctx context.Context, req ipn.ServeStreamRequest) (io.ReadCloser, error) {
+	lc.streamCount++
+	if lc.restarting {
+		switch lc.streamCount {
+		case 1:
+			return io.NopCloser(strings.NewReader("")), nil
+		case 2:
+			return nil, errors.New("connection refused")
+		}
+	}
+	// Stream nothing until ctx is done, like a backend that's
+	// getting no traffic.
+	pr, pw := io.Pipe()
+	go func() {
+		<-ctx.Done()
+		pw.CloseWithError(ctx.Err())
+	}()
+	return pr, nil
+}
+
+func (lc *fakeLocalServeClient) GetCircuitBreakerStatus(ctx context.Context, hostPort string) (*ipn.CircuitStatus, error) {
+	if lc.circuitStatus == nil {
+		return nil, errors.New("404 Not Found: no circuit breaker configured")
+	}
+	return lc.circuitStatus, nil
+}
+
+func (lc *fakeLocalServeClient) GetUpstreamPoolStats(ctx context.Context, hostPort string) (*ipn.UpstreamPoolStats, error) {
+	return &ipn.UpstreamPoolStats{
+		Backend:      hostPort,
+		Active:       1,
+		Idle:         2,
+		WaitCount:    3,
+		WaitDuration: 40 * time.Millisecond,
+	}, nil
+}
+
+func (lc *fakeLocalServeClient) ServeRequestsInFlight(ctx context.Context, hostPort string) (int64, error) {
+	if len(lc.inFlight) == 0 {
+		return 0, nil
+	}
+	n := lc.inFlight[0]
+	if len(lc.inFlight) > 1 {
+		lc.inFlight = lc.inFlight[1:]
+	}
+	return n, nil
+}
+
+// exactError returns an error checker that wants exactly the provided want error.
+// If optName is non-empty, it's used in the error message.
+func exactErr(want error, optName ...string) func(error) string {
+	return func(got error) string {
+		if got == want {
+			return ""
+		}
+		if len(optName) > 0 {
+			return fmt.Sprintf("got error %v, want %v", got, optName[0])
+		}
+		return fmt.Sprintf("got error %v, want %v", got, want)
+	}
+}
+
+// anyErr returns an error checker that wants any error.
+func anyErr() func(error) string {
+	return func(got error) string {
+		return ""
+	}
+}
+
+func cmd(s string) []string {
+	return strings.Fields(s)
+}
+
+func TestRequestLogHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test uses a POSIX shell command")
+	}
+	out := filepath.Join(t.TempDir(), "log")
+	h := newRequestLogHook("cat >> "+out, t.Logf)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.run(ctx)
+	}()
+
+	// Lines may be split across writes; only complete lines are sent.
+	for _, s := range []string{`{"a":1}`, "\n{\"b\"", ":2}\n", `{"c":3}`} {
+		if _, err := h.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := "{\"a\":1}\n{\"b\":2}\n"
+	var got []byte
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		got, _ = os.ReadFile(out)
+		if string(got) == want {
+			break
+		}
+	}
+	cancel()
+	<-done
+	if string(got) != want {
+		t.Errorf("command got %q; want %q", got, want)
+	}
+}
+
+func TestRequestLogShipper(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		posts   int
+		batches [][]json.RawMessage
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q; want application/json", ct)
+		}
+		posts++
+		if posts == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		var batch []json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Errorf("decoding batch: %v", err)
+		}
+		batches = append(batches, batch)
+	}))
+	defer srv.Close()
+
+	s := newRequestLogShipper(srv.URL, time.Hour, 2, 10, t.Logf)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.run(ctx)
+	}()
+
+	// Lines may be split across writes; only complete JSON lines are
+	// shipped. A full batch ships, retried after the first POST fails,
+	// and the rest ships when the shipper stops.
+	for _, w := range []string{`{"a":1}`, "\nnot json\n{\"b\"", ":2}\n{\"c\":3}\n"} {
+		if _, err := s.Write([]byte(w)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		n := len(batches)
+		mu.Unlock()
+		if n == 1 {
+			break
+		}
+	}
+	cancel()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	var got []string
+	for _, b := range batches {
+		var lines []string
+		for _, l := range b {
+			lines = append(lines, string(l))
+		}
+		got = append(got, strings.Join(lines, ","))
+	}
+	want := []string{`{"a":1},{"b":2}`, `{"c":3}`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("batches = %q; want %q", got, want)
+	}
+	if posts != 3 {
+		t.Errorf("got %d POSTs; want 3", posts)
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	var lines []string
+	errStop := errors.New("stop")
+	lw := &lineWriter{onLine: func(line []byte) error {
+		lines = append(lines, string(line))
+		if string(line) == "estop\n" {
+			return errStop
+		}
+		return nil
+	}}
+	for _, p := range []string{"a", "b\nc\n", "", "d", "\n", "e"} {
+		if n, err := lw.Write([]byte(p)); n != len(p) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", p, n, err)
+		}
+	}
+	if want := []string{"ab\n", "c\n", "d\n"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("got lines %q; want %q", lines, want)
+	}
+	lines = nil
+	if _, err := lw.Write([]byte("stop\nf\n")); err != errStop {
+		t.Errorf("got error %v; want %v", err, errStop)
+	}
+	if want := []string{"estop\n"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("got lines %q; want %q", lines, want)
+	}
+}
+
+func TestRequestLogFilter(t *testing.T) {
+	var out bytes.Buffer
+	f := newRequestLogFilter(&out, []string{"/health", "/.well-known/"})
+
+	// Lines may be split across writes.
+	for _, s := range []string{
+		`{"Path":"/health"}` + "\n",
+		`{"Path":"/api/users"}` + "\n" + `{"Path":"/HEAL`,
+		`TH/ready"}` + "\n",
+		`{"Path":"/.well-known/acme-challenge/x"}` + "\n",
+		`{"Path":"/healthy"}` + "\n",        // prefixes match within a path segment
+		`{"SrcAddr":"1.2.3.4:5678"}` + "\n", // TCP connections have no path
+		"not json\n",
+	} {
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := `{"Path":"/api/users"}` + "\n" + `{"SrcAddr":"1.2.3.4:5678"}` + "\n" + "not json\n"
+	if out.String() != want {
+		t.Errorf("got %q; want %q", out.String(), want)
+	}
+
+	// Connection events go to their own log, or nowhere.
+	conn := `{"UpstreamConn":{"Event":"CONNECTION_OPEN"}}` + "\n"
+	out.Reset()
+	f.Write([]byte(conn))
+	var connLog bytes.Buffer
+	f.connLog = &connLog
+	f.Write([]byte(conn))
+	if out.Len() != 0 || connLog.String() != conn {
+		t.Errorf("got request log %q and connection log %q; want only the connection log %q", out.String(), connLog.String(), conn)
+	}
+
+	// As do changes of state, to theirs.
+	state := `{"UpstreamConn":{"Event":"IDLE","ConnID":1}}` + "\n"
+	connLog.Reset()
+	f.Write([]byte(state))
+	var stateLog bytes.Buffer
+	f.stateLog = &stateLog
+	f.Write([]byte(state))
+	if out.Len() != 0 || connLog.Len() != 0 || stateLog.String() != state {
+		t.Errorf("got request log %q, connection log %q and state log %q; want only the state log %q", out.String(), connLog.String(), stateLog.String(), state)
+	}
+}
+
+func TestRequestLogFilterSlow(t *testing.T) {
+	var out bytes.Buffer
+	f := newRequestLogFilter(&out, []string{"/health"})
+	f.slowSampleRate = 0.5
+	samples := []float64{0.7, 0.2, 0.9} // only the second is sampled
+	f.rand = func() float64 {
+		r := samples[0]
+		samples = samples[1:]
+		return r
+	}
+	var warnings []string
+	f.warnSlow = func(slow, total int) {
+		warnings = append(warnings, fmt.Sprintf("%d/%d", slow, total))
+	}
+
+	write := func(s string) {
+		t.Helper()
+		if _, err := f.Write([]byte(s + "\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < slowRequestWarnMin; i++ {
+		write(`{"Path":"/api"}`)
+		write(`{"Path":"/api","Trace":{"Done":1000}}`) // the same request, so not counted
+		write(`{"Path":"/health"}`)                    // excluded, so not counted
+	}
+	write(`{"Path":"/api","Slow":true,"UpstreamLatency":2000000000}`)
+	if len(warnings) != 0 {
+		t.Fatalf("warned after 1 of %d requests were slow: %q", slowRequestWarnMin, warnings)
+	}
+	write(`{"Path":"/api","Slow":true,"UpstreamLatency":3000000000}`)
+	write(`{"Path":"/health","Slow":true}`) // excluded, so not counted
+	write(`{"Path":"/api","Slow":true}`)    // counts as slow, warns
+	if want := []string{"3/20"}; !reflect.DeepEqual(warnings, want) {
+		t.Errorf("got warnings %q; want %q", warnings, want)
+	}
+	if got := strings.Count(out.String(), `"Slow":true`); got != 1 || !strings.Contains(out.String(), "3000000000") {
+		t.Errorf("got slow logs:\n%s\nwant only the sampled one", out.String())
+	}
+}
+
+func TestRequestLogFilterErrorClass(t *testing.T) {
+	var out bytes.Buffer
+	f := newRequestLogFilter(&out, []string{"/health"})
+	var warnings []string
+	f.warnError = func(class string) {
+		warnings = append(warnings, class)
+	}
+	for _, s := range []string{
+		`{"Path":"/api"}`,
+		`{"Path":"/api","ErrorClass":"backend not running"}`,
+		`{"Path":"/api","ErrorClass":"backend not running"}`, // already warned
+		`{"Path":"/health","ErrorClass":"backend slow"}`,     // excluded
+		`{"Path":"/api","ErrorClass":"backend slow"}`,
+		`{"Path":"/api","ResponseBodyBytes":1234}`,
+	} {
+		if _, err := f.Write([]byte(s + "\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{ipn.UpstreamErrorNotRunning, ipn.UpstreamErrorSlow}; !reflect.DeepEqual(warnings, want) {
+		t.Errorf("got warnings %q; want %q", warnings, want)
+	}
+	if got := strings.Count(out.String(), `"ErrorClass"`); got != 3 {
+		t.Errorf("got %d error logs:\n%s\nwant 3", got, out.String())
+	}
+	if f.total != 1 {
+		t.Errorf("counted %d requests; want 1, as error and size logs are for requests already counted", f.total)
+	}
+	if got := upstreamErrorSuggestion(ipn.UpstreamErrorNotRunning); !strings.Contains(got, "Check that it's running") {
+		t.Errorf("got suggestion %q for %q", got, ipn.UpstreamErrorNotRunning)
+	}
+}
+
+func TestGeoIPEnricher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "geoip.csv")
+	var out bytes.Buffer
+	var warnings []string
+	e := newGeoIPEnricher(&out, path, func(format string, args ...any) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	})
+	now := time.Unix(1700000000, 0)
+	e.now = func() time.Time { return now }
+
+	const log = `{"SrcAddr":"1.2.3.4:5678","Path":"/"}` + "\n"
+	check := func(in, want string) {
+		t.Helper()
+		out.Reset()
+		if _, err := e.Write([]byte(in)); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != want {
+			t.Errorf("got %q; want %q", out.String(), want)
+		}
+	}
+	writeTable := func(table string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(table), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, now, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without the table, logs are written as they are.
+	check(log, log)
+
+	writeTable(`network,country_code,city,asn_org
+# The most specific network wins.
+1.0.0.0/8,US,,Other Networks
+1.2.3.0/24,NL,Amsterdam,"Example Networks, B.V."
+2001:db8::/32,DE
+`)
+	check(log, log) // not checked for again yet
+	now = now.Add(geoIPCheckInterval)
+	check(log, `{"SrcAddr":"1.2.3.4:5678","Path":"/","CountryCode":"NL","CityName":"Amsterdam","ASNOrg":"Example Networks, B.V."}`+"\n")
+	check(`{"SrcAddr":"1.9.9.9:5678","Path":"/"}`+"\n", `{"SrcAddr":"1.9.9.9:5678","Path":"/","CountryCode":"US","ASNOrg":"Other Networks"}`+"\n")
+	check(`{"SrcAddr":"[2001:db8::1]:5678","Path":"/"}`+"\n", `{"SrcAddr":"[2001:db8::1]:5678","Path":"/","CountryCode":"DE"}`+"\n")
+	check(`{"SrcAddr":"9.9.9.9:5678","Path":"/"}`+"\n", `{"SrcAddr":"9.9.9.9:5678","Path":"/"}`+"\n")
+	check(`{"Path":"/"}`+"\n", `{"Path":"/"}`+"\n")
+	check("not json\n", "not json\n")
+
+	// Logs written in pieces are enriched once they're whole.
+	check(log[:10], "")
+	check(log[10:], `{"SrcAddr":"1.2.3.4:5678","Path":"/","CountryCode":"NL","CityName":"Amsterdam","ASNOrg":"Example Networks, B.V."}`+"\n")
+
+	// A replaced table is reloaded, rather than serving cached lookups
+	// from the old one.
+	now = now.Add(time.Minute)
+	writeTable("1.2.3.4/32,DE\n")
+	now = now.Add(geoIPCheckInterval)
+	check(log, `{"SrcAddr":"1.2.3.4:5678","Path":"/","CountryCode":"DE"}`+"\n")
+
+	// And a removed one is no longer used.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(geoIPCheckInterval)
+	check(log, log)
+	if len(warnings) > 0 {
+		t.Errorf("got warnings %q", warnings)
+	}
+
+	// A table that can't be parsed is reported, and not used.
+	now = now.Add(time.Minute)
+	writeTable("1.2.3.0/24,NL\nnot-a-network,DE\n")
+	now = now.Add(geoIPCheckInterval)
+	check(log, log)
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "line 2") {
+		t.Errorf("got warnings %q; want one for line 2", warnings)
+	}
+}
+
+func TestRequestLogFilterPreheat(t *testing.T) {
+	var out bytes.Buffer
+	f := newRequestLogFilter(&out, nil)
+	var got []ipn.PreheatLog
+	f.preheated = func(log ipn.PreheatLog) {
+		got = append(got, log)
+	}
+	for _, s := range []string{
+		`{"Path":"/api"}`,
+		`{"Preheat":{"Backend":"http://127.0.0.1:3000","Conns":4}}`,
+	} {
+		if _, err := f.Write([]byte(s + "\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []ipn.PreheatLog{{Backend: "http://127.0.0.1:3000", Conns: 4}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got preheat logs %+v; want %+v", got, want)
+	}
+	if strings.Contains(out.String(), "Preheat") {
+		t.Errorf("preheat log written to request log:\n%s", out.String())
+	}
+	if f.total != 1 {
+		t.Errorf("counted %d requests; want 1", f.total)
+	}
+}
+
+func TestServeOIDCUpstreamAuth(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("s3cret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		discovery string
+		clientID  string
+		bearer    string
+		wantURL   string
+		wantErr   string
+	}{
+		{name: "issuer", discovery: "https://id.example.com/realms/x/", clientID: "serve", wantURL: "https://id.example.com/realms/x/.well-known/openid-configuration"},
+		{name: "discovery-doc", discovery: "https://id.example.com/.well-known/openid-configuration", clientID: "serve", wantURL: "https://id.example.com/.well-known/openid-configuration"},
+		{name: "no-client-id", discovery: "https://id.example.com", wantErr: "--upstream-auth-oidc-discovery, --upstream-auth-oidc-client-id and --upstream-auth-oidc-client-secret-file must be given together"},
+		{name: "bad-url", discovery: "id.example.com", clientID: "serve", wantErr: `invalid --upstream-auth-oidc-discovery "id.example.com"; must be an http or https URL`},
+		{name: "bearer", discovery: "https://id.example.com", clientID: "serve", bearer: secret, wantErr: "--bearer-token-file can't be used with --upstream-auth-oidc-discovery"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &serveEnv{
+				oidcDiscovery:        tt.discovery,
+				oidcClientID:         tt.clientID,
+				oidcClientSecretFile: secret,
+				bearerTokenFile:      tt.bearer,
+			}
+			a, err := e.oidcUpstreamAuth()
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v; want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := &ipn.OIDCUpstreamAuth{DiscoveryURL: tt.wantURL, ClientID: tt.clientID, ClientSecretFile: secret}
+			if *a != *want {
+				t.Errorf("got %+v; want %+v", a, want)
+			}
+		})
+	}
+}
+
+func TestServeOIDCAccessControl(t *testing.T) {
+	tests := []struct {
+		name      string
+		discovery string
+		audience  string
+		wantURL   string
+		wantErr   string
+	}{
+		{name: "issuer", discovery: "https://id.example.com", audience: "app", wantURL: "https://id.example.com/.well-known/openid-configuration"},
+		{name: "discovery-doc", discovery: "https://id.example.com/.well-known/openid-configuration", audience: "app", wantURL: "https://id.example.com/.well-known/openid-configuration"},
+		{name: "no-audience", discovery: "https://id.example.com", wantErr: "--access-control-oidc-discovery and --access-control-oidc-audience must be given together"},
+		{name: "no-discovery", audience: "app", wantErr: "--access-control-oidc-discovery and --access-control-oidc-audience must be given together"},
+		{name: "bad-url", discovery: "id.example.com", audience: "app", wantErr: `invalid --access-control-oidc-discovery "id.example.com"; must be an http or https URL`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &serveEnv{
+				accessOIDCDiscovery: tt.discovery,
+				accessOIDCAudience:  tt.audience,
+			}
+			a, err := e.oidcAccessControl()
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v; want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := &ipn.OIDCAccessControl{DiscoveryURL: tt.wantURL, Audience: tt.audience}
+			if *a != *want {
+				t.Errorf("got %+v; want %+v", a, want)
+			}
+		})
+	}
+}
+
+func TestServeOAuth2ClientConfig(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("s3cret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		authType string
+		tokenURL string
+		clientID string
+		scopes   string
+		bearer   string
+		want     *ipn.OAuth2ClientConfig
+		wantErr  string
+	}{
+		{
+			name:     "scopes",
+			authType: "oauth2",
+			tokenURL: "https://auth.example.com/oauth/token",
+			clientID: "serve",
+			scopes:   "read, write",
+			want:     &ipn.OAuth2ClientConfig{TokenURL: "https://auth.example.com/oauth/token", ClientID: "serve", ClientSecretFile: secret, Scopes: []string{"read", "write"}},
+		},
+		{
+			name:     "no-scopes",
+			authType: "oauth2",
+			tokenURL: "https://auth.example.com/oauth/token",
+			clientID: "serve",
+			want:     &ipn.OAuth2ClientConfig{TokenURL: "https://auth.example.com/oauth/token", ClientID: "serve", ClientSecretFile: secret},
+		},
+		{name: "no-type", tokenURL: "https://auth.example.com/oauth/token", clientID: "serve", wantErr: `invalid --backend-auth-type ""; must be oauth2`},
+		{name: "bad-type", authType: "basic", wantErr: `invalid --backend-auth-type "basic"; must be oauth2`},
+		{name: "no-client-id", authType: "oauth2", tokenURL: "https://auth.example.com/oauth/token", wantErr: "--backend-auth-type=oauth2 requires --backend-oauth2-token-url, --backend-oauth2-client-id and --backend-oauth2-client-secret-file"},
+		{name: "bad-url", authType: "oauth2", tokenURL: "auth.example.com", clientID: "serve", wantErr: `invalid --backend-oauth2-token-url "auth.example.com"; must be an http or https URL`},
+		{name: "bearer", authType: "oauth2", tokenURL: "https://auth.example.com/oauth/token", clientID: "serve", bearer: secret, wantErr: "--backend-auth-type=oauth2 can't be used with --bearer-token-file or --upstream-auth-oidc-discovery"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &serveEnv{
+				backendAuthType:    tt.authType,
+				oauth2TokenURL:     tt.tokenURL,
+				oauth2ClientID:     tt.clientID,
+				oauth2ClientSecret: secret,
+				oauth2Scopes:       tt.scopes,
+				bearerTokenFile:    tt.bearer,
+			}
+			c, err := e.oauth2ClientConfig()
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v; want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(c, tt.want) {
+				t.Errorf("got %+v; want %+v", c, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeDrain(t *testing.T) {
+	oldTimeout, oldPoll := serveDrainTimeout, serveDrainPollInterval
+	serveDrainTimeout, serveDrainPollInterval = 50*time.Millisecond, time.Millisecond
+	t.Cleanup(func() { serveDrainTimeout, serveDrainPollInterval = oldTimeout, oldPoll })
+
+	tests := []struct {
+		name     string
+		sig      os.Signal
+		inFlight []int64
+		want     []string // substrings of stderr
+	}{
+		{
+			name:     "sigterm-drained",
+			sig:      syscall.SIGTERM,
+			inFlight: []int64{2, 1, 0},
+			want:     []string{"Received SIGTERM", "for up to 50ms", "Drained; shutting down."},
+		},
+		{
+			name:     "sigterm-timeout",
+			sig:      syscall.SIGTERM,
+			inFlight: []int64{3},
+			want:     []string{"Received SIGTERM", "Warning: drain timed out after 50ms with 3 requests in flight"},
+		},
+		{
+			name:     "sigint-drained",
+			sig:      os.Interrupt,
+			inFlight: []int64{1, 0},
+			want:     []string{"Received interrupt", "Press Ctrl-C again to force quit.", "Drained; shutting down."},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stderr bytes.Buffer
+			e := &serveEnv{
+				lc:         &fakeLocalServeClient{inFlight: tt.inFlight},
+				testStderr: &stderr,
+			}
+			e.drainServe(context.Background(), "http://127.0.0.1:3000", tt.sig)
+			for _, want := range tt.want {
+				if !strings.Contains(stderr.String(), want) {
+					t.Errorf("stderr = %q; want it to contain %q", stderr.String(), want)
+				}
+			}
+		})
+	}
 }
 
-// exactError returns an error checker that wants exactly the provided want error.
-// If optName is non-empty, it's used in the error message.
-func exactErr(want error, optName ...string) func(error) string {
-	return func(got error) string {
-		if got == want {
-			return ""
+func TestServeReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "serve.conf")
+	writeConfig := func(s string) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(s), 0600); err != nil {
+			t.Fatal(err)
 		}
-		if len(optName) > 0 {
-			return fmt.Sprintf("got error %v, want %v", got, optName[0])
+	}
+	writeConfig("# proxy settings\nupstream-user-agent first\nbackend-disable-http2\n")
+
+	var stderr, flagOut bytes.Buffer
+	lc := &fakeLocalServeClient{}
+	e := &serveEnv{lc: lc, testStderr: &stderr, testFlagOut: &flagOut}
+	fs := newServeDevCommand(e, "serve").FlagSet
+	if err := fs.Parse([]string{"--config", file, "--upstream-sni=backend.example"}); err != nil {
+		t.Fatal(err)
+	}
+	cmdline := flagsSet(fs)
+	if err := e.applyServeConfigFile(fs, cmdline); err != nil {
+		t.Fatal(err)
+	}
+	e.reloadHandler = func() (*ipn.HTTPHandler, error) {
+		return e.reloadedProxyHandler("serve", cmdline)
+	}
+	h, err := e.newProxyHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.UpstreamUserAgent != "first" || !h.ForceHTTP1 || h.UpstreamTLSSNI != "backend.example" {
+		t.Fatalf("handler from --config = %+v", h)
+	}
+	req := ipn.ServeStreamRequest{
+		HostPort:   "foo.test.ts.net:443",
+		Source:     "http://127.0.0.1:3000",
+		MountPoint: "/",
+		Handler:    h,
+	}
+	other := &ipn.HTTPHandler{Proxy: "http://127.0.0.1:4000"}
+	lc.config = req.ServeConfig()
+	lc.config.Web["foo.test.ts.net:443"].Handlers["/other"] = other
+
+	// Flags given on the command line take precedence over the file.
+	writeConfig("upstream-user-agent second\nupstream-sni ignored.example\nbackend-disable-http2\n")
+	if err := e.reloadServe(context.Background(), &req); err != nil {
+		t.Fatal(err)
+	}
+	if got := stderr.String(); !strings.Contains(got, "Configuration reloaded: 1 changes") {
+		t.Errorf("stderr = %q; want it to report 1 change", got)
+	}
+	got := lc.config.GetWebHandler("foo.test.ts.net:443", "/")
+	if got.UpstreamUserAgent != "second" || got.UpstreamTLSSNI != "backend.example" || got.Proxy != "http://127.0.0.1:3000" {
+		t.Errorf("reloaded handler = %+v", got)
+	}
+	if h := lc.config.GetWebHandler("foo.test.ts.net:443", "/other"); !reflect.DeepEqual(h, other) {
+		t.Errorf("other handler = %+v; want it unchanged", h)
+	}
+	if req.Handler.UpstreamUserAgent != "second" {
+		t.Errorf("req.Handler not updated")
+	}
+
+	// An invalid config keeps the old one.
+	setCount := lc.setCount
+	writeConfig("upstream-tls-min-version tls99\n")
+	if err := e.reloadServe(context.Background(), &req); err == nil {
+		t.Error("reload of invalid config succeeded")
+	}
+	writeConfig("no-such-flag 1\n")
+	if err := e.reloadServe(context.Background(), &req); err == nil {
+		t.Error("reload of config with unknown flag succeeded")
+	}
+	if lc.setCount != setCount {
+		t.Error("serve config changed by failed reloads")
+	}
+
+	stderr.Reset()
+	writeConfig("upstream-user-agent second\nbackend-disable-http2 true\n")
+	if err := e.reloadServe(context.Background(), &req); err != nil {
+		t.Fatal(err)
+	}
+	if got := stderr.String(); !strings.Contains(got, "Configuration reloaded: 0 changes") || lc.setCount != setCount {
+		t.Errorf("unchanged reload: stderr = %q, set %d times; want 0 changes and no set", got, lc.setCount-setCount)
+	}
+}
+
+func TestServeStatusField(t *testing.T) {
+	lc := &fakeLocalServeClient{
+		config: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: "http://127.0.0.1:3000"},
+				}},
+			},
+		},
+	}
+	tests := []struct {
+		field   string
+		want    string
+		wantErr string
+	}{
+		{field: `.Web["foo.test.ts.net:443"].Handlers["/"].Proxy`, want: "http://127.0.0.1:3000\n"},
+		{field: `["Web"]["foo.test.ts.net:443"]["Handlers"]`, want: "{\n  \"/\": {\n    \"Proxy\": \"http://127.0.0.1:3000\"\n  }\n}\n"},
+		{field: `.TCP[443].HTTPS`, want: "true\n"},
+		{field: `.TCP[80]`, wantErr: `field ["TCP"]["80"] not found`},
+		{field: `.Web["bar.test.ts.net:443"].Handlers`, wantErr: `field ["Web"]["bar.test.ts.net:443"] not found`},
+		{field: `.Web["foo.test.ts.net:443"].Handlers["/"].Proxy.Host`, wantErr: `field ["Web"]["foo.test.ts.net:443"]["Handlers"]["/"]["Proxy"]["Host"] not found`},
+		{field: `Web`, wantErr: `invalid field path "Web": want . or [ at "Web"`},
+		{field: `.Web[443`, wantErr: `invalid field path ".Web[443": missing ]`},
+		{field: `.Web..TCP`, wantErr: `invalid field path ".Web..TCP": empty name`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			var stdout, flagOut bytes.Buffer
+			e := &serveEnv{lc: lc, testFlagOut: &flagOut, testStdout: &stdout}
+			cmd := newServeDevCommand(e, "serve")
+			err := cmd.ParseAndRun(context.Background(), []string{"status", "--field", tt.field})
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v; want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := stdout.String(); got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeStatusJSONSchema(t *testing.T) {
+	lc := &fakeLocalServeClient{
+		config: &ipn.ServeConfig{
+			TCP: map[uint16]*ipn.TCPPortHandler{
+				443:   {HTTPS: true},
+				10000: {TCPForward: "127.0.0.1:5432"},
+			},
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"foo.test.ts.net:443": {
+					Handlers: map[string]*ipn.HTTPHandler{
+						"/":      {Proxy: "http://127.0.0.1:3000"},
+						"/hello": {Text: "hello"},
+					},
+					MethodHandlers: map[string]*ipn.HTTPHandler{
+						"OPTIONS": {Text: "ok"},
+					},
+				},
+			},
+			AllowFunnel: map[ipn.HostPort]bool{"foo.test.ts.net:443": true},
+		},
+		inFlight: []int64{2},
+		status: &ipnstate.Status{
+			BackendState: ipn.Running.String(),
+			Version:      "1.2.3-test",
+			Self:         &ipnstate.PeerStatus{DNSName: "foo.test.ts.net."},
+		},
+	}
+	var stdout, flagOut bytes.Buffer
+	e := &serveEnv{lc: lc, testFlagOut: &flagOut, testStdout: &stdout}
+	if err := newServeDevCommand(e, "serve").ParseAndRun(context.Background(), []string{"status", "--json", "--schema-version", "v1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every field of the schema must be present, even if it's zero, so
+	// that consumers can tell it apart from an older schema.
+	var fields map[string]json.RawMessage
+	var handlers []map[string]json.RawMessage
+	if err := json.Unmarshal(stdout.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(fields["Handlers"], &handlers); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"SchemaVersion", "Version", "Handlers"} {
+		if _, ok := fields[f]; !ok {
+			t.Errorf("missing field %s in %s", f, stdout.Bytes())
+		}
+	}
+	for i, h := range handlers {
+		for _, f := range []string{"HostPort", "Mount", "Type", "Target", "Funnel", "ActiveConnections"} {
+			if _, ok := h[f]; !ok {
+				t.Errorf("handler %d: missing field %s", i, f)
+			}
+		}
+	}
+
+	var got ipn.ServeStatusV1
+	dec := json.NewDecoder(bytes.NewReader(stdout.Bytes()))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := ipn.ServeStatusV1{
+		SchemaVersion: "v1",
+		Version:       "1.2.3-test",
+		Handlers: []ipn.ServeStatusV1Handler{
+			{HostPort: "foo.test.ts.net:443", Mount: "/", Type: "proxy", Target: "http://127.0.0.1:3000", Funnel: true, ActiveConnections: 2},
+			{HostPort: "foo.test.ts.net:443", Mount: "/hello", Type: "text", Target: "hello", Funnel: true},
+			{HostPort: "foo.test.ts.net:443", Method: "OPTIONS", Type: "text", Target: "ok", Funnel: true},
+			{HostPort: "foo.test.ts.net:10000", Type: "tcp", Target: "127.0.0.1:5432"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+
+	// The raw config is still available, as before.
+	stdout.Reset()
+	e = &serveEnv{lc: lc, testFlagOut: &flagOut, testStdout: &stdout}
+	if err := newServeDevCommand(e, "serve").ParseAndRun(context.Background(), []string{"status", "--raw"}); err != nil {
+		t.Fatal(err)
+	}
+	var sc ipn.ServeConfig
+	if err := json.Unmarshal(stdout.Bytes(), &sc); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&sc, lc.config) {
+		t.Errorf("--raw: got %+v; want %+v", sc, lc.config)
+	}
+
+	for _, tt := range []struct {
+		args    []string
+		wantErr string
+	}{
+		{[]string{"status", "--schema-version", "v2"}, `unsupported --schema-version "v2"; must be v1`},
+		{[]string{"status", "--raw", "--schema-version", "v1"}, "--raw and --schema-version can't both be given"},
+	} {
+		e := &serveEnv{lc: lc, testFlagOut: &flagOut, testStdout: &stdout}
+		err := newServeDevCommand(e, "serve").ParseAndRun(context.Background(), tt.args)
+		if err == nil || err.Error() != tt.wantErr {
+			t.Errorf("%q: got error %v; want %q", tt.args, err, tt.wantErr)
 		}
-		return fmt.Sprintf("got error %v, want %v", got, want)
 	}
 }
 
-// anyErr returns an error checker that wants any error.
-func anyErr() func(error) string {
-	return func(got error) string {
-		return ""
+func TestServeDevBanner(t *testing.T) {
+	const defaultBanner = "Serve started on \"https://foo.test.ts.net\".\nPress Ctrl-C to stop.\n\n"
+	dir := t.TempDir()
+	writeFile := func(name, s string) string {
+		f := filepath.Join(dir, name)
+		if err := os.WriteFile(f, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	custom := writeFile("custom.txt", "Serving {{.URL}} on port {{.Port}}{{with .Session}} ({{.}}){{end}}")
+	bad := writeFile("bad.txt", "{{.Nope}}")
+
+	tests := []struct {
+		name string
+		args []string
+		want string // prefix of stderr
+	}{
+		{"default", nil, defaultBanner},
+		{"quiet", []string{"--quiet"}, "Warning: stopping in"},
+		{"banner-file", []string{"--banner-file", custom}, "Serving https://foo.test.ts.net on port 443\nWarning: stopping in"},
+		{"quiet-banner-file", []string{"--quiet", "--banner-file", custom}, "Serving https://foo.test.ts.net on port 443\n"},
+		{"missing-banner-file", []string{"--banner-file", filepath.Join(dir, "missing.txt")}, defaultBanner},
+		{"bad-banner-file", []string{"--banner-file", bad}, "Warning: banner file: template: " + bad},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr, flagOut bytes.Buffer
+			e := &serveEnv{
+				lc:          &fakeLocalServeClient{},
+				testFlagOut: &flagOut,
+				testStdout:  &stdout,
+				testStderr:  &stderr,
+			}
+			cmd := newServeDevCommand(e, "serve")
+			args := append([]string{"--timeout=10ms", "--skip-listen-check"}, tt.args...)
+			if err := cmd.ParseAndRun(context.Background(), append(args, "3000")); err != nil {
+				t.Fatal(err)
+			}
+			if got := stderr.String(); !strings.HasPrefix(got, tt.want) {
+				t.Errorf("got stderr %q; want it to start with %q", got, tt.want)
+			}
+		})
 	}
 }
 
-func cmd(s string) []string {
-	return strings.Fields(s)
+func TestServeAwaitUpstream(t *testing.T) {
+	old := upstreamPollInterval
+	upstreamPollInterval = time.Millisecond
+	t.Cleanup(func() { upstreamPollInterval = old })
+
+	var (
+		mu       sync.Mutex
+		failures int // before the backend is ready
+		paths    []string
+	)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, r.URL.Path)
+		if failures != 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name     string
+		failures int // -1 for never ready
+		required bool
+		wantErr  string
+		want     string // substring of stderr
+	}{
+		{name: "ready", failures: 2, want: "/healthz is ready."},
+		{name: "not-ready", failures: -1, want: "/healthz wasn't ready after --wait-for-upstream=50ms (status 503 Service Unavailable); starting anyway."},
+		{name: "not-ready-required", failures: -1, required: true, wantErr: "/healthz wasn't ready after --wait-for-upstream=50ms: status 503 Service Unavailable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			failures, paths = tt.failures, nil
+			mu.Unlock()
+			var stderr bytes.Buffer
+			e := &serveEnv{
+				lc:               &fakeLocalServeClient{},
+				testStderr:       &stderr,
+				waitForUpstream:  50 * time.Millisecond,
+				healthCheckPath:  "/healthz",
+				upstreamRequired: tt.required,
+			}
+			err := e.awaitUpstream(context.Background(), backend.URL)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasSuffix(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v; want it to end in %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(stderr.String(), tt.want) {
+				t.Errorf("stderr = %q; want it to contain %q", stderr.String(), tt.want)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.failures >= 0 && len(paths) != tt.failures+1 {
+				t.Errorf("backend polled %d times; want %d", len(paths), tt.failures+1)
+			}
+			for _, p := range paths {
+				if p != "/healthz" {
+					t.Errorf("backend polled at %q; want /healthz", p)
+				}
+			}
+		})
+	}
+}
+
+func TestExpandTailnetTarget(t *testing.T) {
+	st := &ipnstate.Status{
+		BackendState: ipn.Running.String(),
+		Self:         fakeStatus.Self,
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {
+				DNSName:      "db.test.ts.net.",
+				HostName:     "database-1",
+				TailscaleIPs: []netip.Addr{netip.MustParseAddr("fd7a:115c:a1e0::1"), netip.MustParseAddr("100.101.102.103")},
+			},
+			key.NewNode().Public(): {
+				DNSName:      "web.test.ts.net.",
+				HostName:     "web",
+				TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.101.102.104")},
+			},
+			key.NewNode().Public(): {
+				DNSName:      "web-1.test.ts.net.",
+				HostName:     "web",
+				TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.101.102.105")},
+			},
+		},
+	}
+	tests := []struct {
+		target  string
+		want    string
+		wantErr string
+	}{
+		{target: "tailnet://db:5432", want: "http://100.101.102.103:5432"},
+		{target: "tailnet://DB.test.ts.net.:8080/api", want: "http://100.101.102.103:8080/api"},
+		{target: "tailnet://database-1:80", want: "http://100.101.102.103:80"},
+		{target: "tailnet://web:80", want: "http://100.101.102.104:80"}, // MagicDNS name wins over the other hostname
+		{target: "tailnet://100.101.102.105:80", want: "http://100.101.102.105:80"},
+		{target: "tailnet://[fd7a:115c:a1e0::1]:80", want: "http://[fd7a:115c:a1e0::1]:80"},
+		{target: "tailnet://192.168.1.2:80", wantErr: "192.168.1.2 is not a Tailscale IP"},
+		{target: "tailnet://cache:80", wantErr: `no node named "cache" in the tailnet`},
+		{target: "tailnet://db", wantErr: `invalid port "" in tailnet://db`},
+	}
+	for _, tt := range tests {
+		e := &serveEnv{lc: &fakeLocalServeClient{status: st}}
+		got, err := e.expandTailnetTarget(context.Background(), tt.target)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%s: got error %v; want %q", tt.target, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.target, err)
+		} else if got != tt.want {
+			t.Errorf("%s: got %q; want %q", tt.target, got, tt.want)
+		}
+	}
+
+	// Two nodes with the same hostname, neither of which has it as
+	// its MagicDNS name, are ambiguous.
+	for _, ps := range st.Peer {
+		if ps.HostName == "web" {
+			ps.HostName = "frontend"
+		}
+	}
+	e := &serveEnv{lc: &fakeLocalServeClient{status: st}}
+	if _, err := e.expandTailnetTarget(context.Background(), "tailnet://frontend:80"); err == nil || !strings.Contains(err.Error(), "more than one node") {
+		t.Errorf("ambiguous hostname: got error %v", err)
+	}
+}
+
+func TestServeMockBackend(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "mocks.json")
+	if err := os.WriteFile(file, []byte(`[
+		{"method": "GET", "path": "/api", "body": "api"},
+		{"method": "get", "path": "/api/users", "status": 201, "headers": {"Content-Type": "application/json"}, "body": "[]"},
+		{"path": "/static", "body": "static"}
+	]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	target, stop, err := startMockBackend(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	tests := []struct {
+		method     string
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"GET", "/api", 200, "api"},
+		{"GET", "/api/users/1", 201, "[]"}, // longest prefix wins
+		{"POST", "/static/app.js", 200, "static"},
+		{"POST", "/api", 404, "no mock response for POST /api; the mocks are:\n  GET /api\n  get /api/users\n  * /static\n"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, target+tt.path, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != tt.wantStatus || string(body) != tt.wantBody {
+			t.Errorf("%s %s: got %d %q; want %d %q", tt.method, tt.path, res.StatusCode, body, tt.wantStatus, tt.wantBody)
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{name: "check", args: []string{"--check", "--upstream-mock-file=" + file}},
+		{name: "target", args: []string{"--check", "--upstream-mock-file=" + file, "3000"}, wantErr: "--upstream-mock-file can't be used with a <target>"},
+		{name: "tcp", args: []string{"--check", "--protocol=tcp", "--upstream-mock-file=" + file}, wantErr: "--upstream-mock-file requires --protocol=http"},
+	} {
+		var stdout bytes.Buffer
+		e := &serveEnv{lc: &fakeLocalServeClient{}, testFlagOut: io.Discard, testStdout: &stdout}
+		err := newServeDevCommand(e, "serve").ParseAndRun(context.Background(), tc.args)
+		if tc.wantErr != "" {
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("%s: got error %v; want %q", tc.name, err, tc.wantErr)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		} else if got := stdout.String(); got != "OK\n" {
+			t.Errorf("%s: got output %q; want OK", tc.name, got)
+		}
+	}
+}
+
+func TestLoadMockResponses(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		json    string
+		wantErr string
+	}{
+		{json: `[]`, wantErr: "has no mock responses"},
+		{json: `[{"path": "api"}]`, wantErr: `mock 0: path "api" must start with /`},
+		{json: `[{"path": "/"}, {"path": "/x", "status": 700}]`, wantErr: "mock 1: invalid status 700"},
+		{json: `{"path": "/"}`, wantErr: "parsing "},
+	}
+	for i, tt := range tests {
+		file := filepath.Join(dir, fmt.Sprintf("mocks%d.json", i))
+		if err := os.WriteFile(file, []byte(tt.json), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadMockResponses(file); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: got error %v; want %q", tt.json, err, tt.wantErr)
+		}
+	}
+}
+
+func TestReadServeConfigFileJSON(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "serve-config.json")
+	if err := os.WriteFile(file, []byte(`{"upstream-user-agent": "agent", "--max-connections": 10, "backend-disable-http2": true}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readServeConfigFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []serveFlagSetting{
+		{"backend-disable-http2", "true"},
+		{"max-connections", "10"},
+		{"upstream-user-agent", "agent"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+
+	if err := os.WriteFile(file, []byte(`{"access-log-exclude-path": ["/a", "/b"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readServeConfigFile(file); err == nil || !strings.Contains(err.Error(), "must be a string, number or boolean") {
+		t.Errorf("got error %v for a list value", err)
+	}
+}
+
+func TestServeConfigWatchDir(t *testing.T) {
+	if !canWatchServeConfigDir {
+		t.Skipf("--config-watch-dir isn't supported on %s", runtime.GOOS)
+	}
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symlinks needs privileges on Windows")
+	}
+	// Lay out dir like a Kubernetes ConfigMap volume.
+	dir := t.TempDir()
+	writeVersion := func(version, config string) {
+		t.Helper()
+		if err := os.Mkdir(filepath.Join(dir, version), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, version, serveConfigWatchFile), []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(version, filepath.Join(dir, "..data_tmp")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeVersion("..v1", `{"upstream-user-agent": "first"}`)
+	if err := os.Symlink(filepath.Join("..data", serveConfigWatchFile), filepath.Join(dir, serveConfigWatchFile)); err != nil {
+		t.Fatal(err)
+	}
+
+	e := &serveEnv{configWatchDir: dir, testStderr: io.Discard}
+	if err := e.resolveConfigFile(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed, err := e.watchServeConfigDir(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Other files in the directory are ignored.
+	if err := os.WriteFile(filepath.Join(dir, "other"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+		t.Fatal("change to another file was reported")
+	case <-time.After(3 * serveConfigSettleTime):
+	}
+
+	writeVersion("..v2", `{"upstream-user-agent": "second"}`)
+	select {
+	case <-changed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("config change wasn't reported")
+	}
+	set, err := readServeConfigFile(e.configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []serveFlagSetting{{"upstream-user-agent", "second"}}; !reflect.DeepEqual(set, want) {
+		t.Errorf("config after change = %v; want %v", set, want)
+	}
+
+	e = &serveEnv{configWatchDir: dir, configFile: "serve.conf"}
+	if err := e.resolveConfigFile(); err == nil || err.Error() != "--config and --config-watch-dir can't both be given" {
+		t.Errorf("--config with --config-watch-dir: got error %v", err)
+	}
+}
+
+func TestRequestLogHookKillsStuckCommand(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("test command needs a POSIX shell")
+	}
+	defer func(d time.Duration) { requestLogHookExitGrace = d }(requestLogHookExitGrace)
+	requestLogHookExitGrace = 10 * time.Millisecond
+
+	// The command ignores its input closing, so it must be killed.
+	h := newRequestLogHook("exec sleep 60", t.Logf)
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- h.runOnce(ctx) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("runOnce: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("runOnce didn't return after the context was done")
+	}
 }
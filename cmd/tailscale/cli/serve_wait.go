@@ -0,0 +1,89 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// upstreamPollInterval is how often awaitUpstream polls the backend.
+// It's a var for testing.
+var upstreamPollInterval = time.Second
+
+// awaitUpstream polls the backend at source, GETting --health-check-path,
+// until it returns a 2xx status or --wait-for-upstream passes, so that
+// serving doesn't start before the backend is ready. If the backend isn't
+// ready in time, it returns an error with --wait-for-upstream-required,
+// and otherwise warns and returns nil.
+func (e *serveEnv) awaitUpstream(ctx context.Context, source string) error {
+	u := strings.TrimSuffix(source, "/") + e.healthCheckPath
+	insecure := strings.HasPrefix(u, "https+insecure://")
+	if insecure {
+		u = "https://" + strings.TrimPrefix(u, "https+insecure://")
+	}
+	c := &http.Client{
+		Transport: &http.Transport{
+			// The check is whether the backend is ready, not who it
+			// is, so like Kubernetes' HTTPS probes, it doesn't verify
+			// the backend's certificate.
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	defer c.CloseIdleConnections()
+
+	e.logf(serveLogInfo, "Waiting up to %v for %s to be ready.", e.waitForUpstream, u)
+	ctx, cancel := context.WithTimeout(ctx, e.waitForUpstream)
+	defer cancel()
+	tick := time.NewTicker(upstreamPollInterval)
+	defer tick.Stop()
+	var err error // from the last poll that wasn't cut short by ctx
+	for {
+		pollErr := getHealthy(ctx, c, u)
+		if pollErr == nil {
+			e.logf(serveLogInfo, "%s is ready.", u)
+			return nil
+		}
+		if err == nil || ctx.Err() == nil {
+			err = pollErr
+		}
+		e.logf(serveLogDebug, "%s isn't ready: %v", u, pollErr)
+		select {
+		case <-tick.C:
+			continue
+		case <-ctx.Done():
+		}
+		if ctx.Err() != context.DeadlineExceeded {
+			return ctx.Err()
+		}
+		if e.upstreamRequired {
+			return fmt.Errorf("%s wasn't ready after --wait-for-upstream=%v: %w", u, e.waitForUpstream, err)
+		}
+		e.logf(serveLogWarn, "%s wasn't ready after --wait-for-upstream=%v (%v); starting anyway.", u, e.waitForUpstream, err)
+		return nil
+	}
+}
+
+// getHealthy GETs u with c and reports whether it returned a 2xx status.
+func getHealthy(ctx context.Context, c *http.Client, u string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 1<<16))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("status %s", res.Status)
+	}
+	return nil
+}
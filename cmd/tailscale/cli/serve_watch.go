@@ -0,0 +1,37 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// serveConfigWatchFile is the name of the --config file in a
+// --config-watch-dir directory.
+const serveConfigWatchFile = "serve-config.json"
+
+// serveConfigSettleTime is how long to wait after a change in a
+// --config-watch-dir directory for more changes before reloading, so
+// that a file written in several steps is only reloaded once.
+const serveConfigSettleTime = 100 * time.Millisecond
+
+// resolveConfigFile sets e.configFile to the serveConfigWatchFile in
+// e.configWatchDir, if set.
+func (e *serveEnv) resolveConfigFile() error {
+	if e.configWatchDir == "" {
+		return nil
+	}
+	if e.configFile != "" {
+		return errors.New("--config and --config-watch-dir can't both be given")
+	}
+	if !canWatchServeConfigDir {
+		return fmt.Errorf("--config-watch-dir is not supported on %s", runtime.GOOS)
+	}
+	e.configFile = filepath.Join(e.configWatchDir, serveConfigWatchFile)
+	return nil
+}
@@ -0,0 +1,68 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9 && !aix && !js && !wasip1
+
+package cli
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// canWatchServeConfigDir is whether fsnotify supports this platform,
+// for --config-watch-dir.
+const canWatchServeConfigDir = true
+
+// watchServeConfigDir watches e.configWatchDir and sends on the returned
+// channel when its serveConfigWatchFile may have changed, until ctx is
+// done.
+//
+// The directory is watched rather than the file, as Kubernetes updates
+// a ConfigMap volume by atomically renaming a "..data" symlink to a new
+// directory of files, which the file is a symlink into; the file itself
+// is never written.
+func (e *serveEnv) watchServeConfigDir(ctx context.Context) (<-chan struct{}, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Add(e.configWatchDir); err != nil {
+		w.Close()
+		return nil, err
+	}
+	changed := make(chan struct{}, 1)
+	go func() {
+		defer w.Close()
+		var settle <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				switch filepath.Base(ev.Name) {
+				case serveConfigWatchFile, "..data":
+					settle = time.After(serveConfigSettleTime)
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				e.logf(serveLogWarn, "watching %s: %v", e.configWatchDir, err)
+			case <-settle:
+				settle = nil
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changed, nil
+}
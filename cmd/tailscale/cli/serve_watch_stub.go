@@ -0,0 +1,19 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build plan9 || aix || js || wasip1
+
+package cli
+
+import (
+	"context"
+	"errors"
+)
+
+// canWatchServeConfigDir is false: fsnotify doesn't support this
+// platform, so --config-watch-dir is rejected.
+const canWatchServeConfigDir = false
+
+func (e *serveEnv) watchServeConfigDir(ctx context.Context) (<-chan struct{}, error) {
+	return nil, errors.New("not supported on this platform")
+}
@@ -133,6 +133,7 @@ func defaultPort() uint16 {
 	statepath      string
 	statedir       string
 	socketpath     string
+	socketFactotum bool // on Plan 9, require clients to authenticate with factotum
 	birdSocketPath string
 	verbose        int
 	socksAddr      string // listen address for SOCKS5 server
@@ -170,6 +171,9 @@ func main() {
 	flag.StringVar(&args.statepath, "state", "", "absolute path of state file; use 'kube:<secret-name>' to use Kubernetes secrets or 'arn:aws:ssm:...' to store in AWS SSM; use 'mem:' to not store state and register as an ephemeral node. If empty and --statedir is provided, the default is <statedir>/tailscaled.state. Default: "+paths.DefaultTailscaledStateFile())
 	flag.StringVar(&args.statedir, "statedir", "", "path to directory for storage of config state, TLS certs, temporary incoming Taildrop files, etc. If empty, it's derived from --state when possible.")
 	flag.StringVar(&args.socketpath, "socket", paths.DefaultTailscaledSocket(), "path of the service unix socket")
+	if runtime.GOOS == "plan9" {
+		flag.BoolVar(&args.socketFactotum, "socket-factotum", false, "require clients of the service socket to authenticate with factotum(4) as the user tailscaled runs as, or the operator")
+	}
 	flag.StringVar(&args.birdSocketPath, "bird-socket", "", "path of the bird unix socket")
 	flag.BoolVar(&printVersion, "version", false, "print version information and exit")
 	flag.BoolVar(&args.disableLogs, "no-logs-no-support", false, "disable log uploads; this also disables any technical support")
@@ -403,7 +407,18 @@ func run() error {
 var sigPipe os.Signal // set by sigpipe.go
 
 func startIPNServer(ctx context.Context, logf logger.Logf, logID logid.PublicID, sys *tsd.System) error {
-	ln, err := safesocket.Listen(args.socketpath)
+	// lbv is the LocalBackend, once it's started, for the operator.
+	var lbv syncs.AtomicValue[*ipnlocal.LocalBackend]
+	var ln net.Listener
+	var err error
+	if args.socketFactotum {
+		ln, err = safesocket.ListenWithFactotum(args.socketpath, func(user string) bool {
+			lb := lbv.Load()
+			return lb != nil && lb.OperatorUserName() == user
+		})
+	} else {
+		ln, err = safesocket.Listen(args.socketpath)
+	}
 	if err != nil {
 		return fmt.Errorf("safesocket.Listen: %v", err)
 	}
@@ -451,6 +466,7 @@ func startIPNServer(ctx context.Context, logf logger.Logf, logID logid.PublicID,
 		lb, err := getLocalBackend(ctx, logf, logID, sys)
 		if err == nil {
 			logf("got LocalBackend in %v", time.Since(t0).Round(time.Millisecond))
+			lbv.Store(lb)
 			srv.SetLocalBackend(lb)
 			return
 		}
@@ -121,6 +121,10 @@ type Notify struct {
 	// is available.
 	ClientVersion *tailcfg.ClientVersion `json:",omitempty"`
 
+	// FunnelStarted, if non-nil, reports that the backend has applied
+	// the ServeConfig for a new foreground Funnel session.
+	FunnelStarted *FunnelStartedEvent `json:",omitempty"`
+
 	// type is mirrored in xcode/Shared/IPN.swift
 }
 
@@ -160,6 +164,9 @@ func (n Notify) String() string {
 	if n.LocalTCPPort != nil {
 		fmt.Fprintf(&sb, "tcpport=%v ", n.LocalTCPPort)
 	}
+	if n.FunnelStarted != nil {
+		fmt.Fprintf(&sb, "FunnelStarted=%v ", n.FunnelStarted.HostPort)
+	}
 	s := sb.String()
 	return s[0:len(s)-1] + "}"
 }
@@ -8,10 +8,12 @@
 import (
 	"maps"
 	"net/netip"
+	"time"
 
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/persist"
 	"tailscale.com/types/preftype"
+	"tailscale.com/types/ptr"
 )
 
 // Clone makes a deep copy of Prefs.
@@ -76,6 +78,12 @@ func (src *ServeConfig) Clone() *ServeConfig {
 		}
 	}
 	dst.AllowFunnel = maps.Clone(src.AllowFunnel)
+	if dst.FunnelPaths != nil {
+		dst.FunnelPaths = map[HostPort][]string{}
+		for k := range src.FunnelPaths {
+			dst.FunnelPaths[k] = append([]string{}, src.FunnelPaths[k]...)
+		}
+	}
 	if dst.Foreground != nil {
 		dst.Foreground = map[string]*ServeConfig{}
 		for k, v := range src.Foreground {
@@ -90,7 +98,9 @@ func (src *ServeConfig) Clone() *ServeConfig {
 	TCP         map[uint16]*TCPPortHandler
 	Web         map[HostPort]*WebServerConfig
 	AllowFunnel map[HostPort]bool
+	FunnelPaths map[HostPort][]string
 	Foreground  map[string]*ServeConfig
+	ETag        string
 }{})
 
 // Clone makes a deep copy of TCPPortHandler.
@@ -120,14 +130,76 @@ func (src *HTTPHandler) Clone() *HTTPHandler {
 	}
 	dst := new(HTTPHandler)
 	*dst = *src
+	if dst.OIDCUpstreamAuth != nil {
+		dst.OIDCUpstreamAuth = ptr.To(*src.OIDCUpstreamAuth)
+	}
+	if dst.OIDCAccessControl != nil {
+		dst.OIDCAccessControl = ptr.To(*src.OIDCAccessControl)
+	}
+	dst.OAuth2Config = src.OAuth2Config.Clone()
+	dst.NoKeepaliveBackends = append(src.NoKeepaliveBackends[:0:0], src.NoKeepaliveBackends...)
+	dst.PassThroughHeaders = append(src.PassThroughHeaders[:0:0], src.PassThroughHeaders...)
+	dst.StripRequestHeaders = append(src.StripRequestHeaders[:0:0], src.StripRequestHeaders...)
 	return dst
 }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _HTTPHandlerCloneNeedsRegeneration = HTTPHandler(struct {
-	Path  string
-	Proxy string
-	Text  string
+	Path                           string
+	Proxy                          string
+	Text                           string
+	ABTestBackend                  string
+	ABTestPercentage               int
+	ABTestCookie                   bool
+	TLSMinVersion                  string
+	TLSRenegotiation               string
+	UpstreamRootCA                 string
+	UpstreamTLSSNI                 string
+	TLSCertFingerprint             string
+	ForceHTTP1                     bool
+	UpstreamUserAgent              string
+	BearerTokenFile                string
+	RequestSigningSecretFile       string
+	OIDCUpstreamAuth               *OIDCUpstreamAuth
+	OIDCAccessControl              *OIDCAccessControl
+	OAuth2Config                   *OAuth2ClientConfig
+	UpstreamReadTimeout            time.Duration
+	UpstreamStallTimeout           time.Duration
+	MaxResponseBytes               int64
+	NoSniff                        bool
+	CacheControlOverride           string
+	StripPragma                    bool
+	CompressionOffload             bool
+	IdempotencyCacheTTL            time.Duration
+	TraceRequests                  bool
+	LogResponseBodyBytes           bool
+	PropagateTraceParent           bool
+	PropagateRequestID             bool
+	SlowRequestThreshold           time.Duration
+	CircuitBreakerFailures         int
+	CircuitBreakerCooldown         time.Duration
+	CircuitBreakerHalfOpenRequests int
+	MaxConcurrentRequests          int
+	MaxQueueWait                   time.Duration
+	UpstreamHonorRetryAfter        bool
+	UpstreamMaxRetryAfter          time.Duration
+	UpstreamFlushInterval          time.Duration
+	RateLimitFile                  string
+	CollectPoolStats               bool
+	ConnectionEvents               bool
+	ConnectionStates               bool
+	PreheatConnections             int
+	PreheatPath                    string
+	UpstreamProxyProtocol          string
+	UpstreamKeepAliveProbe         bool
+	UpstreamTCPNoDelay             bool
+	NoKeepaliveBackends            []string
+	PassThroughHeaders             []string
+	NoSessionHeaders               bool
+	ClassifyUpstreamErrors         bool
+	ForwardedHeaders               string
+	KeepForwardedHeaders           bool
+	StripRequestHeaders            []string
 }{})
 
 // Clone makes a deep copy of WebServerConfig.
@@ -144,10 +216,37 @@ func (src *WebServerConfig) Clone() *WebServerConfig {
 			dst.Handlers[k] = v.Clone()
 		}
 	}
+	if dst.MethodHandlers != nil {
+		dst.MethodHandlers = map[string]*HTTPHandler{}
+		for k, v := range src.MethodHandlers {
+			dst.MethodHandlers[k] = v.Clone()
+		}
+	}
 	return dst
 }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _WebServerConfigCloneNeedsRegeneration = WebServerConfig(struct {
-	Handlers map[string]*HTTPHandler
+	Handlers       map[string]*HTTPHandler
+	MethodHandlers map[string]*HTTPHandler
+}{})
+
+// Clone makes a deep copy of OAuth2ClientConfig.
+// The result aliases no memory with the original.
+func (src *OAuth2ClientConfig) Clone() *OAuth2ClientConfig {
+	if src == nil {
+		return nil
+	}
+	dst := new(OAuth2ClientConfig)
+	*dst = *src
+	dst.Scopes = append(src.Scopes[:0:0], src.Scopes...)
+	return dst
+}
+
+// A compilation failure here means this code must be regenerated, with the command at the top of this file.
+var _OAuth2ClientConfigCloneNeedsRegeneration = OAuth2ClientConfig(struct {
+	TokenURL         string
+	ClientID         string
+	ClientSecretFile string
+	Scopes           []string
 }{})
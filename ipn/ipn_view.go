@@ -9,6 +9,7 @@
 	"encoding/json"
 	"errors"
 	"net/netip"
+	"time"
 
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/persist"
@@ -16,7 +17,7 @@
 	"tailscale.com/types/views"
 )
 
-//go:generate go run tailscale.com/cmd/cloner  -clonefunc=false -type=Prefs,ServeConfig,TCPPortHandler,HTTPHandler,WebServerConfig
+//go:generate go run tailscale.com/cmd/cloner  -clonefunc=false -type=Prefs,ServeConfig,TCPPortHandler,HTTPHandler,WebServerConfig,OAuth2ClientConfig
 
 // View returns a readonly view of Prefs.
 func (p *Prefs) View() PrefsView {
@@ -177,18 +178,27 @@ func (v ServeConfigView) AllowFunnel() views.Map[HostPort, bool] {
 	return views.MapOf(v.ж.AllowFunnel)
 }
 
+func (v ServeConfigView) FunnelPaths() views.MapFn[HostPort, []string, views.Slice[string]] {
+	return views.MapFnOf(v.ж.FunnelPaths, func(t []string) views.Slice[string] {
+		return views.SliceOf(t)
+	})
+}
+
 func (v ServeConfigView) Foreground() views.MapFn[string, *ServeConfig, ServeConfigView] {
 	return views.MapFnOf(v.ж.Foreground, func(t *ServeConfig) ServeConfigView {
 		return t.View()
 	})
 }
+func (v ServeConfigView) ETag() string { return v.ж.ETag }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _ServeConfigViewNeedsRegeneration = ServeConfig(struct {
 	TCP         map[uint16]*TCPPortHandler
 	Web         map[HostPort]*WebServerConfig
 	AllowFunnel map[HostPort]bool
+	FunnelPaths map[HostPort][]string
 	Foreground  map[string]*ServeConfig
+	ETag        string
 }{})
 
 // View returns a readonly view of TCPPortHandler.
@@ -294,15 +304,141 @@ func (v *HTTPHandlerView) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-func (v HTTPHandlerView) Path() string  { return v.ж.Path }
-func (v HTTPHandlerView) Proxy() string { return v.ж.Proxy }
-func (v HTTPHandlerView) Text() string  { return v.ж.Text }
+func (v HTTPHandlerView) Path() string                     { return v.ж.Path }
+func (v HTTPHandlerView) Proxy() string                    { return v.ж.Proxy }
+func (v HTTPHandlerView) Text() string                     { return v.ж.Text }
+func (v HTTPHandlerView) ABTestBackend() string            { return v.ж.ABTestBackend }
+func (v HTTPHandlerView) ABTestPercentage() int            { return v.ж.ABTestPercentage }
+func (v HTTPHandlerView) ABTestCookie() bool               { return v.ж.ABTestCookie }
+func (v HTTPHandlerView) TLSMinVersion() string            { return v.ж.TLSMinVersion }
+func (v HTTPHandlerView) TLSRenegotiation() string         { return v.ж.TLSRenegotiation }
+func (v HTTPHandlerView) UpstreamRootCA() string           { return v.ж.UpstreamRootCA }
+func (v HTTPHandlerView) UpstreamTLSSNI() string           { return v.ж.UpstreamTLSSNI }
+func (v HTTPHandlerView) TLSCertFingerprint() string       { return v.ж.TLSCertFingerprint }
+func (v HTTPHandlerView) ForceHTTP1() bool                 { return v.ж.ForceHTTP1 }
+func (v HTTPHandlerView) UpstreamUserAgent() string        { return v.ж.UpstreamUserAgent }
+func (v HTTPHandlerView) BearerTokenFile() string          { return v.ж.BearerTokenFile }
+func (v HTTPHandlerView) RequestSigningSecretFile() string { return v.ж.RequestSigningSecretFile }
+func (v HTTPHandlerView) OIDCUpstreamAuth() *OIDCUpstreamAuth {
+	if v.ж.OIDCUpstreamAuth == nil {
+		return nil
+	}
+	x := *v.ж.OIDCUpstreamAuth
+	return &x
+}
+
+func (v HTTPHandlerView) OIDCAccessControl() *OIDCAccessControl {
+	if v.ж.OIDCAccessControl == nil {
+		return nil
+	}
+	x := *v.ж.OIDCAccessControl
+	return &x
+}
+
+func (v HTTPHandlerView) OAuth2Config() OAuth2ClientConfigView  { return v.ж.OAuth2Config.View() }
+func (v HTTPHandlerView) UpstreamReadTimeout() time.Duration    { return v.ж.UpstreamReadTimeout }
+func (v HTTPHandlerView) UpstreamStallTimeout() time.Duration   { return v.ж.UpstreamStallTimeout }
+func (v HTTPHandlerView) MaxResponseBytes() int64               { return v.ж.MaxResponseBytes }
+func (v HTTPHandlerView) NoSniff() bool                         { return v.ж.NoSniff }
+func (v HTTPHandlerView) CacheControlOverride() string          { return v.ж.CacheControlOverride }
+func (v HTTPHandlerView) StripPragma() bool                     { return v.ж.StripPragma }
+func (v HTTPHandlerView) CompressionOffload() bool              { return v.ж.CompressionOffload }
+func (v HTTPHandlerView) IdempotencyCacheTTL() time.Duration    { return v.ж.IdempotencyCacheTTL }
+func (v HTTPHandlerView) TraceRequests() bool                   { return v.ж.TraceRequests }
+func (v HTTPHandlerView) LogResponseBodyBytes() bool            { return v.ж.LogResponseBodyBytes }
+func (v HTTPHandlerView) PropagateTraceParent() bool            { return v.ж.PropagateTraceParent }
+func (v HTTPHandlerView) PropagateRequestID() bool              { return v.ж.PropagateRequestID }
+func (v HTTPHandlerView) SlowRequestThreshold() time.Duration   { return v.ж.SlowRequestThreshold }
+func (v HTTPHandlerView) CircuitBreakerFailures() int           { return v.ж.CircuitBreakerFailures }
+func (v HTTPHandlerView) CircuitBreakerCooldown() time.Duration { return v.ж.CircuitBreakerCooldown }
+func (v HTTPHandlerView) CircuitBreakerHalfOpenRequests() int {
+	return v.ж.CircuitBreakerHalfOpenRequests
+}
+func (v HTTPHandlerView) MaxConcurrentRequests() int           { return v.ж.MaxConcurrentRequests }
+func (v HTTPHandlerView) MaxQueueWait() time.Duration          { return v.ж.MaxQueueWait }
+func (v HTTPHandlerView) UpstreamHonorRetryAfter() bool        { return v.ж.UpstreamHonorRetryAfter }
+func (v HTTPHandlerView) UpstreamMaxRetryAfter() time.Duration { return v.ж.UpstreamMaxRetryAfter }
+func (v HTTPHandlerView) UpstreamFlushInterval() time.Duration { return v.ж.UpstreamFlushInterval }
+func (v HTTPHandlerView) RateLimitFile() string                { return v.ж.RateLimitFile }
+func (v HTTPHandlerView) CollectPoolStats() bool               { return v.ж.CollectPoolStats }
+func (v HTTPHandlerView) ConnectionEvents() bool               { return v.ж.ConnectionEvents }
+func (v HTTPHandlerView) ConnectionStates() bool               { return v.ж.ConnectionStates }
+func (v HTTPHandlerView) PreheatConnections() int              { return v.ж.PreheatConnections }
+func (v HTTPHandlerView) PreheatPath() string                  { return v.ж.PreheatPath }
+func (v HTTPHandlerView) UpstreamProxyProtocol() string        { return v.ж.UpstreamProxyProtocol }
+func (v HTTPHandlerView) UpstreamKeepAliveProbe() bool         { return v.ж.UpstreamKeepAliveProbe }
+func (v HTTPHandlerView) UpstreamTCPNoDelay() bool             { return v.ж.UpstreamTCPNoDelay }
+func (v HTTPHandlerView) NoKeepaliveBackends() views.Slice[string] {
+	return views.SliceOf(v.ж.NoKeepaliveBackends)
+}
+func (v HTTPHandlerView) PassThroughHeaders() views.Slice[string] {
+	return views.SliceOf(v.ж.PassThroughHeaders)
+}
+func (v HTTPHandlerView) NoSessionHeaders() bool       { return v.ж.NoSessionHeaders }
+func (v HTTPHandlerView) ClassifyUpstreamErrors() bool { return v.ж.ClassifyUpstreamErrors }
+func (v HTTPHandlerView) ForwardedHeaders() string     { return v.ж.ForwardedHeaders }
+func (v HTTPHandlerView) KeepForwardedHeaders() bool   { return v.ж.KeepForwardedHeaders }
+func (v HTTPHandlerView) StripRequestHeaders() views.Slice[string] {
+	return views.SliceOf(v.ж.StripRequestHeaders)
+}
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _HTTPHandlerViewNeedsRegeneration = HTTPHandler(struct {
-	Path  string
-	Proxy string
-	Text  string
+	Path                           string
+	Proxy                          string
+	Text                           string
+	ABTestBackend                  string
+	ABTestPercentage               int
+	ABTestCookie                   bool
+	TLSMinVersion                  string
+	TLSRenegotiation               string
+	UpstreamRootCA                 string
+	UpstreamTLSSNI                 string
+	TLSCertFingerprint             string
+	ForceHTTP1                     bool
+	UpstreamUserAgent              string
+	BearerTokenFile                string
+	RequestSigningSecretFile       string
+	OIDCUpstreamAuth               *OIDCUpstreamAuth
+	OIDCAccessControl              *OIDCAccessControl
+	OAuth2Config                   *OAuth2ClientConfig
+	UpstreamReadTimeout            time.Duration
+	UpstreamStallTimeout           time.Duration
+	MaxResponseBytes               int64
+	NoSniff                        bool
+	CacheControlOverride           string
+	StripPragma                    bool
+	CompressionOffload             bool
+	IdempotencyCacheTTL            time.Duration
+	TraceRequests                  bool
+	LogResponseBodyBytes           bool
+	PropagateTraceParent           bool
+	PropagateRequestID             bool
+	SlowRequestThreshold           time.Duration
+	CircuitBreakerFailures         int
+	CircuitBreakerCooldown         time.Duration
+	CircuitBreakerHalfOpenRequests int
+	MaxConcurrentRequests          int
+	MaxQueueWait                   time.Duration
+	UpstreamHonorRetryAfter        bool
+	UpstreamMaxRetryAfter          time.Duration
+	UpstreamFlushInterval          time.Duration
+	RateLimitFile                  string
+	CollectPoolStats               bool
+	ConnectionEvents               bool
+	ConnectionStates               bool
+	PreheatConnections             int
+	PreheatPath                    string
+	UpstreamProxyProtocol          string
+	UpstreamKeepAliveProbe         bool
+	UpstreamTCPNoDelay             bool
+	NoKeepaliveBackends            []string
+	PassThroughHeaders             []string
+	NoSessionHeaders               bool
+	ClassifyUpstreamErrors         bool
+	ForwardedHeaders               string
+	KeepForwardedHeaders           bool
+	StripRequestHeaders            []string
 }{})
 
 // View returns a readonly view of WebServerConfig.
@@ -356,7 +492,72 @@ func (v WebServerConfigView) Handlers() views.MapFn[string, *HTTPHandler, HTTPHa
 	})
 }
 
+func (v WebServerConfigView) MethodHandlers() views.MapFn[string, *HTTPHandler, HTTPHandlerView] {
+	return views.MapFnOf(v.ж.MethodHandlers, func(t *HTTPHandler) HTTPHandlerView {
+		return t.View()
+	})
+}
+
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _WebServerConfigViewNeedsRegeneration = WebServerConfig(struct {
-	Handlers map[string]*HTTPHandler
+	Handlers       map[string]*HTTPHandler
+	MethodHandlers map[string]*HTTPHandler
+}{})
+
+// View returns a readonly view of OAuth2ClientConfig.
+func (p *OAuth2ClientConfig) View() OAuth2ClientConfigView {
+	return OAuth2ClientConfigView{ж: p}
+}
+
+// OAuth2ClientConfigView provides a read-only view over OAuth2ClientConfig.
+//
+// Its methods should only be called if `Valid()` returns true.
+type OAuth2ClientConfigView struct {
+	// ж is the underlying mutable value, named with a hard-to-type
+	// character that looks pointy like a pointer.
+	// It is named distinctively to make you think of how dangerous it is to escape
+	// to callers. You must not let callers be able to mutate it.
+	ж *OAuth2ClientConfig
+}
+
+// Valid reports whether underlying value is non-nil.
+func (v OAuth2ClientConfigView) Valid() bool { return v.ж != nil }
+
+// AsStruct returns a clone of the underlying value which aliases no memory with
+// the original.
+func (v OAuth2ClientConfigView) AsStruct() *OAuth2ClientConfig {
+	if v.ж == nil {
+		return nil
+	}
+	return v.ж.Clone()
+}
+
+func (v OAuth2ClientConfigView) MarshalJSON() ([]byte, error) { return json.Marshal(v.ж) }
+
+func (v *OAuth2ClientConfigView) UnmarshalJSON(b []byte) error {
+	if v.ж != nil {
+		return errors.New("already initialized")
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	var x OAuth2ClientConfig
+	if err := json.Unmarshal(b, &x); err != nil {
+		return err
+	}
+	v.ж = &x
+	return nil
+}
+
+func (v OAuth2ClientConfigView) TokenURL() string            { return v.ж.TokenURL }
+func (v OAuth2ClientConfigView) ClientID() string            { return v.ж.ClientID }
+func (v OAuth2ClientConfigView) ClientSecretFile() string    { return v.ж.ClientSecretFile }
+func (v OAuth2ClientConfigView) Scopes() views.Slice[string] { return views.SliceOf(v.ж.Scopes) }
+
+// A compilation failure here means this code must be regenerated, with the command at the top of this file.
+var _OAuth2ClientConfigViewNeedsRegeneration = OAuth2ClientConfig(struct {
+	TokenURL         string
+	ClientID         string
+	ClientSecretFile string
+	Scopes           []string
 }{})
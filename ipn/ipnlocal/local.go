@@ -13,7 +13,6 @@
 	"log"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/netip"
 	"net/url"
 	"os"
@@ -245,10 +244,22 @@ type LocalBackend struct {
 	serveConfig       ipn.ServeConfigView // or !Valid if none
 
 	serveListeners     map[netip.AddrPort]*serveListener // addrPort => serveListener
-	serveProxyHandlers sync.Map                          // string (HTTPHandler.Proxy) => *httputil.ReverseProxy
+	serveProxyHandlers sync.Map                          // string (proxyHandlerKey) => *reverseProxy
+	serveProxyKeys     sync.Map                          // ipn.HTTPHandlerView (of serveConfig) => serveProxyKeys
+	serveInFlight      sync.Map                          // string (backend host:port) => *atomic.Int64 of requests being proxied
 	// serveStreamers is a map for those running Funnel in the foreground
 	// and streaming incoming requests.
 	serveStreamers map[uint16]map[uint32]func(ipn.FunnelRequestLog) // serve port => map of stream loggers (key is UUID)
+	// funnelSessions is the session ID of the latest foreground Funnel
+	// stream for each serve port, as sent in FunnelStartedEvent.
+	funnelSessions map[uint16]string
+	// funnelSessionLabels is the SessionLabel of each session in
+	// funnelSessions that has one.
+	funnelSessionLabels map[uint16]string
+	// serveStreams are the foreground serve streams whose configs are
+	// merged into the serve config, so that when one ends, what the
+	// others still need is left in place.
+	serveStreams map[string]serveStream // session ID => stream
 
 	// statusLock must be held before calling statusChanged.Wait() or
 	// statusChanged.Broadcast().
@@ -592,6 +603,15 @@ func (b *LocalBackend) Shutdown() {
 	if b.sockstatLogger != nil {
 		b.sockstatLogger.Shutdown()
 	}
+	b.serveProxyHandlers.Range(func(key, value any) bool {
+		value.(*reverseProxy).close()
+		b.serveProxyHandlers.Delete(key)
+		return true
+	})
+	b.serveProxyKeys.Range(func(key, _ any) bool {
+		b.serveProxyKeys.Delete(key)
+		return true
+	})
 
 	b.unregisterNetMon()
 	b.unregisterHealthWatch()
@@ -2933,7 +2953,7 @@ func (b *LocalBackend) TCPHandlerForDst(src, dst netip.AddrPort) (handler func(c
 			return nil
 		}, opts
 	}
-	if handler := b.tcpHandlerForServe(dst.Port(), src); handler != nil {
+	if handler := b.tcpHandlerForServe(dst.Port(), src, nil); handler != nil {
 		return handler, opts
 	}
 	return nil, nil
@@ -4171,49 +4191,69 @@ func (b *LocalBackend) setServeProxyHandlersLocked() {
 	if !b.serveConfig.Valid() {
 		return
 	}
-	var backends map[string]bool
+	var handlers map[string]bool
+	var views map[ipn.HTTPHandlerView]bool
 	b.serveConfig.Web().Range(func(_ ipn.HostPort, conf ipn.WebServerConfigView) (cont bool) {
-		conf.Handlers().Range(func(_ string, h ipn.HTTPHandlerView) (cont bool) {
+		addProxy := func(h ipn.HTTPHandlerView) (key string) {
 			backend := h.Proxy()
-			if backend == "" {
-				// Only create proxy handlers for servers with a proxy backend.
-				return true
-			}
-			mak.Set(&backends, backend, true)
-			if _, ok := b.serveProxyHandlers.Load(backend); ok {
-				return true
+			key = proxyHandlerKey(h)
+			mak.Set(&handlers, key, true)
+			if _, ok := b.serveProxyHandlers.Load(key); ok {
+				return key
 			}
 
 			b.logf("serve: creating a new proxy handler for %s", backend)
-			p, err := b.proxyHandlerForBackend(backend)
+			p, err := b.proxyHandlerForBackend(h)
 			if err != nil {
 				// The backend endpoint (h.Proxy) should have been validated by expandProxyTarget
 				// in the CLI, so just log the error here.
 				b.logf("[unexpected] could not create proxy for %v: %s", backend, err)
+				return key
+			}
+			b.serveProxyHandlers.Store(key, p)
+			return key
+		}
+		addProxyHandler := func(_ string, h ipn.HTTPHandlerView) (cont bool) {
+			if h.Proxy() == "" {
+				// Only create proxy handlers for servers with a proxy backend.
 				return true
 			}
-			b.serveProxyHandlers.Store(backend, p)
+			var keys serveProxyKeys
+			keys.a = addProxy(h)
+			if h.ABTestBackend() != "" {
+				keys.b = addProxy(abTestHandlerB(h))
+			}
+			mak.Set(&views, h, true)
+			b.serveProxyKeys.Store(h, keys)
 			return true
-		})
+		}
+		conf.Handlers().Range(addProxyHandler)
+		conf.MethodHandlers().Range(addProxyHandler)
 		return true
 	})
 
 	// Clean up handlers for proxy backends that are no longer present
 	// in configuration.
 	b.serveProxyHandlers.Range(func(key, value any) bool {
-		backend := key.(string)
-		if !backends[backend] {
-			b.logf("serve: closing idle connections to %s", backend)
-			value.(*httputil.ReverseProxy).Transport.(*http.Transport).CloseIdleConnections()
-			b.serveProxyHandlers.Delete(backend)
+		if !handlers[key.(string)] {
+			p := value.(*reverseProxy)
+			b.logf("serve: closing idle connections to %s", p.h.Proxy())
+			p.close()
+			b.serveProxyHandlers.Delete(key)
+		}
+		return true
+	})
+	b.serveProxyKeys.Range(func(h, _ any) bool {
+		if !views[h.(ipn.HTTPHandlerView)] {
+			b.serveProxyKeys.Delete(h)
 		}
 		return true
 	})
 }
 
-// operatorUserName returns the current pref's OperatorUser's name, or the
+// OperatorUserName returns the current pref's OperatorUser's name, or the
 // empty string if none.
-func (b *LocalBackend) operatorUserName() string {
+func (b *LocalBackend) OperatorUserName() string {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	prefs := b.pm.CurrentPrefs()
@@ -4226,7 +4266,7 @@ func (b *LocalBackend) operatorUserName() string {
 // OperatorUserID returns the current pref's OperatorUser's ID (in
 // os/user.User.Uid string form), or the empty string if none.
 func (b *LocalBackend) OperatorUserID() string {
-	opUserName := b.operatorUserName()
+	opUserName := b.OperatorUserName()
 	if opUserName == "" {
 		return ""
 	}
@@ -4,8 +4,12 @@
 package ipnlocal
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -21,15 +25,21 @@
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
+	"golang.org/x/net/http/httpguts"
 	"tailscale.com/ipn"
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/netutil"
+	"tailscale.com/net/proxyproto"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/views"
+	"tailscale.com/util/clientmetric"
 	"tailscale.com/util/mak"
 	"tailscale.com/version"
 )
@@ -37,9 +47,22 @@
 // serveHTTPContextKey is the context.Value key for a *serveHTTPContext.
 type serveHTTPContextKey struct{}
 
+// serveRequestPathKey is the request context key for the URL path of a
+// proxied request as the client sent it, before the mount point is
+// trimmed.
+type serveRequestPathKey struct{}
+
 type serveHTTPContext struct {
 	SrcAddr  netip.AddrPort
 	DestPort uint16
+	Funnel   *funnelFlow // nil if the request isn't from Funnel
+}
+
+// funnelFlow is the state of a connection that came in over Funnel.
+type funnelFlow struct {
+	// IngressPeer is the Funnel ingress node that relayed the
+	// connection.
+	IngressPeer tailcfg.NodeView
 }
 
 // serveListener is the state of host-level net.Listen for a specific (Tailscale IP, serve port)
@@ -163,7 +186,7 @@ func (s *serveListener) handleServeListenersAccept(ln net.Listener) error {
 			return err
 		}
 		srcAddr := conn.RemoteAddr().(*net.TCPAddr).AddrPort()
-		handler := s.b.tcpHandlerForServe(s.ap.Port(), srcAddr)
+		handler := s.b.tcpHandlerForServe(s.ap.Port(), srcAddr, nil)
 		if handler == nil {
 			s.b.logf("serve RST for %v", srcAddr)
 			conn.Close()
@@ -215,12 +238,61 @@ func (b *LocalBackend) updateServeTCPPortNetMapAddrListenersLocked(ports []uint1
 }
 
 // SetServeConfig establishes or replaces the current serve config.
-func (b *LocalBackend) SetServeConfig(config *ipn.ServeConfig) error {
+//
+// If ifMatch is non-empty, it's the value of an If-Match header, and
+// the config is only replaced if it matches the current config's ETag.
+func (b *LocalBackend) SetServeConfig(config *ipn.ServeConfig, ifMatch string) error {
+	return b.SetServeConfigForClient(config, ifMatch, true)
+}
+
+// SetServeConfigForClient is SetServeConfig for a LocalAPI client. Unless
+// mayReadFiles, as when the client isn't root, config may only name
+// files for tailscaled to read in handlers already in the serve config,
+// per ipn.CheckServeConfigFiles.
+func (b *LocalBackend) SetServeConfigForClient(config *ipn.ServeConfig, ifMatch string, mayReadFiles bool) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	if !mayReadFiles {
+		if err := ipn.CheckServeConfigFiles(config, b.serveConfig); err != nil {
+			return err
+		}
+	}
+	if ifMatch != "" && !etagMatches(ifMatch, ipn.ServeConfigETag(b.serveConfig)) {
+		return ErrETagMismatch
+	}
 	return b.setServeConfigLocked(config)
 }
 
+// etagMatches reports whether ifMatch, an If-Match header value of "*"
+// or a comma-separated list of entity tags (RFC 7232, section 3.1),
+// matches etag. If-Match uses the strong comparison, so weak ("W/")
+// tags never match.
+func etagMatches(ifMatch, etag string) bool {
+	if strings.TrimSpace(ifMatch) == "*" {
+		return true
+	}
+	// The tags are split on commas, which the ETags of serve configs
+	// never contain.
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if !strings.HasPrefix(tag, "W/") && tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrETagMismatch is returned by SetServeConfig when the serve config
+// has changed since the caller read it.
+var ErrETagMismatch = errors.New("etag mismatch")
+
+// ServeConfigWithETag returns the current serve config and its ETag.
+func (b *LocalBackend) ServeConfigWithETag() (ipn.ServeConfigView, string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.serveConfig, ipn.ServeConfigETag(b.serveConfig)
+}
+
 func (b *LocalBackend) setServeConfigLocked(config *ipn.ServeConfig) error {
 	prefs := b.pm.CurrentPrefs()
 	if config.IsFunnelOn() && prefs.ShieldsUp() {
@@ -253,6 +325,69 @@ func (b *LocalBackend) setServeConfigLocked(config *ipn.ServeConfig) error {
 	return nil
 }
 
+// serveStream is a foreground serve stream whose config is merged into
+// the serve config.
+type serveStream struct {
+	req ipn.ServeStreamRequest
+	// base is the serve config from before the stream started, less
+	// what the streams running then needed: that is, what was set up
+	// by other means, which outlives the streams.
+	base *ipn.ServeConfig
+}
+
+// mergeServeStream merges the config of req, the request of the stream
+// sessionID, into the current serve config and records the stream as
+// running. It returns an error without changing anything if the two
+// conflict.
+func (b *LocalBackend) mergeServeStream(sessionID string, req ipn.ServeStreamRequest) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	merged, err := b.serveConfig.AsStruct().Merge(req.ServeConfig())
+	if err != nil {
+		return err
+	}
+	base, _ := b.serveConfig.AsStruct().Merge(nil)
+	for _, s := range b.serveStreams {
+		port, _ := s.req.HostPort.Port()
+		deleteHandler(base, s.req, port, new(ipn.ServeConfig))
+	}
+	if err := b.setServeConfigLocked(merged); err != nil {
+		return err
+	}
+	mak.Set(&b.serveStreams, sessionID, serveStream{req: req, base: base})
+	return nil
+}
+
+// unmergeServeStream removes from the serve config what the stream
+// sessionID merged into it, except for what was set up by other means
+// or what another stream still running needs.
+func (b *LocalBackend) unmergeServeStream(sessionID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stream, ok := b.serveStreams[sessionID]
+	if !ok {
+		return nil
+	}
+	delete(b.serveStreams, sessionID)
+	sc := b.serveConfig.AsStruct()
+	if sc == nil {
+		return nil
+	}
+	keep, _ := stream.base.Merge(nil)
+	for _, s := range b.serveStreams {
+		// The configs were all merged together, so they only conflict
+		// if the serve config was replaced since; keep what's left.
+		for _, c := range []*ipn.ServeConfig{s.base, s.req.ServeConfig()} {
+			if k, err := keep.Merge(c); err == nil {
+				keep = k
+			}
+		}
+	}
+	port, _ := stream.req.HostPort.Port()
+	deleteHandler(sc, stream.req, port, keep)
+	return b.setServeConfigLocked(sc)
+}
+
 // ServeConfig provides a view of the current serve mappings.
 // If serving is not configured, the returned view is not Valid.
 func (b *LocalBackend) ServeConfig() ipn.ServeConfigView {
@@ -283,6 +418,18 @@ func (b *LocalBackend) DeleteForegroundSession(sessionID string) error {
 // then turns it back off once the context is closed. If either are already enabled,
 // then they remain that way but logs are still streamed
 func (b *LocalBackend) StreamServe(ctx context.Context, w io.Writer, req ipn.ServeStreamRequest) (err error) {
+	return b.StreamServeForClient(ctx, w, req, true)
+}
+
+// StreamServeForClient is StreamServe for a LocalAPI client. Unless
+// mayReadFiles, as when the client isn't root, req's Handler may not
+// name files for tailscaled to read.
+func (b *LocalBackend) StreamServeForClient(ctx context.Context, w io.Writer, req ipn.ServeStreamRequest, mayReadFiles bool) (err error) {
+	if h := req.Handler; !mayReadFiles && h != nil {
+		if fields := h.FileFields(); len(fields) > 0 {
+			return fmt.Errorf("%s: %w", strings.Join(fields, ", "), ipn.ErrServeFilesDenied)
+		}
+	}
 	f, ok := w.(http.Flusher)
 	if !ok {
 		return errors.New("writer not a flusher")
@@ -293,21 +440,21 @@ func (b *LocalBackend) StreamServe(ctx context.Context, w io.Writer, req ipn.Ser
 	if err != nil {
 		return err
 	}
-
-	// Turn on Funnel for the given HostPort.
-	sc := b.ServeConfig().AsStruct()
-	if sc == nil {
-		sc = &ipn.ServeConfig{}
+	if req.SessionLabel != "" {
+		if err := ipn.CheckSessionLabel(req.SessionLabel); err != nil {
+			return err
+		}
 	}
-	setHandler(sc, req)
-	if err := b.SetServeConfig(sc); err != nil {
+
+	// Turn on Funnel for the given HostPort, merging with the current
+	// config so that handlers set up by other processes are kept.
+	sessionID := uuid.New()
+	if err := b.mergeServeStream(sessionID.String(), req); err != nil {
 		return fmt.Errorf("errro setting serve config: %w", err)
 	}
 	// Defer turning off Funnel once stream ends.
 	defer func() {
-		sc := b.ServeConfig().AsStruct()
-		deleteHandler(sc, req, port)
-		err = errors.Join(err, b.SetServeConfig(sc))
+		err = errors.Join(err, b.unmergeServeStream(sessionID.String()))
 	}()
 
 	var writeErrs []error
@@ -330,17 +477,42 @@ func (b *LocalBackend) StreamServe(ctx context.Context, w io.Writer, req ipn.Ser
 	if b.serveStreamers[port] == nil {
 		b.serveStreamers[port] = make(map[uint32]func(ipn.FunnelRequestLog))
 	}
-	id := uuid.New().ID()
+	id := sessionID.ID()
 	b.serveStreamers[port][id] = writeToStream
+	if req.Funnel {
+		mak.Set(&b.funnelSessions, port, sessionID.String())
+		if req.SessionLabel != "" {
+			mak.Set(&b.funnelSessionLabels, port, req.SessionLabel)
+		} else {
+			delete(b.funnelSessionLabels, port)
+		}
+	}
 	b.mu.Unlock()
 
 	// Clean up streamer when done.
 	defer func() {
 		b.mu.Lock()
 		delete(b.serveStreamers[port], id)
+		if b.funnelSessions[port] == sessionID.String() {
+			delete(b.funnelSessions, port)
+			delete(b.funnelSessionLabels, port)
+		}
 		b.mu.Unlock()
 	}()
 
+	if req.Funnel {
+		// Let the foreground process know that the config
+		// has been applied and Funnel traffic is flowing.
+		b.send(ipn.Notify{FunnelStarted: &ipn.FunnelStartedEvent{
+			HostPort:  req.HostPort,
+			SessionID: sessionID.String(),
+			Time:      b.clock.Now(),
+		}})
+	}
+	if req.Handler != nil && req.Handler.PreheatConnections > 0 && !req.TCP {
+		go b.preheatServeProxy(ctx, req, port)
+	}
+
 	select {
 	case <-ctx.Done():
 		// Triggered by foreground `tailscale funnel` process
@@ -350,65 +522,50 @@ func (b *LocalBackend) StreamServe(ctx context.Context, w io.Writer, req ipn.Ser
 	return errors.Join(writeErrs...)
 }
 
-func setHandler(sc *ipn.ServeConfig, req ipn.ServeStreamRequest) {
-	if sc.TCP == nil {
-		sc.TCP = make(map[uint16]*ipn.TCPPortHandler)
-	}
-	if _, ok := sc.TCP[443]; !ok {
-		sc.TCP[443] = &ipn.TCPPortHandler{
-			HTTPS: true,
+// deleteHandler removes from sc the handler of req, the request of a
+// stream on port, along with the TCP port and Funnel settings it needed,
+// except for those keep has too.
+func deleteHandler(sc *ipn.ServeConfig, req ipn.ServeStreamRequest, port uint16, keep *ipn.ServeConfig) {
+	if req.Funnel && sc.AllowFunnel[req.HostPort] {
+		switch {
+		case !keep.AllowFunnel[req.HostPort]:
+			delete(sc.AllowFunnel, req.HostPort)
+			delete(sc.FunnelPaths, req.HostPort)
+		case len(keep.FunnelPaths[req.HostPort]) > 0:
+			mak.Set(&sc.FunnelPaths, req.HostPort, slices.Clone(keep.FunnelPaths[req.HostPort]))
+		default:
+			delete(sc.FunnelPaths, req.HostPort)
 		}
 	}
-	if sc.Web == nil {
-		sc.Web = make(map[ipn.HostPort]*ipn.WebServerConfig)
-	}
-	wsc, ok := sc.Web[req.HostPort]
-	if !ok {
-		wsc = &ipn.WebServerConfig{}
-		sc.Web[req.HostPort] = wsc
-	}
-	if wsc.Handlers == nil {
-		wsc.Handlers = make(map[string]*ipn.HTTPHandler)
-	}
-	wsc.Handlers[req.MountPoint] = &ipn.HTTPHandler{
-		Proxy: req.Source,
-	}
-	if req.Funnel {
-		if sc.AllowFunnel == nil {
-			sc.AllowFunnel = make(map[ipn.HostPort]bool)
+	if !req.TCP && keep.GetWebHandler(req.HostPort, req.MountPoint) == nil {
+		if wsc := sc.Web[req.HostPort]; wsc != nil {
+			delete(wsc.Handlers, req.MountPoint)
+			if len(wsc.Handlers) == 0 && len(wsc.MethodHandlers) == 0 {
+				delete(sc.Web, req.HostPort)
+			}
 		}
-		sc.AllowFunnel[req.HostPort] = true
-	}
-}
-
-func deleteHandler(sc *ipn.ServeConfig, req ipn.ServeStreamRequest, port uint16) {
-	delete(sc.AllowFunnel, req.HostPort)
-	if sc.TCP != nil {
-		delete(sc.TCP, port)
-	}
-	if sc.Web == nil {
-		return
-	}
-	if sc.Web[req.HostPort] == nil {
-		return
-	}
-	wsc, ok := sc.Web[req.HostPort]
-	if !ok {
-		return
 	}
-	if wsc.Handlers == nil {
+	if _, ok := keep.TCP[port]; ok {
 		return
 	}
-	if _, ok := wsc.Handlers[req.MountPoint]; !ok {
-		return
-	}
-	delete(wsc.Handlers, req.MountPoint)
-	if len(wsc.Handlers) == 0 {
-		delete(sc.Web, req.HostPort)
+	if !req.TCP {
+		// Another HostPort, with another DNS name, may still be
+		// served on the port.
+		for hp := range sc.Web {
+			if p, err := hp.Port(); err == nil && p == port {
+				return
+			}
+		}
 	}
+	delete(sc.TCP, port)
 }
 
-func (b *LocalBackend) maybeLogServeConnection(destPort uint16, srcAddr netip.AddrPort) {
+// logServeEvent sends log, a FunnelRequestLog for a request or TCP
+// connection to destPort, to any foreground serve streams for destPort.
+// The caller sets the fields describing the request, such as SrcAddr,
+// and logServeEvent fills in the time and the client's identity. f is
+// non-nil if the request came in over Funnel.
+func (b *LocalBackend) logServeEvent(destPort uint16, f *funnelFlow, log ipn.FunnelRequestLog) {
 	b.mu.Lock()
 	streamers := b.serveStreamers[destPort]
 	b.mu.Unlock()
@@ -416,11 +573,15 @@ func (b *LocalBackend) maybeLogServeConnection(destPort uint16, srcAddr netip.Ad
 		return
 	}
 
-	var log ipn.FunnelRequestLog
-	log.SrcAddr = srcAddr
 	log.Time = b.clock.Now()
+	if log.ClientTLSVersion == "" && log.UpstreamConn == nil && log.Preheat == nil {
+		log.ClientTLSVersion, log.ClientCipherSuite = clientTLSInfo(nil)
+	}
+	if f != nil {
+		log.EdgeRegion = b.funnelEdgeRegion(f)
+	}
 
-	if node, user, ok := b.WhoIs(srcAddr); ok {
+	if node, user, ok := b.WhoIs(log.SrcAddr); ok {
 		log.NodeName = node.ComputedName()
 		if node.IsTagged() {
 			log.NodeTags = node.Tags().AsSlice()
@@ -435,6 +596,24 @@ func (b *LocalBackend) maybeLogServeConnection(destPort uint16, srcAddr netip.Ad
 	}
 }
 
+// clientTLSInfo returns the TLS version and cipher suite of cs, the
+// state of a client's TLS connection, as logged in FunnelRequestLog.
+// Either is "unknown" if cs is nil or doesn't have it.
+func clientTLSInfo(cs *tls.ConnectionState) (version, cipherSuite string) {
+	version, cipherSuite = "unknown", "unknown"
+	if cs == nil {
+		return
+	}
+	if cs.Version != 0 {
+		// Like "TLS1.3" rather than the "TLS 1.3" of tls.VersionName.
+		version = strings.ReplaceAll(tls.VersionName(cs.Version), " ", "")
+	}
+	if cs.CipherSuite != 0 {
+		cipherSuite = tls.CipherSuiteName(cs.CipherSuite)
+	}
+	return
+}
+
 func (b *LocalBackend) HandleIngressTCPConn(ingressPeer tailcfg.NodeView, target ipn.HostPort, srcAddr netip.AddrPort, getConnOrReset func() (net.Conn, bool), sendRST func()) {
 	b.mu.Lock()
 	sc := b.serveConfig
@@ -477,9 +656,7 @@ func (b *LocalBackend) HandleIngressTCPConn(ingressPeer tailcfg.NodeView, target
 			return
 		}
 	}
-	// TODO(bradfitz): pass ingressPeer etc in context to tcpHandlerForServe,
-	// extend serveHTTPContext or similar.
-	handler := b.tcpHandlerForServe(dport, srcAddr)
+	handler := b.tcpHandlerForServe(dport, srcAddr, &funnelFlow{IngressPeer: ingressPeer})
 	if handler == nil {
 		sendRST()
 		return
@@ -493,8 +670,8 @@ func (b *LocalBackend) HandleIngressTCPConn(ingressPeer tailcfg.NodeView, target
 }
 
 // tcpHandlerForServe returns a handler for a TCP connection to be served via
-// the ipn.ServeConfig.
-func (b *LocalBackend) tcpHandlerForServe(dport uint16, srcAddr netip.AddrPort) (handler func(net.Conn) error) {
+// the ipn.ServeConfig. f is non-nil if the connection came in over Funnel.
+func (b *LocalBackend) tcpHandlerForServe(dport uint16, srcAddr netip.AddrPort, f *funnelFlow) (handler func(net.Conn) error) {
 	b.mu.Lock()
 	sc := b.serveConfig
 	b.mu.Unlock()
@@ -517,6 +694,7 @@ func (b *LocalBackend) tcpHandlerForServe(dport uint16, srcAddr netip.AddrPort)
 				return context.WithValue(context.Background(), serveHTTPContextKey{}, &serveHTTPContext{
 					SrcAddr:  srcAddr,
 					DestPort: dport,
+					Funnel:   f,
 				})
 			},
 		}
@@ -537,7 +715,7 @@ func (b *LocalBackend) tcpHandlerForServe(dport uint16, srcAddr netip.AddrPort)
 	if backDst := tcph.TCPForward(); backDst != "" {
 		return func(conn net.Conn) error {
 			defer conn.Close()
-			b.maybeLogServeConnection(dport, srcAddr)
+			b.logServeEvent(dport, f, ipn.FunnelRequestLog{Kind: ipn.FunnelLogConnection, SrcAddr: srcAddr})
 			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 			backConn, err := b.dialer.SystemDial(ctx, "tcp", backDst)
 			cancel()
@@ -613,11 +791,34 @@ func (b *LocalBackend) getServeHandler(r *http.Request) (_ ipn.HTTPHandlerView,
 	if !ok {
 		return z, "", false
 	}
+	if sctx.Funnel != nil && !b.funnelPathAllowed(hostname, sctx.DestPort, r.URL.Path) {
+		return z, "", false
+	}
+
+	h, at, ok := mountedHandler(wsc, r.URL.Path)
+	// Handlers for a specific method are mounted at "/", so a narrower
+	// mount point still wins, and they win over a handler at "/".
+	if !ok || at == "/" {
+		if h, ok := wsc.MethodHandlers().GetOk(r.Method); ok {
+			return h, "/", true
+		}
+	}
+	if ok {
+		return h, at, true
+	}
+	if h, ok := wsc.MethodHandlers().GetOk("*"); ok {
+		return h, "/", true
+	}
+	return z, "", false
+}
 
-	if h, ok := wsc.Handlers().GetOk(r.URL.Path); ok {
-		return h, r.URL.Path, true
+// mountedHandler returns the handler in wsc.Handlers whose mount point
+// is the longest prefix of the path p, and that mount point.
+func mountedHandler(wsc ipn.WebServerConfigView, p string) (_ ipn.HTTPHandlerView, at string, ok bool) {
+	if h, ok := wsc.Handlers().GetOk(p); ok {
+		return h, p, true
 	}
-	pth := path.Clean(r.URL.Path)
+	pth := path.Clean(p)
 	for {
 		withSlash := pth + "/"
 		if h, ok := wsc.Handlers().GetOk(withSlash); ok {
@@ -627,53 +828,812 @@ func (b *LocalBackend) getServeHandler(r *http.Request) (_ ipn.HTTPHandlerView,
 			return h, pth, true
 		}
 		if pth == "/" {
-			return z, "", false
+			break
 		}
 		pth = path.Dir(pth)
 	}
+	return ipn.HTTPHandlerView{}, "", false
+}
+
+// proxyHandlerKey returns the key for h in b.serveProxyHandlers.
+// Handlers proxying to the same backend with the same settings
+// share a reverse proxy.
+func proxyHandlerKey(h ipn.HTTPHandlerView) string {
+	j, _ := json.Marshal(h)
+	return string(j)
+}
+
+// serveProxyKeys are the keys in b.serveProxyHandlers of the reverse
+// proxies of an HTTPHandler with a Proxy backend, worked out once per
+// serve config by setServeProxyHandlersLocked.
+type serveProxyKeys struct {
+	a string // for its Proxy
+	b string // for its ABTestBackend, if any
+}
+
+// serveProxy returns the reverse proxy for h, a handler with a Proxy
+// backend, to the backend with backendID: "B" for its ABTestBackend,
+// otherwise its Proxy.
+func (b *LocalBackend) serveProxy(h ipn.HTTPHandlerView, backendID string) (*reverseProxy, bool) {
+	var key string
+	if v, ok := b.serveProxyKeys.Load(h); ok {
+		key = v.(serveProxyKeys).a
+		if backendID == "B" {
+			key = v.(serveProxyKeys).b
+		}
+	} else if backendID == "B" {
+		// h isn't from the current serve config, as when that was
+		// replaced during the request.
+		key = proxyHandlerKey(abTestHandlerB(h))
+	} else {
+		key = proxyHandlerKey(h)
+	}
+	p, ok := b.serveProxyHandlers.Load(key)
+	if !ok {
+		return nil, false
+	}
+	return p.(*reverseProxy), true
+}
+
+// reverseProxy is the http.Handler for an HTTPHandler with a Proxy backend.
+type reverseProxy struct {
+	logf      logger.Logf
+	h         ipn.HTTPHandlerView
+	target    *url.URL
+	rp        *httputil.ReverseProxy
+	transport *http.Transport
+	cb        *circuitBreaker    // or nil if h has no circuit breaker
+	stats     *upstreamPoolStats // or nil if !h.CollectPoolStats
+	limiter   *pathRateLimiter   // or nil if h has no RateLimitFile
+	queue     *requestQueue      // or nil if h has no MaxConcurrentRequests
+	tokens    *oauth2TokenSource // or nil if h has no OIDCUpstreamAuth or OAuth2Config
+	inFlight  *atomic.Int64      // requests being proxied to target.Host
+
+	idempotency *idempotencyCache  // or nil if h has no IdempotencyCacheTTL
+	access      *oidcAccessControl // or nil if h has no OIDCAccessControl
+
+	// logEvent sends a FunnelRequestLog to foreground serve streams, as
+	// LocalBackend.logServeEvent does.
+	logEvent func(destPort uint16, f *funnelFlow, log ipn.FunnelRequestLog)
+}
+
+func (p *reverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.access != nil && !p.access.allow(w, r) {
+		return
+	}
+	if p.idempotency != nil && !isWebSocketUpgradeRequest(r) {
+		if key := r.Header.Get("Idempotency-Key"); key != "" {
+			p.idempotency.serveHTTP(w, r, key, http.HandlerFunc(p.serveHTTP))
+			return
+		}
+	}
+	p.serveHTTP(w, r)
+}
+
+// serveHTTP proxies r to the backend.
+func (p *reverseProxy) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	p.inFlight.Add(1)
+	defer p.inFlight.Add(-1)
+	tok, err := p.bearerToken()
+	if err != nil {
+		p.logf("serve: getting bearer token for %s: %v", p.h.Proxy(), err)
+		http.Error(w, "bearer token unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if f := p.h.RequestSigningSecretFile(); f != "" {
+		secret, err := readBearerToken(f)
+		if err != nil {
+			p.logf("serve: reading request signing secret for %s: %v", p.h.Proxy(), err)
+			http.Error(w, "request signing secret unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		// Signed in Rewrite, once the request's URL is final.
+		r = r.WithContext(context.WithValue(r.Context(), requestSigningSecretKey{}, []byte(secret)))
+	}
+	var traceParent string
+	if p.h.PropagateTraceParent() {
+		traceParent = newTraceParent(r.Header.Get("Traceparent"))
+	}
+	if tok != "" || traceParent != "" {
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.Header = r.Header.Clone()
+		if tok != "" {
+			r2.Header.Set("Authorization", "Bearer "+tok)
+		}
+		if traceParent != "" {
+			r2.Header.Set("Traceparent", traceParent)
+		}
+		r = r2
+	}
+	if p.cb != nil && !p.cb.allow() {
+		http.Error(w, "backend unavailable (circuit open)", http.StatusServiceUnavailable)
+		return
+	}
+	if p.queue != nil {
+		if !p.queue.acquire(r.Context()) {
+			http.Error(w, "backend busy", http.StatusServiceUnavailable)
+			return
+		}
+		defer p.queue.release()
+	}
+	if p.stats != nil {
+		var done func()
+		r, done = p.stats.trace(r)
+		defer done()
+	}
+	if p.h.ConnectionEvents() || p.h.ConnectionStates() {
+		r = countConnRequests(r)
+	}
+	if p.h.TraceRequests() {
+		var done func() *ipn.RequestTraceLog
+		r, done = traceRequest(r)
+		defer func() {
+			tl := done()
+			tl.TraceParent = traceParent
+			p.logRequestTrace(r, tl)
+		}()
+	}
+	if d := p.h.SlowRequestThreshold(); d > 0 {
+		var latency func() time.Duration
+		r, latency = traceUpstreamLatency(r)
+		defer func() {
+			if l := latency(); l > d {
+				p.logSlowRequest(r, l)
+			}
+		}()
+	}
+	p.rp.ServeHTTP(w, r)
+}
+
+// requestSigningSecretKey is the context key of the secret to sign a
+// request to a Proxy backend with, for HTTPHandler.RequestSigningSecretFile.
+type requestSigningSecretKey struct{}
+
+// bearerToken returns the token to send to the backend in an
+// Authorization header, or the empty string if there's none.
+func (p *reverseProxy) bearerToken() (string, error) {
+	if f := p.h.BearerTokenFile(); f != "" {
+		return readBearerToken(f)
+	}
+	if p.tokens != nil {
+		return p.tokens.token()
+	}
+	return "", nil
+}
+
+// close closes any idle connections to the backend, and stops reloading
+// its rate limits.
+func (p *reverseProxy) close() {
+	p.transport.CloseIdleConnections()
+	if p.limiter != nil {
+		p.limiter.close()
+	}
+}
+
+// proxiesForBackend returns the serve reverse proxies to the backend at
+// hostPort, which may be given in any form accepted as a Proxy backend
+// (such as "3000" or "localhost:3000").
+func (b *LocalBackend) proxiesForBackend(hostPort string) ([]*reverseProxy, error) {
+	target, _ := expandProxyArg(hostPort)
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend %q: %w", hostPort, err)
+	}
+	var ret []*reverseProxy
+	b.serveProxyHandlers.Range(func(_, value any) bool {
+		if p := value.(*reverseProxy); p.target.Host == u.Host {
+			ret = append(ret, p)
+		}
+		return true
+	})
+	return ret, nil
+}
+
+// proxyProtocolDial returns a dial func that writes a PROXY protocol
+// header of the given version ("v1" or "v2") to each connection made by
+// dial, with the address of the client whose request it's for.
+func proxyProtocolDial(dial func(ctx context.Context, network, addr string) (net.Conn, error), version string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	v := 1
+	if version == "v2" {
+		v = 2
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		sctx, ok := ctx.Value(serveHTTPContextKey{}).(*serveHTTPContext)
+		if !ok {
+			return nil, errors.New("no client address for PROXY protocol header")
+		}
+		dst := netip.IPv6Unspecified()
+		if sctx.SrcAddr.Addr().Unmap().Is4() {
+			dst = netip.IPv4Unspecified()
+		}
+		hdr, err := proxyproto.Header{
+			Version: v,
+			Src:     sctx.SrcAddr,
+			Dst:     netip.AddrPortFrom(dst, sctx.DestPort),
+		}.Format()
+		if err != nil {
+			return nil, err
+		}
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := c.Write(hdr); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("writing PROXY protocol header: %w", err)
+		}
+		return c, nil
+	}
+}
+
+// serveInFlightCounter returns the count of requests being proxied to the
+// backend at hostPort. It's shared by all proxies to the backend, and
+// outlives them so that requests can be counted until they finish after
+// the backend is removed from the serve config.
+func (b *LocalBackend) serveInFlightCounter(hostPort string) *atomic.Int64 {
+	v, _ := b.serveInFlight.LoadOrStore(hostPort, new(atomic.Int64))
+	return v.(*atomic.Int64)
+}
+
+// ServeRequestsInFlight returns the number of requests being proxied to
+// the serve Proxy backend at hostPort, which may be given in any form
+// accepted as a Proxy backend (such as "3000" or "localhost:3000").
+func (b *LocalBackend) ServeRequestsInFlight(hostPort string) (int64, error) {
+	target, _ := expandProxyArg(hostPort)
+	u, err := url.Parse(target)
+	if err != nil {
+		return 0, fmt.Errorf("invalid backend %q: %w", hostPort, err)
+	}
+	if v, ok := b.serveInFlight.Load(u.Host); ok {
+		return v.(*atomic.Int64).Load(), nil
+	}
+	return 0, nil
+}
+
+// readBearerToken returns the token stored in file, without surrounding
+// whitespace.
+func readBearerToken(file string) (string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	tok := strings.TrimSpace(string(b))
+	if tok == "" {
+		return "", fmt.Errorf("%s is empty", file)
+	}
+	return tok, nil
+}
+
+// keepAliveDisabled reports whether backend, the URL of h's Proxy
+// backend, starts with one of h's NoKeepaliveBackends.
+func keepAliveDisabled(h ipn.HTTPHandlerView, backend string) bool {
+	return h.NoKeepaliveBackends().ContainsFunc(func(p string) bool {
+		return strings.HasPrefix(backend, p)
+	})
 }
 
 // proxyHandlerForBackend creates a new HTTP reverse proxy for a particular backend that
-// we serve requests for. `backend` is a HTTPHandler.Proxy string (url, hostport or just port).
-func (b *LocalBackend) proxyHandlerForBackend(backend string) (*httputil.ReverseProxy, error) {
-	targetURL, insecure := expandProxyArg(backend)
+// we serve requests for. The backend is h.Proxy (url, hostport or just port).
+func (b *LocalBackend) proxyHandlerForBackend(h ipn.HTTPHandlerView) (*reverseProxy, error) {
+	targetURL, insecure := expandProxyArg(h.Proxy())
 	u, err := url.Parse(targetURL)
 	if err != nil {
 		return nil, fmt.Errorf("invalid url %s: %w", targetURL, err)
 	}
+	tlsConf, err := upstreamTLSConfig(h, insecure)
+	if err != nil {
+		return nil, err
+	}
+	baseDial := b.dialer.SystemDial
+	if ip, err := netip.ParseAddr(u.Hostname()); err == nil && tsaddr.IsTailscaleIP(ip) {
+		// The backend is another node in the tailnet, reached over
+		// Tailscale rather than the system's network.
+		baseDial = b.dialer.UserDial
+	}
+	if h.UpstreamKeepAliveProbe() {
+		baseDial = keepAliveDial(baseDial)
+	}
+	if h.UpstreamTCPNoDelay() {
+		baseDial = noDelayDial(baseDial)
+	}
+	dial := baseDial
+	if d := h.UpstreamReadTimeout(); d > 0 {
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c, err := baseDial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &readTimeoutConn{Conn: c, timeout: d}, nil
+		}
+	}
+	if v := h.UpstreamProxyProtocol(); v != "" {
+		dial = proxyProtocolDial(dial, v)
+	}
+	var stats *upstreamPoolStats
+	if h.CollectPoolStats() {
+		stats = new(upstreamPoolStats)
+		dial = stats.wrapDial(dial)
+	}
+	tr := &http.Transport{
+		DialContext:       dial,
+		TLSClientConfig:   tlsConf,
+		ForceAttemptHTTP2: !h.ForceHTTP1(),
+		DisableKeepAlives: h.UpstreamProxyProtocol() != "" || keepAliveDisabled(h, targetURL),
+		// Values for the following parameters have been copied from http.DefaultTransport.
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if n := h.PreheatConnections(); n > http.DefaultMaxIdleConnsPerHost {
+		// Keep the connections opened by preheatServeProxy.
+		tr.MaxIdleConnsPerHost = n
+	}
 	rp := &httputil.ReverseProxy{
 		Rewrite: func(r *httputil.ProxyRequest) {
 			r.SetURL(u)
 			r.Out.Host = r.In.Host
-			addProxyForwardedHeaders(r)
+			passThroughHeaders(r, h.PassThroughHeaders())
+			stripHeaders(r, h.StripRequestHeaders())
+			addProxyForwardedHeaders(r, h.ForwardedHeaders(), h.KeepForwardedHeaders())
 			b.addTailscaleIdentityHeaders(r)
+			r.Out.Header.Del("X-Tailscale-Session")
+			r.Out.Header.Del("X-Tailscale-Session-Label")
+			r.Out.Header.Del("X-Tailscale-Edge-Region")
+			if !h.NoSessionHeaders() {
+				b.addFunnelSessionHeaders(r)
+			}
+			if ua := h.UpstreamUserAgent(); ua != "" {
+				r.Out.Header.Set("User-Agent", ua)
+			}
+			r.Out.Header.Del(ipn.RequestSignatureHeader)
+			if secret, ok := r.In.Context().Value(requestSigningSecretKey{}).([]byte); ok {
+				r.Out.Header.Set(ipn.RequestSignatureHeader, ipn.RequestSignature(secret, r.Out.Method, r.Out.URL.RequestURI(), b.clock.Now()))
+			}
 		},
-		Transport: &http.Transport{
-			DialContext: b.dialer.SystemDial,
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: insecure,
-			},
-			// Values for the following parameters have been copied from http.DefaultTransport.
-			ForceAttemptHTTP2:     true,
-			MaxIdleConns:          100,
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-		},
+		Transport:     tr,
+		FlushInterval: h.UpstreamFlushInterval(),
+	}
+	p := &reverseProxy{
+		logf:      b.logf,
+		h:         h,
+		target:    u,
+		rp:        rp,
+		transport: tr,
+		cb:        newCircuitBreaker(h, b.clock),
+		stats:     stats,
+		inFlight:  b.serveInFlightCounter(u.Host),
+		logEvent:  b.logServeEvent,
+	}
+	if h.ConnectionEvents() || h.ConnectionStates() {
+		tr.DialContext = p.connEventsDial(tr.DialContext)
+	}
+	if h.UpstreamHonorRetryAfter() {
+		maxWait := h.UpstreamMaxRetryAfter()
+		if maxWait == 0 {
+			maxWait = ipn.DefaultUpstreamMaxRetryAfter
+		}
+		rp.Transport = &retryAfterTransport{
+			rt:      tr,
+			max:     maxWait,
+			clock:   b.clock,
+			logf:    b.logf,
+			backend: h.Proxy(),
+		}
+	}
+	if f := h.RateLimitFile(); f != "" {
+		p.limiter = newPathRateLimiter(f, b.logf)
+	}
+	if n := h.MaxConcurrentRequests(); n > 0 {
+		p.queue = newRequestQueue(n, h.MaxQueueWait())
+	}
+	if ttl := h.IdempotencyCacheTTL(); ttl > 0 {
+		p.idempotency = newIdempotencyCache(ttl, b.clock)
+	}
+	if a := h.OIDCAccessControl(); a != nil {
+		p.access = newOIDCAccessControl(*a, b.clock, b.logf)
+	}
+	if a := h.OIDCUpstreamAuth(); a != nil {
+		p.tokens = newOIDCTokenSource(*a)
+	} else if c := h.OAuth2Config(); c.Valid() {
+		p.tokens = newOAuth2TokenSource(c)
+	}
+	rp.ModifyResponse = func(res *http.Response) error {
+		if cb := p.cb; cb != nil {
+			if res.StatusCode >= 500 {
+				cb.failure()
+			} else {
+				cb.success()
+			}
+		}
+		if h.NoSniff() {
+			// Already set by serveWebHandler.
+			res.Header.Del("X-Content-Type-Options")
+		}
+		if h.PropagateRequestID() {
+			// Already set by serveWebHandler, to the ID the backend
+			// got, whatever it sends back.
+			res.Header.Del("X-Request-ID")
+		}
+		if v := h.CacheControlOverride(); v != "" {
+			res.Header.Set("Cache-Control", v)
+		}
+		if h.StripPragma() {
+			res.Header.Del("Pragma")
+		}
+		if isWebSocketUpgrade(res) {
+			b.trackWebSocket(res)
+			return nil
+		}
+		if d := h.UpstreamStallTimeout(); d > 0 {
+			res.Body = newStallTimeoutBody(res.Body, d, func(n int64) {
+				b.logf("serve: upstream %s stalled after %d bytes", h.Proxy(), n)
+			})
+		}
+		if limit := h.MaxResponseBytes(); limit > 0 {
+			if res.ContentLength > limit {
+				b.logf("serve: upstream %s response exceeded size limit: Content-Length %d > %d", h.Proxy(), res.ContentLength, limit)
+				return errResponseTooLarge
+			}
+			res.Body = newMaxSizeBody(res.Body, limit, func() {
+				b.logf("serve: upstream %s response exceeded size limit of %d bytes", h.Proxy(), limit)
+			})
+		}
+		if h.CompressionOffload() {
+			offloadCompression(res)
+		}
+		p.countResponseBody(res)
+		return nil
+	}
+	if p.cb != nil || h.ClassifyUpstreamErrors() {
+		rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			if cb := p.cb; cb != nil {
+				if r.Context().Err() != nil {
+					cb.abandon()
+				} else {
+					cb.failure()
+				}
+			}
+			b.logf("serve: proxy error for %s: %v", h.Proxy(), err)
+			if h.ClassifyUpstreamErrors() && r.Context().Err() == nil {
+				if class := classifyUpstreamError(err); class != "" {
+					p.logUpstreamError(r, class)
+				}
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}
+	return p, nil
+}
+
+// errResponseTooLarge is the error for a backend's response body that's
+// larger than its handler's MaxResponseBytes.
+var errResponseTooLarge = errors.New("upstream response exceeded size limit")
+
+// maxSizeBody is a backend's response body whose reads fail once more
+// than limit bytes have been read, for MaxResponseBytes. Like an
+// io.LimitReader of limit+1 bytes, it reads one byte past the limit to
+// tell a body of exactly limit bytes from a larger one.
+type maxSizeBody struct {
+	io.ReadCloser
+	remaining int64  // bytes that may still be read
+	exceeded  func() // called when the limit is exceeded
+}
+
+func newMaxSizeBody(rc io.ReadCloser, limit int64, exceeded func()) *maxSizeBody {
+	return &maxSizeBody{ReadCloser: rc, remaining: limit, exceeded: exceeded}
+}
+
+func (mb *maxSizeBody) Read(p []byte) (int, error) {
+	if mb.remaining < 0 {
+		return 0, errResponseTooLarge
+	}
+	if int64(len(p)) > mb.remaining+1 {
+		p = p[:mb.remaining+1]
+	}
+	n, err := mb.ReadCloser.Read(p)
+	if int64(n) > mb.remaining {
+		n = int(mb.remaining)
+		mb.remaining = -1
+		mb.exceeded()
+		return n, errResponseTooLarge
+	}
+	mb.remaining -= int64(n)
+	return n, err
+}
+
+// readTimeoutConn is a net.Conn whose reads fail if no data arrives
+// within timeout. The deadline is only in effect during each Read.
+type readTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *readTimeoutConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	n, err := c.Conn.Read(p)
+	c.Conn.SetReadDeadline(time.Time{})
+	return n, err
+}
+
+// stallTimeoutBody is a backend's response body whose reads fail if no
+// data arrives within timeout, for UpstreamStallTimeout. As with
+// readTimeoutConn, the timer only runs during each Read, so that a slow
+// client doesn't count against the backend.
+type stallTimeoutBody struct {
+	rc      io.ReadCloser
+	timeout time.Duration
+	stalled func(n int64) // called with the bytes read before the stall
+	timer   *time.Timer   // closes rc when it fires
+
+	n         atomic.Int64 // bytes read
+	timedOut  atomic.Bool
+	closeOnce sync.Once
+}
+
+func newStallTimeoutBody(rc io.ReadCloser, timeout time.Duration, stalled func(n int64)) *stallTimeoutBody {
+	sb := &stallTimeoutBody{rc: rc, timeout: timeout, stalled: stalled}
+	sb.timer = time.AfterFunc(timeout, sb.stall)
+	sb.timer.Stop()
+	return sb
+}
+
+// stall closes the body to end a Read that's taken too long.
+func (sb *stallTimeoutBody) stall() {
+	sb.timedOut.Store(true)
+	sb.stalled(sb.n.Load())
+	sb.close()
+}
+
+func (sb *stallTimeoutBody) Read(p []byte) (int, error) {
+	if sb.timedOut.Load() {
+		return 0, sb.stallErr()
+	}
+	sb.timer.Reset(sb.timeout)
+	n, err := sb.rc.Read(p)
+	sb.timer.Stop()
+	sb.n.Add(int64(n))
+	if sb.timedOut.Load() {
+		return n, sb.stallErr()
+	}
+	return n, err
+}
+
+func (sb *stallTimeoutBody) stallErr() error {
+	return fmt.Errorf("upstream stalled for %v after %d bytes", sb.timeout, sb.n.Load())
+}
+
+func (sb *stallTimeoutBody) Close() error {
+	sb.timer.Stop()
+	return sb.close()
+}
+
+func (sb *stallTimeoutBody) close() (err error) {
+	sb.closeOnce.Do(func() { err = sb.rc.Close() })
+	return err
+}
+
+// Keep-alive settings for UpstreamKeepAliveProbe: a connection is probed
+// after keepAliveProbeInterval idle, and again at that interval, and is
+// closed after keepAliveProbeCount unanswered probes.
+const (
+	keepAliveProbeInterval = 15 * time.Second
+	keepAliveProbeCount    = 4
+)
+
+// setKeepAliveCount, if non-nil, sets the number of unanswered keep-alive
+// probes after which c is closed. It's set on platforms that support
+// TCP_KEEPCNT.
+var setKeepAliveCount func(c *net.TCPConn, n int) error
+
+// keepAliveDial returns a dial func that enables TCP keep-alive probes
+// on each connection made by dial, if it's a TCP connection, so that
+// idle connections to a backend that died silently are detected and
+// closed rather than reused.
+func keepAliveDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tc, ok := unwrapTCPConn(c)
+		if !ok {
+			// For example, a netstack connection to a Tailscale IP,
+			// which has no socket to set options on.
+			return c, nil
+		}
+		// SetKeepAlivePeriod sets both the idle time before the first
+		// probe and the interval between probes (TCP_KEEPIDLE and
+		// TCP_KEEPINTVL on Linux).
+		err = tc.SetKeepAlive(true)
+		if err == nil {
+			err = tc.SetKeepAlivePeriod(keepAliveProbeInterval)
+		}
+		if err == nil && setKeepAliveCount != nil {
+			err = setKeepAliveCount(tc, keepAliveProbeCount)
+		}
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("enabling keep-alive probes: %w", err)
+		}
+		return c, nil
+	}
+}
+
+// noDelayDial returns a dial func that disables Nagle's algorithm on
+// each connection made by dial, if it's a TCP connection, for
+// UpstreamTCPNoDelay.
+func noDelayDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tc, ok := unwrapTCPConn(c)
+		if !ok {
+			return c, nil
+		}
+		if err := tc.SetNoDelay(true); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("setting TCP_NODELAY: %w", err)
+		}
+		return c, nil
+	}
+}
+
+// unwrapTCPConn returns the *net.TCPConn underlying c, unwrapping it
+// through NetConn methods like that of tsdial's SystemDial conns.
+func unwrapTCPConn(c net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch cc := c.(type) {
+		case *net.TCPConn:
+			return cc, true
+		case interface{ NetConn() net.Conn }:
+			c = cc.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// upstreamTLSConfig returns the TLS config for connecting to the HTTPS
+// backend of h. If insecure, the backend's certificate is not verified.
+func upstreamTLSConfig(h ipn.HTTPHandlerView, insecure bool) (*tls.Config, error) {
+	minTLS, err := ipn.ParseTLSVersion(h.TLSMinVersion())
+	if err != nil {
+		return nil, err
+	}
+	reneg, err := ipn.ParseTLSRenegotiation(h.TLSRenegotiation())
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		InsecureSkipVerify: insecure,
+		MinVersion:         minTLS,
+		ServerName:         h.UpstreamTLSSNI(),
+		Renegotiation:      reneg,
+	}
+	if ca := h.UpstreamRootCA(); ca != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(ca)) {
+			return nil, errors.New("no valid certificates in UpstreamRootCA")
+		}
+		conf.RootCAs = pool
+	}
+	if fp := h.TLSCertFingerprint(); fp != "" {
+		want, err := hex.DecodeString(fp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLSCertFingerprint: %w", err)
+		}
+		// The pin replaces the usual verification, so that it can be
+		// used for self-signed certificates.
+		conf.InsecureSkipVerify = true
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("backend presented no certificate")
+			}
+			got := sha256.Sum256(cs.PeerCertificates[0].Raw)
+			if !bytes.Equal(got[:], want) {
+				return fmt.Errorf("backend certificate has fingerprint %x, not the pinned %x", got, want)
+			}
+			return nil
+		}
+	}
+	return conf, nil
+}
+
+// passThroughHeaders copies the headers named by keys from the client's
+// request to the request to the backend, replacing any changes made to
+// them by httputil.ReverseProxy.
+func passThroughHeaders(r *httputil.ProxyRequest, keys views.Slice[string]) {
+	for i := 0; i < keys.Len(); i++ {
+		k := http.CanonicalHeaderKey(keys.At(i))
+		if vv := r.In.Header.Values(k); len(vv) > 0 {
+			r.Out.Header[k] = slices.Clone(vv)
+		}
 	}
-	return rp, nil
 }
 
-func addProxyForwardedHeaders(r *httputil.ProxyRequest) {
-	r.Out.Header.Set("X-Forwarded-Host", r.In.Host)
+// stripHeaders removes the headers named by keys from the request to
+// the backend.
+func stripHeaders(r *httputil.ProxyRequest, keys views.Slice[string]) {
+	for i := 0; i < keys.Len(); i++ {
+		r.Out.Header.Del(keys.At(i))
+	}
+}
+
+// addProxyForwardedHeaders sets the headers of the request to the
+// backend that tell it about the client: the X-Forwarded-* and X-Real-IP
+// headers, the Forwarded header of RFC 7239, or both, as selected by
+// mode, an ipn.HTTPHandler.ForwardedHeaders. If keep, the values sent by
+// the client are kept, with the client's address appended to
+// X-Forwarded-For and Forwarded; otherwise they're replaced.
+func addProxyForwardedHeaders(r *httputil.ProxyRequest, mode string, keep bool) {
+	xff := mode == "" || mode == "xff" || mode == "both"
+	rfc7239 := mode == "rfc7239" || mode == "both"
+
+	// httputil.ReverseProxy removes the client's X-Forwarded-* and
+	// Forwarded headers from r.Out before calling Rewrite, but not
+	// X-Real-IP.
+	if !keep || !xff {
+		r.Out.Header.Del("X-Real-IP")
+	}
+	proto := "http"
 	if r.In.TLS != nil {
-		r.Out.Header.Set("X-Forwarded-Proto", "https")
+		proto = "https"
 	}
-	if c, ok := getServeHTTPContext(r.Out); ok {
-		r.Out.Header.Set("X-Forwarded-For", c.SrcAddr.Addr().String())
+	c, hasClient := getServeHTTPContext(r.Out)
+	if xff {
+		if xfh := r.In.Header.Get("X-Forwarded-Host"); keep && xfh != "" {
+			r.Out.Header.Set("X-Forwarded-Host", xfh)
+		} else {
+			r.Out.Header.Set("X-Forwarded-Host", r.In.Host)
+		}
+		if proto == "https" {
+			r.Out.Header.Set("X-Forwarded-Proto", "https")
+		}
+		if hasClient {
+			client := c.SrcAddr.Addr().String()
+			forwardedFor := client
+			if prior := r.In.Header.Values("X-Forwarded-For"); keep && len(prior) > 0 {
+				forwardedFor = strings.Join(prior, ", ") + ", " + client
+			}
+			r.Out.Header.Set("X-Forwarded-For", forwardedFor)
+			if r.Out.Header.Get("X-Real-IP") == "" {
+				r.Out.Header.Set("X-Real-IP", client)
+			}
+		}
 	}
+	if rfc7239 {
+		var elem strings.Builder
+		if hasClient {
+			node := c.SrcAddr.Addr().String()
+			if c.SrcAddr.Addr().Is6() {
+				node = "[" + node + "]"
+			}
+			fmt.Fprintf(&elem, "for=%s;", forwardedValue(node))
+		}
+		fmt.Fprintf(&elem, "proto=%s;host=%s", proto, forwardedValue(r.In.Host))
+		fwd := elem.String()
+		if prior := r.In.Header.Values("Forwarded"); keep && len(prior) > 0 {
+			fwd = strings.Join(prior, ", ") + ", " + fwd
+		}
+		r.Out.Header.Set("Forwarded", fwd)
+	}
+}
+
+// forwardedValue returns v as the value of a Forwarded header parameter:
+// as is if it's a token, or else as a quoted string.
+func forwardedValue(v string) string {
+	if v != "" && strings.IndexFunc(v, func(r rune) bool { return !httpguts.IsTokenRune(r) }) < 0 {
+		return v
+	}
+	return `"` + forwardedQuoter.Replace(v) + `"`
 }
 
+var forwardedQuoter = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
 func (b *LocalBackend) addTailscaleIdentityHeaders(r *httputil.ProxyRequest) {
 	// Clear any incoming values squatting in the headers.
 	r.Out.Header.Del("Tailscale-User-Login")
@@ -700,14 +1660,83 @@ func (b *LocalBackend) addTailscaleIdentityHeaders(r *httputil.ProxyRequest) {
 	r.Out.Header.Set("Tailscale-Headers-Info", "https://tailscale.com/s/serve-headers")
 }
 
+// addFunnelSessionHeaders sets the X-Tailscale-Session header of r to
+// the session ID of the foreground Funnel stream for its port, if any,
+// its X-Tailscale-Session-Label header to the session's label, if it
+// has one, and its X-Tailscale-Edge-Region header to the region of the Funnel
+// ingress node it came through, if it came in over Funnel.
+func (b *LocalBackend) addFunnelSessionHeaders(r *httputil.ProxyRequest) {
+	c, ok := getServeHTTPContext(r.Out)
+	if !ok {
+		return
+	}
+	b.mu.Lock()
+	session := b.funnelSessions[c.DestPort]
+	label := b.funnelSessionLabels[c.DestPort]
+	b.mu.Unlock()
+	if session != "" {
+		r.Out.Header.Set("X-Tailscale-Session", session)
+	}
+	if label != "" {
+		r.Out.Header.Set("X-Tailscale-Session-Label", label)
+	}
+	if c.Funnel != nil {
+		if region := b.funnelEdgeRegion(c.Funnel); region != "" {
+			r.Out.Header.Set("X-Tailscale-Edge-Region", region)
+		}
+	}
+}
+
+// funnelEdgeRegion returns the region code of the home DERP region of
+// f's ingress node, or "" if it isn't known.
+func (b *LocalBackend) funnelEdgeRegion(f *funnelFlow) string {
+	if !f.IngressPeer.Valid() {
+		return ""
+	}
+	id, ok := strings.CutPrefix(f.IngressPeer.DERP(), tailcfg.DerpMagicIP+":")
+	if !ok {
+		return ""
+	}
+	regionID, err := strconv.Atoi(id)
+	if err != nil {
+		return ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.netMap == nil || b.netMap.DERPMap == nil {
+		return ""
+	}
+	if r := b.netMap.DERPMap.Regions[regionID]; r != nil {
+		return r.RegionCode
+	}
+	return ""
+}
+
+// metricServeHTTPRequests counts the HTTP requests handled by serve,
+// whether or not they're sent to foreground serve streams.
+var metricServeHTTPRequests = clientmetric.NewCounter("serve_http_requests")
+
 func (b *LocalBackend) serveWebHandler(w http.ResponseWriter, r *http.Request) {
 	h, mountPoint, ok := b.getServeHandler(r)
 	if !ok {
 		http.NotFound(w, r)
 		return
 	}
+	metricServeHTTPRequests.Add(1)
+	if h.NoSniff() {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+	var backendID string
+	if h.ABTestBackend() != "" {
+		backendID = abTestChoose(w, r, h, mountPoint, b.clock.Now())
+	}
+	if h.PropagateRequestID() {
+		r = setRequestID(w, r)
+	}
 	if c, ok := getServeHTTPContext(r); ok {
-		b.maybeLogServeConnection(c.DestPort, c.SrcAddr)
+		log := ipn.FunnelRequestLog{Kind: ipn.FunnelLogRequest, SrcAddr: c.SrcAddr, Path: r.URL.Path, BackendID: backendID, RequestID: serveRequestID(r.Context())}
+		log.ClientTLSVersion, log.ClientCipherSuite = clientTLSInfo(r.TLS)
+		b.logServeEvent(c.DestPort, c.Funnel, log)
 	}
 	if s := h.Text(); s != "" {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
@@ -719,12 +1748,23 @@ func (b *LocalBackend) serveWebHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if v := h.Proxy(); v != "" {
-		p, ok := b.serveProxyHandlers.Load(v)
+		p, ok := b.serveProxy(h, backendID)
 		if !ok {
 			http.Error(w, "unknown proxy destination", http.StatusInternalServerError)
 			return
 		}
-		h := p.(http.Handler)
+		if rl := p.limiter; rl != nil && !rl.allow(r.URL.Path) {
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		if h.NoSniff() {
+			// A nil Content-Type stops net/http from sniffing one
+			// if the backend doesn't send it.
+			w.Header()["Content-Type"] = nil
+		}
+		h := http.Handler(p)
+		// For logs at the end of the request or WebSocket connection.
+		r = r.WithContext(context.WithValue(r.Context(), serveRequestPathKey{}, r.URL.Path))
 		// Trim the mount point from the URL path before proxying. (#6571)
 		if r.URL.Path != "/" {
 			h = http.StripPrefix(strings.TrimSuffix(mountPoint, "/"), h)
@@ -847,6 +1887,17 @@ func (b *LocalBackend) webServerConfig(hostname string, port uint16) (c ipn.WebS
 	return b.serveConfig.Web().GetOk(key)
 }
 
+// funnelPathAllowed reports whether the serve config allows Funnel
+// requests to urlPath on hostname:port, as limited by its FunnelPaths.
+func (b *LocalBackend) funnelPathAllowed(hostname string, port uint16, urlPath string) bool {
+	key := ipn.HostPort(fmt.Sprintf("%s:%v", hostname, port))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.serveConfig.Valid() && b.serveConfig.AllowsFunnelPath(key, urlPath)
+}
+
 func (b *LocalBackend) getTLSServeCertForPort(port uint16) func(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
 	return func(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
 		if hi == nil || hi.ServerName == "" {
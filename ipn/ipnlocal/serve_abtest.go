@@ -0,0 +1,80 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math/rand"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+// abTestCookieName is the cookie that keeps a client on one backend of
+// an HTTPHandler with an ABTestBackend and ABTestCookie.
+const abTestCookieName = "ts_ab_backend"
+
+// abTestHandlerB returns the handler for the B backend of h, which has
+// an ABTestBackend: h with that as its Proxy, and no A/B test. Its
+// reverse proxy is kept in LocalBackend.serveProxyHandlers alongside
+// h's.
+func abTestHandlerB(h ipn.HTTPHandlerView) ipn.HTTPHandlerView {
+	hb := h.AsStruct()
+	hb.Proxy = hb.ABTestBackend
+	hb.ABTestBackend = ""
+	hb.ABTestPercentage = 0
+	hb.ABTestCookie = false
+	return hb.View()
+}
+
+// abTestChoose returns which backend of h, which has an ABTestBackend,
+// serves r: "A" or "B", as logged in FunnelRequestLog.BackendID.
+//
+// With ABTestCookie, a client with a cookie from an earlier request
+// keeps its backend. Otherwise the choice is made at random and set in
+// a cookie for mountPoint. Without ABTestCookie, it's a hash of the
+// client's IP address and the day, per abTestBucket.
+func abTestChoose(w http.ResponseWriter, r *http.Request, h ipn.HTTPHandlerView, mountPoint string, now time.Time) string {
+	pct := h.ABTestPercentage()
+	if !h.ABTestCookie() {
+		var ip netip.Addr
+		if c, ok := getServeHTTPContext(r); ok {
+			ip = c.SrcAddr.Addr()
+		}
+		return abTestBucket(ip, now, pct)
+	}
+	if c, err := r.Cookie(abTestCookieName); err == nil && (c.Value == "A" || c.Value == "B") {
+		// Unless the test has been wound down to one backend.
+		if 0 < pct && pct < 100 {
+			return c.Value
+		}
+	}
+	id := "A"
+	if rand.Intn(100) < pct {
+		id = "B"
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     abTestCookieName,
+		Value:    id,
+		Path:     mountPoint,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id
+}
+
+// abTestBucket returns "B" for pct percent of client IP addresses, and
+// "A" for the rest. The same address gets the same backend all day
+// (UTC), and the clients are shuffled anew each day.
+func abTestBucket(ip netip.Addr, now time.Time, pct int) string {
+	sum := sha256.Sum256([]byte(now.UTC().Format("2006-01-02") + "|" + ip.String()))
+	if binary.BigEndian.Uint64(sum[:8])%100 < uint64(pct) {
+		return "B"
+	}
+	return "A"
+}
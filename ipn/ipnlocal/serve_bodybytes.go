@@ -0,0 +1,76 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"io"
+	"net/http"
+	"sync"
+
+	"tailscale.com/ipn"
+	"tailscale.com/util/clientmetric"
+)
+
+// metricServeResponseBodyBytes counts the bytes of Proxy backends'
+// response bodies sent to clients.
+var metricServeResponseBodyBytes = clientmetric.NewCounter("serve_response_body_bytes")
+
+// countingBody is a response body that counts the bytes read from it,
+// and calls done with the count once it's closed.
+type countingBody struct {
+	io.ReadCloser
+	n    int64
+	once sync.Once
+	done func(n int64)
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.done(b.n) })
+	return err
+}
+
+// countResponseBody wraps the body of res, a response from p's backend,
+// to count the bytes sent to the client, in metricServeResponseBodyBytes
+// and, with HTTPHandler.LogResponseBodyBytes, in a FunnelRequestLog at
+// the end of the request.
+func (p *reverseProxy) countResponseBody(res *http.Response) {
+	r := res.Request
+	logBytes := p.h.LogResponseBodyBytes()
+	res.Body = &countingBody{
+		ReadCloser: res.Body,
+		done: func(n int64) {
+			metricServeResponseBodyBytes.Add(n)
+			if logBytes {
+				p.logResponseBodyBytes(r, n)
+			}
+		},
+	}
+}
+
+// logResponseBodyBytes sends a FunnelRequestLog with the number of
+// bytes, n, of the response body sent to the client for r to foreground
+// serve streams. Empty bodies aren't logged.
+func (p *reverseProxy) logResponseBodyBytes(r *http.Request, n int64) {
+	sctx, ok := getServeHTTPContext(r)
+	if !ok || n == 0 {
+		return
+	}
+	path, _ := r.Context().Value(serveRequestPathKey{}).(string)
+	log := ipn.FunnelRequestLog{
+		Kind:              ipn.FunnelLogResponseBodyBytes,
+		SrcAddr:           sctx.SrcAddr,
+		Path:              path,
+		ResponseBodyBytes: n,
+		RequestID:         serveRequestID(r.Context()),
+	}
+	log.ClientTLSVersion, log.ClientCipherSuite = clientTLSInfo(r.TLS)
+	p.logEvent(sctx.DestPort, sctx.Funnel, log)
+}
@@ -0,0 +1,172 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/tstime"
+)
+
+// circuitBreaker stops requests from being forwarded to a Proxy backend
+// after it has failed too many times in a row, as configured by
+// HTTPHandler.CircuitBreakerFailures.
+//
+// Once open, the circuit stays open for the cooldown, after which up to
+// halfOpen trial requests are allowed through at once. The circuit
+// closes once half of them, rounded up, succeed, and opens again as
+// soon as one fails.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	halfOpen  int // trial requests allowed while half-open
+	clock     tstime.Clock
+
+	mu          sync.Mutex
+	failures    int       // consecutive failures
+	lastFailure time.Time // zero if no failures yet
+	openedAt    time.Time // zero if closed
+	trials      int       // half-open trial requests let through and not abandoned
+	passed      int       // of trials, how many succeeded
+}
+
+func newCircuitBreaker(h ipn.HTTPHandlerView, clock tstime.Clock) *circuitBreaker {
+	if h.CircuitBreakerFailures() <= 0 {
+		return nil
+	}
+	cooldown := h.CircuitBreakerCooldown()
+	if cooldown <= 0 {
+		cooldown = ipn.DefaultCircuitBreakerCooldown
+	}
+	halfOpen := h.CircuitBreakerHalfOpenRequests()
+	if halfOpen <= 0 {
+		halfOpen = 1
+	}
+	return &circuitBreaker{
+		threshold: h.CircuitBreakerFailures(),
+		cooldown:  cooldown,
+		halfOpen:  halfOpen,
+		clock:     clock,
+	}
+}
+
+// allow reports whether a request may be forwarded to the backend. If it
+// returns true, the caller must report the request's outcome with
+// exactly one of success, failure or abandon.
+func (cb *circuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.openedAt.IsZero() {
+		return true
+	}
+	if cb.trials >= cb.halfOpen || cb.clock.Since(cb.openedAt) < cb.cooldown {
+		return false
+	}
+	cb.trials++
+	return true
+}
+
+// resetTrials forgets the half-open trials of cb.
+func (cb *circuitBreaker) resetTrials() {
+	cb.trials = 0
+	cb.passed = 0
+}
+
+// success records a request that the backend handled.
+func (cb *circuitBreaker) success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if !cb.openedAt.IsZero() {
+		if cb.trials == 0 {
+			return // a request let through before the circuit opened
+		}
+		cb.passed++
+		if cb.passed < (cb.halfOpen+1)/2 {
+			return
+		}
+	}
+	cb.failures = 0
+	cb.openedAt = time.Time{}
+	cb.resetTrials()
+}
+
+// failure records a request that the backend failed.
+func (cb *circuitBreaker) failure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	now := cb.clock.Now()
+	cb.failures++
+	cb.lastFailure = now
+	if !cb.openedAt.IsZero() || cb.failures >= cb.threshold {
+		cb.openedAt = now
+		cb.resetTrials()
+	}
+}
+
+// abandon records a request that ended without telling us anything about
+// the backend, such as one canceled by the client.
+func (cb *circuitBreaker) abandon() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.trials > cb.passed {
+		cb.trials--
+	}
+}
+
+// status returns the current state of cb.
+func (cb *circuitBreaker) status() ipn.CircuitStatus {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	st := ipn.CircuitStatus{
+		State:       ipn.CircuitClosed,
+		Failures:    cb.failures,
+		LastFailure: cb.lastFailure,
+	}
+	switch {
+	case cb.openedAt.IsZero():
+	case cb.trials > 0 || cb.clock.Since(cb.openedAt) >= cb.cooldown:
+		st.State = ipn.CircuitHalfOpen
+	default:
+		st.State = ipn.CircuitOpen
+		st.RecoveryTime = cb.openedAt.Add(cb.cooldown)
+	}
+	return st
+}
+
+// circuitStates orders circuit states from healthiest to least healthy.
+var circuitStates = map[string]int{
+	ipn.CircuitClosed:   0,
+	ipn.CircuitHalfOpen: 1,
+	ipn.CircuitOpen:     2,
+}
+
+// CircuitBreakerStatus returns the circuit breaker state of the serve
+// Proxy backend at hostPort, which may be given in any form accepted as
+// a Proxy backend (such as "3000" or "localhost:3000"). If several
+// handlers with circuit breakers proxy to hostPort, the least healthy
+// is returned.
+func (b *LocalBackend) CircuitBreakerStatus(hostPort string) (*ipn.CircuitStatus, error) {
+	proxies, err := b.proxiesForBackend(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	var ret *ipn.CircuitStatus
+	for _, p := range proxies {
+		if p.cb == nil {
+			continue
+		}
+		st := p.cb.status()
+		if ret == nil || circuitStates[st.State] > circuitStates[ret.State] {
+			st.Backend = p.target.String()
+			ret = &st
+		}
+	}
+	if ret == nil {
+		return nil, fmt.Errorf("no circuit breaker configured for backend %q", hostPort)
+	}
+	return ret, nil
+}
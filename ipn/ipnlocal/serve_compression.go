@@ -0,0 +1,190 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"tailscale.com/util/clientmetric"
+)
+
+var (
+	metricCompressionOffloadResponses = clientmetric.NewCounter("serve_compression_offload_responses")
+	metricCompressionOffloadCPUUs     = clientmetric.NewCounter("serve_compression_offload_cpu_us")
+)
+
+// offloadCompression re-encodes res, a Proxy backend's response, to the
+// best content coding its client accepts, for
+// HTTPHandler.CompressionOffload: brotli, then gzip, then none. Only
+// whole gzip or brotli bodies are re-encoded; other codings, partial
+// content and responses with no body are left alone.
+func offloadCompression(res *http.Response) {
+	from := strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding")))
+	if from != "gzip" && from != "br" {
+		return
+	}
+	if res.StatusCode == http.StatusPartialContent || res.StatusCode == http.StatusNoContent ||
+		res.StatusCode == http.StatusNotModified || res.Request.Method == "HEAD" {
+		return
+	}
+	accept := res.Request.Header.Values("Accept-Encoding")
+	to := ""
+	switch {
+	case acceptsEncoding(accept, "br"):
+		to = "br"
+	case acceptsEncoding(accept, "gzip"):
+		to = "gzip"
+	}
+	if to == from {
+		return
+	}
+	metricCompressionOffloadResponses.Add(1)
+	res.Body = newTranscodedBody(res.Body, from, to)
+	if to == "" {
+		res.Header.Del("Content-Encoding")
+	} else {
+		res.Header.Set("Content-Encoding", to)
+	}
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		// The bytes differ, but the content is the same.
+		res.Header.Set("ETag", "W/"+etag)
+	}
+	if !varyHasAcceptEncoding(res.Header.Values("Vary")) {
+		res.Header.Add("Vary", "Accept-Encoding")
+	}
+}
+
+// acceptsEncoding reports whether a client with the Accept-Encoding
+// header values accept takes the content coding enc, named or by "*",
+// with a non-zero q-value.
+func acceptsEncoding(accept []string, enc string) bool {
+	q := -1.0 // for enc, or -1 if not listed
+	qStar := -1.0
+	for _, v := range accept {
+		for _, part := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(part, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != enc && name != "*" {
+				continue
+			}
+			pq := 1.0
+			for _, p := range strings.Split(params, ";") {
+				k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+				if ok && strings.EqualFold(k, "q") {
+					if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+						pq = f
+					}
+				}
+			}
+			if name == enc {
+				q = pq
+			} else {
+				qStar = pq
+			}
+		}
+	}
+	if q >= 0 {
+		return q > 0
+	}
+	return qStar > 0
+}
+
+// varyHasAcceptEncoding reports whether the Vary header values vary
+// already cover Accept-Encoding.
+func varyHasAcceptEncoding(vary []string) bool {
+	for _, v := range vary {
+		for _, f := range strings.Split(v, ",") {
+			f = strings.TrimSpace(f)
+			if f == "*" || strings.EqualFold(f, "Accept-Encoding") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// transcodedBody is a response body re-encoded from one content coding
+// to another by a goroutine, for offloadCompression.
+type transcodedBody struct {
+	*io.PipeReader
+	src io.ReadCloser
+}
+
+// newTranscodedBody returns src, encoded with from ("gzip" or "br"),
+// re-encoded with to ("gzip", "br", or "" for none). The time spent
+// decoding and encoding, but not waiting on the backend or the client,
+// is counted in metricCompressionOffloadCPUUs.
+func newTranscodedBody(src io.ReadCloser, from, to string) *transcodedBody {
+	pr, pw := io.Pipe()
+	go func() {
+		var waited time.Duration
+		start := time.Now()
+		err := transcode(&waitTimer{r: src, d: &waited}, &waitTimer{w: pw, d: &waited}, from, to)
+		metricCompressionOffloadCPUUs.Add((time.Since(start) - waited).Microseconds())
+		pw.CloseWithError(err)
+	}()
+	return &transcodedBody{PipeReader: pr, src: src}
+}
+
+func (b *transcodedBody) Close() error {
+	b.PipeReader.Close()
+	return b.src.Close()
+}
+
+// transcode copies src, encoded with from, to dst, encoded with to.
+func transcode(src io.Reader, dst io.Writer, from, to string) error {
+	var dec io.Reader
+	switch from {
+	case "gzip":
+		zr, err := gzip.NewReader(src)
+		if err != nil {
+			return err
+		}
+		dec = zr
+	case "br":
+		dec = brotli.NewReader(src)
+	}
+	var enc io.WriteCloser
+	switch to {
+	case "gzip":
+		enc = gzip.NewWriter(dst)
+	case "br":
+		enc = brotli.NewWriterLevel(dst, brotli.DefaultCompression)
+	default:
+		_, err := io.Copy(dst, dec)
+		return err
+	}
+	if _, err := io.Copy(enc, dec); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// waitTimer is an io.Reader or io.Writer that adds the time spent in
+// each Read or Write to *d.
+type waitTimer struct {
+	r io.Reader
+	w io.Writer
+	d *time.Duration
+}
+
+func (t *waitTimer) Read(p []byte) (int, error) {
+	start := time.Now()
+	defer func() { *t.d += time.Since(start) }()
+	return t.r.Read(p)
+}
+
+func (t *waitTimer) Write(p []byte) (int, error) {
+	start := time.Now()
+	defer func() { *t.d += time.Since(start) }()
+	return t.w.Write(p)
+}
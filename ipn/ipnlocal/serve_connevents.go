@@ -0,0 +1,154 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+// upstreamConnIDs is the last ConnID given to a connection to a backend.
+var upstreamConnIDs atomic.Int64
+
+// connEventsDial returns a dial func that calls dial and sends a
+// FunnelRequestLog with an UpstreamConnLog to the foreground serve
+// streams for the request's port when each connection it returns is
+// opened and closed, as enabled by HTTPHandler.ConnectionEvents, or
+// changes state, as enabled by HTTPHandler.ConnectionStates.
+func (p *reverseProxy) connEventsDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		sctx, ok := ctx.Value(serveHTTPContextKey{}).(*serveHTTPContext)
+		if !ok {
+			return c, nil
+		}
+		ec := &eventConn{Conn: c, id: upstreamConnIDs.Add(1), start: time.Now()}
+		log := func(event string) *ipn.UpstreamConnLog {
+			return ec.log(event, p.target.String())
+		}
+		send := func(logs ...*ipn.UpstreamConnLog) {
+			for _, l := range logs {
+				p.logEvent(sctx.DestPort, nil, ipn.FunnelRequestLog{Kind: ipn.FunnelLogUpstreamConn, UpstreamConn: l})
+			}
+		}
+		events, states := p.h.ConnectionEvents(), p.h.ConnectionStates()
+		if states {
+			ec.onState = func(state string) { send(log(state)) }
+		}
+		ec.onClose = func() {
+			var logs []*ipn.UpstreamConnLog
+			if events {
+				logs = append(logs, log(ipn.UpstreamConnClose))
+			}
+			if states {
+				logs = append(logs, log(ipn.UpstreamConnClosed))
+			}
+			// Idle connections are closed when the serve config
+			// changes, with LocalBackend.mu held, which logging needs.
+			go send(logs...)
+		}
+		if events {
+			send(log(ipn.UpstreamConnOpen))
+		}
+		if states {
+			send(log(ipn.UpstreamConnNew))
+		}
+		return ec, nil
+	}
+}
+
+// countConnRequests returns r with a client trace that counts it as a
+// request on its connection to the backend, if that's an eventConn, and
+// sets the connection's state while and after it's used for r.
+func countConnRequests(r *http.Request) *http.Request {
+	var used atomic.Pointer[eventConn]
+	ct := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c := info.Conn
+			if tc, ok := c.(*tls.Conn); ok {
+				c = tc.NetConn()
+			}
+			if ec, ok := c.(*eventConn); ok {
+				ec.requests.Add(1)
+				ec.setState(ipn.UpstreamConnActive)
+				used.Store(ec)
+			}
+		},
+		PutIdleConn: func(err error) {
+			if ec := used.Load(); ec != nil && err == nil {
+				ec.setState(ipn.UpstreamConnIdle)
+			}
+		},
+	}
+	return r.WithContext(httptrace.WithClientTrace(r.Context(), ct))
+}
+
+// eventConn is a connection to a backend whose requests and bytes are
+// counted for its UpstreamConnLog. onClose is called once it's closed,
+// and onState, if non-nil, when it becomes active or idle.
+type eventConn struct {
+	net.Conn
+	id        int64
+	start     time.Time
+	requests  atomic.Int64
+	sent      atomic.Int64
+	received  atomic.Int64
+	onState   func(state string)
+	onClose   func()
+	closeOnce sync.Once
+}
+
+func (c *eventConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.received.Add(int64(n))
+	return n, err
+}
+
+func (c *eventConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.sent.Add(int64(n))
+	return n, err
+}
+
+func (c *eventConn) setState(state string) {
+	if c.onState != nil {
+		c.onState(state)
+	}
+}
+
+func (c *eventConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(c.onClose)
+	return err
+}
+
+// log returns the UpstreamConnLog of event for c, a connection to the
+// backend URL.
+func (c *eventConn) log(event, backend string) *ipn.UpstreamConnLog {
+	l := &ipn.UpstreamConnLog{
+		Event:      event,
+		Backend:    backend,
+		RemoteAddr: c.RemoteAddr().String(),
+		Start:      c.start,
+		ConnID:     c.id,
+		Time:       time.Now(),
+	}
+	if event == ipn.UpstreamConnClose || event == ipn.UpstreamConnClosed {
+		l.Requests = c.requests.Load()
+		l.BytesSent = c.sent.Load()
+		l.BytesReceived = c.received.Load()
+	}
+	return l
+}
@@ -0,0 +1,58 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"tailscale.com/ipn"
+)
+
+// classifyUpstreamError returns the likely cause of err, an error from a
+// request to a Proxy backend, as one of the ipn.UpstreamError constants,
+// or "" if it's not one serve recognizes.
+func classifyUpstreamError(err error) string {
+	if class := classifyUpstreamSysError(err); class != "" {
+		return class
+	}
+	// The error messages are checked too, for platforms whose errnos
+	// differ, like Windows's WSAECONNREFUSED.
+	msg := err.Error()
+	var ne net.Error
+	switch {
+	case strings.Contains(msg, "connection refused"),
+		strings.Contains(msg, "actively refused"):
+		return ipn.UpstreamErrorNotRunning
+	case strings.Contains(msg, "no route to host"),
+		strings.Contains(msg, "network is unreachable"):
+		return ipn.UpstreamErrorNetwork
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &ne) && ne.Timeout():
+		return ipn.UpstreamErrorSlow
+	}
+	return ""
+}
+
+// logUpstreamError sends a FunnelRequestLog with the ErrorClass class of
+// r's failed request to the backend to foreground serve streams.
+func (p *reverseProxy) logUpstreamError(r *http.Request, class string) {
+	sctx, ok := getServeHTTPContext(r)
+	if !ok {
+		return
+	}
+	path, _ := r.Context().Value(serveRequestPathKey{}).(string)
+	log := ipn.FunnelRequestLog{
+		Kind:       ipn.FunnelLogUpstreamError,
+		SrcAddr:    sctx.SrcAddr,
+		Path:       path,
+		ErrorClass: class,
+		RequestID:  serveRequestID(r.Context()),
+	}
+	log.ClientTLSVersion, log.ClientCipherSuite = clientTLSInfo(r.TLS)
+	p.logEvent(sctx.DestPort, sctx.Funnel, log)
+}
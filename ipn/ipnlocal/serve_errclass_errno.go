@@ -0,0 +1,26 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package ipnlocal
+
+import (
+	"errors"
+	"syscall"
+
+	"tailscale.com/ipn"
+)
+
+// classifyUpstreamSysError returns the ipn.UpstreamError constant for the
+// errno in err, or "" if it has none that serve recognizes.
+func classifyUpstreamSysError(err error) string {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ipn.UpstreamErrorNotRunning
+	case errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, syscall.ENETUNREACH):
+		return ipn.UpstreamErrorNetwork
+	}
+	return ""
+}
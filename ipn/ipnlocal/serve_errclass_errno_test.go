@@ -0,0 +1,35 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !plan9
+
+package ipnlocal
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"tailscale.com/ipn"
+)
+
+func TestClassifyUpstreamErrno(t *testing.T) {
+	dialErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"refused", dialErr(syscall.ECONNREFUSED), ipn.UpstreamErrorNotRunning},
+		{"host-unreachable", dialErr(syscall.EHOSTUNREACH), ipn.UpstreamErrorNetwork},
+		{"net-unreachable", dialErr(syscall.ENETUNREACH), ipn.UpstreamErrorNetwork},
+	}
+	for _, tt := range tests {
+		if got := classifyUpstreamError(tt.err); got != tt.want {
+			t.Errorf("%s: got %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"strings"
+
+	"tailscale.com/ipn"
+)
+
+// classifyUpstreamSysError returns the ipn.UpstreamError constant for
+// err from the messages of the Plan 9 IP stack, which has no errnos, or
+// "" if it's not one serve recognizes. "connection refused" is the same
+// as elsewhere and is left to classifyUpstreamError.
+func classifyUpstreamSysError(err error) string {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "host unreachable"),
+		strings.Contains(msg, "network unreachable"),
+		strings.Contains(msg, "no route"):
+		return ipn.UpstreamErrorNetwork
+	}
+	return ""
+}
@@ -0,0 +1,132 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+
+	"tailscale.com/tstime"
+	"tailscale.com/util/lru"
+)
+
+const (
+	// idempotencyCacheMaxEntries is the most responses an
+	// idempotencyCache keeps.
+	idempotencyCacheMaxEntries = 1000
+
+	// idempotencyCacheMaxBody is the largest response body an
+	// idempotencyCache keeps.
+	idempotencyCacheMaxBody = 64 << 10
+)
+
+// idempotencyCache keeps a Proxy backend's responses to requests with an
+// Idempotency-Key header for HTTPHandler.IdempotencyCacheTTL, so that a
+// retried request with the same key is answered without reaching the
+// backend. Concurrent requests with the same key all go to the backend.
+type idempotencyCache struct {
+	ttl   time.Duration
+	clock tstime.Clock
+
+	mu sync.Mutex
+	m  lru.Cache[string, *cachedResponse] // by Idempotency-Key
+}
+
+// cachedResponse is a response kept by an idempotencyCache.
+type cachedResponse struct {
+	expires time.Time
+	status  int
+	header  http.Header
+	body    []byte
+}
+
+func newIdempotencyCache(ttl time.Duration, clock tstime.Clock) *idempotencyCache {
+	c := &idempotencyCache{ttl: ttl, clock: clock}
+	c.m.MaxEntries = idempotencyCacheMaxEntries
+	return c
+}
+
+// serveHTTP serves r, which has the Idempotency-Key key, from the cache
+// if it has an unexpired response for key, and otherwise from next,
+// keeping the response if it's cacheable.
+func (c *idempotencyCache) serveHTTP(w http.ResponseWriter, r *http.Request, key string, next http.Handler) {
+	if res, ok := c.get(key); ok {
+		h := w.Header()
+		for k, vv := range res.header {
+			h[k] = vv
+		}
+		w.WriteHeader(res.status)
+		w.Write(res.body)
+		return
+	}
+	rw := &recordingResponseWriter{ResponseWriter: w}
+	next.ServeHTTP(rw, r)
+	if rw.status == 0 || rw.status >= 500 || rw.tooLarge || r.Context().Err() != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m.Set(key, &cachedResponse{
+		expires: c.clock.Now().Add(c.ttl),
+		status:  rw.status,
+		header:  rw.header,
+		body:    rw.body.Bytes(),
+	})
+}
+
+// get returns the unexpired response for key, if any.
+func (c *idempotencyCache) get(key string) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res, ok := c.m.GetOk(key)
+	if !ok {
+		return nil, false
+	}
+	if !c.clock.Now().Before(res.expires) {
+		c.m.Delete(key)
+		return nil, false
+	}
+	return res, true
+}
+
+// recordingResponseWriter is an http.ResponseWriter wrapper that keeps a
+// copy of the response written through it, for an idempotencyCache.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status   int         // or 0 if the headers haven't been written
+	header   http.Header // as of when the headers were written
+	body     bytes.Buffer
+	tooLarge bool // the body is larger than idempotencyCacheMaxBody
+}
+
+func (w *recordingResponseWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= 200 {
+		w.status = code
+		w.header = w.ResponseWriter.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recordingResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.tooLarge {
+		if w.body.Len()+len(p) > idempotencyCacheMaxBody {
+			w.tooLarge = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(p)
+		}
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap returns the underlying ResponseWriter, for
+// http.ResponseController.
+func (w *recordingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,31 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || darwin
+
+package ipnlocal
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	setKeepAliveCount = setKeepAliveCountUnix
+}
+
+func setKeepAliveCountUnix(c *net.TCPConn, n int) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPCNT, n)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
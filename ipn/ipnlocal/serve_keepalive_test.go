@@ -0,0 +1,117 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || darwin
+
+package ipnlocal
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// wrappedConn is a net.Conn wrapper like tsdial's SystemDial conns.
+type wrappedConn struct{ net.Conn }
+
+func (c wrappedConn) NetConn() net.Conn { return c.Conn }
+
+func TestKeepAliveDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var d net.Dialer
+	dial := keepAliveDial(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return wrappedConn{c}, nil
+	})
+	c, err := dial(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	tc, ok := unwrapTCPConn(c)
+	if !ok {
+		t.Fatalf("unwrapTCPConn(%T) failed", c)
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	getsockopt := func(level, opt int) (v int) {
+		t.Helper()
+		var serr error
+		if err := rc.Control(func(fd uintptr) {
+			v, serr = unix.GetsockoptInt(int(fd), level, opt)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if serr != nil {
+			t.Fatal(serr)
+		}
+		return v
+	}
+	if v := getsockopt(unix.SOL_SOCKET, unix.SO_KEEPALIVE); v == 0 {
+		t.Error("SO_KEEPALIVE not set")
+	}
+	if got, want := getsockopt(unix.IPPROTO_TCP, unix.TCP_KEEPINTVL), int(keepAliveProbeInterval.Seconds()); got != want {
+		t.Errorf("TCP_KEEPINTVL = %d; want %d", got, want)
+	}
+	if got := getsockopt(unix.IPPROTO_TCP, unix.TCP_KEEPCNT); got != keepAliveProbeCount {
+		t.Errorf("TCP_KEEPCNT = %d; want %d", got, keepAliveProbeCount)
+	}
+}
+
+func TestNoDelayDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var d net.Dialer
+	dial := noDelayDial(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		// Start from Nagle's algorithm enabled, unlike Go's default.
+		if err := c.(*net.TCPConn).SetNoDelay(false); err != nil {
+			t.Fatal(err)
+		}
+		return wrappedConn{c}, nil
+	})
+	c, err := dial(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	tc, _ := unwrapTCPConn(c)
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		v, serr = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_NODELAY)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	if v == 0 {
+		t.Error("TCP_NODELAY not set")
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+	"tailscale.com/ipn"
+)
+
+// oauth2RequestTimeout is how long to wait for each request to an OAuth
+// 2.0 or OpenID Connect provider.
+const oauth2RequestTimeout = 30 * time.Second
+
+// oauth2ExpiryBuffer is how long before a token expires to get a new
+// one, so that it doesn't expire on the way to the backend.
+const oauth2ExpiryBuffer = 30 * time.Second
+
+// oauth2TokenSource gets access tokens for a Proxy backend from an OAuth
+// 2.0 token endpoint using the client credentials grant, as configured
+// by an ipn.OAuth2ClientConfig or ipn.OIDCUpstreamAuth. Tokens are
+// reused until shortly before they expire.
+type oauth2TokenSource struct {
+	clientID         string
+	clientSecretFile string
+	scopes           []string
+	client           *http.Client
+	reuse            oauth2.TokenSource // caches tokens from fetcher
+
+	// tokenURL returns the URL of the token endpoint.
+	tokenURL func(context.Context) (string, error)
+}
+
+func newOAuth2TokenSource(conf ipn.OAuth2ClientConfigView) *oauth2TokenSource {
+	s := &oauth2TokenSource{
+		clientID:         conf.ClientID(),
+		clientSecretFile: conf.ClientSecretFile(),
+		scopes:           conf.Scopes().AsSlice(),
+		client:           &http.Client{Timeout: oauth2RequestTimeout},
+	}
+	tokenURL := conf.TokenURL()
+	s.tokenURL = func(context.Context) (string, error) { return tokenURL, nil }
+	s.reuse = oauth2.ReuseTokenSourceWithExpiry(nil, oauth2Fetcher{s}, oauth2ExpiryBuffer)
+	return s
+}
+
+func newOIDCTokenSource(conf ipn.OIDCUpstreamAuth) *oauth2TokenSource {
+	s := &oauth2TokenSource{
+		clientID:         conf.ClientID,
+		clientSecretFile: conf.ClientSecretFile,
+		client:           &http.Client{Timeout: oauth2RequestTimeout},
+	}
+	d := &oidcDiscovery{url: conf.DiscoveryURL, client: s.client}
+	s.tokenURL = d.tokenURL
+	s.reuse = oauth2.ReuseTokenSourceWithExpiry(nil, oauth2Fetcher{s}, oauth2ExpiryBuffer)
+	return s
+}
+
+// token returns a current access token.
+func (s *oauth2TokenSource) token() (string, error) {
+	t, err := s.reuse.Token()
+	if err != nil {
+		return "", err
+	}
+	return t.AccessToken, nil
+}
+
+// oauth2Fetcher is an oauth2.TokenSource that requests a new token for
+// each call.
+type oauth2Fetcher struct {
+	s *oauth2TokenSource
+}
+
+func (f oauth2Fetcher) Token() (*oauth2.Token, error) {
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, f.s.client)
+	tokenURL, err := f.s.tokenURL(ctx)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := readBearerToken(f.s.clientSecretFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading client secret: %w", err)
+	}
+	cc := &clientcredentials.Config{
+		ClientID:     f.s.clientID,
+		ClientSecret: secret,
+		TokenURL:     tokenURL,
+		Scopes:       f.s.scopes,
+	}
+	return cc.Token(ctx)
+}
+
+// oidcDiscovery fetches an OpenID Connect provider's discovery
+// document.
+type oidcDiscovery struct {
+	url    string // of the discovery document
+	client *http.Client
+
+	mu  sync.Mutex
+	doc *oidcDiscoveryDoc // once fetched
+}
+
+// oidcDiscoveryDoc is the part of an OpenID Connect discovery document
+// that serve uses.
+type oidcDiscoveryDoc struct {
+	Issuer        string `json:"issuer"`
+	TokenEndpoint string `json:"token_endpoint"`
+	JWKSURI       string `json:"jwks_uri"`
+}
+
+// document returns the provider's discovery document, fetching it the
+// first time it's needed.
+func (d *oidcDiscovery) document(ctx context.Context) (*oidcDiscoveryDoc, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.doc != nil {
+		return d.doc, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", d.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching OIDC discovery document: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching OIDC discovery document: %s", res.Status)
+	}
+	doc := new(oidcDiscoveryDoc)
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(doc); err != nil {
+		return nil, fmt.Errorf("decoding OIDC discovery document: %w", err)
+	}
+	d.doc = doc
+	return d.doc, nil
+}
+
+// tokenURL returns the token endpoint from the provider's discovery
+// document.
+func (d *oidcDiscovery) tokenURL(ctx context.Context) (string, error) {
+	doc, err := d.document(ctx)
+	if err != nil {
+		return "", err
+	}
+	if doc.TokenEndpoint == "" {
+		return "", errors.New("OIDC discovery document has no token_endpoint")
+	}
+	return doc.TokenEndpoint, nil
+}
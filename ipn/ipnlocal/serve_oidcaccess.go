@@ -0,0 +1,455 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/tstime"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/singleflight"
+)
+
+const (
+	// jwksCacheTTL is how long an oidcAccessControl uses a provider's
+	// keys before fetching them again in the background.
+	jwksCacheTTL = 5 * time.Minute
+
+	// jwksMinRefresh is how long an oidcAccessControl waits after
+	// fetching a provider's keys before fetching them again for a token
+	// signed by a key it doesn't know, as after a key rotation.
+	jwksMinRefresh = time.Minute
+
+	// jwtClockSkew is how far a token's expiry and not-before times may
+	// be off, to allow for clocks that don't quite agree.
+	jwtClockSkew = time.Minute
+)
+
+// errInvalidToken is wrapped by the errors of tokens rejected by an
+// oidcAccessControl, as opposed to failures to check them.
+var errInvalidToken = errors.New("invalid token")
+
+// oidcAccessControl checks that requests to a Proxy backend carry a
+// valid JWT from an OpenID Connect provider, for
+// HTTPHandler.OIDCAccessControl.
+type oidcAccessControl struct {
+	audience  string
+	discovery *oidcDiscovery
+	client    *http.Client
+	clock     tstime.Clock
+	logf      logger.Logf
+	jwksSF    singleflight.Group[string, []jwtKey] // fetches of the JWKS, by URL
+
+	mu      sync.Mutex
+	keys    []jwtKey  // from the provider's JWKS
+	fetched time.Time // when keys were fetched, or zero if never
+}
+
+func newOIDCAccessControl(conf ipn.OIDCAccessControl, clock tstime.Clock, logf logger.Logf) *oidcAccessControl {
+	client := &http.Client{Timeout: oauth2RequestTimeout}
+	return &oidcAccessControl{
+		audience:  conf.Audience,
+		discovery: &oidcDiscovery{url: conf.DiscoveryURL, client: client},
+		client:    client,
+		clock:     clock,
+		logf:      logf,
+	}
+}
+
+// allow reports whether r carries a valid token, and otherwise responds
+// to it with 401 Unauthorized, or 503 Service Unavailable if the token
+// can't be checked.
+func (a *oidcAccessControl) allow(w http.ResponseWriter, r *http.Request) bool {
+	scheme, tok, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(tok) == "" {
+		a.unauthorized(w, r, "")
+		return false
+	}
+	err := a.verify(r.Context(), strings.TrimSpace(tok))
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errInvalidToken):
+		a.unauthorized(w, r, "invalid_token")
+	default:
+		a.logf("serve: checking access token: %v", err)
+		http.Error(w, "access control unavailable", http.StatusServiceUnavailable)
+	}
+	return false
+}
+
+// unauthorized responds to r with 401 Unauthorized and a Bearer
+// challenge for the host r was sent to, with the RFC 6750 error code
+// errCode if non-empty.
+func (a *oidcAccessControl) unauthorized(w http.ResponseWriter, r *http.Request, errCode string) {
+	realm := r.Host
+	if h, _, err := net.SplitHostPort(realm); err == nil {
+		realm = h
+	}
+	challenge := fmt.Sprintf("Bearer realm=%q", realm)
+	if errCode != "" {
+		challenge += fmt.Sprintf(", error=%q", errCode)
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
+// verify checks tok, a JWT in JWS compact serialization. It returns an
+// error wrapping errInvalidToken if tok isn't valid, or another error
+// if it can't be checked, such as when the provider is unreachable.
+func (a *oidcAccessControl) verify(ctx context.Context, tok string) error {
+	parts := strings.Split(tok, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("%w: not a signed JWT", errInvalidToken)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return fmt.Errorf("%w: header: %v", errInvalidToken, err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("%w: signature: %v", errInvalidToken, err)
+	}
+	doc, err := a.discovery.document(ctx)
+	if err != nil {
+		return err
+	}
+	if doc.JWKSURI == "" {
+		return errors.New("OIDC discovery document has no jwks_uri")
+	}
+	keys, err := a.providerKeys(ctx, doc.JWKSURI, header.Kid)
+	if err != nil {
+		return err
+	}
+	signed := parts[0] + "." + parts[1]
+	verified := false
+	for _, k := range keys {
+		if header.Kid != "" && k.kid != header.Kid {
+			continue
+		}
+		if verifyJWS(header.Alg, k.key, signed, sig) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return fmt.Errorf("%w: bad signature", errInvalidToken)
+	}
+
+	var claims struct {
+		Iss string      `json:"iss"`
+		Aud jwtAudience `json:"aud"`
+		Exp *float64    `json:"exp"`
+		Nbf *float64    `json:"nbf"`
+	}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return fmt.Errorf("%w: claims: %v", errInvalidToken, err)
+	}
+	now := a.clock.Now()
+	switch {
+	case claims.Iss != doc.Issuer:
+		return fmt.Errorf("%w: issuer %q", errInvalidToken, claims.Iss)
+	case !claims.Aud.contains(a.audience):
+		return fmt.Errorf("%w: wrong audience", errInvalidToken)
+	case claims.Exp == nil:
+		return fmt.Errorf("%w: no expiry", errInvalidToken)
+	case now.After(jwtTime(*claims.Exp).Add(jwtClockSkew)):
+		return fmt.Errorf("%w: expired", errInvalidToken)
+	case claims.Nbf != nil && now.Add(jwtClockSkew).Before(jwtTime(*claims.Nbf)):
+		return fmt.Errorf("%w: not valid yet", errInvalidToken)
+	}
+	return nil
+}
+
+// providerKeys returns the provider's signing keys from its JWKS at
+// jwksURL. Keys older than jwksCacheTTL are still returned while newer
+// ones are fetched in the background. It only waits for a fetch when
+// there are no keys yet, or when none has the key ID kid and they're
+// older than jwksMinRefresh, giving up on it when ctx is done.
+func (a *oidcAccessControl) providerKeys(ctx context.Context, jwksURL, kid string) ([]jwtKey, error) {
+	a.mu.Lock()
+	keys, fetched := a.keys, a.fetched
+	a.mu.Unlock()
+	have := !fetched.IsZero()
+	age := a.clock.Since(fetched)
+	if have && (kid == "" || hasJWTKey(keys, kid) || age < jwksMinRefresh) {
+		if age >= jwksCacheTTL {
+			a.fetchKeys(jwksURL)
+		}
+		return keys, nil
+	}
+	select {
+	case res := <-a.fetchKeys(jwksURL):
+		if res.Err != nil {
+			if have {
+				return keys, nil
+			}
+			return nil, res.Err
+		}
+		return res.Val, nil
+	case <-ctx.Done():
+		if have {
+			return keys, nil
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// fetchKeys starts fetching the provider's JWKS at jwksURL, unless a
+// fetch is already running, and caches the keys once fetched. It isn't
+// tied to the request that needed them, so it isn't given up on when
+// that request is, and its result goes to every request waiting for it.
+func (a *oidcAccessControl) fetchKeys(jwksURL string) <-chan singleflight.Result[[]jwtKey] {
+	return a.jwksSF.DoChan(jwksURL, func() ([]jwtKey, error) {
+		keys, err := fetchJWKS(context.Background(), a.client, jwksURL)
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if err != nil {
+			// Without keys, the error goes back to the requests
+			// waiting for them; otherwise nothing else reports it.
+			if !a.fetched.IsZero() {
+				a.logf("serve: fetching JWKS, still using keys from %v ago: %v", a.clock.Since(a.fetched).Round(time.Second), err)
+			}
+			return nil, err
+		}
+		a.keys, a.fetched = keys, a.clock.Now()
+		return keys, nil
+	})
+}
+
+// jwtKey is a public key from a provider's JWKS.
+type jwtKey struct {
+	kid string
+	key crypto.PublicKey // *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey
+}
+
+func hasJWTKey(keys []jwtKey, kid string) bool {
+	for _, k := range keys {
+		if k.kid == kid {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchJWKS returns the signing keys of the JSON Web Key Set at jwksURL
+// (RFC 7517), skipping keys of unsupported types.
+func fetchJWKS(ctx context.Context, client *http.Client, jwksURL string) ([]jwtKey, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching JWKS: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching JWKS: %s", res.Status)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("decoding JWKS: %w", err)
+	}
+	var keys []jwtKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		switch k.Kty {
+		case "RSA":
+			n, err1 := decodeJWKInt(k.N)
+			e, err2 := decodeJWKInt(k.E)
+			if err1 != nil || err2 != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+				continue
+			}
+			key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, err1 := decodeJWKInt(k.X)
+			y, err2 := decodeJWKInt(k.Y)
+			if err1 != nil || err2 != nil || !curve.IsOnCurve(x, y) {
+				continue
+			}
+			key = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		case "OKP":
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+				continue
+			}
+			key = ed25519.PublicKey(x)
+		default:
+			continue
+		}
+		keys = append(keys, jwtKey{kid: k.Kid, key: key})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no supported signing keys")
+	}
+	return keys, nil
+}
+
+// verifyJWS checks that sig is a signature of signed by key, with the
+// JWS algorithm alg (RFC 7518, section 3). Only asymmetric algorithms
+// are supported.
+func verifyJWS(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	errWrongKey := fmt.Errorf("key can't verify %s", alg)
+	if alg == "EdDSA" {
+		k, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return errWrongKey
+		}
+		if !ed25519.Verify(k, []byte(signed), sig) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	var (
+		hash   crypto.Hash
+		digest []byte
+	)
+	switch alg[2:] {
+	case "256":
+		sum := sha256.Sum256([]byte(signed))
+		hash, digest = crypto.SHA256, sum[:]
+	case "384":
+		sum := sha512.Sum384([]byte(signed))
+		hash, digest = crypto.SHA384, sum[:]
+	case "512":
+		sum := sha512.Sum512([]byte(signed))
+		hash, digest = crypto.SHA512, sum[:]
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	switch alg[:2] {
+	case "RS", "PS":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errWrongKey
+		}
+		if alg[0] == 'R' {
+			return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+		}
+		return rsa.VerifyPSS(k, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errWrongKey
+		}
+		// ES512 uses P-521, the rest the curve of their hash's size.
+		bits := k.Curve.Params().BitSize
+		if bits != map[string]int{"256": 256, "384": 384, "512": 521}[alg[2:]] {
+			return errWrongKey
+		}
+		size := (bits + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("bad signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+// decodeJWTSegment decodes seg, a base64url-encoded JSON segment of a
+// JWT, into v.
+func decodeJWTSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// decodeJWKInt decodes s, a base64url-encoded big-endian integer in a
+// JWK.
+func decodeJWKInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// jwtTime returns the time of a JWT NumericDate, in seconds since the
+// Unix epoch.
+func jwtTime(secs float64) time.Time {
+	return time.Unix(int64(secs), 0)
+}
+
+// jwtAudience is a JWT's "aud" claim, which may be a single string or
+// an array of them.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		*a = jwtAudience{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+func (a jwtAudience) contains(aud string) bool {
+	for _, v := range a {
+		if v == aud {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/util/clientmetric"
+)
+
+// upstreamConnsOpen is the number of open connections to all backends
+// collecting pool stats, from which serve_upstream_conns_idle is derived.
+var upstreamConnsOpen atomic.Int64
+
+var (
+	metricUpstreamConnsActive = clientmetric.NewGauge("serve_upstream_conns_active")
+	metricUpstreamConnsIdle   = clientmetric.NewGaugeFunc("serve_upstream_conns_idle", func() int64 {
+		return max(upstreamConnsOpen.Load()-metricUpstreamConnsActive.Value(), 0)
+	})
+	metricUpstreamConnWaits  = clientmetric.NewCounter("serve_upstream_conn_waits")
+	metricUpstreamConnWaitMs = clientmetric.NewCounter("serve_upstream_conn_wait_ms")
+)
+
+// upstreamPoolStats tracks the pool of connections of a reverseProxy to
+// its backend, as enabled by HTTPHandler.CollectPoolStats. The totals
+// over all backends are also exported as client metrics.
+type upstreamPoolStats struct {
+	open      atomic.Int64 // connections dialed and not yet closed
+	active    atomic.Int64 // requests that have a connection
+	waits     atomic.Int64
+	waitNanos atomic.Int64
+}
+
+// wrapDial returns a dial func that calls dial and counts the connections
+// it returns until they're closed.
+func (s *upstreamPoolStats) wrapDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		s.open.Add(1)
+		upstreamConnsOpen.Add(1)
+		return &countedConn{Conn: c, s: s}, nil
+	}
+}
+
+// trace returns r with a client trace that counts its use of a connection
+// to the backend. The caller must call done once the request is finished.
+func (s *upstreamPoolStats) trace(r *http.Request) (_ *http.Request, done func()) {
+	var (
+		mu      sync.Mutex
+		getConn time.Time
+		gotConn bool
+	)
+	ct := &httptrace.ClientTrace{
+		GetConn: func(string) {
+			mu.Lock()
+			defer mu.Unlock()
+			getConn = time.Now()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			if gotConn {
+				return
+			}
+			gotConn = true
+			s.active.Add(1)
+			metricUpstreamConnsActive.Add(1)
+			if !info.Reused {
+				wait := time.Since(getConn)
+				s.waits.Add(1)
+				s.waitNanos.Add(int64(wait))
+				metricUpstreamConnWaits.Add(1)
+				metricUpstreamConnWaitMs.Add(wait.Milliseconds())
+			}
+		},
+	}
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), ct))
+	return r, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if gotConn {
+			s.active.Add(-1)
+			metricUpstreamConnsActive.Add(-1)
+		}
+	}
+}
+
+// snapshot returns the current stats.
+func (s *upstreamPoolStats) snapshot() ipn.UpstreamPoolStats {
+	active := s.active.Load()
+	return ipn.UpstreamPoolStats{
+		Active:       active,
+		Idle:         max(s.open.Load()-active, 0),
+		WaitCount:    s.waits.Load(),
+		WaitDuration: time.Duration(s.waitNanos.Load()),
+	}
+}
+
+// countedConn is a net.Conn counted in upstreamPoolStats.open until
+// it's closed.
+type countedConn struct {
+	net.Conn
+	s         *upstreamPoolStats
+	closeOnce sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.s.open.Add(-1)
+		upstreamConnsOpen.Add(-1)
+	})
+	return c.Conn.Close()
+}
+
+// UpstreamPoolStats returns the connection pool statistics of the serve
+// Proxy backend at hostPort, which may be given in any form accepted as
+// a Proxy backend (such as "3000" or "localhost:3000"). If several
+// handlers collecting stats proxy to hostPort, their stats are summed.
+func (b *LocalBackend) UpstreamPoolStats(hostPort string) (*ipn.UpstreamPoolStats, error) {
+	proxies, err := b.proxiesForBackend(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	var ret *ipn.UpstreamPoolStats
+	for _, p := range proxies {
+		if p.stats == nil {
+			continue
+		}
+		st := p.stats.snapshot()
+		if ret == nil {
+			st.Backend = p.target.String()
+			ret = &st
+			continue
+		}
+		ret.Active += st.Active
+		ret.Idle += st.Idle
+		ret.WaitCount += st.WaitCount
+		ret.WaitDuration += st.WaitDuration
+	}
+	if ret == nil {
+		return nil, fmt.Errorf("no pool stats collected for backend %q", hostPort)
+	}
+	return ret, nil
+}
@@ -0,0 +1,86 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+// preheatTimeout is how long the HEAD requests sent for
+// HTTPHandler.PreheatConnections may take.
+const preheatTimeout = 10 * time.Second
+
+// preheatServeProxy opens connections to the Proxy backend of req, a
+// foreground serve stream to port whose Handler has PreheatConnections,
+// and sends a FunnelRequestLog with the outcome to the stream.
+func (b *LocalBackend) preheatServeProxy(ctx context.Context, req ipn.ServeStreamRequest, port uint16) {
+	h := req.ServeConfig().Web[req.HostPort].Handlers[req.MountPoint].View()
+	p, ok := b.serveProxy(h, "")
+	if !ok {
+		return
+	}
+	hctx, cancel := context.WithTimeout(ctx, preheatTimeout)
+	defer cancel()
+	log := p.preheat(hctx, h.PreheatConnections(), h.PreheatPath())
+	if ctx.Err() != nil {
+		return // the stream has ended
+	}
+	b.logf("serve: pre-warmed %d connections to %s", log.Conns, log.Backend)
+	b.logServeEvent(port, nil, ipn.FunnelRequestLog{Kind: ipn.FunnelLogPreheat, Preheat: log})
+}
+
+// preheat opens n connections to p's backend by sending it n
+// concurrent HEAD requests for path, or "/" if empty, leaving them idle
+// for later requests.
+func (p *reverseProxy) preheat(ctx context.Context, n int, path string) *ipn.PreheatLog {
+	if path == "" {
+		path = "/"
+	}
+	u := *p.target
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = ""
+	target := u.String()
+
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		log = &ipn.PreheatLog{Backend: p.h.Proxy()}
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := p.head(ctx, target)
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				log.Conns++
+			} else if log.Err == "" {
+				log.Err = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+	return log
+}
+
+// head sends a HEAD request for target to p's backend, whatever the
+// response.
+func (p *reverseProxy) head(ctx context.Context, target string) error {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", target, nil)
+	if err != nil {
+		return err
+	}
+	res, err := p.transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
@@ -0,0 +1,69 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"context"
+	"time"
+
+	"tailscale.com/util/clientmetric"
+)
+
+var (
+	metricServeRequestsActive   = clientmetric.NewGauge("serve_requests_active")
+	metricServeRequestsQueued   = clientmetric.NewGauge("serve_requests_queued")
+	metricServeRequestsRejected = clientmetric.NewCounter("serve_requests_rejected")
+)
+
+// requestQueue limits the number of requests proxied to a backend at
+// once, as configured by HTTPHandler.MaxConcurrentRequests, queueing the
+// rest for up to HTTPHandler.MaxQueueWait. Its counts, summed over all
+// backends, are exported as client metrics.
+type requestQueue struct {
+	slots   chan struct{} // holds a value for each active request
+	maxWait time.Duration
+}
+
+func newRequestQueue(n int, maxWait time.Duration) *requestQueue {
+	return &requestQueue{
+		slots:   make(chan struct{}, n),
+		maxWait: maxWait,
+	}
+}
+
+// acquire waits for the request with context ctx to be let through to
+// the backend, and reports whether it was. If it was, the caller must
+// call release when the request is finished.
+func (q *requestQueue) acquire(ctx context.Context) bool {
+	select {
+	case q.slots <- struct{}{}:
+		metricServeRequestsActive.Add(1)
+		return true
+	default:
+	}
+	if q.maxWait <= 0 {
+		metricServeRequestsRejected.Add(1)
+		return false
+	}
+	metricServeRequestsQueued.Add(1)
+	defer metricServeRequestsQueued.Add(-1)
+	t := time.NewTimer(q.maxWait)
+	defer t.Stop()
+	select {
+	case q.slots <- struct{}{}:
+		metricServeRequestsActive.Add(1)
+		return true
+	case <-t.C:
+		metricServeRequestsRejected.Add(1)
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// release frees the slot of a request let through by acquire.
+func (q *requestQueue) release() {
+	<-q.slots
+	metricServeRequestsActive.Add(-1)
+}
@@ -0,0 +1,134 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/tstime/rate"
+	"tailscale.com/types/logger"
+)
+
+// rateLimitReloadInterval is how often a pathRateLimiter checks its file
+// for changes. It's a var for testing.
+var rateLimitReloadInterval = time.Second
+
+// pathRateLimiter limits the rate of requests by path, as configured by
+// the file at HTTPHandler.RateLimitFile. The file is re-read in the
+// background whenever its modification time or size changes, so that
+// requests only load the current limits.
+type pathRateLimiter struct {
+	file     string
+	logf     logger.Logf
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{} // closed once run returns
+
+	limiters atomic.Pointer[map[string]*rate.Limiter] // nil until the file is first read
+
+	// Only used by reload, which isn't run concurrently.
+	mod  time.Time // of file when last read
+	size int64     // of file when last read
+}
+
+// newPathRateLimiter returns a pathRateLimiter for the limits in file,
+// which it starts checking for changes every rateLimitReloadInterval
+// until it's closed.
+func newPathRateLimiter(file string, logf logger.Logf) *pathRateLimiter {
+	rl := &pathRateLimiter{
+		file: file,
+		logf: logf,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	rl.reload()
+	go rl.run()
+	return rl
+}
+
+// allow reports whether a request for path is within its rate limit.
+func (rl *pathRateLimiter) allow(path string) bool {
+	limiters := rl.limiters.Load()
+	if limiters == nil {
+		return true
+	}
+	lim := (*limiters)[longestPathPrefix(*limiters, path)]
+	return lim == nil || lim.Allow()
+}
+
+// run reloads the limits every rateLimitReloadInterval until rl is
+// closed.
+func (rl *pathRateLimiter) run() {
+	defer close(rl.done)
+	t := time.NewTicker(rateLimitReloadInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-rl.stop:
+			return
+		case <-t.C:
+			rl.reload()
+		}
+	}
+}
+
+// close stops checking the file for changes, waiting for any check
+// underway to finish.
+func (rl *pathRateLimiter) close() {
+	rl.stopOnce.Do(func() { close(rl.stop) })
+	<-rl.done
+}
+
+// reload re-reads the file if it has changed since it was last read. If
+// the file can't be read or parsed, the previous limits are kept.
+func (rl *pathRateLimiter) reload() {
+	fi, err := os.Stat(rl.file)
+	if err != nil {
+		if !rl.mod.IsZero() {
+			rl.logf("serve: rate limits: %v; keeping previous limits", err)
+			rl.mod = time.Time{}
+		}
+		return
+	}
+	if fi.ModTime().Equal(rl.mod) && fi.Size() == rl.size {
+		return
+	}
+	rl.mod, rl.size = fi.ModTime(), fi.Size()
+	b, err := os.ReadFile(rl.file)
+	if err != nil {
+		rl.logf("serve: rate limits: %v; keeping previous limits", err)
+		return
+	}
+	limits, err := ipn.ParseRateLimits(b)
+	if err != nil {
+		rl.logf("serve: rate limits in %s: %v; keeping previous limits", rl.file, err)
+		return
+	}
+	limiters := make(map[string]*rate.Limiter, len(limits))
+	for p, l := range limits {
+		limiters[p] = rate.NewLimiter(rate.Limit(l.Rate), l.Burst)
+	}
+	rl.limiters.Store(&limiters)
+	rl.logf("serve: loaded %d rate limits from %s", len(limits), rl.file)
+}
+
+// longestPathPrefix returns the longest key of m that is path or a
+// parent of it, or "" if there's none.
+func longestPathPrefix[V any](m map[string]V, path string) string {
+	var best string
+	for p := range m {
+		if len(p) <= len(best) {
+			continue
+		}
+		if path == p || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/") {
+			best = p
+		}
+	}
+	return best
+}
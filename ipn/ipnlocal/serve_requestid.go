@@ -0,0 +1,53 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"context"
+	"net/http"
+)
+
+// maxRequestIDLen is the longest client X-Request-ID that's kept for
+// HTTPHandler.PropagateRequestID.
+const maxRequestIDLen = 128
+
+// serveRequestIDKey is the request context key for the ID of a proxied
+// request, for HTTPHandler.PropagateRequestID.
+type serveRequestIDKey struct{}
+
+// serveRequestID returns the ID of the proxied request with ctx, or the
+// empty string if it has none.
+func serveRequestID(ctx context.Context) string {
+	id, _ := ctx.Value(serveRequestIDKey{}).(string)
+	return id
+}
+
+// setRequestID gives r, a request for a handler with PropagateRequestID,
+// an ID, and sets it as the X-Request-ID of the request to the backend
+// and of the response to the client, w. It returns r with the ID in its
+// context.
+func setRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get("X-Request-ID")
+	if !validRequestID(id) {
+		id = randomHex(16)
+	}
+	r = r.WithContext(context.WithValue(r.Context(), serveRequestIDKey{}, id))
+	r.Header.Set("X-Request-ID", id)
+	w.Header().Set("X-Request-ID", id)
+	return r
+}
+
+// validRequestID reports whether the client's X-Request-ID, id, can be
+// kept: it's not too long, and only printable ASCII without spaces.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/tstime"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/clientmetric"
+)
+
+// maxRetryAfterRetries is the most times a request is retried for
+// HTTPHandler.UpstreamHonorRetryAfter before the backend's 503 is passed
+// on to the client.
+const maxRetryAfterRetries = 3
+
+// metricServeRetryAfterRetries counts the requests retried for
+// HTTPHandler.UpstreamHonorRetryAfter.
+var metricServeRetryAfterRetries = clientmetric.NewCounter("serve_upstream_retry_after_retries")
+
+// retryAfterTransport is an http.RoundTripper that retries requests
+// answered with 503 Service Unavailable and a Retry-After header, once
+// the time the header asks for, capped at max, has passed.
+type retryAfterTransport struct {
+	rt      http.RoundTripper
+	max     time.Duration
+	clock   tstime.Clock
+	logf    logger.Logf
+	backend string // for logging
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for retries := 0; ; retries++ {
+		res, err := t.rt.RoundTrip(req)
+		if err != nil || res.StatusCode != http.StatusServiceUnavailable ||
+			retries == maxRetryAfterRetries || (req.Body != nil && req.Body != http.NoBody) {
+			return res, err
+		}
+		d, ok := parseRetryAfter(res.Header.Get("Retry-After"), t.clock.Now())
+		if !ok {
+			return res, nil
+		}
+		d = min(d, t.max)
+		res.Body.Close()
+		t.logf("serve: backend %s unavailable, retrying %s in %v", t.backend, req.URL.Path, d)
+		metricServeRetryAfterRetries.Add(1)
+		timer, c := t.clock.NewTimer(d)
+		select {
+		case <-c:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// parseRetryAfter returns how long the Retry-After header value v asks
+// to wait from now, given either as seconds or as an HTTP date.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseUint(v, 10, 32); err == nil {
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	return max(t.Sub(now), 0), true
+}
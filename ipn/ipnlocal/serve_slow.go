@@ -0,0 +1,63 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+// traceUpstreamLatency returns r with a trace that measures how long the
+// backend takes to send the first byte of its response. The returned
+// latency func reports that, or if no response has arrived, the time
+// since traceUpstreamLatency was called.
+func traceUpstreamLatency(r *http.Request) (_ *http.Request, latency func() time.Duration) {
+	var (
+		mu        sync.Mutex
+		start     = time.Now()
+		firstByte time.Duration // or zero if none yet
+	)
+	ct := &httptrace.ClientTrace{
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if firstByte == 0 {
+				firstByte = time.Since(start)
+			}
+		},
+	}
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), ct))
+	return r, func() time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstByte != 0 {
+			return firstByte
+		}
+		return time.Since(start)
+	}
+}
+
+// logSlowRequest sends a FunnelRequestLog marked Slow for r, whose
+// backend took latency to start responding, to foreground serve streams.
+func (p *reverseProxy) logSlowRequest(r *http.Request, latency time.Duration) {
+	sctx, ok := getServeHTTPContext(r)
+	if !ok {
+		return
+	}
+	path, _ := r.Context().Value(serveRequestPathKey{}).(string)
+	log := ipn.FunnelRequestLog{
+		Kind:            ipn.FunnelLogSlow,
+		SrcAddr:         sctx.SrcAddr,
+		Path:            path,
+		Slow:            true,
+		UpstreamLatency: latency,
+		RequestID:       serveRequestID(r.Context()),
+	}
+	log.ClientTLSVersion, log.ClientCipherSuite = clientTLSInfo(r.TLS)
+	p.logEvent(sctx.DestPort, sctx.Funnel, log)
+}
@@ -4,23 +4,49 @@
 package ipnlocal
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/andybalholm/brotli"
+	"nhooyr.io/websocket"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/store/mem"
+	"tailscale.com/net/proxyproto"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tsd"
+	"tailscale.com/tstest"
 	"tailscale.com/types/logid"
 	"tailscale.com/types/netmap"
 	"tailscale.com/util/cmpx"
@@ -169,7 +195,9 @@ func TestGetServeHandler(t *testing.T) {
 	}
 }
 
-func TestServeHTTPProxy(t *testing.T) {
+// newTestServeBackend returns a LocalBackend with enough state (profile,
+// netmap, and peers) to exercise the serve code paths.
+func newTestServeBackend(t *testing.T) *LocalBackend {
 	sys := &tsd.System{}
 	e, err := wgengine.NewUserspaceEngine(t.Logf, wgengine.Config{SetSubsystem: sys.Set})
 	if err != nil {
@@ -181,7 +209,7 @@ func TestServeHTTPProxy(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer b.Shutdown()
+	t.Cleanup(b.Shutdown)
 	dir := t.TempDir()
 	b.SetVarRoot(dir)
 
@@ -212,6 +240,11 @@ func TestServeHTTPProxy(t *testing.T) {
 			User:         tailcfg.UserID(1),
 		}).View(),
 	}
+	return b
+}
+
+func TestServeHTTPProxy(t *testing.T) {
+	b := newTestServeBackend(t)
 
 	// Start test serve endpoint.
 	testServ := httptest.NewServer(http.HandlerFunc(
@@ -232,7 +265,7 @@ func(w http.ResponseWriter, r *http.Request) {
 			}},
 		},
 	}
-	if err := b.SetServeConfig(conf); err != nil {
+	if err := b.SetServeConfig(conf, ""); err != nil {
 		t.Fatal(err)
 	}
 
@@ -398,3 +431,3703 @@ func TestServeFileOrDirectory(t *testing.T) {
 		}
 	}
 }
+
+func TestStreamServeFunnelStarted(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	started := make(chan *ipn.FunnelStartedEvent, 1)
+	b.SetNotifyCallback(func(n ipn.Notify) {
+		if n.FunnelStarted != nil {
+			started <- n.FunnelStarted
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := ipn.ServeStreamRequest{
+		HostPort:   "example.ts.net:443",
+		Source:     "http://127.0.0.1:3000",
+		MountPoint: "/",
+		Funnel:     true,
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- b.StreamServe(ctx, httptest.NewRecorder(), req)
+	}()
+
+	select {
+	case ev := <-started:
+		if ev.HostPort != req.HostPort {
+			t.Errorf("HostPort = %q; want %q", ev.HostPort, req.HostPort)
+		}
+		if ev.SessionID == "" {
+			t.Error("empty SessionID")
+		}
+		if !b.ServeConfig().AllowFunnel().Get(req.HostPort) {
+			t.Error("FunnelStarted sent before ServeConfig was applied")
+		}
+	case err := <-errc:
+		t.Fatalf("StreamServe returned early: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for FunnelStarted")
+	}
+
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatalf("StreamServe: %v", err)
+	}
+}
+
+// streamLines is an http.ResponseWriter for StreamServe that sends
+// each line written to it to a channel.
+type streamLines struct {
+	http.ResponseWriter
+	lines chan []byte
+}
+
+func (w streamLines) Write(p []byte) (int, error) {
+	w.lines <- bytes.Clone(p)
+	return len(p), nil
+}
+
+func (w streamLines) Flush() {}
+
+func TestStreamServePreheat(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	var heads atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "HEAD" && r.URL.Path == "/healthz" {
+				heads.Add(1)
+			}
+		},
+	))
+	defer backend.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := ipn.ServeStreamRequest{
+		HostPort:   "example.ts.net:443",
+		Source:     backend.URL,
+		MountPoint: "/",
+		Handler:    &ipn.HTTPHandler{PreheatConnections: 3, PreheatPath: "/healthz"},
+	}
+	w := streamLines{ResponseWriter: httptest.NewRecorder(), lines: make(chan []byte, 1)}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- b.StreamServe(ctx, w, req)
+	}()
+
+	select {
+	case line := <-w.lines:
+		var log ipn.FunnelRequestLog
+		if err := json.Unmarshal(line, &log); err != nil {
+			t.Fatal(err)
+		}
+		want := &ipn.PreheatLog{Backend: backend.URL, Conns: 3}
+		if !reflect.DeepEqual(log.Preheat, want) {
+			t.Errorf("Preheat = %+v; want %+v", log.Preheat, want)
+		}
+	case err := <-errc:
+		t.Fatalf("StreamServe returned early: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for preheat log")
+	}
+	if got := heads.Load(); got != 3 {
+		t.Errorf("backend got %d HEAD requests; want 3", got)
+	}
+
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatalf("StreamServe: %v", err)
+	}
+}
+
+func TestStreamServeTCP(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := ipn.ServeStreamRequest{
+		HostPort: "example.ts.net:10000",
+		Source:   ln.Addr().String(),
+		TCP:      true,
+	}
+	served := func() bool {
+		sc := b.ServeConfig()
+		return sc.Valid() && sc.TCP().Has(10000)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- b.StreamServe(ctx, httptest.NewRecorder(), req) }()
+	for !served() {
+		select {
+		case err := <-errc:
+			t.Fatalf("StreamServe returned early: %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if sc := b.ServeConfig().AsStruct(); sc.TCP[10000].TCPForward != req.Source || len(sc.Web) != 0 {
+		t.Fatalf("got serve config %+v; want only a TCPForward to %s on port 10000", sc, req.Source)
+	}
+
+	// Connections to the port are forwarded to Source as is.
+	handler := b.tcpHandlerForServe(10000, netip.MustParseAddrPort("100.150.151.152:1234"), nil)
+	if handler == nil {
+		t.Fatal("no handler for port 10000")
+	}
+	client, server := net.Pipe()
+	go handler(server)
+	defer client.Close()
+	if _, err := io.WriteString(client, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "ping" {
+		t.Errorf("got %q back; want ping", got)
+	}
+
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatalf("StreamServe: %v", err)
+	}
+	if served() {
+		t.Error("TCP port 10000 still served after the stream ended")
+	}
+}
+
+func TestStreamServeMergeConflict(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	// Another process is already serving a different backend on
+	// the same mount point.
+	conf := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":    {Proxy: "http://127.0.0.1:3000"},
+				"/foo": {Proxy: "http://127.0.0.1:3001"},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	req := ipn.ServeStreamRequest{
+		HostPort:   "example.ts.net:443",
+		Source:     "http://127.0.0.1:4000",
+		MountPoint: "/",
+	}
+	if err := b.StreamServe(context.Background(), httptest.NewRecorder(), req); err == nil {
+		t.Fatal("StreamServe succeeded; want conflict error")
+	}
+	if got := b.ServeConfig().AsStruct(); !reflect.DeepEqual(got, conf) {
+		t.Errorf("serve config changed on conflict:\ngot  %+v\nwant %+v", got, conf)
+	}
+
+	// A different mount point is merged in alongside the others.
+	req.MountPoint = "/bar"
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- b.StreamServe(ctx, httptest.NewRecorder(), req) }()
+	for b.ServeConfig().AsStruct().GetWebHandler(req.HostPort, "/bar") == nil {
+		select {
+		case err := <-errc:
+			t.Fatalf("StreamServe returned early: %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	sc := b.ServeConfig().AsStruct()
+	for _, mount := range []string{"/", "/foo"} {
+		if sc.GetWebHandler(req.HostPort, mount) == nil {
+			t.Errorf("handler for %q was dropped", mount)
+		}
+	}
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatalf("StreamServe: %v", err)
+	}
+}
+
+func TestStreamServeSharedEntries(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	const hp = ipn.HostPort("example.ts.net:443")
+	start := func(mount string) (stop func()) {
+		req := ipn.ServeStreamRequest{
+			HostPort:    hp,
+			Source:      "http://127.0.0.1:4000",
+			MountPoint:  mount,
+			Funnel:      true,
+			FunnelPaths: []string{mount},
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		errc := make(chan error, 1)
+		go func() { errc <- b.StreamServe(ctx, httptest.NewRecorder(), req) }()
+		for b.ServeConfig().AsStruct().GetWebHandler(hp, mount) == nil {
+			select {
+			case err := <-errc:
+				t.Fatalf("StreamServe for %s returned early: %v", mount, err)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+		return func() {
+			cancel()
+			if err := <-errc; err != nil {
+				t.Fatalf("StreamServe for %s: %v", mount, err)
+			}
+		}
+	}
+
+	stopA := start("/a")
+	stopB := start("/b")
+	stopA()
+
+	// The second session keeps serving, on the port and over Funnel,
+	// but only its own path.
+	sc := b.ServeConfig().AsStruct()
+	if sc.GetWebHandler(hp, "/a") != nil {
+		t.Error("handler for the ended session is still set")
+	}
+	if sc.GetWebHandler(hp, "/b") == nil {
+		t.Error("handler for the running session was deleted")
+	}
+	if sc.TCP[443] == nil {
+		t.Error("TCP port 443 was deleted")
+	}
+	if !sc.AllowFunnel[hp] {
+		t.Error("Funnel was turned off")
+	}
+	if got, want := sc.FunnelPaths[hp], []string{"/b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FunnelPaths = %q; want %q", got, want)
+	}
+
+	stopB()
+	sc = b.ServeConfig().AsStruct()
+	if len(sc.Web) != 0 || len(sc.TCP) != 0 || len(sc.AllowFunnel) != 0 || len(sc.FunnelPaths) != 0 {
+		t.Errorf("serve config after both sessions ended = %+v; want empty", sc)
+	}
+}
+
+func TestServeHTTPProxyTLSMinVersion(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	// Start a backend that only speaks TLS 1.0 and 1.1.
+	testServ := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "ok")
+		},
+	))
+	testServ.TLS = &tls.Config{
+		MinVersion: tls.VersionTLS10,
+		MaxVersion: tls.VersionTLS11,
+	}
+	testServ.StartTLS()
+	defer testServ.Close()
+	backend := "https+insecure://" + testServ.Listener.Addr().String()
+
+	tests := []struct {
+		minVersion string
+		wantCode   int
+	}{
+		{"", http.StatusBadGateway}, // default is TLS 1.2
+		{"tls12", http.StatusBadGateway},
+		{"tls11", http.StatusOK},
+	}
+	for _, tt := range tests {
+		conf := &ipn.ServeConfig{
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: backend, TLSMinVersion: tt.minVersion},
+				}},
+			},
+		}
+		if err := b.SetServeConfig(conf, ""); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, newTestServeRequest("GET", "/", "100.150.151.152"))
+		if w.Code != tt.wantCode {
+			t.Errorf("TLSMinVersion %q: got status %d; want %d", tt.minVersion, w.Code, tt.wantCode)
+		}
+	}
+}
+
+func TestUpstreamTLSConfigRenegotiation(t *testing.T) {
+	tests := []struct {
+		reneg string
+		want  tls.RenegotiationSupport
+	}{
+		{"", tls.RenegotiateNever},
+		{"none", tls.RenegotiateNever},
+		{"once", tls.RenegotiateOnceAsClient},
+		{"freely", tls.RenegotiateFreelyAsClient},
+	}
+	for _, tt := range tests {
+		h := &ipn.HTTPHandler{Proxy: "https+insecure://127.0.0.1:3000", TLSRenegotiation: tt.reneg}
+		conf, err := upstreamTLSConfig(h.View(), true)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.reneg, err)
+		}
+		if conf.Renegotiation != tt.want {
+			t.Errorf("%q: Renegotiation = %v; want %v", tt.reneg, conf.Renegotiation, tt.want)
+		}
+	}
+}
+
+func TestServeHTTPProxyUpstreamRootCA(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	testServ := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "ok")
+		},
+	))
+	defer testServ.Close()
+	backend := "https://" + testServ.Listener.Addr().String()
+	caPEM := string(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: testServ.Certificate().Raw,
+	}))
+
+	tests := []struct {
+		name     string
+		rootCA   string
+		wantCode int
+	}{
+		{"system-roots", "", http.StatusBadGateway},
+		{"custom-root", caPEM, http.StatusOK},
+	}
+	for _, tt := range tests {
+		conf := &ipn.ServeConfig{
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: backend, UpstreamRootCA: tt.rootCA},
+				}},
+			},
+		}
+		if err := b.SetServeConfig(conf, ""); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, newTestServeRequest("GET", "/", "100.150.151.152"))
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: got status %d; want %d", tt.name, w.Code, tt.wantCode)
+		}
+	}
+}
+
+func TestServeHTTPProxyUpstreamTLSSNI(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	type seen struct{ sni, host string }
+	seenc := make(chan seen, 1)
+	testServ := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			seenc <- seen{r.TLS.ServerName, r.Host}
+		},
+	))
+	defer testServ.Close()
+	// The test server's certificate is for example.com and 127.0.0.1,
+	// not localhost.
+	_, port, _ := net.SplitHostPort(testServ.Listener.Addr().String())
+	backend := "https://localhost:" + port
+	caPEM := string(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: testServ.Certificate().Raw,
+	}))
+
+	tests := []struct {
+		sni      string
+		wantCode int
+	}{
+		{"", http.StatusBadGateway},
+		{"example.com", http.StatusOK},
+	}
+	for _, tt := range tests {
+		conf := &ipn.ServeConfig{
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: backend, UpstreamRootCA: caPEM, UpstreamTLSSNI: tt.sni},
+				}},
+			},
+		}
+		if err := b.SetServeConfig(conf, ""); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, newTestServeRequest("GET", "/", "100.150.151.152"))
+		if w.Code != tt.wantCode {
+			t.Fatalf("UpstreamTLSSNI %q: got status %d; want %d", tt.sni, w.Code, tt.wantCode)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		got := <-seenc
+		if got.sni != tt.sni {
+			t.Errorf("backend saw SNI %q; want %q", got.sni, tt.sni)
+		}
+		if got.host != "example.ts.net" {
+			t.Errorf("backend saw Host %q; want %q", got.host, "example.ts.net")
+		}
+	}
+}
+
+func TestServeHTTPProxyUpstreamUserAgent(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	// The backend only accepts requests from a known User-Agent.
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.UserAgent() != "known-agent/1.0" {
+				http.Error(w, "unknown user agent", http.StatusForbidden)
+			}
+		},
+	))
+	defer testServ.Close()
+
+	tests := []struct {
+		userAgent string
+		wantCode  int
+	}{
+		{"", http.StatusForbidden}, // pass through the client's
+		{"known-agent/1.0", http.StatusOK},
+	}
+	for _, tt := range tests {
+		conf := &ipn.ServeConfig{
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: testServ.URL, UpstreamUserAgent: tt.userAgent},
+				}},
+			},
+		}
+		if err := b.SetServeConfig(conf, ""); err != nil {
+			t.Fatal(err)
+		}
+		req := newTestServeRequest("GET", "/", "100.150.151.152")
+		req.Header.Set("User-Agent", "curl/8.0")
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		if w.Code != tt.wantCode {
+			t.Errorf("UpstreamUserAgent %q: got status %d; want %d", tt.userAgent, w.Code, tt.wantCode)
+		}
+	}
+}
+
+func TestServeHTTPProxyRequestSigning(t *testing.T) {
+	b := newTestServeBackend(t)
+	start := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+	b.clock = tstest.NewClock(tstest.ClockOpts{Start: start})
+
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	verified := make(chan error, 1)
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			verified <- ipn.VerifyRequestSignature(r.Header.Get(ipn.RequestSignatureHeader), []byte("s3cret"), r.Method, r.URL.RequestURI(), ipn.DefaultRequestSignatureMaxDrift, start)
+		},
+	))
+	defer testServ.Close()
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/app/": {Proxy: testServ.URL + "/base", RequestSigningSecretFile: secretFile},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The backend can verify the signature of the request as it sees
+	// it, after the mount point is stripped and the target's path
+	// added, and a client's own signature header is replaced.
+	req := newTestServeRequest("POST", "/app/hooks?x=1", "100.150.151.152")
+	req.Header.Set(ipn.RequestSignatureHeader, "ts=1,v1=00")
+	w := httptest.NewRecorder()
+	b.serveWebHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d; want %d", w.Code, http.StatusOK)
+	}
+	if err := <-verified; err != nil {
+		t.Errorf("backend couldn't verify signature: %v", err)
+	}
+
+	// An unreadable secret fails the request rather than sending it
+	// unsigned.
+	if err := os.Remove(secretFile); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	b.serveWebHandler(w, newTestServeRequest("GET", "/app/", "100.150.151.152"))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d; want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestServeHTTPProxyBearerTokenFile(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	authc := make(chan string, 1)
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			authc <- r.Header.Get("Authorization")
+		},
+	))
+	defer testServ.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: testServ.URL, BearerTokenFile: tokenFile},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The token file is re-read on each request, so rotating it takes
+	// effect immediately.
+	for _, tok := range []string{"token1", "token2"} {
+		if err := os.WriteFile(tokenFile, []byte(tok+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		req := newTestServeRequest("GET", "/", "100.150.151.152")
+		req.Header.Set("Authorization", "Bearer from-client")
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d; want %d", w.Code, http.StatusOK)
+		}
+		if got, want := <-authc, "Bearer "+tok; got != want {
+			t.Errorf("backend got Authorization %q; want %q", got, want)
+		}
+	}
+
+	// An unreadable token file fails the request rather than
+	// sending a stale token.
+	if err := os.Remove(tokenFile); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	b.serveWebHandler(w, newTestServeRequest("GET", "/", "100.150.151.152"))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d; want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	select {
+	case got := <-authc:
+		t.Errorf("backend was called with Authorization %q", got)
+	default:
+	}
+}
+
+func TestServeHTTPProxyOIDCUpstreamAuth(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	var tokenRequests atomic.Int32
+	var provider *httptest.Server
+	provider = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/.well-known/openid-configuration":
+				fmt.Fprintf(w, `{"token_endpoint": %q}`, provider.URL+"/token")
+			case "/token":
+				id, secret, ok := r.BasicAuth()
+				if !ok {
+					r.ParseForm()
+					id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+				}
+				if r.FormValue("grant_type") != "client_credentials" || id != "serve" || secret != "s3cret" {
+					http.Error(w, `{"error": "invalid_client"}`, http.StatusUnauthorized)
+					return
+				}
+				n := tokenRequests.Add(1)
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"access_token": "token%d", "token_type": "Bearer", "expires_in": 3600}`, n)
+			default:
+				http.NotFound(w, r)
+			}
+		},
+	))
+	defer provider.Close()
+
+	authc := make(chan string, 1)
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			authc <- r.Header.Get("Authorization")
+		},
+	))
+	defer testServ.Close()
+
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: testServ.URL, OIDCUpstreamAuth: &ipn.OIDCUpstreamAuth{
+					DiscoveryURL:     provider.URL + "/.well-known/openid-configuration",
+					ClientID:         "serve",
+					ClientSecretFile: secretFile,
+				}},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The token is fetched once and reused until it's close to expiry.
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, newTestServeRequest("GET", "/", "100.150.151.152"))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d; want %d", w.Code, http.StatusOK)
+		}
+		if got, want := <-authc, "Bearer token1"; got != want {
+			t.Errorf("backend got Authorization %q; want %q", got, want)
+		}
+	}
+	if n := tokenRequests.Load(); n != 1 {
+		t.Errorf("got %d token requests; want 1", n)
+	}
+}
+
+func TestServeHTTPProxyOIDCUpstreamAuthFailure(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	provider := httptest.NewServer(http.NotFoundHandler())
+	defer provider.Close()
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("backend was called with Authorization %q", r.Header.Get("Authorization"))
+		},
+	))
+	defer testServ.Close()
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: testServ.URL, OIDCUpstreamAuth: &ipn.OIDCUpstreamAuth{
+					DiscoveryURL:     provider.URL + "/.well-known/openid-configuration",
+					ClientID:         "serve",
+					ClientSecretFile: filepath.Join(t.TempDir(), "secret"),
+				}},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	b.serveWebHandler(w, newTestServeRequest("GET", "/", "100.150.151.152"))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d; want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+// signTestJWT returns a JWT with claims, signed with key using alg,
+// which is ES256 or RS256.
+func signTestJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	enc := func(v any) string {
+		j, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(j)
+	}
+	signed := enc(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + enc(claims)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestServeHTTPProxyOIDCAccessControl(t *testing.T) {
+	b := newTestServeBackend(t)
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)})
+	b.clock = clock
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+	var jwksRequests atomic.Int32
+	var provider *httptest.Server
+	provider = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/.well-known/openid-configuration":
+				fmt.Fprintf(w, `{"issuer": %q, "jwks_uri": %q}`, provider.URL, provider.URL+"/jwks")
+			case "/jwks":
+				jwksRequests.Add(1)
+				json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+					{"kty": "EC", "kid": "ec", "use": "sig", "crv": "P-256",
+						"x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+					{"kty": "RSA", "kid": "rsa", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+				}})
+			default:
+				http.NotFound(w, r)
+			}
+		},
+	))
+	defer provider.Close()
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "ok")
+		},
+	))
+	defer backend.Close()
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: backend.URL, OIDCAccessControl: &ipn.OIDCAccessControl{
+					DiscoveryURL: provider.URL + "/.well-known/openid-configuration",
+					Audience:     "app",
+				}},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	now := clock.Now().Unix()
+	claims := func(mod func(map[string]any)) map[string]any {
+		c := map[string]any{"iss": provider.URL, "aud": "app", "sub": "alice", "exp": now + 3600}
+		if mod != nil {
+			mod(c)
+		}
+		return c
+	}
+	tests := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+		wantChallenge string
+	}{
+		{"no-token", "", 401, `Bearer realm="example.ts.net"`},
+		{"basic-auth", "Basic YWxpY2U6cGFzcw==", 401, `Bearer realm="example.ts.net"`},
+		{"es256", "Bearer " + signTestJWT(t, "ES256", "ec", ecKey, claims(nil)), 200, ""},
+		{"rs256", "Bearer " + signTestJWT(t, "RS256", "rsa", rsaKey, claims(nil)), 200, ""},
+		{"audience-list", "Bearer " + signTestJWT(t, "ES256", "ec", ecKey, claims(func(c map[string]any) { c["aud"] = []string{"other", "app"} })), 200, ""},
+		{"wrong-audience", "Bearer " + signTestJWT(t, "ES256", "ec", ecKey, claims(func(c map[string]any) { c["aud"] = "other" })), 401, `Bearer realm="example.ts.net", error="invalid_token"`},
+		{"wrong-issuer", "Bearer " + signTestJWT(t, "ES256", "ec", ecKey, claims(func(c map[string]any) { c["iss"] = "https://evil.example.com" })), 401, `Bearer realm="example.ts.net", error="invalid_token"`},
+		{"expired", "Bearer " + signTestJWT(t, "ES256", "ec", ecKey, claims(func(c map[string]any) { c["exp"] = now - 3600 })), 401, `Bearer realm="example.ts.net", error="invalid_token"`},
+		{"no-expiry", "Bearer " + signTestJWT(t, "ES256", "ec", ecKey, claims(func(c map[string]any) { delete(c, "exp") })), 401, `Bearer realm="example.ts.net", error="invalid_token"`},
+		{"unknown-key", "Bearer " + signTestJWT(t, "ES256", "ec", otherKey, claims(nil)), 401, `Bearer realm="example.ts.net", error="invalid_token"`},
+		{"alg-none", "Bearer " + strings.TrimSuffix(signTestJWT(t, "none", "ec", ecKey, claims(nil)), "."), 401, `Bearer realm="example.ts.net", error="invalid_token"`},
+		{"garbage", "Bearer not-a-jwt", 401, `Bearer realm="example.ts.net", error="invalid_token"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newTestServeRequest("GET", "/", "100.150.151.152")
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			b.serveWebHandler(w, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %d; want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("WWW-Authenticate"); got != tt.wantChallenge {
+				t.Errorf("got WWW-Authenticate %q; want %q", got, tt.wantChallenge)
+			}
+		})
+	}
+
+	// The keys are cached for 5 minutes, even for unknown key IDs, which
+	// only refetch them once they're over a minute old.
+	if n := jwksRequests.Load(); n != 1 {
+		t.Errorf("got %d JWKS requests; want 1", n)
+	}
+	// After that, they're still used while they're fetched again in the
+	// background.
+	clock.Advance(6 * time.Minute)
+	req := newTestServeRequest("GET", "/", "100.150.151.152")
+	req.Header.Set("Authorization", "Bearer "+signTestJWT(t, "ES256", "ec", ecKey, claims(nil)))
+	w := httptest.NewRecorder()
+	b.serveWebHandler(w, req)
+	if w.Code != 200 {
+		t.Errorf("after 6m: got status %d; want 200", w.Code)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for jwksRequests.Load() != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := jwksRequests.Load(); n != 2 {
+		t.Errorf("after 6m: got %d JWKS requests; want 2", n)
+	}
+}
+
+func TestOIDCAccessControlKeyFetches(t *testing.T) {
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)})
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+	var requests atomic.Int32
+	release := make(chan struct{})
+	provider := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			<-release
+			json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+				{"kty": "EC", "kid": "ec", "crv": "P-256",
+					"x": b64(key.X.FillBytes(make([]byte, 32))), "y": b64(key.Y.FillBytes(make([]byte, 32)))},
+			}})
+		},
+	))
+	defer provider.Close()
+	a := newOIDCAccessControl(ipn.OIDCAccessControl{DiscoveryURL: provider.URL}, clock, t.Logf)
+
+	// Requests waiting for the first keys share a single fetch.
+	const n = 10
+	errc := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			keys, err := a.providerKeys(context.Background(), provider.URL, "ec")
+			if err == nil && len(keys) != 1 {
+				err = fmt.Errorf("got %d keys; want 1", len(keys))
+			}
+			errc <- err
+		}()
+	}
+	for requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	release <- struct{}{}
+	for i := 0; i < n; i++ {
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("got %d JWKS requests; want 1", got)
+	}
+
+	// Once the keys are old, they're returned without waiting for the
+	// fetch of new ones, which isn't given up on with the request.
+	clock.Advance(6 * time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	keys, err := a.providerKeys(ctx, provider.URL, "ec")
+	cancel()
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("with stale keys: got %d keys, %v; want 1 key", len(keys), err)
+	}
+	for requests.Load() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	release <- struct{}{}
+	for {
+		a.mu.Lock()
+		fetched := a.fetched
+		a.mu.Unlock()
+		if fetched.Equal(clock.Now()) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// A request waiting for a key that isn't cached gives up when its
+	// context is done, with the cached keys, but the fetch doesn't.
+	clock.Advance(2 * time.Minute)
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if keys, err := a.providerKeys(ctx, provider.URL, "rotated"); err != nil || len(keys) != 1 {
+		t.Errorf("unknown key with context done: got %d keys, %v; want the cached key", len(keys), err)
+	}
+	for requests.Load() != 3 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+}
+
+func TestServeConfigFilesForClient(t *testing.T) {
+	b := newTestServeBackend(t)
+	h := &ipn.HTTPHandler{
+		Proxy: "http://127.0.0.1:3000",
+		OAuth2Config: &ipn.OAuth2ClientConfig{
+			TokenURL:         "https://id.example.com/token",
+			ClientID:         "serve",
+			ClientSecretFile: "/etc/serve/secret",
+		},
+	}
+	conf := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{"/": h}},
+		},
+	}
+
+	// A client that isn't root can't name a file for tailscaled to
+	// read, but can keep one that root set while changing the rest.
+	if err := b.SetServeConfigForClient(conf, "", false); !errors.Is(err, ipn.ErrServeFilesDenied) {
+		t.Fatalf("new ClientSecretFile from non-root: got %v; want ErrServeFilesDenied", err)
+	}
+	if err := b.SetServeConfigForClient(conf, "", true); err != nil {
+		t.Fatal(err)
+	}
+	conf.Web["example.ts.net:443"].Handlers["/api"] = &ipn.HTTPHandler{Proxy: "http://127.0.0.1:4000"}
+	if err := b.SetServeConfigForClient(conf, "", false); err != nil {
+		t.Fatalf("unchanged ClientSecretFile from non-root: %v", err)
+	}
+	h.OAuth2Config.TokenURL = "https://evil.example.com/token"
+	if err := b.SetServeConfigForClient(conf, "", false); !errors.Is(err, ipn.ErrServeFilesDenied) {
+		t.Fatalf("changed TokenURL from non-root: got %v; want ErrServeFilesDenied", err)
+	}
+
+	req := ipn.ServeStreamRequest{
+		HostPort:   "example.ts.net:443",
+		Source:     "http://127.0.0.1:5000",
+		MountPoint: "/stream",
+		Handler:    h,
+	}
+	w := streamLines{ResponseWriter: httptest.NewRecorder(), lines: make(chan []byte, 1)}
+	if err := b.StreamServeForClient(context.Background(), w, req, false); !errors.Is(err, ipn.ErrServeFilesDenied) {
+		t.Fatalf("stream from non-root: got %v; want ErrServeFilesDenied", err)
+	}
+}
+
+func TestServeHTTPProxyOAuth2Config(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	var tokenRequests atomic.Int32
+	expiresIn := 3600
+	provider := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/oauth/token" {
+				http.NotFound(w, r)
+				return
+			}
+			id, secret, ok := r.BasicAuth()
+			if !ok {
+				r.ParseForm()
+				id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+			}
+			if r.FormValue("grant_type") != "client_credentials" || id != "serve" || secret != "s3cret" || r.FormValue("scope") != "read write" {
+				http.Error(w, `{"error": "invalid_client"}`, http.StatusUnauthorized)
+				return
+			}
+			n := tokenRequests.Add(1)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"access_token": "token%d", "token_type": "Bearer", "expires_in": %d}`, n, expiresIn)
+		},
+	))
+	defer provider.Close()
+
+	authc := make(chan string, 1)
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			authc <- r.Header.Get("Authorization")
+		},
+	))
+	defer testServ.Close()
+
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: testServ.URL, OAuth2Config: &ipn.OAuth2ClientConfig{
+					TokenURL:         provider.URL + "/oauth/token",
+					ClientID:         "serve",
+					ClientSecretFile: secretFile,
+					Scopes:           []string{"read", "write"},
+				}},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	send := func(wantAuth string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, newTestServeRequest("GET", "/", "100.150.151.152"))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d; want %d", w.Code, http.StatusOK)
+		}
+		if got := <-authc; got != wantAuth {
+			t.Errorf("backend got Authorization %q; want %q", got, wantAuth)
+		}
+	}
+
+	// A token expiring within 30 seconds isn't reused.
+	expiresIn = 20
+	send("Bearer token1")
+	send("Bearer token2")
+
+	// Otherwise, it's fetched once and reused.
+	expiresIn = 3600
+	send("Bearer token3")
+	send("Bearer token3")
+}
+
+func TestServeHTTPProxyForceHTTP1(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	protoc := make(chan string, 1)
+	testServ := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			protoc <- r.Proto
+		},
+	))
+	testServ.EnableHTTP2 = true
+	testServ.StartTLS()
+	defer testServ.Close()
+	backend := "https+insecure://" + testServ.Listener.Addr().String()
+
+	tests := []struct {
+		forceHTTP1 bool
+		wantProto  string
+	}{
+		{false, "HTTP/2.0"},
+		{true, "HTTP/1.1"},
+	}
+	for _, tt := range tests {
+		conf := &ipn.ServeConfig{
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: backend, ForceHTTP1: tt.forceHTTP1},
+				}},
+			},
+		}
+		if err := b.SetServeConfig(conf, ""); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, newTestServeRequest("GET", "/", "100.150.151.152"))
+		if w.Code != http.StatusOK {
+			t.Fatalf("ForceHTTP1=%v: got status %d; want %d", tt.forceHTTP1, w.Code, http.StatusOK)
+		}
+		if got := <-protoc; got != tt.wantProto {
+			t.Errorf("ForceHTTP1=%v: backend got %s; want %s", tt.forceHTTP1, got, tt.wantProto)
+		}
+	}
+}
+
+func TestServeHTTPProxyUpstreamReadTimeout(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	release := make(chan struct{})
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/drip":
+				// Trickle out the body, taking longer in total
+				// than the per-read timeout.
+				for _, c := range "abcde" {
+					io.WriteString(w, string(c))
+					w.(http.Flusher).Flush()
+					time.Sleep(40 * time.Millisecond)
+				}
+			case "/stall":
+				io.WriteString(w, "a")
+				w.(http.Flusher).Flush()
+				<-release
+				io.WriteString(w, "b")
+			}
+		},
+	))
+	defer testServ.Close()
+	defer close(release) // before Close, which waits for the handler
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: testServ.URL, UpstreamReadTimeout: 150 * time.Millisecond},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		wantBody string
+	}{
+		{"/drip", "abcde"},
+		{"/stall", "a"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, newTestServeRequest("GET", tt.path, "100.150.151.152"))
+		if got := w.Body.String(); got != tt.wantBody {
+			t.Errorf("%s: got body %q; want %q", tt.path, got, tt.wantBody)
+		}
+	}
+}
+
+func TestServeHTTPProxyUpstreamStallTimeout(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	release := make(chan struct{})
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/slow-start":
+				// Take longer than the stall timeout to respond,
+				// which only UpstreamReadTimeout limits.
+				time.Sleep(300 * time.Millisecond)
+				io.WriteString(w, "ok")
+			case "/stall":
+				io.WriteString(w, "abc")
+				w.(http.Flusher).Flush()
+				<-release
+				io.WriteString(w, "d")
+			}
+		},
+	))
+	defer testServ.Close()
+	defer close(release) // before Close, which waits for the handler
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: testServ.URL, UpstreamStallTimeout: 150 * time.Millisecond},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		wantBody string
+	}{
+		{"/slow-start", "ok"},
+		{"/stall", "abc"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, newTestServeRequest("GET", tt.path, "100.150.151.152"))
+		if got := w.Body.String(); got != tt.wantBody {
+			t.Errorf("%s: got body %q; want %q", tt.path, got, tt.wantBody)
+		}
+	}
+}
+
+func TestServeHTTPProxyMaxResponseBytes(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	body := strings.Repeat("x", 100)
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/stream" {
+				// Without a Content-Length, the size is only known
+				// once the body has been read.
+				io.WriteString(w, body[:5])
+				w.(http.Flusher).Flush()
+				io.WriteString(w, body[5:])
+				return
+			}
+			io.WriteString(w, body)
+		},
+	))
+	defer testServ.Close()
+
+	tests := []struct {
+		limit      int64
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{100, "/", http.StatusOK, body},
+		{100, "/stream", http.StatusOK, body},
+		{99, "/", http.StatusBadGateway, ""},
+		{10, "/stream", http.StatusOK, body[:10]},
+	}
+	for _, tt := range tests {
+		conf := &ipn.ServeConfig{
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: testServ.URL, MaxResponseBytes: tt.limit},
+				}},
+			},
+		}
+		if err := b.SetServeConfig(conf, ""); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, newTestServeRequest("GET", tt.path, "100.150.151.152"))
+		if w.Code != tt.wantStatus || w.Body.String() != tt.wantBody {
+			t.Errorf("limit %d, %s: got %d %q; want %d %q", tt.limit, tt.path, w.Code, w.Body, tt.wantStatus, tt.wantBody)
+		}
+	}
+}
+
+func TestServeRequestTrace(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	gotTraceParent := make(chan string, 1)
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			gotTraceParent <- r.Header.Get("Traceparent")
+			io.WriteString(w, "ok")
+		},
+	))
+	defer testServ.Close()
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: testServ.URL, TraceRequests: true, PropagateTraceParent: true},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	logs := make(chan ipn.FunnelRequestLog, 10)
+	b.mu.Lock()
+	b.serveStreamers = map[uint16]map[uint32]func(ipn.FunnelRequestLog){
+		443: {1: func(l ipn.FunnelRequestLog) { logs <- l }},
+	}
+	b.mu.Unlock()
+
+	const clientTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	tests := []struct {
+		name        string
+		traceParent string // sent by the client
+		wantTraceID string // or empty for a new trace
+	}{
+		{"continue-trace", "00-" + clientTraceID + "-00f067aa0ba902b7-01", clientTraceID},
+		{"new-trace", "", ""},
+		{"invalid-trace", "00-" + clientTraceID + "-0000000000000000-01", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestServeRequest("GET", "/", "100.150.151.152")
+			if tt.traceParent != "" {
+				r.Header.Set("Traceparent", tt.traceParent)
+			}
+			w := httptest.NewRecorder()
+			b.serveWebHandler(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d", w.Code)
+			}
+			sent := <-gotTraceParent
+			traceID, _, ok := parseTraceParent(sent)
+			if !ok || sent == tt.traceParent {
+				t.Fatalf("backend got traceparent %q; want a new valid one", sent)
+			}
+			if tt.wantTraceID != "" && traceID != tt.wantTraceID {
+				t.Errorf("backend got trace ID %s; want %s", traceID, tt.wantTraceID)
+			}
+			if tt.wantTraceID == "" && traceID == clientTraceID {
+				t.Errorf("backend got the client's trace ID %s; want a new one", traceID)
+			}
+
+			if l := <-logs; l.Trace != nil {
+				t.Fatalf("first log is for the end of the request: %+v", l.Trace)
+			}
+			tl := (<-logs).Trace
+			if tl == nil {
+				t.Fatal("no trace log at the end of the request")
+			}
+			if tl.TraceParent != sent {
+				t.Errorf("logged traceparent %q; backend got %q", tl.TraceParent, sent)
+			}
+			if tl.GotConn == 0 || tl.WroteHeaders < tl.GotConn || tl.FirstByte < tl.WroteHeaders || tl.Done < tl.FirstByte {
+				t.Errorf("timings out of order: %+v", tl)
+			}
+		})
+	}
+}
+
+func TestCorrelationHeaderPropagation(t *testing.T) {
+	b := newTestServeBackend(t)
+	b.netMap.DERPMap = &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {RegionID: 1, RegionCode: "nyc"},
+		},
+	}
+	ingressPeer := (&tailcfg.Node{DERP: tailcfg.DerpMagicIP + ":1"}).View()
+
+	gotHeaders := make(chan http.Header, 1)
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			gotHeaders <- r.Header.Clone()
+		},
+	))
+	defer testServ.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logs := httptest.NewRecorder() // written to by serveWebHandler below
+	req := ipn.ServeStreamRequest{
+		HostPort:     "example.ts.net:443",
+		Source:       testServ.URL,
+		MountPoint:   "/",
+		Funnel:       true,
+		SessionLabel: "tenant1",
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- b.StreamServe(ctx, logs, req) }()
+	var session string
+	for session == "" {
+		select {
+		case err := <-errc:
+			t.Fatalf("StreamServe returned early: %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+		b.mu.Lock()
+		session = b.funnelSessions[443]
+		b.mu.Unlock()
+	}
+
+	send := func(funnel bool, spoof bool) http.Header {
+		t.Helper()
+		r := newTestServeRequest("GET", "/", "1.2.3.4")
+		if funnel {
+			sctx, _ := getServeHTTPContext(r)
+			sctx.Funnel = &funnelFlow{IngressPeer: ingressPeer}
+		}
+		if spoof {
+			r.Header.Set("X-Tailscale-Session", "spoofed")
+			r.Header.Set("X-Tailscale-Session-Label", "spoofed")
+			r.Header.Set("X-Tailscale-Edge-Region", "spoofed")
+		}
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d", w.Code)
+		}
+		return <-gotHeaders
+	}
+
+	h := send(true, true)
+	if got := h.Get("X-Tailscale-Session"); got != session {
+		t.Errorf("X-Tailscale-Session = %q; want %q", got, session)
+	}
+	if got := h.Get("X-Tailscale-Edge-Region"); got != "nyc" {
+		t.Errorf("X-Tailscale-Edge-Region = %q; want nyc", got)
+	}
+	if got := h.Get("X-Tailscale-Session-Label"); got != "tenant1" {
+		t.Errorf("X-Tailscale-Session-Label = %q; want tenant1", got)
+	}
+	// The request log has the same region, to correlate with.
+	var log ipn.FunnelRequestLog
+	if err := json.Unmarshal(logs.Body.Bytes(), &log); err != nil {
+		t.Fatalf("request log %q: %v", logs.Body, err)
+	}
+	if log.EdgeRegion != "nyc" {
+		t.Errorf("request log EdgeRegion = %q; want nyc", log.EdgeRegion)
+	}
+
+	// Requests from the tailnet have no edge region, and clients can't
+	// set either header themselves.
+	h = send(false, true)
+	if got := h.Get("X-Tailscale-Session"); got != session {
+		t.Errorf("tailnet request: X-Tailscale-Session = %q; want %q", got, session)
+	}
+	if got := h.Values("X-Tailscale-Edge-Region"); len(got) != 0 {
+		t.Errorf("tailnet request: X-Tailscale-Edge-Region = %q; want none", got)
+	}
+
+	// With NoSessionHeaders, neither is sent.
+	sc := b.ServeConfig().AsStruct()
+	sc.Web["example.ts.net:443"].Handlers["/"].NoSessionHeaders = true
+	if err := b.SetServeConfig(sc, ""); err != nil {
+		t.Fatal(err)
+	}
+	h = send(true, true)
+	for _, k := range []string{"X-Tailscale-Session", "X-Tailscale-Session-Label", "X-Tailscale-Edge-Region"} {
+		if got := h.Values(k); len(got) != 0 {
+			t.Errorf("with NoSessionHeaders: %s = %q; want none", k, got)
+		}
+	}
+
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s, ok := b.funnelSessions[443]; ok {
+		t.Errorf("session %q still recorded after the stream ended", s)
+	}
+	if l, ok := b.funnelSessionLabels[443]; ok {
+		t.Errorf("session label %q still recorded after the stream ended", l)
+	}
+}
+
+func TestServeSlowRequestLog(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				time.Sleep(200 * time.Millisecond)
+			}
+			io.WriteString(w, "ok")
+		},
+	))
+	defer testServ.Close()
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/api": {Proxy: testServ.URL, SlowRequestThreshold: 100 * time.Millisecond},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	logs := make(chan ipn.FunnelRequestLog, 10)
+	b.mu.Lock()
+	b.serveStreamers = map[uint16]map[uint32]func(ipn.FunnelRequestLog){
+		443: {1: func(l ipn.FunnelRequestLog) { logs <- l }},
+	}
+	b.mu.Unlock()
+
+	for _, path := range []string{"/api/fast", "/api/slow"} {
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, newTestServeRequest("GET", path, "100.150.151.152"))
+		if got := w.Body.String(); got != "ok" {
+			t.Fatalf("%s: got body %q; want ok", path, got)
+		}
+	}
+	close(logs)
+
+	var slow []ipn.FunnelRequestLog
+	n := 0
+	for l := range logs {
+		n++
+		if l.Slow {
+			slow = append(slow, l)
+		}
+	}
+	if n != 3 || len(slow) != 1 {
+		t.Fatalf("got %d logs, %d slow; want a log for each request and one slow", n, len(slow))
+	}
+	if l := slow[0]; l.Path != "/api/slow" || l.UpstreamLatency < 200*time.Millisecond {
+		t.Errorf("got slow log for %q after %v; want /api/slow after at least 200ms", l.Path, l.UpstreamLatency)
+	}
+}
+
+func TestServeRequestLogClientTLS(t *testing.T) {
+	b := newTestServeBackend(t)
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Text: "ok"},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	logs := make(chan ipn.FunnelRequestLog, 10)
+	b.mu.Lock()
+	b.serveStreamers = map[uint16]map[uint32]func(ipn.FunnelRequestLog){
+		443: {1: func(l ipn.FunnelRequestLog) { logs <- l }},
+	}
+	b.mu.Unlock()
+
+	tests := []struct {
+		name        string
+		tls         *tls.ConnectionState
+		wantVersion string
+		wantCipher  string
+	}{
+		{"tls13", &tls.ConnectionState{ServerName: "example.ts.net", Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_256_GCM_SHA384}, "TLS1.3", "TLS_AES_256_GCM_SHA384"},
+		{"tls12", &tls.ConnectionState{ServerName: "example.ts.net", Version: tls.VersionTLS12, CipherSuite: tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, "TLS1.2", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		{"no-cipher", &tls.ConnectionState{ServerName: "example.ts.net", Version: tls.VersionTLS13}, "TLS1.3", "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestServeRequest("GET", "/", "100.150.151.152")
+			r.TLS = tt.tls
+			w := httptest.NewRecorder()
+			b.serveWebHandler(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d", w.Code)
+			}
+			l := <-logs
+			if l.ClientTLSVersion != tt.wantVersion || l.ClientCipherSuite != tt.wantCipher {
+				t.Errorf("got %q, %q; want %q, %q", l.ClientTLSVersion, l.ClientCipherSuite, tt.wantVersion, tt.wantCipher)
+			}
+		})
+	}
+
+	// Without TLS terminated here, as for plain HTTP or forwarded TCP
+	// connections, neither is known.
+	if v, cs := clientTLSInfo(nil); v != "unknown" || cs != "unknown" {
+		t.Errorf("clientTLSInfo(nil) = %q, %q; want unknown, unknown", v, cs)
+	}
+}
+
+func TestServeResponseBodyBytesLog(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/big" {
+				w.Write(bytes.Repeat([]byte("x"), 100_000))
+			}
+		},
+	))
+	defer backend.Close()
+
+	for _, logBytes := range []bool{false, true} {
+		conf := &ipn.ServeConfig{
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/app/": {Proxy: backend.URL, LogResponseBodyBytes: logBytes},
+				}},
+			},
+		}
+		if err := b.SetServeConfig(conf, ""); err != nil {
+			t.Fatal(err)
+		}
+		logs := make(chan ipn.FunnelRequestLog, 10)
+		b.mu.Lock()
+		b.serveStreamers = map[uint16]map[uint32]func(ipn.FunnelRequestLog){
+			443: {1: func(l ipn.FunnelRequestLog) { logs <- l }},
+		}
+		b.mu.Unlock()
+
+		before := metricServeResponseBodyBytes.Value()
+		for _, path := range []string{"/app/empty", "/app/big"} {
+			w := httptest.NewRecorder()
+			b.serveWebHandler(w, newTestServeRequest("GET", path, "100.150.151.152"))
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: got status %d", path, w.Code)
+			}
+		}
+		close(logs)
+		var got []ipn.FunnelRequestLog
+		for l := range logs {
+			got = append(got, l)
+		}
+		// The metric counts bytes either way.
+		if n := metricServeResponseBodyBytes.Value() - before; n != 100_000 {
+			t.Errorf("LogResponseBodyBytes=%v: serve_response_body_bytes grew by %d; want 100000", logBytes, n)
+		}
+		if !logBytes {
+			// Only a log at the start of each request.
+			if len(got) != 2 {
+				t.Errorf("without LogResponseBodyBytes, got %d logs; want 2: %+v", len(got), got)
+			}
+			continue
+		}
+		// A log at the start of each request, and one at the end of
+		// the one with a body.
+		if len(got) != 3 {
+			t.Fatalf("got %d logs; want 3: %+v", len(got), got)
+		}
+		if l := got[2]; l.Path != "/app/big" || l.ResponseBodyBytes != 100_000 {
+			t.Errorf("got end log for %q with %d bytes; want /app/big with 100000", l.Path, l.ResponseBodyBytes)
+		}
+	}
+}
+
+func TestServePropagateRequestID(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/fail" {
+				// Drop the connection, for a 502.
+				c, _, _ := w.(http.Hijacker).Hijack()
+				c.Close()
+				return
+			}
+			w.Header().Set("X-Request-ID", "from-backend")
+			io.WriteString(w, r.Header.Get("X-Request-ID"))
+		},
+	))
+	defer backend.Close()
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: backend.URL, PropagateRequestID: true},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	logs := make(chan ipn.FunnelRequestLog, 10)
+	b.mu.Lock()
+	b.serveStreamers = map[uint16]map[uint32]func(ipn.FunnelRequestLog){
+		443: {1: func(l ipn.FunnelRequestLog) { logs <- l }},
+	}
+	b.mu.Unlock()
+
+	tests := []struct {
+		name       string
+		path       string
+		clientID   string
+		wantID     string // or empty for a new one
+		wantStatus int
+	}{
+		{"client-id", "/", "abc-123", "abc-123", http.StatusOK},
+		{"no-client-id", "/", "", "", http.StatusOK},
+		{"bad-client-id", "/", "has space", "", http.StatusOK},
+		{"error", "/fail", "abc-456", "abc-456", http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newTestServeRequest("GET", tt.path, "100.150.151.152")
+			if tt.clientID != "" {
+				req.Header.Set("X-Request-ID", tt.clientID)
+			}
+			w := httptest.NewRecorder()
+			b.serveWebHandler(w, req)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d; want %d", w.Code, tt.wantStatus)
+			}
+			ids := w.Header().Values("X-Request-ID")
+			if len(ids) != 1 {
+				t.Fatalf("response X-Request-IDs = %q; want one", ids)
+			}
+			id := ids[0]
+			if tt.wantID != "" && id != tt.wantID {
+				t.Errorf("response X-Request-ID = %q; want %q", id, tt.wantID)
+			}
+			if tt.wantID == "" && !isLowerHex(id, 32) {
+				t.Errorf("response X-Request-ID = %q; want a new random ID", id)
+			}
+			if tt.wantStatus == http.StatusOK && w.Body.String() != id {
+				t.Errorf("backend got X-Request-ID %q; want %q", w.Body.String(), id)
+			}
+			if len(logs) == 0 {
+				t.Errorf("no logs")
+			}
+			for len(logs) > 0 {
+				if l := <-logs; l.RequestID != id {
+					t.Errorf("log %+v has RequestID %q; want %q", l, l.RequestID, id)
+				}
+			}
+		})
+	}
+}
+
+func TestServeConnectionEvents(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "ok")
+		},
+	))
+	defer testServ.Close()
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: testServ.URL, ConnectionEvents: true},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	logs := make(chan ipn.FunnelRequestLog, 10)
+	b.mu.Lock()
+	b.serveStreamers = map[uint16]map[uint32]func(ipn.FunnelRequestLog){
+		443: {1: func(l ipn.FunnelRequestLog) { logs <- l }},
+	}
+	b.mu.Unlock()
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, newTestServeRequest("GET", "/", "100.150.151.152"))
+		if got := w.Body.String(); got != "ok" {
+			t.Fatalf("got body %q; want ok", got)
+		}
+	}
+	// Removing the handler closes its idle connection to the backend.
+	if err := b.SetServeConfig(&ipn.ServeConfig{}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var conns []*ipn.UpstreamConnLog
+	timeout := time.After(5 * time.Second)
+	for len(conns) < 2 {
+		select {
+		case l := <-logs:
+			if l.UpstreamConn != nil {
+				conns = append(conns, l.UpstreamConn)
+			}
+		case <-timeout:
+			t.Fatalf("got %d connection events; want 2", len(conns))
+		}
+	}
+	open, closed := conns[0], conns[1]
+	if open.Event != ipn.UpstreamConnOpen || closed.Event != ipn.UpstreamConnClose {
+		t.Fatalf("got events %s, %s; want %s, %s", open.Event, closed.Event, ipn.UpstreamConnOpen, ipn.UpstreamConnClose)
+	}
+	wantAddr := strings.TrimPrefix(testServ.URL, "http://")
+	for _, c := range conns {
+		if c.Backend != testServ.URL || c.RemoteAddr != wantAddr || c.Start.IsZero() {
+			t.Errorf("%s: got backend %q at %q, started %v; want %q at %q", c.Event, c.Backend, c.RemoteAddr, c.Start, testServ.URL, wantAddr)
+		}
+	}
+	if closed.Requests != 2 || closed.BytesSent == 0 || closed.BytesReceived == 0 {
+		t.Errorf("got %d requests, %d bytes sent, %d received; want 2 requests on the one connection", closed.Requests, closed.BytesSent, closed.BytesReceived)
+	}
+}
+
+func TestConnectionStateSequence(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "ok")
+		},
+	))
+	defer testServ.Close()
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: testServ.URL, ConnectionStates: true},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	logs := make(chan ipn.FunnelRequestLog, 20)
+	b.mu.Lock()
+	b.serveStreamers = map[uint16]map[uint32]func(ipn.FunnelRequestLog){
+		443: {1: func(l ipn.FunnelRequestLog) { logs <- l }},
+	}
+	b.mu.Unlock()
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, newTestServeRequest("GET", "/", "100.150.151.152"))
+		if got := w.Body.String(); got != "ok" {
+			t.Fatalf("got body %q; want ok", got)
+		}
+	}
+	// Removing the handler closes its idle connection to the backend.
+	if err := b.SetServeConfig(&ipn.ServeConfig{}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		ipn.UpstreamConnNew,
+		ipn.UpstreamConnActive,
+		ipn.UpstreamConnIdle,
+		ipn.UpstreamConnActive,
+		ipn.UpstreamConnIdle,
+		ipn.UpstreamConnClosed,
+	}
+	var conns []*ipn.UpstreamConnLog
+	timeout := time.After(5 * time.Second)
+	for len(conns) < len(want) {
+		select {
+		case l := <-logs:
+			if l.UpstreamConn != nil {
+				conns = append(conns, l.UpstreamConn)
+			}
+		case <-timeout:
+			t.Fatalf("got %d connection states; want %d", len(conns), len(want))
+		}
+	}
+	for i, c := range conns {
+		if c.Event != want[i] {
+			t.Errorf("state %d = %s; want %s", i, c.Event, want[i])
+		}
+		if c.ConnID == 0 || c.ConnID != conns[0].ConnID {
+			t.Errorf("%s: ConnID = %d; want %d, non-zero", c.Event, c.ConnID, conns[0].ConnID)
+		}
+		if i > 0 && c.Time.Before(conns[i-1].Time) {
+			t.Errorf("%s at %v, before %s at %v", c.Event, c.Time, conns[i-1].Event, conns[i-1].Time)
+		}
+	}
+	if closed := conns[len(conns)-1]; closed.Requests != 2 {
+		t.Errorf("closed after %d requests; want 2", closed.Requests)
+	}
+}
+
+// BenchmarkUpstreamTCPNoDelay measures the round trip of messages of
+// various sizes to a WebSocket echo backend over a connection with
+// Nagle's algorithm enabled, and over one from noDelayDial, as for
+// UpstreamTCPNoDelay. Like WebSocket libraries, it writes the frame
+// header and payload of each message separately, which Nagle's
+// algorithm can hold back until the header is acknowledged.
+func BenchmarkUpstreamTCPNoDelay(b *testing.B) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+				http.Error(w, "not a WebSocket upgrade", http.StatusBadRequest)
+				return
+			}
+			c, brw, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+			io.Copy(c, brw.Reader)
+		},
+	))
+	defer backend.Close()
+
+	var d net.Dialer
+	nagleDial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return c, c.(*net.TCPConn).SetNoDelay(false)
+	}
+	for _, size := range []int{16, 1 << 10, 16 << 10} {
+		for _, noDelay := range []bool{false, true} {
+			b.Run(fmt.Sprintf("size=%d/nodelay=%v", size, noDelay), func(b *testing.B) {
+				dial := nagleDial
+				if noDelay {
+					dial = noDelayDial(nagleDial)
+				}
+				c, err := dial(context.Background(), "tcp", backend.Listener.Addr().String())
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer c.Close()
+				io.WriteString(c, "GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+				br := bufio.NewReader(c)
+				res, err := http.ReadResponse(br, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if res.StatusCode != http.StatusSwitchingProtocols {
+					b.Fatalf("got status %v; want 101", res.Status)
+				}
+
+				header := []byte{0x82, 126, byte(size >> 8), byte(size)} // binary frame, 16-bit length
+				payload := make([]byte, size)
+				echo := make([]byte, len(header)+size)
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := c.Write(header); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := c.Write(payload); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := io.ReadFull(br, echo); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestStallTimeoutBody(t *testing.T) {
+	pr, pw := io.Pipe()
+	stalled := make(chan int64, 1)
+	sb := newStallTimeoutBody(pr, 50*time.Millisecond, func(n int64) { stalled <- n })
+	defer sb.Close()
+
+	go func() {
+		io.WriteString(pw, "hello")
+		// A pause between reads doesn't count as a stall.
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(pw, "!")
+	}()
+	buf := make([]byte, 10)
+	n, err := sb.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("first Read = %q, %v; want hello", buf[:n], err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	n, err = sb.Read(buf)
+	if err != nil || string(buf[:n]) != "!" {
+		t.Fatalf("second Read = %q, %v; want !", buf[:n], err)
+	}
+	n, err = sb.Read(buf)
+	if err == nil || n != 0 {
+		t.Fatalf("stalled Read = %d, %v; want error", n, err)
+	}
+	if want := "upstream stalled for 50ms after 6 bytes"; err.Error() != want {
+		t.Errorf("stalled Read error = %q; want %q", err, want)
+	}
+	if got := <-stalled; got != 6 {
+		t.Errorf("stalled after %d bytes; want 6", got)
+	}
+}
+
+// newTestServeRequest returns a request for path on example.ts.net:443
+// as it arrives at serveWebHandler from srcIP.
+// newTestServeFrontend returns a server that serves requests with b as
+// though they were for https://example.ts.net from 100.150.151.152. Unlike
+// the ResponseRecorders used with newTestServeRequest, it supports
+// streaming responses and connection upgrades.
+func newTestServeFrontend(t *testing.T, b *LocalBackend) *httptest.Server {
+	front := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			r = r.WithContext(context.WithValue(r.Context(), serveHTTPContextKey{}, &serveHTTPContext{
+				DestPort: 443,
+				SrcAddr:  netip.MustParseAddrPort("100.150.151.152:1234"),
+			}))
+			r.TLS = &tls.ConnectionState{ServerName: "example.ts.net"}
+			b.serveWebHandler(w, r)
+		},
+	))
+	t.Cleanup(front.Close)
+	return front
+}
+
+func TestServeForwardedHeaderSanitizing(t *testing.T) {
+	b := newTestServeBackend(t)
+	gotHeaders := make(chan http.Header, 1)
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			gotHeaders <- r.Header.Clone()
+		},
+	))
+	defer testServ.Close()
+
+	tests := []struct {
+		name string
+		h    *ipn.HTTPHandler
+		want map[string]string // header to value, or "" for none
+	}{
+		{
+			name: "sanitized",
+			h:    &ipn.HTTPHandler{Proxy: testServ.URL, StripRequestHeaders: []string{"X-Client-Cert"}},
+			want: map[string]string{
+				"X-Forwarded-For":  "1.2.3.4",
+				"X-Forwarded-Host": "example.ts.net",
+				"X-Real-IP":        "1.2.3.4",
+				"X-Client-Cert":    "",
+				"X-Other":          "kept",
+			},
+		},
+		{
+			name: "kept",
+			h:    &ipn.HTTPHandler{Proxy: testServ.URL, KeepForwardedHeaders: true},
+			want: map[string]string{
+				"X-Forwarded-For":  "10.0.0.1, 1.2.3.4",
+				"X-Forwarded-Host": "spoofed.example.com",
+				"X-Real-IP":        "10.0.0.1",
+				"X-Client-Cert":    "spoofed",
+				"X-Other":          "kept",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &ipn.ServeConfig{
+				Web: map[ipn.HostPort]*ipn.WebServerConfig{
+					"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{"/": tt.h}},
+				},
+			}
+			if err := b.SetServeConfig(conf, ""); err != nil {
+				t.Fatal(err)
+			}
+			r := newTestServeRequest("GET", "/", "1.2.3.4")
+			r.Header.Set("X-Forwarded-For", "10.0.0.1")
+			r.Header.Set("X-Forwarded-Host", "spoofed.example.com")
+			r.Header.Set("X-Real-IP", "10.0.0.1")
+			r.Header.Set("X-Client-Cert", "spoofed")
+			r.Header.Set("X-Other", "kept")
+			w := httptest.NewRecorder()
+			b.serveWebHandler(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d", w.Code)
+			}
+			h := <-gotHeaders
+			for k, want := range tt.want {
+				if got := strings.Join(h.Values(k), ","); got != want {
+					t.Errorf("%s = %q; want %q", k, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestServeForwardedHeader(t *testing.T) {
+	b := newTestServeBackend(t)
+	gotHeaders := make(chan http.Header, 1)
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			gotHeaders <- r.Header.Clone()
+		},
+	))
+	defer testServ.Close()
+
+	tests := []struct {
+		mode  string
+		keep  bool
+		srcIP string
+		want  map[string]string // header to value, or "" for none
+	}{
+		{
+			mode:  "",
+			srcIP: "1.2.3.4",
+			want:  map[string]string{"X-Forwarded-For": "1.2.3.4", "X-Real-IP": "1.2.3.4", "Forwarded": ""},
+		},
+		{
+			mode:  "both",
+			srcIP: "1.2.3.4",
+			want:  map[string]string{"X-Forwarded-For": "1.2.3.4", "Forwarded": "for=1.2.3.4;proto=https;host=example.ts.net"},
+		},
+		{
+			mode:  "rfc7239",
+			srcIP: "[fd7a:115c:a1e0::1]",
+			want: map[string]string{
+				"Forwarded":        `for="[fd7a:115c:a1e0::1]";proto=https;host=example.ts.net`,
+				"X-Forwarded-For":  "",
+				"X-Forwarded-Host": "",
+				"X-Real-IP":        "",
+			},
+		},
+		{
+			mode:  "rfc7239",
+			keep:  true,
+			srcIP: "1.2.3.4",
+			want:  map[string]string{"Forwarded": "for=10.0.0.1, for=1.2.3.4;proto=https;host=example.ts.net"},
+		},
+		{
+			mode:  "none",
+			srcIP: "1.2.3.4",
+			want:  map[string]string{"Forwarded": "", "X-Forwarded-For": "", "X-Real-IP": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s-keep=%v", tt.mode, tt.keep), func(t *testing.T) {
+			conf := &ipn.ServeConfig{
+				Web: map[ipn.HostPort]*ipn.WebServerConfig{
+					"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+						"/": {Proxy: testServ.URL, ForwardedHeaders: tt.mode, KeepForwardedHeaders: tt.keep},
+					}},
+				},
+			}
+			if err := b.SetServeConfig(conf, ""); err != nil {
+				t.Fatal(err)
+			}
+			r := newTestServeRequest("GET", "/", tt.srcIP)
+			r.Header.Set("Forwarded", "for=10.0.0.1")
+			r.Header.Set("X-Real-IP", "10.0.0.1")
+			w := httptest.NewRecorder()
+			b.serveWebHandler(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d", w.Code)
+			}
+			h := <-gotHeaders
+			for k, want := range tt.want {
+				if got := strings.Join(h.Values(k), ","); got != want {
+					t.Errorf("%s = %q; want %q", k, got, want)
+				}
+			}
+		})
+	}
+}
+
+func newTestServeRequest(method, path, srcIP string) *http.Request {
+	req := httptest.NewRequest(method, "https://example.ts.net"+path, nil)
+	return req.WithContext(context.WithValue(req.Context(), serveHTTPContextKey{}, &serveHTTPContext{
+		DestPort: 443,
+		SrcAddr:  netip.MustParseAddrPort(srcIP + ":1234"),
+	}))
+}
+
+func TestServeFunnelPaths(t *testing.T) {
+	b := newTestServeBackend(t)
+	conf := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Text: "hi"},
+			}},
+		},
+		AllowFunnel: map[ipn.HostPort]bool{"example.ts.net:443": true},
+		FunnelPaths: map[ipn.HostPort][]string{"example.ts.net:443": {"/api/"}},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		funnel   bool
+		wantCode int
+	}{
+		{"/api/users", true, http.StatusOK},
+		{"/admin", true, http.StatusNotFound},
+		{"/api/../admin", true, http.StatusNotFound},
+		{"/admin", false, http.StatusOK}, // the tailnet can reach every path
+	}
+	for _, tt := range tests {
+		r := newTestServeRequest("GET", tt.path, "100.150.151.152")
+		if tt.funnel {
+			sctx, _ := getServeHTTPContext(r)
+			sctx.Funnel = &funnelFlow{}
+		}
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, r)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s (funnel=%v): got status %d; want %d", tt.path, tt.funnel, w.Code, tt.wantCode)
+		}
+	}
+}
+
+func TestServeHTTPMethodHandlers(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "api "+r.Method+" "+r.URL.Path)
+		},
+	))
+	defer testServ.Close()
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {
+				Handlers: map[string]*ipn.HTTPHandler{
+					"/static/": {Text: "static"},
+				},
+				MethodHandlers: map[string]*ipn.HTTPHandler{
+					"POST":    {Proxy: testServ.URL},
+					"OPTIONS": {Text: "preflight"},
+					"*":       {Text: "fallback"},
+				},
+			},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{"GET", "/static/a.css", "static"},
+		{"POST", "/static/a.css", "static"}, // mount point before method
+		{"OPTIONS", "/static/a.css", "static"},
+		{"POST", "/api", "api POST /api"},
+		{"OPTIONS", "/api", "preflight"},
+		{"DELETE", "/static/a.css", "static"}, // mount point before catch-all
+		{"GET", "/other", "fallback"},
+	}
+	for _, tt := range tests {
+		req := newTestServeRequest(tt.method, tt.path, "100.150.151.152")
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		if got := w.Body.String(); w.Code != http.StatusOK || got != tt.want {
+			t.Errorf("%s %s: got %d %q; want 200 %q", tt.method, tt.path, w.Code, got, tt.want)
+		}
+	}
+}
+
+func TestServeHTTPMethodHandlersMounts(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {
+				Handlers: map[string]*ipn.HTTPHandler{
+					"/":     {Text: "root"},
+					"/api/": {Text: "api"},
+				},
+				MethodHandlers: map[string]*ipn.HTTPHandler{
+					"POST": {Text: "post"},
+					"*":    {Text: "fallback"},
+				},
+			},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{"GET", "/api/users", "api"},
+		{"POST", "/api/users", "api"}, // the narrower mount point wins
+		{"POST", "/api", "api"},
+		{"POST", "/", "post"}, // a method wins over the mount point at "/"
+		{"POST", "/other", "post"},
+		{"GET", "/other", "root"}, // the mount point at "/" wins over the catch-all
+	}
+	for _, tt := range tests {
+		req := newTestServeRequest(tt.method, tt.path, "100.150.151.152")
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, req)
+		if got := w.Body.String(); w.Code != http.StatusOK || got != tt.want {
+			t.Errorf("%s %s: got %d %q; want 200 %q", tt.method, tt.path, w.Code, got, tt.want)
+		}
+	}
+}
+
+func TestClassifyUpstreamError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"refused-message", errors.New("dial tcp 127.0.0.1:3000: connectex: No connection could be made because the target machine actively refused it."), ipn.UpstreamErrorNotRunning},
+		{"unreachable-message", errors.New("dial tcp 10.0.0.1:3000: connect: network is unreachable"), ipn.UpstreamErrorNetwork},
+		{"timeout", &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, ipn.UpstreamErrorSlow},
+		{"deadline", fmt.Errorf("waiting: %w", context.DeadlineExceeded), ipn.UpstreamErrorSlow},
+		{"other", io.ErrUnexpectedEOF, ""},
+	}
+	for _, tt := range tests {
+		if got := classifyUpstreamError(tt.err); got != tt.want {
+			t.Errorf("%s: got %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestServeHTTPProxyErrorClass(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	// Nothing listens on the backend's port.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := "http://" + ln.Addr().String()
+	ln.Close()
+
+	logs := make(chan ipn.FunnelRequestLog, 10)
+	b.mu.Lock()
+	b.serveStreamers = map[uint16]map[uint32]func(ipn.FunnelRequestLog){
+		443: {1: func(l ipn.FunnelRequestLog) { logs <- l }},
+	}
+	b.mu.Unlock()
+
+	for _, classify := range []bool{false, true} {
+		conf := &ipn.ServeConfig{
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: backend, ClassifyUpstreamErrors: classify},
+				}},
+			},
+		}
+		if err := b.SetServeConfig(conf, ""); err != nil {
+			t.Fatal(err)
+		}
+		front := newTestServeFrontend(t, b)
+		res, err := http.Get(front.URL + "/api")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadGateway {
+			t.Errorf("ClassifyUpstreamErrors=%v: got status %d; want 502", classify, res.StatusCode)
+		}
+		if log := <-logs; log.Kind != ipn.FunnelLogRequest || log.ErrorClass != "" {
+			t.Errorf("ClassifyUpstreamErrors=%v: got Kind %q, ErrorClass %q in the request's first log; want %q, none", classify, log.Kind, log.ErrorClass, ipn.FunnelLogRequest)
+		}
+		var got ipn.FunnelRequestLog
+		select {
+		case got = <-logs:
+		default:
+		}
+		var want ipn.FunnelRequestLog
+		if classify {
+			want = ipn.FunnelRequestLog{Kind: ipn.FunnelLogUpstreamError, Path: "/api", ErrorClass: ipn.UpstreamErrorNotRunning}
+		}
+		if got.Kind != want.Kind || got.ErrorClass != want.ErrorClass || got.Path != want.Path {
+			t.Errorf("ClassifyUpstreamErrors=%v: got error log %q for %q with ErrorClass %q; want %q, %q, %q", classify, got.Kind, got.Path, got.ErrorClass, want.Kind, want.Path, want.ErrorClass)
+		}
+	}
+}
+
+func TestServeHTTPProxyCircuitBreaker(t *testing.T) {
+	b := newTestServeBackend(t)
+	start := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+	clock := tstest.NewClock(tstest.ClockOpts{Start: start})
+	b.clock = clock
+
+	var healthy atomic.Bool
+	var hits atomic.Int32
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			if !healthy.Load() {
+				http.Error(w, "down", http.StatusInternalServerError)
+			}
+		},
+	))
+	defer testServ.Close()
+	backend := strings.TrimPrefix(testServ.URL, "http://")
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {
+					Proxy:                  testServ.URL,
+					CircuitBreakerFailures: 2,
+					CircuitBreakerCooldown: 10 * time.Second,
+				},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(wantCode int) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, newTestServeRequest("GET", "/", "100.150.151.152"))
+		if w.Code != wantCode {
+			t.Errorf("got status %d; want %d", w.Code, wantCode)
+		}
+	}
+	checkStatus := func(want ipn.CircuitStatus) {
+		t.Helper()
+		want.Backend = testServ.URL
+		got, err := b.CircuitBreakerStatus(backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(*got, want) {
+			t.Errorf("got status %+v; want %+v", *got, want)
+		}
+	}
+
+	checkStatus(ipn.CircuitStatus{State: ipn.CircuitClosed})
+	serve(http.StatusInternalServerError)
+	checkStatus(ipn.CircuitStatus{State: ipn.CircuitClosed, Failures: 1, LastFailure: start})
+	serve(http.StatusInternalServerError)
+	open := ipn.CircuitStatus{
+		State:        ipn.CircuitOpen,
+		Failures:     2,
+		LastFailure:  start,
+		RecoveryTime: start.Add(10 * time.Second),
+	}
+	checkStatus(open)
+
+	// While open, requests don't reach the backend.
+	serve(http.StatusServiceUnavailable)
+	if got := hits.Load(); got != 2 {
+		t.Errorf("backend got %d requests; want 2", got)
+	}
+	checkStatus(open)
+
+	// After the cooldown, a trial request closes the circuit.
+	clock.Advance(10 * time.Second)
+	checkStatus(ipn.CircuitStatus{State: ipn.CircuitHalfOpen, Failures: 2, LastFailure: start})
+	healthy.Store(true)
+	serve(http.StatusOK)
+	checkStatus(ipn.CircuitStatus{State: ipn.CircuitClosed, LastFailure: start})
+
+	if _, err := b.CircuitBreakerStatus("127.0.0.1:1"); err == nil {
+		t.Error("got status for unknown backend; want error")
+	}
+}
+
+func TestCircuitBreakerHalfOpenRequests(t *testing.T) {
+	start := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+	clock := tstest.NewClock(tstest.ClockOpts{Start: start})
+	h := &ipn.HTTPHandler{
+		Proxy:                          "3000",
+		CircuitBreakerFailures:         2,
+		CircuitBreakerCooldown:         10 * time.Second,
+		CircuitBreakerHalfOpenRequests: 3,
+	}
+	cb := newCircuitBreaker(h.View(), clock)
+
+	checkState := func(want string) {
+		t.Helper()
+		if got := cb.status().State; got != want {
+			t.Errorf("state = %q; want %q", got, want)
+		}
+	}
+	// allowN calls allow n times and returns how many were allowed.
+	allowN := func(n int) int {
+		allowed := 0
+		for i := 0; i < n; i++ {
+			if cb.allow() {
+				allowed++
+			}
+		}
+		return allowed
+	}
+	open := func() {
+		t.Helper()
+		for i := 0; i < 2; i++ {
+			if !cb.allow() {
+				t.Fatal("closed circuit didn't allow request")
+			}
+			cb.failure()
+		}
+		checkState(ipn.CircuitOpen)
+		if cb.allow() {
+			t.Fatal("open circuit allowed request")
+		}
+		clock.Advance(10 * time.Second)
+		checkState(ipn.CircuitHalfOpen)
+	}
+
+	// Closed to open, then half-open with up to 3 trials at once.
+	checkState(ipn.CircuitClosed)
+	open()
+	if got := allowN(5); got != 3 {
+		t.Fatalf("half-open circuit allowed %d requests; want 3", got)
+	}
+
+	// Half-open to open: any failed trial opens the circuit again,
+	// even after others succeeded.
+	cb.success()
+	checkState(ipn.CircuitHalfOpen)
+	cb.failure()
+	checkState(ipn.CircuitOpen)
+	if cb.allow() {
+		t.Fatal("reopened circuit allowed request")
+	}
+	// Late outcomes of earlier trials don't close it.
+	cb.success()
+	cb.abandon()
+	checkState(ipn.CircuitOpen)
+
+	// Abandoned trials free their place for another.
+	clock.Advance(10 * time.Second)
+	if got := allowN(3); got != 3 {
+		t.Fatalf("half-open circuit allowed %d requests; want 3", got)
+	}
+	cb.abandon()
+	if !cb.allow() {
+		t.Fatal("half-open circuit didn't allow request after abandoned trial")
+	}
+	if cb.allow() {
+		t.Fatal("half-open circuit allowed more than 3 trials")
+	}
+
+	// Half-open to closed: 2 of 3 trials must succeed.
+	cb.success()
+	checkState(ipn.CircuitHalfOpen)
+	cb.success()
+	checkState(ipn.CircuitClosed)
+	if st := cb.status(); st.Failures != 0 {
+		t.Errorf("closed circuit has %d failures; want 0", st.Failures)
+	}
+	if got := allowN(10); got != 10 {
+		t.Errorf("closed circuit allowed %d requests; want 10", got)
+	}
+
+	// With the default of one trial, it alone decides.
+	h.CircuitBreakerHalfOpenRequests = 0
+	cb = newCircuitBreaker(h.View(), clock)
+	open()
+	if got := allowN(2); got != 1 {
+		t.Fatalf("half-open circuit allowed %d requests; want 1", got)
+	}
+	cb.success()
+	checkState(ipn.CircuitClosed)
+}
+
+func TestServeHTTPProxyPoolStats(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	testServ := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "ok")
+		},
+	))
+	defer testServ.Close()
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: testServ.URL, CollectPoolStats: true, ForceHTTP1: true},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, newTestServeRequest("GET", "/", "100.150.151.152"))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d; want 200", w.Code)
+		}
+	}
+
+	st, err := b.UpstreamPoolStats(strings.TrimPrefix(testServ.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first request dials a connection, which the others reuse.
+	if st.Backend != testServ.URL || st.Active != 0 || st.Idle != 1 || st.WaitCount != 1 {
+		t.Errorf("got stats %+v; want 0 active, 1 idle and 1 wait for %s", st, testServ.URL)
+	}
+}
+
+func TestServeHTTPProxyWebSocketLog(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			c, err := websocket.Accept(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer c.Close(websocket.StatusInternalError, "")
+			for {
+				typ, msg, err := c.Read(r.Context())
+				if err != nil {
+					return
+				}
+				if err := c.Write(r.Context(), typ, msg); err != nil {
+					return
+				}
+			}
+		},
+	))
+	defer backend.Close()
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: backend.URL},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	logs := make(chan ipn.FunnelRequestLog, 10)
+	b.mu.Lock()
+	b.serveStreamers = map[uint16]map[uint32]func(ipn.FunnelRequestLog){
+		443: {1: func(l ipn.FunnelRequestLog) { logs <- l }},
+	}
+	b.mu.Unlock()
+
+	front := newTestServeFrontend(t, b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, _, err := websocket.Dial(ctx, "ws://"+front.Listener.Addr().String()+"/chat", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"hello", "world"} {
+		if err := c.Write(ctx, websocket.MessageText, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		if _, got, err := c.Read(ctx); err != nil || string(got) != msg {
+			t.Fatalf("got echo %q, %v; want %q", got, err, msg)
+		}
+	}
+	c.Close(websocket.StatusGoingAway, "bye")
+
+	for {
+		select {
+		case l := <-logs:
+			if l.Path != "/chat" {
+				t.Errorf("got log for path %q; want /chat", l.Path)
+			}
+			ws := l.WebSocket
+			if ws == nil {
+				continue // the log for the start of the request
+			}
+			if ws.MessagesIn != 2 || ws.MessagesOut != 2 || ws.CloseCode != int(websocket.StatusGoingAway) || ws.BytesIn == 0 || ws.BytesOut == 0 {
+				t.Errorf("got WebSocket log %+v; want 2 messages each way and close code %d", ws, websocket.StatusGoingAway)
+			}
+			return
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for WebSocket log")
+		}
+	}
+}
+
+func TestWSFrameCounter(t *testing.T) {
+	var frames []byte
+	// A masked single-frame text message.
+	frames = append(frames, 0x81, 0x82, 1, 2, 3, 4, 'h'^1, 'i'^2)
+	// An unmasked binary message with a 16-bit length.
+	frames = append(frames, 0x82, 126, 0, 200)
+	frames = append(frames, make([]byte, 200)...)
+	// A text message in two fragments, with a ping between them.
+	frames = append(frames, 0x01, 0x01, 'a')
+	frames = append(frames, 0x89, 0x00)
+	frames = append(frames, 0x80, 0x01, 'b')
+	// A masked close frame with status 1001 and a reason.
+	frames = append(frames, 0x88, 0x84, 5, 6, 7, 8, 0x03^5, 0xe9^6, 'x'^7, 'y'^8)
+
+	// Feed it a byte at a time to exercise frames split across writes.
+	var c wsFrameCounter
+	for i := range frames {
+		c.count(frames[i : i+1])
+	}
+	if c.messages != 3 || c.closeCode != 1001 || c.bytes != int64(len(frames)) {
+		t.Errorf("got %d messages, close code %d, %d bytes; want 3, 1001, %d", c.messages, c.closeCode, c.bytes, len(frames))
+	}
+}
+
+func TestServeHTTPProxyFlushInterval(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	// The backend sends one event and then holds the stream open.
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, "data: one\n\n")
+			w.(http.Flusher).Flush()
+			<-release
+		},
+	))
+	defer backend.Close()
+	defer close(release)
+
+	h := &ipn.HTTPHandler{Proxy: backend.URL, UpstreamFlushInterval: time.Hour}
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{"/": h}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	front := newTestServeFrontend(t, b)
+
+	// Despite the long flush interval, the event arrives right away.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", front.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	if err != nil || line != "data: one\n" {
+		t.Fatalf("got %q, %v; want first event", line, err)
+	}
+
+	for _, d := range []time.Duration{-1, 0, 50 * time.Millisecond} {
+		h.UpstreamFlushInterval = d
+		p, err := b.proxyHandlerForBackend(h.View())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.rp.FlushInterval; got != d {
+			t.Errorf("FlushInterval = %v; want %v", got, d)
+		}
+	}
+}
+
+func TestServeHTTPProxyNoSniff(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/typed" {
+				w.Header().Set("Content-Type", "application/octet-stream")
+				w.Header().Set("X-Content-Type-Options", "nosniff")
+			} else {
+				w.Header()["Content-Type"] = nil
+			}
+			io.WriteString(w, "<html><body>not really</body></html>")
+		},
+	))
+	defer backend.Close()
+
+	tests := []struct {
+		noSniff     bool
+		path        string
+		wantType    string
+		wantOptions []string
+	}{
+		{false, "/untyped", "text/html; charset=utf-8", nil},
+		{false, "/typed", "application/octet-stream", []string{"nosniff"}},
+		{true, "/untyped", "", []string{"nosniff"}},
+		{true, "/typed", "application/octet-stream", []string{"nosniff"}},
+	}
+	for _, tt := range tests {
+		conf := &ipn.ServeConfig{
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: backend.URL, NoSniff: tt.noSniff},
+				}},
+			},
+		}
+		if err := b.SetServeConfig(conf, ""); err != nil {
+			t.Fatal(err)
+		}
+		front := newTestServeFrontend(t, b)
+		res, err := http.Get(front.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if got := res.Header.Get("Content-Type"); got != tt.wantType {
+			t.Errorf("NoSniff=%v %s: Content-Type = %q; want %q", tt.noSniff, tt.path, got, tt.wantType)
+		}
+		if got := res.Header.Values("X-Content-Type-Options"); !slices.Equal(got, tt.wantOptions) {
+			t.Errorf("NoSniff=%v %s: X-Content-Type-Options = %q; want %q", tt.noSniff, tt.path, got, tt.wantOptions)
+		}
+	}
+}
+
+func TestServeHTTPProxyCacheControlOverride(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/no-store" {
+				w.Header().Set("Cache-Control", "no-store")
+				w.Header().Set("Pragma", "no-cache")
+			}
+			io.WriteString(w, "hi")
+		},
+	))
+	defer backend.Close()
+
+	tests := []struct {
+		override    string
+		stripPragma bool
+		path        string
+		wantCache   string
+		wantPragma  string
+	}{
+		{"", false, "/no-store", "no-store", "no-cache"},
+		{"public, max-age=60", false, "/no-store", "public, max-age=60", "no-cache"},
+		{"public, max-age=60", false, "/plain", "public, max-age=60", ""},
+		{"", true, "/no-store", "no-store", ""},
+		{"public, max-age=60", true, "/no-store", "public, max-age=60", ""},
+	}
+	for _, tt := range tests {
+		conf := &ipn.ServeConfig{
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: backend.URL, CacheControlOverride: tt.override, StripPragma: tt.stripPragma},
+				}},
+			},
+		}
+		if err := b.SetServeConfig(conf, ""); err != nil {
+			t.Fatal(err)
+		}
+		front := newTestServeFrontend(t, b)
+		res, err := http.Get(front.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if got := res.Header.Get("Cache-Control"); got != tt.wantCache {
+			t.Errorf("CacheControlOverride=%q %s: Cache-Control = %q; want %q", tt.override, tt.path, got, tt.wantCache)
+		}
+		if got := res.Header.Get("Pragma"); got != tt.wantPragma {
+			t.Errorf("StripPragma=%v %s: Pragma = %q; want %q", tt.stripPragma, tt.path, got, tt.wantPragma)
+		}
+	}
+}
+
+func TestServeHTTPProxyNoKeepaliveBackends(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	// newBackend returns a backend that counts the connections to it.
+	newBackend := func() (*httptest.Server, *atomic.Int32) {
+		conns := new(atomic.Int32)
+		s := httptest.NewUnstartedServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "ok")
+			},
+		))
+		s.Config.ConnState = func(c net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				conns.Add(1)
+			}
+		}
+		s.Start()
+		t.Cleanup(s.Close)
+		return s, conns
+	}
+	fpm, fpmConns := newBackend()
+	app, appConns := newBackend()
+
+	noKeepalive := []string{fpm.URL}
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/php/": {Proxy: fpm.URL, NoKeepaliveBackends: noKeepalive},
+				"/app/": {Proxy: app.URL, NoKeepaliveBackends: noKeepalive},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/php/", "/app/", "/php/", "/app/", "/php/"} {
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, newTestServeRequest("GET", path, "100.150.151.152"))
+		if got := w.Body.String(); got != "ok" {
+			t.Fatalf("%s: got body %q; want ok", path, got)
+		}
+	}
+	if got := fpmConns.Load(); got != 3 {
+		t.Errorf("got %d connections to the backend without keep-alive; want 3, one per request", got)
+	}
+	if got := appConns.Load(); got != 1 {
+		t.Errorf("got %d connections to the other backend; want 1, reused", got)
+	}
+}
+
+func TestServeHTTPProxyCompressionOffload(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	const body = "hello, hello, hello, hello, world"
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("ETag", `"v1"`)
+			zw := gzip.NewWriter(w)
+			io.WriteString(zw, body)
+			zw.Close()
+		},
+	))
+	defer backend.Close()
+
+	tests := []struct {
+		offload      bool
+		accept       string
+		wantEncoding string
+		wantETag     string
+	}{
+		{false, "identity", "gzip", `"v1"`},
+		{true, "identity", "", `W/"v1"`},
+		{true, "gzip;q=0, br;q=0", "", `W/"v1"`},
+		{true, "gzip", "gzip", `"v1"`},
+		{true, "gzip, br", "br", `W/"v1"`},
+		{true, "*", "br", `W/"v1"`},
+		{true, "br;q=0, *", "gzip", `"v1"`},
+	}
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	for _, tt := range tests {
+		conf := &ipn.ServeConfig{
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: backend.URL, CompressionOffload: tt.offload},
+				}},
+			},
+		}
+		if err := b.SetServeConfig(conf, ""); err != nil {
+			t.Fatal(err)
+		}
+		front := newTestServeFrontend(t, b)
+		req, _ := http.NewRequest("GET", front.URL, nil)
+		req.Header.Set("Accept-Encoding", tt.accept)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r io.Reader = res.Body
+		switch res.Header.Get("Content-Encoding") {
+		case "gzip":
+			if r, err = gzip.NewReader(r); err != nil {
+				t.Fatal(err)
+			}
+		case "br":
+			r = brotli.NewReader(r)
+		}
+		got, err := io.ReadAll(r)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := fmt.Sprintf("offload=%v Accept-Encoding %q", tt.offload, tt.accept)
+		if string(got) != body {
+			t.Errorf("%s: body = %q; want %q", name, got, body)
+		}
+		if got := res.Header.Get("Content-Encoding"); got != tt.wantEncoding {
+			t.Errorf("%s: Content-Encoding = %q; want %q", name, got, tt.wantEncoding)
+		}
+		if got := res.Header.Get("ETag"); got != tt.wantETag {
+			t.Errorf("%s: ETag = %q; want %q", name, got, tt.wantETag)
+		}
+		if tt.wantETag != `"v1"` && res.Header.Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s: Vary = %q; want Accept-Encoding", name, res.Header.Get("Vary"))
+		}
+	}
+}
+
+func TestServeHTTPProxyABTest(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	newBackend := func(id string) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, id)
+			},
+		))
+		t.Cleanup(s.Close)
+		return s
+	}
+	backendA, backendB := newBackend("A"), newBackend("B")
+	logs := make(chan ipn.FunnelRequestLog, 10)
+	b.mu.Lock()
+	b.serveStreamers = map[uint16]map[uint32]func(ipn.FunnelRequestLog){
+		443: {1: func(l ipn.FunnelRequestLog) { logs <- l }},
+	}
+	b.mu.Unlock()
+
+	get := func(h *ipn.HTTPHandler, cookie string) (body, setCookie string) {
+		t.Helper()
+		conf := &ipn.ServeConfig{
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{"/": h}},
+			},
+		}
+		if err := b.SetServeConfig(conf, ""); err != nil {
+			t.Fatal(err)
+		}
+		front := newTestServeFrontend(t, b)
+		req, err := http.NewRequest("GET", front.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: abTestCookieName, Value: cookie})
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		got, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range res.Cookies() {
+			if c.Name == abTestCookieName {
+				setCookie = c.Value
+			}
+		}
+		return string(got), setCookie
+	}
+
+	tests := []struct {
+		name          string
+		pct           int
+		cookie        bool
+		reqCookie     string
+		want          string
+		wantSetCookie string
+	}{
+		{name: "ip-none", pct: 0, want: "A"},
+		{name: "ip-all", pct: 100, want: "B"},
+		{name: "cookie-new-none", pct: 0, cookie: true, want: "A", wantSetCookie: "A"},
+		{name: "cookie-new-all", pct: 100, cookie: true, want: "B", wantSetCookie: "B"},
+		{name: "cookie-kept-a", pct: 50, cookie: true, reqCookie: "A", want: "A"},
+		{name: "cookie-kept-b", pct: 50, cookie: true, reqCookie: "B", want: "B"},
+		{name: "cookie-wound-down", pct: 0, cookie: true, reqCookie: "B", want: "A", wantSetCookie: "A"},
+		{name: "cookie-invalid", pct: 100, cookie: true, reqCookie: "C", want: "B", wantSetCookie: "B"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &ipn.HTTPHandler{
+				Proxy:            backendA.URL,
+				ABTestBackend:    backendB.URL,
+				ABTestPercentage: tt.pct,
+				ABTestCookie:     tt.cookie,
+			}
+			body, setCookie := get(h, tt.reqCookie)
+			if body != tt.want || setCookie != tt.wantSetCookie {
+				t.Errorf("got backend %q, cookie %q; want %q, %q", body, setCookie, tt.want, tt.wantSetCookie)
+			}
+			if log := <-logs; log.BackendID != tt.want {
+				t.Errorf("request log BackendID = %q; want %q", log.BackendID, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeProxyKeys(t *testing.T) {
+	b := newTestServeBackend(t)
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/":    {Proxy: "http://127.0.0.1:3000"},
+				"/api": {Proxy: "http://127.0.0.1:3000"},
+				"/ab":  {Proxy: "http://127.0.0.1:3000", ABTestBackend: "http://127.0.0.1:3001", ABTestPercentage: 10},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	handler := func(mount string) ipn.HTTPHandlerView {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		wsc, _ := b.serveConfig.Web().GetOk("example.ts.net:443")
+		return wsc.Handlers().Get(mount)
+	}
+	root, api, ab := handler("/"), handler("/api"), handler("/ab")
+
+	// The keys of the config's handlers are worked out when it's set,
+	// and handlers with the same settings share a proxy.
+	for _, h := range []ipn.HTTPHandlerView{root, api, ab} {
+		if _, ok := b.serveProxyKeys.Load(h); !ok {
+			t.Errorf("no keys for handler %v", h.Proxy())
+		}
+	}
+	pRoot, ok1 := b.serveProxy(root, "")
+	pAPI, ok2 := b.serveProxy(api, "")
+	if !ok1 || !ok2 || pRoot != pAPI {
+		t.Errorf("got proxies %p, %p; want the same one", pRoot, pAPI)
+	}
+	if p, ok := b.serveProxy(ab, "B"); !ok || p.target.Port() != "3001" {
+		t.Errorf("got B proxy %v, %v; want one to port 3001", p, ok)
+	}
+
+	// Those of handlers no longer in the config are dropped, but their
+	// proxies can still be found while they're in use.
+	delete(conf.Web["example.ts.net:443"].Handlers, "/ab")
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.serveProxyKeys.Load(ab); ok {
+		t.Errorf("keys for a removed handler still there")
+	}
+	if _, ok := b.serveProxyKeys.Load(root); ok {
+		t.Errorf("keys for a handler of the old config still there")
+	}
+	if p, ok := b.serveProxy(root, ""); !ok || p != pRoot {
+		t.Errorf("handler of the old config: got proxy %p, %v; want %p", p, ok, pRoot)
+	}
+}
+
+func TestABTestBucket(t *testing.T) {
+	day := time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)
+	ip := netip.MustParseAddr("100.101.102.103")
+	for _, pct := range []int{0, 30, 100} {
+		want := abTestBucket(ip, day, pct)
+		if got := abTestBucket(ip, day.Add(11*time.Hour), pct); got != want {
+			t.Errorf("pct %d: later that day, got %q; want %q", pct, got, want)
+		}
+		var n int
+		for i := 0; i < 1000; i++ {
+			ip := netip.AddrFrom4([4]byte{100, 64, byte(i >> 8), byte(i)})
+			if abTestBucket(ip, day, pct) == "B" {
+				n++
+			}
+		}
+		if lo, hi := pct*10-60, pct*10+60; n < lo || n > hi {
+			t.Errorf("pct %d: %d of 1000 clients got B; want %d to %d", pct, n, lo, hi)
+		}
+	}
+}
+
+func TestServeHTTPProxyIdempotencyCache(t *testing.T) {
+	b := newTestServeBackend(t)
+	clock := tstest.NewClock(tstest.ClockOpts{Start: time.Date(2023, 9, 1, 12, 0, 0, 0, time.UTC)})
+	b.clock = clock
+
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			n := hits.Add(1)
+			w.Header().Set("X-Response", fmt.Sprint(n))
+			if r.URL.Path == "/fail" {
+				w.WriteHeader(http.StatusInternalServerError)
+			} else {
+				w.WriteHeader(http.StatusCreated)
+			}
+			fmt.Fprintf(w, "response %d", n)
+		},
+	))
+	defer backend.Close()
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: backend.URL, IdempotencyCacheTTL: time.Minute},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	front := newTestServeFrontend(t, b)
+
+	post := func(path, key string) string {
+		t.Helper()
+		req, err := http.NewRequest("POST", front.URL+path, strings.NewReader("charge"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("%d %s %s", res.StatusCode, res.Header.Get("X-Response"), body)
+	}
+
+	steps := []struct {
+		name    string
+		path    string
+		key     string
+		advance time.Duration
+		want    string
+	}{
+		{name: "first", path: "/charge", key: "k1", want: "201 1 response 1"},
+		{name: "duplicate", path: "/charge", key: "k1", want: "201 1 response 1"},
+		{name: "other-key", path: "/charge", key: "k2", want: "201 2 response 2"},
+		{name: "no-key", path: "/charge", want: "201 3 response 3"},
+		{name: "no-key-again", path: "/charge", want: "201 4 response 4"},
+		{name: "server-error", path: "/fail", key: "k3", want: "500 5 response 5"},
+		{name: "server-error-not-kept", path: "/fail", key: "k3", want: "500 6 response 6"},
+		{name: "still-kept", path: "/charge", key: "k1", advance: 59 * time.Second, want: "201 1 response 1"},
+		{name: "expired", path: "/charge", key: "k1", advance: time.Second, want: "201 7 response 7"},
+	}
+	for _, st := range steps {
+		clock.Advance(st.advance)
+		if got := post(st.path, st.key); got != st.want {
+			t.Errorf("%s: got %q; want %q", st.name, got, st.want)
+		}
+	}
+}
+
+func TestServeHTTPProxyRateLimitFile(t *testing.T) {
+	defer func(d time.Duration) { rateLimitReloadInterval = d }(rateLimitReloadInterval)
+	rateLimitReloadInterval = 10 * time.Millisecond
+	b := newTestServeBackend(t)
+
+	testServ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer testServ.Close()
+
+	limits := filepath.Join(t.TempDir(), "limits.json")
+	writeLimits := func(s string) {
+		t.Helper()
+		if err := os.WriteFile(limits, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeLimits(`{"paths": [{"/api": {"rate": 0.001, "burst": 1}}]}`)
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: testServ.URL, RateLimitFile: limits},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, newTestServeRequest("GET", path, "100.150.151.152"))
+		return w.Code
+	}
+	serve := func(path string, wantCode int) {
+		t.Helper()
+		if got := get(path); got != wantCode {
+			t.Errorf("GET %s: got status %d; want %d", path, got, wantCode)
+		}
+	}
+
+	serve("/api/items", http.StatusOK)
+	serve("/api/items", http.StatusTooManyRequests)
+	serve("/api", http.StatusTooManyRequests)
+	serve("/apiary", http.StatusOK) // not under /api
+	serve("/other", http.StatusOK)
+
+	// Raising the limit takes effect without reconfiguring, once the
+	// file is next checked.
+	writeLimits(`{"paths": [{"/api": {"rate": 0.001, "burst": 100}}]}`)
+	for deadline := time.Now().Add(10 * time.Second); get("/api/items") != http.StatusOK; {
+		if time.Now().After(deadline) {
+			t.Fatal("raised limit didn't take effect")
+		}
+		time.Sleep(rateLimitReloadInterval)
+	}
+
+	// An invalid file keeps the previous limits.
+	writeLimits(`{"paths": [{"/api": {"rate": -1, "burst": 1}}], "x": 1}`)
+	time.Sleep(5 * rateLimitReloadInterval)
+	serve("/api/items", http.StatusOK)
+}
+
+func TestServeHTTPProxyProtocol(t *testing.T) {
+	// The backend reads the PROXY protocol header, then a single request,
+	// and responds with the client address from the header.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				hdr, err := proxyproto.Read(br)
+				if err != nil {
+					fmt.Fprintf(c, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+					return
+				}
+				if _, err := http.ReadRequest(br); err != nil {
+					return
+				}
+				body := fmt.Sprintf("v%d %v %v", hdr.Version, hdr.Src, hdr.Dst)
+				fmt.Fprintf(c, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+			}()
+		}
+	}()
+
+	for _, version := range []string{"v1", "v2"} {
+		t.Run(version, func(t *testing.T) {
+			b := newTestServeBackend(t)
+			conf := &ipn.ServeConfig{
+				Web: map[ipn.HostPort]*ipn.WebServerConfig{
+					"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+						"/": {Proxy: "http://" + ln.Addr().String(), UpstreamProxyProtocol: version},
+					}},
+				},
+			}
+			if err := b.SetServeConfig(conf, ""); err != nil {
+				t.Fatal(err)
+			}
+			// Each request gets its own connection, with its own client's
+			// address.
+			for _, src := range []string{"100.150.151.152", "100.150.151.153"} {
+				w := httptest.NewRecorder()
+				b.serveWebHandler(w, newTestServeRequest("GET", "/", src))
+				if w.Code != http.StatusOK {
+					t.Fatalf("got status %d; want %d", w.Code, http.StatusOK)
+				}
+				want := fmt.Sprintf("%s %s:1234 0.0.0.0:443", version, src)
+				if got := w.Body.String(); got != want {
+					t.Errorf("got %q; want %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestServeRequestsInFlight(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	started := make(chan bool)
+	release := make(chan bool)
+	testServ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+	}))
+	defer testServ.Close()
+	backend := strings.TrimPrefix(testServ.URL, "http://")
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: testServ.URL},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	checkInFlight := func(want int64) {
+		t.Helper()
+		got, err := b.ServeRequestsInFlight(backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("ServeRequestsInFlight = %d; want %d", got, want)
+		}
+	}
+
+	checkInFlight(0)
+	done := make(chan bool)
+	go func() {
+		b.serveWebHandler(httptest.NewRecorder(), newTestServeRequest("GET", "/", "100.150.151.152"))
+		close(done)
+	}()
+	<-started
+	checkInFlight(1)
+
+	// The request is still counted after the backend is removed from
+	// the config, until it finishes.
+	if err := b.SetServeConfig(&ipn.ServeConfig{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	checkInFlight(1)
+	close(release)
+	<-done
+	checkInFlight(0)
+}
+
+func TestServeHTTPProxyPassThroughHeaders(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	testServ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%q %q", r.Header.Get("X-Request-Id"), r.Header.Get("X-Trace-Id"))
+	}))
+	defer testServ.Close()
+
+	conf := &ipn.ServeConfig{
+		Web: map[ipn.HostPort]*ipn.WebServerConfig{
+			"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+				"/": {Proxy: testServ.URL, PassThroughHeaders: []string{"X-Request-ID"}},
+			}},
+		},
+	}
+	if err := b.SetServeConfig(conf, ""); err != nil {
+		t.Fatal(err)
+	}
+	req := newTestServeRequest("GET", "/", "100.150.151.152")
+	req.Header.Set("X-Request-ID", "req-1")
+	req.Header.Set("X-Trace-ID", "trace-1")
+	// Naming the headers in Connection makes them hop-by-hop, so
+	// httputil.ReverseProxy drops them unless they're passed through.
+	req.Header.Set("Connection", "X-Request-ID, X-Trace-ID")
+	w := httptest.NewRecorder()
+	b.serveWebHandler(w, req)
+	if got, want := w.Body.String(), `"req-1" ""`; got != want {
+		t.Errorf("backend got headers %s; want %s", got, want)
+	}
+}
+
+func TestServeConfigETag(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	_, emptyTag := b.ServeConfigWithETag()
+	conf := &ipn.ServeConfig{
+		TCP: map[uint16]*ipn.TCPPortHandler{443: {HTTPS: true}},
+	}
+	if err := b.SetServeConfig(conf, "not-the-etag"); !errors.Is(err, ErrETagMismatch) {
+		t.Fatalf("SetServeConfig with wrong etag: got %v; want ErrETagMismatch", err)
+	}
+	if err := b.SetServeConfig(conf, emptyTag); err != nil {
+		t.Fatalf("SetServeConfig with current etag: %v", err)
+	}
+	_, tag := b.ServeConfigWithETag()
+	if tag == emptyTag {
+		t.Fatal("etag didn't change with the config")
+	}
+	// The old etag is now stale.
+	if err := b.SetServeConfig(&ipn.ServeConfig{}, emptyTag); !errors.Is(err, ErrETagMismatch) {
+		t.Fatalf("SetServeConfig with stale etag: got %v; want ErrETagMismatch", err)
+	}
+	// An empty etag always succeeds.
+	if err := b.SetServeConfig(&ipn.ServeConfig{}, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeConfigETagIfMatch(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	// Each match sets this same config, so the ETag stays the same.
+	if err := b.SetServeConfig(&ipn.ServeConfig{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	_, tag := b.ServeConfigWithETag()
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		t.Fatalf("ETag %s isn't quoted", tag)
+	}
+	tests := []struct {
+		ifMatch string
+		want    bool
+	}{
+		{tag, true},
+		{strings.Trim(tag, `"`), false},
+		{"*", true},
+		{` * `, true},
+		{`"x", ` + tag, true},
+		{`"x",` + tag + `, "y"`, true},
+		{`"x", "y"`, false},
+		{"W/" + tag, false},
+		{`W/"x", ` + tag, true},
+	}
+	for _, tt := range tests {
+		err := b.SetServeConfig(&ipn.ServeConfig{}, tt.ifMatch)
+		if got := err == nil; got != tt.want {
+			t.Errorf("If-Match %s: got err %v; want match %v", tt.ifMatch, err, tt.want)
+		}
+	}
+}
+
+func TestServeHTTPProxyTLSCertFingerprint(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	// A self-signed certificate, which no CA vouches for.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "backend.internal"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testServ := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "ok")
+		},
+	))
+	testServ.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	testServ.StartTLS()
+	defer testServ.Close()
+	backend := "https://" + testServ.Listener.Addr().String()
+	sum := sha256.Sum256(der)
+	pin := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name     string
+		pin      string
+		wantCode int
+	}{
+		{"unpinned", "", http.StatusBadGateway},
+		{"pinned", pin, http.StatusOK},
+		{"mismatch", strings.Repeat("00", sha256.Size), http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		conf := &ipn.ServeConfig{
+			Web: map[ipn.HostPort]*ipn.WebServerConfig{
+				"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+					"/": {Proxy: backend, TLSCertFingerprint: tt.pin},
+				}},
+			},
+		}
+		if err := b.SetServeConfig(conf, ""); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		b.serveWebHandler(w, newTestServeRequest("GET", "/", "100.150.151.152"))
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: got status %d; want %d", tt.name, w.Code, tt.wantCode)
+		}
+	}
+}
+
+func TestRequestQueue(t *testing.T) {
+	ctx := context.Background()
+	q := newRequestQueue(1, 20*time.Millisecond)
+	if !q.acquire(ctx) {
+		t.Fatal("first request was queued")
+	}
+
+	// With the slot taken, a request times out in the queue.
+	rejected := metricServeRequestsRejected.Value()
+	if q.acquire(ctx) {
+		t.Fatal("second request got in while the first was active")
+	}
+	if got := metricServeRequestsRejected.Value() - rejected; got != 1 {
+		t.Errorf("rejected %d requests; want 1", got)
+	}
+
+	// A queued request gets the slot once it's released.
+	q.maxWait = time.Minute
+	got := make(chan bool)
+	go func() { got <- q.acquire(ctx) }()
+	for metricServeRequestsQueued.Value() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	q.release()
+	if !<-got {
+		t.Fatal("queued request was rejected")
+	}
+	if n := metricServeRequestsQueued.Value(); n != 0 {
+		t.Errorf("%d requests still queued", n)
+	}
+
+	// A queued request whose client goes away leaves the queue.
+	cctx, cancel := context.WithCancel(ctx)
+	go func() { got <- q.acquire(cctx) }()
+	for metricServeRequestsQueued.Value() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if <-got {
+		t.Fatal("canceled request got in")
+	}
+	q.release()
+
+	// Without a queue, requests over the limit fail immediately.
+	q = newRequestQueue(1, 0)
+	q.acquire(ctx)
+	defer q.release()
+	start := time.Now()
+	if q.acquire(ctx) {
+		t.Fatal("request got in over the limit")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("rejecting took %v", d)
+	}
+}
+
+func TestServeHTTPProxyHonorRetryAfter(t *testing.T) {
+	b := newTestServeBackend(t)
+
+	var attempts atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if attempts.Add(1) <= 2 {
+				w.Header().Set("Retry-After", "5")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			io.WriteString(w, "ok")
+		},
+	))
+	defer backend.Close()
+
+	tests := []struct {
+		name         string
+		honor        bool
+		method       string
+		body         string
+		wantStatus   int
+		wantAttempts int32
+	}{
+		{"not-honored", false, "GET", "", http.StatusServiceUnavailable, 1},
+		{"honored", true, "GET", "", http.StatusOK, 3},
+		{"with-body", true, "POST", "data", http.StatusServiceUnavailable, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := &ipn.ServeConfig{
+				Web: map[ipn.HostPort]*ipn.WebServerConfig{
+					"example.ts.net:443": {Handlers: map[string]*ipn.HTTPHandler{
+						"/": {
+							Proxy:                   backend.URL,
+							UpstreamHonorRetryAfter: tt.honor,
+							// Well short of the 5s asked for.
+							UpstreamMaxRetryAfter: 10 * time.Millisecond,
+						},
+					}},
+				},
+			}
+			if err := b.SetServeConfig(conf, ""); err != nil {
+				t.Fatal(err)
+			}
+			attempts.Store(0)
+			front := newTestServeFrontend(t, b)
+			req, _ := http.NewRequest(tt.method, front.URL, strings.NewReader(tt.body))
+			start := time.Now()
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d; want %d", res.StatusCode, tt.wantStatus)
+			}
+			if got := attempts.Load(); got != tt.wantAttempts {
+				t.Errorf("backend got %d requests; want %d", got, tt.wantAttempts)
+			}
+			if d := time.Since(start); d > 4*time.Second {
+				t.Errorf("request took %v; the Retry-After wait wasn't capped", d)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		in     string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"", 0, false},
+		{"5", 5 * time.Second, true},
+		{" 0 ", 0, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{now.Add(time.Minute).Format(http.TimeFormat), time.Minute, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.in, now)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseRetryAfter(%q) = %v, %v; want %v, %v", tt.in, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+// traceRequest returns r with a client trace that records the timings
+// of its request to the backend, for HTTPHandler.TraceRequests. The
+// returned done func stops the clock and returns them.
+func traceRequest(r *http.Request) (_ *http.Request, done func() *ipn.RequestTraceLog) {
+	var (
+		mu    sync.Mutex
+		start = time.Now()
+		tl    ipn.RequestTraceLog
+	)
+	// set sets *d to the time since start, unless it's already set.
+	set := func(d *time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		if *d == 0 {
+			*d = time.Since(start)
+		}
+	}
+	ct := &httptrace.ClientTrace{
+		DNSDone: func(httptrace.DNSDoneInfo) { set(&tl.DNSDone) },
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				set(&tl.ConnectDone)
+			}
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				set(&tl.TLSHandshakeDone)
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			set(&tl.GotConn)
+			mu.Lock()
+			defer mu.Unlock()
+			tl.ConnReused = info.Reused
+		},
+		WroteHeaders:         func() { set(&tl.WroteHeaders) },
+		GotFirstResponseByte: func() { set(&tl.FirstByte) },
+	}
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), ct))
+	return r, func() *ipn.RequestTraceLog {
+		set(&tl.Done)
+		mu.Lock()
+		defer mu.Unlock()
+		ret := tl
+		return &ret
+	}
+}
+
+// logRequestTrace sends a FunnelRequestLog with the timings tl of r's
+// request to the backend to foreground serve streams.
+func (p *reverseProxy) logRequestTrace(r *http.Request, tl *ipn.RequestTraceLog) {
+	sctx, ok := getServeHTTPContext(r)
+	if !ok {
+		return
+	}
+	path, _ := r.Context().Value(serveRequestPathKey{}).(string)
+	log := ipn.FunnelRequestLog{
+		Kind:      ipn.FunnelLogTrace,
+		SrcAddr:   sctx.SrcAddr,
+		Path:      path,
+		Trace:     tl,
+		RequestID: serveRequestID(r.Context()),
+	}
+	log.ClientTLSVersion, log.ClientCipherSuite = clientTLSInfo(r.TLS)
+	p.logEvent(sctx.DestPort, sctx.Funnel, log)
+}
+
+// newTraceParent returns a W3C traceparent header for a request to a
+// backend, for HTTPHandler.PropagateTraceParent. If the client's
+// traceparent, in, is valid, the request is a new span of its trace,
+// and otherwise it starts a new trace.
+//
+// See https://www.w3.org/TR/trace-context/#traceparent-header.
+func newTraceParent(in string) string {
+	traceID, flags := randomHex(16), "01" // sampled
+	if id, f, ok := parseTraceParent(in); ok {
+		traceID, flags = id, f
+	}
+	return "00-" + traceID + "-" + randomHex(8) + "-" + flags
+}
+
+// parseTraceParent returns the trace ID and flags of tp, a version 00
+// W3C traceparent header, and whether it's valid.
+func parseTraceParent(tp string) (traceID, flags string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(tp), "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return "", "", false
+	}
+	traceID, parentID, flags := parts[1], parts[2], parts[3]
+	if !isLowerHex(traceID, 32) || !isLowerHex(parentID, 16) || !isLowerHex(flags, 2) {
+		return "", "", false
+	}
+	if strings.Trim(traceID, "0") == "" || strings.Trim(parentID, "0") == "" {
+		return "", "", false // all zeros is invalid
+	}
+	return traceID, flags, true
+}
+
+// isLowerHex reports whether s is n lowercase hex digits.
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// randomHex returns n random bytes in lowercase hex.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
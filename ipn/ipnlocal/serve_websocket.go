@@ -0,0 +1,204 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package ipnlocal
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"tailscale.com/ipn"
+)
+
+// isWebSocketUpgrade reports whether res switches the connection to the
+// WebSocket protocol.
+func isWebSocketUpgrade(res *http.Response) bool {
+	return res.StatusCode == http.StatusSwitchingProtocols &&
+		strings.EqualFold(res.Header.Get("Upgrade"), "websocket")
+}
+
+// isWebSocketUpgradeRequest reports whether r asks to switch the
+// connection to the WebSocket protocol.
+func isWebSocketUpgradeRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// trackWebSocket replaces the body of res, a WebSocket upgrade response
+// from a Proxy backend, with one that counts the messages and bytes sent
+// each way, and sends a FunnelRequestLog with the totals to any
+// foreground serve streams once the connection is closed.
+//
+// The body of such a response is the connection to the backend, which
+// httputil.ReverseProxy copies to and from the client's connection.
+func (b *LocalBackend) trackWebSocket(res *http.Response) {
+	rwc, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		return
+	}
+	sctx, ok := getServeHTTPContext(res.Request)
+	if !ok {
+		return
+	}
+	path, _ := res.Request.Context().Value(serveRequestPathKey{}).(string)
+	id := serveRequestID(res.Request.Context())
+	res.Body = &webSocketConn{
+		ReadWriteCloser: rwc,
+		onClose: func(ws *ipn.WebSocketLog) {
+			log := ipn.FunnelRequestLog{Kind: ipn.FunnelLogWebSocket, SrcAddr: sctx.SrcAddr, Path: path, RequestID: id, WebSocket: ws}
+			log.ClientTLSVersion, log.ClientCipherSuite = clientTLSInfo(res.Request.TLS)
+			b.logServeEvent(sctx.DestPort, sctx.Funnel, log)
+		},
+	}
+}
+
+// webSocketConn is a connection to a WebSocket backend that counts the
+// frames read from (out to the client) and written to (in from the
+// client) the backend.
+type webSocketConn struct {
+	io.ReadWriteCloser
+	onClose func(*ipn.WebSocketLog)
+
+	mu        sync.Mutex
+	in, out   wsFrameCounter
+	closeOnce sync.Once
+}
+
+func (c *webSocketConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.mu.Lock()
+	c.out.count(p[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *webSocketConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.mu.Lock()
+	c.in.count(p[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *webSocketConn) Close() error {
+	err := c.ReadWriteCloser.Close()
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		ws := &ipn.WebSocketLog{
+			MessagesIn:  c.in.messages,
+			MessagesOut: c.out.messages,
+			BytesIn:     c.in.bytes,
+			BytesOut:    c.out.bytes,
+			CloseCode:   c.in.closeCode,
+		}
+		if ws.CloseCode == 0 {
+			ws.CloseCode = c.out.closeCode
+		}
+		c.mu.Unlock()
+		c.onClose(ws)
+	})
+	return err
+}
+
+// WebSocket frame opcodes (RFC 6455, section 5.2).
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+)
+
+// wsFrameCounter parses the frames of one direction of a WebSocket
+// connection, as written to it in arbitrary chunks, counting the data
+// messages and remembering the status code of the first close frame.
+type wsFrameCounter struct {
+	bytes     int64
+	messages  int64
+	closeCode int
+
+	hdr       []byte  // frame header read so far
+	remaining uint64  // payload bytes left in the current frame
+	opcode    byte    // of the current frame
+	mask      [4]byte // masking key of the current frame, or zeros
+	off       uint64  // payload bytes of the current frame read so far
+	code      [2]byte // start of the current close frame's payload
+}
+
+func (c *wsFrameCounter) count(p []byte) {
+	c.bytes += int64(len(p))
+	for len(p) > 0 {
+		if c.remaining == 0 {
+			n := c.readHeader(p)
+			p = p[n:]
+			continue
+		}
+		n := uint64(len(p))
+		if n > c.remaining {
+			n = c.remaining
+		}
+		if c.opcode == wsOpClose {
+			for i := uint64(0); i < n && c.off+i < 2; i++ {
+				c.code[c.off+i] = p[i] ^ c.mask[(c.off+i)%4]
+			}
+			if c.off < 2 && c.off+n >= 2 && c.closeCode == 0 {
+				c.closeCode = int(binary.BigEndian.Uint16(c.code[:]))
+			}
+		}
+		c.off += n
+		c.remaining -= n
+		p = p[n:]
+	}
+}
+
+// readHeader consumes bytes of a frame header from p, returning how
+// many it used. Once the header is complete, it starts the frame.
+func (c *wsFrameCounter) readHeader(p []byte) int {
+	used := 0
+	for used < len(p) {
+		c.hdr = append(c.hdr, p[used])
+		used++
+		if len(c.hdr) < 2 {
+			continue
+		}
+		want := 2
+		switch c.hdr[1] & 0x7f {
+		case 126:
+			want += 2
+		case 127:
+			want += 8
+		}
+		masked := c.hdr[1]&0x80 != 0
+		if masked {
+			want += 4
+		}
+		if len(c.hdr) < want {
+			continue
+		}
+
+		fin := c.hdr[0]&0x80 != 0
+		c.opcode = c.hdr[0] & 0x0f
+		var length uint64
+		switch l := c.hdr[1] & 0x7f; l {
+		case 126:
+			length = uint64(binary.BigEndian.Uint16(c.hdr[2:4]))
+		case 127:
+			length = binary.BigEndian.Uint64(c.hdr[2:10])
+		default:
+			length = uint64(l)
+		}
+		c.mask = [4]byte{}
+		if masked {
+			copy(c.mask[:], c.hdr[want-4:want])
+		}
+		if fin && (c.opcode == wsOpText || c.opcode == wsOpBinary || c.opcode == wsOpContinuation) {
+			c.messages++
+		}
+		c.hdr = c.hdr[:0]
+		c.off = 0
+		c.remaining = length
+		break
+	}
+	return used
+}
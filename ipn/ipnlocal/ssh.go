@@ -69,7 +69,7 @@ func (b *LocalBackend) getSSHUsernames(req *tailcfg.C2NSSHUsernamesRequest) (*ta
 		res.Usernames = append(res.Usernames, u)
 	}
 
-	if opUser := b.operatorUserName(); opUser != "" {
+	if opUser := b.OperatorUserName(); opUser != "" {
 		add(opUser)
 	}
 
@@ -11,6 +11,7 @@
 	"io"
 	"net"
 	"net/http"
+	"os"
 	"os/user"
 	"strconv"
 	"strings"
@@ -202,6 +203,7 @@ func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
 		lah := localapi.NewHandler(lb, s.logf, s.netMon, s.backendLogID)
 		lah.PermitRead, lah.PermitWrite = s.localAPIPermissions(ci)
 		lah.PermitCert = s.connCanFetchCerts(ci)
+		lah.PermitServeFiles = s.connCanReadFiles(ci)
 		lah.ServeHTTP(w, r)
 		return
 	}
@@ -341,6 +343,21 @@ func (s *Server) connCanFetchCerts(ci *ipnauth.ConnIdentity) bool {
 	return false
 }
 
+// connCanReadFiles reports whether the client on ci may have tailscaled
+// read files on its behalf, as for serve settings like
+// ipn.OAuth2ClientConfig.ClientSecretFile: whether it's root, or the
+// user tailscaled runs as, which could read them anyway.
+func (s *Server) connCanReadFiles(ci *ipnauth.ConnIdentity) bool {
+	if envknob.GOOS() == "js" {
+		return true
+	}
+	if !ci.IsUnixSock() || ci.Creds() == nil {
+		return false
+	}
+	uid, ok := ci.Creds().UserID()
+	return ok && (uid == "0" || uid == strconv.Itoa(os.Getuid()))
+}
+
 // addActiveHTTPRequest adds c to the server's list of active HTTP requests.
 //
 // If the returned error may be of type inUseOtherUserError.
@@ -92,7 +92,10 @@
 	"prefs":                       (*Handler).servePrefs,
 	"pprof":                       (*Handler).servePprof,
 	"reset-auth":                  (*Handler).serveResetAuth,
+	"serve-circuit-status":        (*Handler).serveCircuitStatus,
 	"serve-config":                (*Handler).serveServeConfig,
+	"serve-pool-stats":            (*Handler).servePoolStats,
+	"serve-in-flight":             (*Handler).serveInFlight,
 	"set-dns":                     (*Handler).serveSetDNS,
 	"set-expiry-sooner":           (*Handler).serveSetExpirySooner,
 	"start":                       (*Handler).serveStart,
@@ -152,6 +155,12 @@ type Handler struct {
 	// cert fetching access.
 	PermitCert bool
 
+	// PermitServeFiles is whether the client may set serve settings
+	// that name files for tailscaled to read, such as
+	// OAuth2ClientConfig.ClientSecretFile. It means the user is root,
+	// or the user tailscaled runs as, so could read them anyway.
+	PermitServeFiles bool
+
 	b            *ipnlocal.LocalBackend
 	logf         logger.Logf
 	netMon       *netmon.Monitor // optional; nil means interfaces will be looked up on-demand
@@ -831,10 +840,11 @@ func (h *Handler) serveServeConfig(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "serve config denied", http.StatusForbidden)
 			return
 		}
+		config, etag := h.b.ServeConfigWithETag()
 		w.Header().Set("Content-Type", "application/json")
-		config := h.b.ServeConfig()
+		w.Header().Set("Etag", etag)
 		json.NewEncoder(w).Encode(config)
-	case "POST":
+	case "POST", "PUT":
 		if !h.PermitWrite {
 			http.Error(w, "serve config denied", http.StatusForbidden)
 			return
@@ -844,7 +854,19 @@ func (h *Handler) serveServeConfig(w http.ResponseWriter, r *http.Request) {
 			writeErrorJSON(w, fmt.Errorf("decoding config: %w", err))
 			return
 		}
-		if err := h.b.SetServeConfig(configIn); err != nil {
+		// If-Match, if set, must match the ETag of the current
+		// config, so that concurrent read-modify-write updates don't
+		// overwrite each other.
+		ifMatch := strings.Join(r.Header.Values("If-Match"), ",")
+		if err := h.b.SetServeConfigForClient(configIn, ifMatch, h.PermitServeFiles); err != nil {
+			if errors.Is(err, ipnlocal.ErrETagMismatch) {
+				http.Error(w, err.Error(), http.StatusPreconditionFailed)
+				return
+			}
+			if errors.Is(err, ipn.ErrServeFilesDenied) {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
 			writeErrorJSON(w, fmt.Errorf("updating config: %w", err))
 			return
 		}
@@ -854,6 +876,81 @@ func (h *Handler) serveServeConfig(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// serveCircuitStatus returns the circuit breaker state of the serve
+// Proxy backend given by the "backend" query parameter.
+func (h *Handler) serveCircuitStatus(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "circuit status access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "GET required", http.StatusMethodNotAllowed)
+		return
+	}
+	backend := r.FormValue("backend")
+	if backend == "" {
+		http.Error(w, "missing 'backend' parameter", http.StatusBadRequest)
+		return
+	}
+	st, err := h.b.CircuitBreakerStatus(backend)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// servePoolStats returns the connection pool statistics of the serve
+// Proxy backend given by the "backend" query parameter.
+func (h *Handler) servePoolStats(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "pool stats access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "GET required", http.StatusMethodNotAllowed)
+		return
+	}
+	backend := r.FormValue("backend")
+	if backend == "" {
+		http.Error(w, "missing 'backend' parameter", http.StatusBadRequest)
+		return
+	}
+	st, err := h.b.UpstreamPoolStats(backend)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// serveInFlight returns the number of requests being proxied to a serve
+// Proxy backend.
+func (h *Handler) serveInFlight(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "in-flight requests access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "GET required", http.StatusMethodNotAllowed)
+		return
+	}
+	backend := r.FormValue("backend")
+	if backend == "" {
+		http.Error(w, "missing 'backend' parameter", http.StatusBadRequest)
+		return
+	}
+	n, err := h.b.ServeRequestsInFlight(backend)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(n)
+}
+
 // serveStreamServe handles foreground serve and funnel streams. This is
 // currently in development per https://github.com/tailscale/tailscale/issues/8489
 func (h *Handler) serveStreamServe(w http.ResponseWriter, r *http.Request) {
@@ -876,7 +973,7 @@ func (h *Handler) serveStreamServe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	if err := h.b.StreamServe(r.Context(), w, req); err != nil {
+	if err := h.b.StreamServeForClient(r.Context(), w, req, h.PermitServeFiles); err != nil {
 		writeErrorJSON(w, fmt.Errorf("streaming serve: %w", err))
 		return
 	}
@@ -4,17 +4,28 @@
 package ipn
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"net/netip"
 	"net/url"
+	"path"
+	"reflect"
 	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"golang.org/x/net/http/httpguts"
 	"tailscale.com/tailcfg"
+	"tailscale.com/util/mak"
 )
 
 // ServeConfigKey returns a StateKey that stores the
@@ -38,6 +49,14 @@ type ServeConfig struct {
 	// traffic is allowed, from trusted ingress peers.
 	AllowFunnel map[HostPort]bool `json:",omitempty"`
 
+	// FunnelPaths optionally limits the Funnel traffic allowed by
+	// AllowFunnel to web requests whose paths are under one of the
+	// given path prefixes, such as "/api/". Other Funnel requests to
+	// the HostPort get 404 Not Found, while requests from the tailnet
+	// are served as usual. A HostPort in AllowFunnel without
+	// FunnelPaths allows Funnel traffic to all of its paths.
+	FunnelPaths map[HostPort][]string `json:",omitempty"`
+
 	// Foreground is a map of an IPN Bus session id to a
 	// foreground serve config. Note that only TCP and Web
 	// are used inside the Foreground map.
@@ -45,6 +64,13 @@ type ServeConfig struct {
 	// TODO(marwan-at-work): this is not currently
 	// used. Remove the TODO in the follow up PR.
 	Foreground map[string]*ServeConfig `json:",omitempty"`
+
+	// ETag is the checksum of the serve config as returned by the
+	// LocalAPI, in its ETag response header. It's populated by
+	// LocalClient.GetServeConfig and, if non-empty, sent back by
+	// LocalClient.SetServeConfig so that the update fails if the
+	// config was changed in between. It isn't stored.
+	ETag string `json:"-"`
 }
 
 // HostPort is an SNI name and port number, joined by a colon.
@@ -105,6 +131,135 @@ type ServeStreamRequest struct {
 	// Funnel indicates whether the request
 	// is a serve request or a funnel one.
 	Funnel bool `json:",omitempty"`
+
+	// FunnelPaths, if non-empty, limits Funnel traffic to requests
+	// under these path prefixes, as in ServeConfig.FunnelPaths.
+	FunnelPaths []string `json:",omitempty"`
+
+	// SessionLabel, if non-empty, is sent to the Proxy backend in the
+	// X-Tailscale-Session-Label header of requests served by this
+	// Funnel session, alongside X-Tailscale-Session, so that a backend
+	// shared by several sessions can tell their traffic apart, such as
+	// to route it to different tenants. It must pass CheckSessionLabel.
+	SessionLabel string `json:",omitempty"`
+
+	// Handler, if non-nil, holds additional settings for
+	// the HTTPHandler that proxies to Source. Its Proxy field
+	// is ignored and replaced by Source.
+	Handler *HTTPHandler `json:",omitempty"`
+
+	// TCP, if true, means that TCP connections to HostPort's
+	// port are forwarded as is to Source, an IP:port, rather
+	// than served as HTTPS. MountPoint and Handler are ignored.
+	TCP bool `json:",omitempty"`
+}
+
+// ServeConfig returns the ServeConfig that serves req. It is merged
+// into the current config for as long as req's stream is open.
+func (req ServeStreamRequest) ServeConfig() *ServeConfig {
+	var sc *ServeConfig
+	port, _ := req.HostPort.Port()
+	if req.TCP {
+		sc = &ServeConfig{
+			TCP: map[uint16]*TCPPortHandler{
+				port: {TCPForward: req.Source},
+			},
+		}
+	} else {
+		h := req.Handler.Clone()
+		if h == nil {
+			h = new(HTTPHandler)
+		}
+		h.Proxy = req.Source
+		sc = &ServeConfig{
+			TCP: map[uint16]*TCPPortHandler{
+				port: {HTTPS: true},
+			},
+			Web: map[HostPort]*WebServerConfig{
+				req.HostPort: {Handlers: map[string]*HTTPHandler{
+					req.MountPoint: h,
+				}},
+			},
+		}
+	}
+	if req.Funnel {
+		sc.AllowFunnel = map[HostPort]bool{req.HostPort: true}
+		if len(req.FunnelPaths) > 0 && !req.TCP {
+			sc.FunnelPaths = map[HostPort][]string{req.HostPort: slices.Clone(req.FunnelPaths)}
+		}
+	}
+	return sc
+}
+
+// CheckSessionLabel reports whether label can be a
+// ServeStreamRequest.SessionLabel: 1 to 64 ASCII letters and digits.
+func CheckSessionLabel(label string) error {
+	if label == "" || len(label) > 64 {
+		return fmt.Errorf("invalid session label %q; must be 1 to 64 letters and digits", label)
+	}
+	for _, c := range label {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			return fmt.Errorf("invalid session label %q; must be 1 to 64 letters and digits", label)
+		}
+	}
+	return nil
+}
+
+// RequestSignatureHeader is the header in which requests to a Proxy
+// backend with HTTPHandler.RequestSigningSecretFile are signed.
+const RequestSignatureHeader = "X-Tailscale-Signature"
+
+// DefaultRequestSignatureMaxDrift is the suggested maxDrift for
+// VerifyRequestSignature: how far a request's signing time may be from
+// the backend's clock before the request is rejected as a replay.
+const DefaultRequestSignatureMaxDrift = 5 * time.Second
+
+// RequestSignature returns the RequestSignatureHeader value for a
+// request to a Proxy backend with the given method and requestURI (its
+// path and query, as sent to the backend), signed with secret at t:
+//
+//	ts=<t in Unix seconds>,v1=<hex HMAC-SHA256>
+//
+// where the HMAC-SHA256, keyed by secret, is of method, requestURI and
+// the timestamp, each followed by a newline.
+func RequestSignature(secret []byte, method, requestURI string, t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "ts=" + ts + ",v1=" + hex.EncodeToString(requestMAC(secret, method, requestURI, ts))
+}
+
+func requestMAC(secret []byte, method, requestURI, ts string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", method, requestURI, ts)
+	return mac.Sum(nil)
+}
+
+// VerifyRequestSignature reports an error unless sig is a valid
+// RequestSignatureHeader value, as returned by RequestSignature, for a
+// request with the given method and requestURI, signed with secret no
+// further than maxDrift from now.
+func VerifyRequestSignature(sig string, secret []byte, method, requestURI string, maxDrift time.Duration, now time.Time) error {
+	var ts, v1 string
+	for _, f := range strings.Split(sig, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(f), "=")
+		switch k {
+		case "ts":
+			ts = v
+		case "v1":
+			v1 = v
+		}
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid signature timestamp %q", ts)
+	}
+	got, err := hex.DecodeString(v1)
+	if err != nil || !hmac.Equal(got, requestMAC(secret, method, requestURI, ts)) {
+		return errors.New("signature mismatch")
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > maxDrift || d < -maxDrift {
+		return fmt.Errorf("signature timestamp is %v from now; more than %v", d.Round(time.Second), maxDrift)
+	}
+	return nil
 }
 
 // FunnelRequestLog is the JSON type written out to io.Writers
@@ -114,9 +269,50 @@ type ServeStreamRequest struct {
 type FunnelRequestLog struct {
 	Time time.Time `json:",omitempty"` // time of request forwarding
 
+	// Kind is what the log is for, one of the FunnelLog constants, so
+	// that the start of a request can be told from the logs that
+	// follow it.
+	Kind string
+
 	// SrcAddr is the address that initiated the Funnel request.
 	SrcAddr netip.AddrPort `json:",omitempty"`
 
+	// Path is the URL path of the request, or empty for a TCP
+	// connection.
+	Path string `json:",omitempty"`
+
+	// EdgeRegion is the region code of the Funnel ingress node's home
+	// DERP region, like "nyc", for requests from Funnel. It's also sent
+	// to Proxy backends in the X-Tailscale-Edge-Region header.
+	EdgeRegion string `json:",omitempty"`
+
+	// CountryCode, CityName and ASNOrg are where the client at SrcAddr
+	// is, like "NL", "Amsterdam" and "Example Networks B.V.", as looked
+	// up in the table of networks given to the tailscale CLI's
+	// --geoip-db when it writes the log; tailscaled doesn't set them.
+	// Each is empty if the table doesn't have it.
+	CountryCode string `json:",omitempty"`
+	CityName    string `json:",omitempty"`
+	ASNOrg      string `json:",omitempty"`
+
+	// BackendID is which backend of an HTTPHandler with an
+	// ABTestBackend serves the request: "A" for its Proxy, or "B" for
+	// its ABTestBackend. It's empty for other handlers.
+	BackendID string `json:",omitempty"`
+
+	// RequestID is the request's X-Request-ID, if its HTTPHandler has
+	// PropagateRequestID, for correlating it with the Proxy backend's
+	// logs.
+	RequestID string `json:",omitempty"`
+
+	// ClientTLSVersion and ClientCipherSuite are the TLS version, like
+	// "TLS1.3", and cipher suite, like "TLS_AES_256_GCM_SHA384", of the
+	// client's connection, for auditing. They're "unknown" if this node
+	// didn't terminate TLS for the request, such as for plain HTTP or
+	// forwarded TCP connections.
+	ClientTLSVersion  string `json:",omitempty"`
+	ClientCipherSuite string `json:",omitempty"`
+
 	// The following fields are only populated if the connection
 	// initiated from another node on the client's tailnet.
 
@@ -124,11 +320,327 @@ type FunnelRequestLog struct {
 	NodeTags        []string `json:",omitempty"` // src node tags
 	UserLoginName   string   `json:",omitempty"` // src node's owner login (if not tagged)
 	UserDisplayName string   `json:",omitempty"` // src node's owner name (if not tagged)
+
+	// WebSocket, if non-nil, means that this log is for the end of a
+	// proxied WebSocket connection, rather than the start of a request.
+	WebSocket *WebSocketLog `json:",omitempty"`
+
+	// Slow, if true, means that this log is for the end of a request,
+	// already logged when it started, whose Proxy backend took longer
+	// than its HTTPHandler's SlowRequestThreshold to start responding.
+	// UpstreamLatency is how long it took.
+	Slow            bool          `json:",omitempty"`
+	UpstreamLatency time.Duration `json:",omitempty"`
+
+	// Trace, if non-nil, means that this log is for the end of a
+	// request, already logged when it started, with the timings of its
+	// request to the Proxy backend, as enabled by
+	// HTTPHandler.TraceRequests.
+	Trace *RequestTraceLog `json:",omitempty"`
+
+	// ErrorClass, if non-empty, means that this log is for the end of
+	// a request, already logged when it started, whose request to the
+	// Proxy backend failed, and is the likely cause: one of the
+	// UpstreamError constants. Only failures whose cause serve
+	// recognizes are logged, and only with
+	// HTTPHandler.ClassifyUpstreamErrors.
+	ErrorClass string `json:",omitempty"`
+
+	// ResponseBodyBytes, if non-zero, means that this log is for the
+	// end of a request, already logged when it started, and is how many
+	// bytes of the Proxy backend's response body were sent to the
+	// client, after any CompressionOffload, as enabled by
+	// HTTPHandler.LogResponseBodyBytes. Empty bodies aren't logged.
+	ResponseBodyBytes int64 `json:",omitempty"`
+
+	// UpstreamConn, if non-nil, means that this log is for a connection
+	// to a Proxy backend being opened or closed, as enabled by
+	// HTTPHandler.ConnectionEvents, rather than for a request. It has
+	// no SrcAddr or Path.
+	UpstreamConn *UpstreamConnLog `json:",omitempty"`
+
+	// Preheat, if non-nil, means that this log is for the end of
+	// opening connections to a Proxy backend when a foreground serve
+	// stream started, as enabled by HTTPHandler.PreheatConnections,
+	// rather than for a request. It has no SrcAddr or Path.
+	Preheat *PreheatLog `json:",omitempty"`
+}
+
+// Kinds of FunnelRequestLog, as in its Kind.
+const (
+	FunnelLogRequest           = "REQUEST"             // start of an HTTP request
+	FunnelLogConnection        = "CONNECTION"          // start of a forwarded TCP connection
+	FunnelLogWebSocket         = "WEBSOCKET"           // see FunnelRequestLog.WebSocket
+	FunnelLogSlow              = "SLOW"                // see FunnelRequestLog.Slow
+	FunnelLogTrace             = "TRACE"               // see FunnelRequestLog.Trace
+	FunnelLogUpstreamError     = "UPSTREAM_ERROR"      // see FunnelRequestLog.ErrorClass
+	FunnelLogResponseBodyBytes = "RESPONSE_BODY_BYTES" // see FunnelRequestLog.ResponseBodyBytes
+	FunnelLogUpstreamConn      = "UPSTREAM_CONN"       // see FunnelRequestLog.UpstreamConn
+	FunnelLogPreheat           = "PREHEAT"             // see FunnelRequestLog.Preheat
+)
+
+// OIDCUpstreamAuth configures how serve gets access tokens for a Proxy
+// backend from an OpenID Connect provider, using the OAuth 2.0 client
+// credentials grant. Tokens are cached until shortly before they expire.
+type OIDCUpstreamAuth struct {
+	// DiscoveryURL is the URL of the provider's discovery document,
+	// like https://id.example.com/.well-known/openid-configuration,
+	// whose token_endpoint tokens are requested from.
+	DiscoveryURL string
+
+	// ClientID is the OAuth 2.0 client ID of serve.
+	ClientID string
+
+	// ClientSecretFile is the absolute path of a file holding the
+	// client secret. It's read each time a token is requested, so the
+	// secret can be rotated, and isn't stored in the ServeConfig.
+	ClientSecretFile string
+}
+
+// OIDCAccessControl configures how serve checks the JWTs that requests
+// to a Proxy backend must carry. A token must be signed by one of the
+// provider's keys, from the JWKS at the discovery document's jwks_uri,
+// which are cached for 5 minutes. Its issuer must be the document's
+// issuer, its audience must include Audience, and it mustn't have
+// expired.
+type OIDCAccessControl struct {
+	// DiscoveryURL is the URL of the provider's discovery document,
+	// like https://id.example.com/.well-known/openid-configuration.
+	DiscoveryURL string
+
+	// Audience is the audience ("aud" claim) that tokens must be issued
+	// for, typically the client ID of the application.
+	Audience string
+}
+
+// OAuth2ClientConfig configures how serve gets access tokens for a
+// Proxy backend from an OAuth 2.0 token endpoint, using the client
+// credentials grant. Tokens are cached until 30 seconds before they
+// expire.
+type OAuth2ClientConfig struct {
+	// TokenURL is the URL of the token endpoint.
+	TokenURL string
+
+	// ClientID is the OAuth 2.0 client ID of serve.
+	ClientID string
+
+	// ClientSecretFile is the absolute path of a file holding the
+	// client secret. It's read each time a token is requested, so the
+	// secret can be rotated, and isn't stored in the ServeConfig.
+	ClientSecretFile string
+
+	// Scopes are the scopes to request, if any.
+	Scopes []string `json:",omitempty"`
+}
+
+// WebSocketLog summarizes a proxied WebSocket connection once it's
+// closed. In is from the client to the backend and Out is back.
+type WebSocketLog struct {
+	MessagesIn  int64 // data messages sent by the client
+	MessagesOut int64 // data messages sent by the backend
+	BytesIn     int64 // bytes sent by the client, including framing
+	BytesOut    int64 // bytes sent by the backend, including framing
+
+	// CloseCode is the status code of the first close frame sent by
+	// either side, or zero if there was none.
+	CloseCode int `json:",omitempty"`
+}
+
+// RequestTraceLog is the part of a FunnelRequestLog with the timings of
+// a request to a Proxy backend, as measured with net/http/httptrace.
+// Each is the time from when the request was handed to the reverse
+// proxy, or zero if it didn't happen, as for a DNS lookup of an IP
+// address or the dial of a reused connection.
+type RequestTraceLog struct {
+	DNSDone          time.Duration `json:",omitempty"` // DNS lookup of the backend finished
+	ConnectDone      time.Duration `json:",omitempty"` // TCP connection to the backend established
+	TLSHandshakeDone time.Duration `json:",omitempty"` // TLS handshake with the backend finished
+	GotConn          time.Duration `json:",omitempty"` // connection to use obtained, new or reused
+	WroteHeaders     time.Duration `json:",omitempty"` // request headers written
+	FirstByte        time.Duration `json:",omitempty"` // first byte of the response read
+	Done             time.Duration // response finished being copied to the client
+
+	ConnReused bool `json:",omitempty"` // whether GotConn was an existing connection
+
+	// TraceParent is the W3C traceparent header sent to the backend, as
+	// enabled by HTTPHandler.PropagateTraceParent.
+	TraceParent string `json:",omitempty"`
+}
+
+// Events of an UpstreamConnLog.
+const (
+	UpstreamConnOpen  = "CONNECTION_OPEN"
+	UpstreamConnClose = "CONNECTION_CLOSE"
+)
+
+// States of a connection to a Proxy backend, as the Events of the
+// UpstreamConnLogs for HTTPHandler.ConnectionStates. A connection is NEW
+// when it's opened, ACTIVE while a request is sent on it, IDLE while
+// it's back in the pool waiting for another, and CLOSED once closed.
+const (
+	UpstreamConnNew    = "NEW"
+	UpstreamConnActive = "ACTIVE"
+	UpstreamConnIdle   = "IDLE"
+	UpstreamConnClosed = "CLOSED"
+)
+
+// Likely causes of failed requests to a Proxy backend, as in
+// FunnelRequestLog.ErrorClass.
+const (
+	UpstreamErrorNotRunning = "backend not running"      // connection refused
+	UpstreamErrorSlow       = "backend slow"             // timed out
+	UpstreamErrorNetwork    = "network misconfiguration" // no route to host
+)
+
+// UpstreamConnLog is the part of a FunnelRequestLog for a connection to a
+// Proxy backend.
+type UpstreamConnLog struct {
+	Event      string    // UpstreamConnOpen, UpstreamConnClose or a state, such as UpstreamConnIdle
+	Backend    string    // the backend URL
+	RemoteAddr string    // the backend's IP:port
+	Start      time.Time // when the connection was opened
+
+	// ConnID identifies the connection among all of tailscaled's
+	// connections to Proxy backends.
+	ConnID int64 `json:",omitempty"`
+
+	// Time is when the event happened, which can be a little before
+	// the FunnelRequestLog's Time.
+	Time time.Time `json:",omitempty"`
+
+	// The following fields are only set for UpstreamConnClose and
+	// UpstreamConnClosed.
+
+	Requests      int64 // requests sent over the connection
+	BytesSent     int64 // bytes written to the backend
+	BytesReceived int64 // bytes read from the backend
+}
+
+// PreheatLog is the part of a FunnelRequestLog for the connections
+// opened to a Proxy backend for HTTPHandler.PreheatConnections.
+type PreheatLog struct {
+	Backend string // the backend URL
+	Conns   int    // connections opened, as the HEAD requests that succeeded
+
+	// Err is the error of the first HEAD request that failed, if any.
+	Err string `json:",omitempty"`
+}
+
+// FunnelStartedEvent is sent on the IPN bus (as Notify.FunnelStarted) once
+// the local backend has applied the ServeConfig for a foreground Funnel
+// session started via ipnlocal.StreamServe.
+type FunnelStartedEvent struct {
+	HostPort  HostPort  // the HostPort being funneled
+	SessionID string    // unique ID of the foreground session
+	Time      time.Time // time the ServeConfig was applied
+}
+
+// DefaultCircuitBreakerCooldown is the HTTPHandler.CircuitBreakerCooldown
+// used if none is set.
+const DefaultCircuitBreakerCooldown = 30 * time.Second
+
+// DefaultUpstreamMaxRetryAfter is the HTTPHandler.UpstreamMaxRetryAfter
+// used if none is set.
+const DefaultUpstreamMaxRetryAfter = 30 * time.Second
+
+// Circuit breaker states, as reported in CircuitStatus.State.
+const (
+	CircuitClosed   = "closed"    // requests are forwarded to the backend
+	CircuitOpen     = "open"      // requests fail without reaching the backend
+	CircuitHalfOpen = "half-open" // trial requests are allowed through
+)
+
+// CircuitStatus is the state of the circuit breaker of a Proxy backend,
+// as returned by the LocalAPI.
+type CircuitStatus struct {
+	Backend string // the backend URL
+	State   string // CircuitClosed, CircuitOpen or CircuitHalfOpen
+
+	// Failures is the number of consecutive failed requests.
+	Failures int
+
+	// LastFailure is when the most recent failed request was, or the
+	// zero time if there hasn't been one.
+	LastFailure time.Time
+
+	// RecoveryTime is when an open circuit will let a trial request
+	// through to the backend. It's the zero time unless State is
+	// CircuitOpen.
+	RecoveryTime time.Time
+}
+
+// UpstreamPoolStats are statistics about the pool of connections to a
+// Proxy backend, as enabled by HTTPHandler.CollectPoolStats.
+type UpstreamPoolStats struct {
+	Backend string // the backend URL
+
+	// Active is the number of requests currently using a connection
+	// to the backend.
+	Active int64
+
+	// Idle is the number of open connections to the backend not in
+	// use by a request. With HTTP/2, where requests share connections,
+	// it's only an approximation.
+	Idle int64
+
+	// WaitCount is the number of requests that couldn't reuse an
+	// existing connection, and WaitDuration is the total time they
+	// spent waiting for a new one.
+	WaitCount    int64
+	WaitDuration time.Duration
+}
+
+// ServeStatusSchemaV1 is the SchemaVersion of ServeStatusV1.
+const ServeStatusSchemaV1 = "v1"
+
+// ServeStatusV1 is version 1 of the serve status, as printed by
+// "tailscale serve status --json --schema-version=v1". Unlike the JSON
+// form of ServeConfig, which follows the internal type and can change
+// between releases, it's stable: fields may be added, but changing or
+// removing one needs a new schema version.
+type ServeStatusV1 struct {
+	SchemaVersion string // ServeStatusSchemaV1
+	Version       string // tailscaled's long version
+
+	// Handlers are the web handlers and TCP forwarders of the serve
+	// config, sorted by host:port and then mount point.
+	Handlers []ServeStatusV1Handler
+}
+
+// ServeStatusV1Handler is a web handler or TCP forwarder in a
+// ServeStatusV1.
+type ServeStatusV1Handler struct {
+	HostPort HostPort
+
+	// Mount is the mount point of a web handler, or empty for a TCP
+	// forwarder or a handler in WebServerConfig.MethodHandlers.
+	Mount string
+
+	// Method is the key of a handler in WebServerConfig.MethodHandlers,
+	// such as "GET" or "*".
+	Method string `json:",omitempty"`
+
+	Type   string // "proxy", "path", "text" or "tcp"
+	Target string // the backend URL, file path, text or TCP host:port
+	Funnel bool   // whether HostPort is served publicly with Funnel
+
+	// ActiveConnections is the number of requests being proxied to a
+	// "proxy" backend. It's always zero for other types.
+	ActiveConnections int64
 }
 
 // WebServerConfig describes a web server's configuration.
 type WebServerConfig struct {
 	Handlers map[string]*HTTPHandler // mountPoint => handler
+
+	// MethodHandlers optionally maps an HTTP request method (such as
+	// "GET" or "OPTIONS") to the handler for requests with that method.
+	// They're mounted at "/": a mount point in Handlers that matches
+	// more of the path takes precedence, but a matching method takes
+	// precedence over a handler at "/". The "*" key is a catch-all,
+	// used for requests that match neither a method nor a mount point
+	// in Handlers.
+	MethodHandlers map[string]*HTTPHandler `json:",omitempty"`
 }
 
 // TCPPortHandler describes what to do when handling a TCP
@@ -169,10 +681,840 @@ type HTTPHandler struct {
 
 	Text string `json:",omitempty"` // plaintext to serve (primarily for testing)
 
+	// ABTestBackend, if non-empty, is a second Proxy backend, in the
+	// same form as Proxy, that serves ABTestPercentage percent of
+	// clients, for A/B testing a new version of a service. Each client
+	// sticks to one backend: the choice is a hash of its IP address and
+	// the day or, if ABTestCookie is true, kept in a cookie.
+	ABTestBackend    string `json:",omitempty"`
+	ABTestPercentage int    `json:",omitempty"` // 0 to 100
+	ABTestCookie     bool   `json:",omitempty"`
+
+	// TLSMinVersion is the minimum TLS version accepted from an HTTPS
+	// Proxy backend. It must be one of "tls10", "tls11", "tls12" or
+	// "tls13"; the empty string means "tls12".
+	TLSMinVersion string `json:",omitempty"`
+
+	// TLSRenegotiation is whether an HTTPS Proxy backend may ask to
+	// renegotiate TLS 1.2 connections, as some legacy servers do to ask
+	// for client certificates: "none", "once" (once per connection) or
+	// "freely". The empty string means "none". Allowing renegotiation
+	// weakens TLS, so it's only for backends that can't work without it.
+	TLSRenegotiation string `json:",omitempty"`
+
+	// UpstreamRootCA, if non-empty, is a PEM-encoded bundle of CA
+	// certificates used instead of the system roots to verify an
+	// HTTPS Proxy backend.
+	UpstreamRootCA string `json:",omitempty"`
+
+	// UpstreamTLSSNI, if non-empty, is the server name sent in the TLS
+	// handshake with an HTTPS Proxy backend, and verified against its
+	// certificate, in place of the backend's host. It doesn't change the
+	// Host header of proxied requests.
+	UpstreamTLSSNI string `json:",omitempty"`
+
+	// TLSCertFingerprint, if non-empty, is the SHA-256 fingerprint, in
+	// hex, of the certificate an HTTPS Proxy backend must present. The
+	// certificate is then pinned: it's accepted if it matches, whether
+	// or not it's signed by a trusted CA, and rejected otherwise.
+	TLSCertFingerprint string `json:",omitempty"`
+
+	// ForceHTTP1, if true, disables HTTP/2 to a Proxy backend so that
+	// requests are always forwarded using HTTP/1.1.
+	ForceHTTP1 bool `json:",omitempty"`
+
+	// UpstreamUserAgent, if non-empty, replaces the User-Agent header
+	// of requests to a Proxy backend. If empty, the client's
+	// User-Agent is passed through.
+	UpstreamUserAgent string `json:",omitempty"`
+
+	// BearerTokenFile, if non-empty, is the absolute path of a file
+	// holding a token to send to a Proxy backend as an
+	// "Authorization: Bearer" header. The file is read for each request
+	// so the token can be rotated; requests fail with 503 Service
+	// Unavailable if it can't be read.
+	BearerTokenFile string `json:",omitempty"`
+
+	// RequestSigningSecretFile, if non-empty, is the absolute path of a
+	// file holding a secret with which requests to a Proxy backend are
+	// signed, so that the backend can check that they came through
+	// serve. The signature is sent in the RequestSignatureHeader, as
+	// described at RequestSignature. Like BearerTokenFile, the file is
+	// read for each request; requests fail with 503 Service Unavailable
+	// if it can't be read.
+	RequestSigningSecretFile string `json:",omitempty"`
+
+	// OIDCUpstreamAuth, if non-nil, is how to get OpenID Connect access
+	// tokens to send to a Proxy backend as an "Authorization: Bearer"
+	// header. It can't be used with BearerTokenFile.
+	OIDCUpstreamAuth *OIDCUpstreamAuth `json:",omitempty"`
+
+	// OIDCAccessControl, if non-nil, requires requests to a Proxy
+	// backend to carry a valid JWT from an OpenID Connect provider in an
+	// "Authorization: Bearer" header. Others get 401 Unauthorized.
+	OIDCAccessControl *OIDCAccessControl `json:",omitempty"`
+
+	// OAuth2Config, if non-nil, is how to get OAuth 2.0 access tokens
+	// to send to a Proxy backend as an "Authorization: Bearer" header,
+	// for token endpoints without OpenID Connect discovery. It can't be
+	// used with BearerTokenFile or OIDCUpstreamAuth.
+	OAuth2Config *OAuth2ClientConfig `json:",omitempty"`
+
+	// UpstreamReadTimeout, if non-zero, is how long to wait for each
+	// read from a Proxy backend before giving up on the connection.
+	// Unlike a timeout on the whole response, it only fails backends
+	// that stall, not ones that are slowly streaming a long response.
+	UpstreamReadTimeout time.Duration `json:",omitempty"`
+
+	// UpstreamStallTimeout, if non-zero, is how long a Proxy backend's
+	// response body may go without sending any bytes before the
+	// response is cut off, leaving the client with a truncated body.
+	// Unlike UpstreamReadTimeout, it doesn't limit how long the backend
+	// takes to start responding, only stalls partway through the body.
+	UpstreamStallTimeout time.Duration `json:",omitempty"`
+
+	// MaxResponseBytes, if non-zero, is the largest response body a
+	// Proxy backend may send. A response with a larger Content-Length
+	// fails with 502 Bad Gateway. One that only turns out to be larger
+	// partway through is cut off at the limit, leaving the client with
+	// a truncated body, as the headers have already been sent.
+	MaxResponseBytes int64 `json:",omitempty"`
+
+	// NoSniff, if true, sets "X-Content-Type-Options: nosniff" on all
+	// responses, and leaves a Proxy backend's responses without a
+	// Content-Type without one, rather than one guessed from the body,
+	// which can be wrong for binary protocols.
+	NoSniff bool `json:",omitempty"`
+
+	// CacheControlOverride, if non-empty, replaces the Cache-Control
+	// header of a Proxy backend's responses, such as to let an edge
+	// cache keep responses the backend marks no-store. Responses
+	// without a Cache-Control header get this one.
+	CacheControlOverride string `json:",omitempty"`
+
+	// StripPragma, if true, removes the Pragma header, such as the
+	// legacy "Pragma: no-cache", from a Proxy backend's responses.
+	StripPragma bool `json:",omitempty"`
+
+	// CompressionOffload, if true, re-encodes a Proxy backend's gzip or
+	// brotli compressed responses to suit the client's Accept-Encoding:
+	// brotli if the client accepts it, else gzip, else uncompressed.
+	CompressionOffload bool `json:",omitempty"`
+
+	// IdempotencyCacheTTL, if non-zero, is how long a Proxy backend's
+	// response to a request with an Idempotency-Key header is kept, so
+	// that a retried request with the same key gets the same response
+	// without reaching the backend again. Only small responses without
+	// a 5xx status are kept, up to a fixed number, least recently used
+	// first out.
+	IdempotencyCacheTTL time.Duration `json:",omitempty"`
+
+	// TraceRequests, if true, logs each request to a Proxy backend again
+	// at its end to foreground serve streams, with a RequestTraceLog of
+	// its timings.
+	TraceRequests bool `json:",omitempty"`
+
+	// LogResponseBodyBytes, if true, logs each request to a Proxy
+	// backend with a non-empty response body again at its end to
+	// foreground serve streams, with its ResponseBodyBytes.
+	LogResponseBodyBytes bool `json:",omitempty"`
+
+	// PropagateTraceParent, if true, sends a W3C traceparent header to
+	// a Proxy backend with each request. It continues the trace of the
+	// client's traceparent, if it sent a valid one, and otherwise starts
+	// a new trace.
+	PropagateTraceParent bool `json:",omitempty"`
+
+	// PropagateRequestID, if true, gives each request to a Proxy backend
+	// an ID: the client's X-Request-ID, if it sent a usable one, or else
+	// a new random one. The ID is sent to the backend and back to the
+	// client in X-Request-ID headers, also on error responses, and is
+	// the RequestID of the request's FunnelRequestLogs.
+	PropagateRequestID bool `json:",omitempty"`
+
+	// SlowRequestThreshold, if non-zero, is how long a Proxy backend
+	// may take to start responding to a request before the request is
+	// logged again at its end as Slow, to foreground serve streams.
+	SlowRequestThreshold time.Duration `json:",omitempty"`
+
+	// CircuitBreakerFailures, if non-zero, is the number of consecutive
+	// failed requests to a Proxy backend after which the circuit opens
+	// and further requests fail fast with 503 Service Unavailable. A
+	// request fails if the backend can't be reached or responds with a
+	// 5xx status.
+	CircuitBreakerFailures int `json:",omitempty"`
+
+	// CircuitBreakerCooldown is how long an open circuit stays open
+	// before trial requests are let through to the backend (the
+	// half-open state), as set by CircuitBreakerHalfOpenRequests.
+	// If zero, DefaultCircuitBreakerCooldown is used.
+	CircuitBreakerCooldown time.Duration `json:",omitempty"`
+
+	// CircuitBreakerHalfOpenRequests is how many trial requests a
+	// half-open circuit lets through to the backend at once. The
+	// circuit closes once half of them, rounded up, succeed, and opens
+	// again if any fails. If zero, a single trial request is let
+	// through.
+	CircuitBreakerHalfOpenRequests int `json:",omitempty"`
+
+	// MaxConcurrentRequests, if non-zero, is the most requests that are
+	// proxied to a Proxy backend at once. Further requests are queued
+	// for up to MaxQueueWait, and fail with 503 Service Unavailable if
+	// none finishes by then. The numbers of active, queued and rejected
+	// requests are exported as client metrics.
+	MaxConcurrentRequests int `json:",omitempty"`
+
+	// MaxQueueWait is how long a request waits in the queue of a Proxy
+	// backend with MaxConcurrentRequests. If zero, requests over the
+	// limit fail immediately.
+	MaxQueueWait time.Duration `json:",omitempty"`
+
+	// UpstreamHonorRetryAfter, if true, retries a request to a Proxy
+	// backend that responds with 503 Service Unavailable and a
+	// Retry-After header, once the time the header asks for has passed,
+	// holding the client's connection open meanwhile. Requests with a
+	// body aren't retried, as it's already been sent, and a request is
+	// retried at most a few times before the 503 is passed on.
+	UpstreamHonorRetryAfter bool `json:",omitempty"`
+
+	// UpstreamMaxRetryAfter is the longest UpstreamHonorRetryAfter waits
+	// before a retry; longer Retry-After times are cut short to it. If
+	// zero, DefaultUpstreamMaxRetryAfter is used.
+	UpstreamMaxRetryAfter time.Duration `json:",omitempty"`
+
+	// UpstreamFlushInterval is how often to flush the response body of
+	// a Proxy backend to the client while it's being copied. If zero,
+	// the body is only flushed when the copy finishes; if negative, it's
+	// flushed after each write. Server-sent events (text/event-stream)
+	// and responses of unknown length are always flushed after each
+	// write.
+	UpstreamFlushInterval time.Duration `json:",omitempty"`
+
+	// RateLimitFile, if non-empty, is the absolute path of a JSON file of
+	// per-path rate limits for requests to a Proxy backend, in the format
+	// parsed by ParseRateLimits. Requests over the limit fail with 429 Too
+	// Many Requests. The file is checked for changes on each request, so
+	// limits can be changed without restarting.
+	RateLimitFile string `json:",omitempty"`
+
+	// CollectPoolStats, if true, tracks statistics about the pool of
+	// connections to a Proxy backend, as returned by the LocalAPI in an
+	// UpstreamPoolStats and exported as client metrics.
+	CollectPoolStats bool `json:",omitempty"`
+
+	// ConnectionEvents, if true, sends a FunnelRequestLog with an
+	// UpstreamConnLog to foreground serve streams when each connection
+	// to a Proxy backend is opened and closed.
+	ConnectionEvents bool `json:",omitempty"`
+
+	// ConnectionStates, if true, sends a FunnelRequestLog with an
+	// UpstreamConnLog to foreground serve streams on each change of
+	// state of each connection to a Proxy backend, such as from
+	// UpstreamConnActive to UpstreamConnIdle, for debugging exhaustion
+	// of the connection pool. HTTP/2 connections, which take several
+	// requests at once, are never logged as idle.
+	ConnectionStates bool `json:",omitempty"`
+
+	// PreheatConnections, if non-zero, is how many connections to a
+	// Proxy backend to open when a foreground serve stream for the
+	// handler starts, by sending that many concurrent HEAD requests for
+	// PreheatPath, so that the first requests don't wait for dials and
+	// TLS handshakes. At least this many idle connections are kept.
+	// The outcome is sent to the stream in a FunnelRequestLog with a
+	// PreheatLog.
+	PreheatConnections int `json:",omitempty"`
+
+	// PreheatPath is the path of the HEAD requests sent for
+	// PreheatConnections, or "/" if empty.
+	PreheatPath string `json:",omitempty"`
+
+	// UpstreamProxyProtocol, if non-empty, is the version of the PROXY
+	// protocol header ("v1" or "v2") to send at the start of each
+	// connection to a Proxy backend, telling it the address of the
+	// client. Connections to the backend are then not reused, as each
+	// belongs to a single client.
+	UpstreamProxyProtocol string `json:",omitempty"`
+
+	// UpstreamKeepAliveProbe, if true, sends TCP keep-alive probes every
+	// 15 seconds on idle connections to a Proxy backend, so that ones
+	// that died silently, such as when dropped by a firewall, are closed
+	// rather than reused.
+	UpstreamKeepAliveProbe bool `json:",omitempty"`
+
+	// UpstreamTCPNoDelay, if true, disables Nagle's algorithm
+	// (TCP_NODELAY) on connections to a Proxy backend, so that small
+	// writes, such as of interactive WebSocket messages, aren't held
+	// back waiting for earlier ones to be acknowledged. Go disables it
+	// on the TCP connections it dials by default; this makes sure of it
+	// whatever the dialer.
+	UpstreamTCPNoDelay bool `json:",omitempty"`
+
+	// NoKeepaliveBackends are prefixes, such as "http://127.0.0.1:9000",
+	// of the URLs of Proxy backends whose connections aren't reused for
+	// more than one request, for backends that mishandle HTTP keep-alive.
+	// They're matched against the Proxy URL, and the ABTestBackend, in
+	// their long form, like "http://127.0.0.1:3000" for "3000". Other
+	// backends keep their pools of idle connections.
+	NoKeepaliveBackends []string `json:",omitempty"`
+
+	// PassThroughHeaders are the names of request headers, such as
+	// X-Request-ID, that are sent to a Proxy backend exactly as the
+	// client sent them, even if the client named them as hop-by-hop in
+	// its Connection header. Headers that serve sets itself (Tailscale-*,
+	// X-Forwarded-*, X-Real-IP, Forwarded and the session headers below)
+	// and hop-by-hop headers of the connection to the backend can't be
+	// passed through.
+	PassThroughHeaders []string `json:",omitempty"`
+
+	// NoSessionHeaders, if true, means that requests to a Proxy backend
+	// don't get the X-Tailscale-Session header, with the session ID of
+	// the foreground Funnel stream serving the request (nor its
+	// X-Tailscale-Session-Label), or the X-Tailscale-Edge-Region
+	// header, with the FunnelRequestLog's EdgeRegion. Backends can log those to correlate their logs with
+	// the Funnel request logs.
+	NoSessionHeaders bool `json:",omitempty"`
+
+	// ClassifyUpstreamErrors, if true, means that failed requests to a
+	// Proxy backend whose likely cause serve recognizes are logged again
+	// to foreground serve streams, with the cause in
+	// FunnelRequestLog.ErrorClass.
+	ClassifyUpstreamErrors bool `json:",omitempty"`
+
+	// ForwardedHeaders is which headers telling a Proxy backend about
+	// the client are sent: "xff" for X-Forwarded-For, X-Forwarded-Host,
+	// X-Forwarded-Proto and X-Real-IP, "rfc7239" for the standard
+	// Forwarded header, "both" or "none". The empty string means "xff".
+	ForwardedHeaders string `json:",omitempty"`
+
+	// KeepForwardedHeaders, if true, means that the X-Forwarded-For,
+	// X-Forwarded-Host, X-Real-IP and Forwarded headers sent by the
+	// client are sent to a Proxy backend, with the client's address
+	// appended to X-Forwarded-For and Forwarded. By default they're
+	// replaced by the values serve knows to be true, as clients can set
+	// them to anything, and a backend that trusts them can be fooled.
+	// Only the headers selected by ForwardedHeaders are sent either way.
+	KeepForwardedHeaders bool `json:",omitempty"`
+
+	// StripRequestHeaders are the names of more request headers that
+	// aren't sent to a Proxy backend, such as ones a backend trusts to
+	// have been set by a proxy in front of it. They must not be in
+	// PassThroughHeaders.
+	StripRequestHeaders []string `json:",omitempty"`
+
 	// TODO(bradfitz): bool to not enumerate directories? TTL on mapping for
 	// temporary ones? Error codes? Redirects?
 }
 
+// tlsVersions maps the names accepted by HTTPHandler.TLSMinVersion
+// to their crypto/tls values.
+var tlsVersions = map[string]uint16{
+	"tls10": tls.VersionTLS10,
+	"tls11": tls.VersionTLS11,
+	"tls12": tls.VersionTLS12,
+	"tls13": tls.VersionTLS13,
+}
+
+// ParseTLSVersion returns the crypto/tls version for s, a TLS version
+// name as used by HTTPHandler.TLSMinVersion. The empty string is
+// TLS 1.2.
+func ParseTLSVersion(s string) (uint16, error) {
+	if s == "" {
+		return tls.VersionTLS12, nil
+	}
+	if v, ok := tlsVersions[s]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("invalid TLS version %q; must be one of tls10, tls11, tls12 or tls13", s)
+}
+
+// ParseTLSRenegotiation returns the crypto/tls renegotiation support
+// for s, as used by HTTPHandler.TLSRenegotiation. The empty string is
+// "none".
+func ParseTLSRenegotiation(s string) (tls.RenegotiationSupport, error) {
+	switch s {
+	case "", "none":
+		return tls.RenegotiateNever, nil
+	case "once":
+		return tls.RenegotiateOnceAsClient, nil
+	case "freely":
+		return tls.RenegotiateFreelyAsClient, nil
+	}
+	return 0, fmt.Errorf("invalid TLS renegotiation %q; must be none, once or freely", s)
+}
+
+// RateLimit is the rate limit for requests to a path, as configured by
+// HTTPHandler.RateLimitFile.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`  // sustained requests per second
+	Burst int     `json:"burst"` // requests allowed at once
+}
+
+// ParseRateLimits parses the contents of an HTTPHandler.RateLimitFile,
+// returning the rate limits by path. The file looks like:
+//
+//	{"paths": [{"/api/expensive": {"rate": 10, "burst": 5}}]}
+//
+// A path limits requests for it and for any path below it, with the
+// longest matching path taking precedence.
+func ParseRateLimits(b []byte) (map[string]RateLimit, error) {
+	var f struct {
+		Paths []map[string]RateLimit `json:"paths"`
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&f); err != nil {
+		return nil, fmt.Errorf("parsing rate limits: %w", err)
+	}
+	ret := make(map[string]RateLimit)
+	for _, m := range f.Paths {
+		for p, l := range m {
+			if !strings.HasPrefix(p, "/") {
+				return nil, fmt.Errorf("rate limit path %q must start with /", p)
+			}
+			if l.Rate <= 0 || l.Burst < 1 {
+				return nil, fmt.Errorf("rate limit for %s: rate must be positive and burst at least 1", p)
+			}
+			if _, dup := ret[p]; dup {
+				return nil, fmt.Errorf("duplicate rate limit for %s", p)
+			}
+			ret[p] = l
+		}
+	}
+	return ret, nil
+}
+
+// ValidateServeConfig reports an error if sc is malformed: if a TCP
+// port or web handler doesn't do exactly one thing, if a web HostPort
+// isn't on a port served as HTTP or HTTPS, or if a handler's settings
+// are invalid. A nil sc is valid.
+func ValidateServeConfig(sc *ServeConfig) error {
+	if sc == nil {
+		return nil
+	}
+	for port, h := range sc.TCP {
+		if h == nil {
+			return fmt.Errorf("TCP port %d: no handler", port)
+		}
+		n := 0
+		for _, set := range []bool{h.HTTPS, h.HTTP, h.TCPForward != ""} {
+			if set {
+				n++
+			}
+		}
+		if n != 1 {
+			return fmt.Errorf("TCP port %d: exactly one of HTTPS, HTTP or TCPForward must be set", port)
+		}
+		if h.TerminateTLS != "" && h.TCPForward == "" {
+			return fmt.Errorf("TCP port %d: TerminateTLS requires TCPForward", port)
+		}
+	}
+	for hp, wsc := range sc.Web {
+		port, err := hp.Port()
+		if err != nil {
+			return fmt.Errorf("invalid HostPort %q: %w", hp, err)
+		}
+		if !sc.IsServingWeb(port) {
+			return fmt.Errorf("%s: port %d is not served as HTTP or HTTPS", hp, port)
+		}
+		if wsc == nil {
+			continue
+		}
+		for mount, h := range wsc.Handlers {
+			if err := validateHTTPHandler(mount, h); err != nil {
+				return fmt.Errorf("%s%s: %w", hp, mount, err)
+			}
+		}
+		for method, h := range wsc.MethodHandlers {
+			if method == "" || method != "*" && strings.ToUpper(method) != method {
+				return fmt.Errorf("%s: invalid method %q; must be upper case or \"*\"", hp, method)
+			}
+			if err := validateHTTPHandler("/", h); err != nil {
+				return fmt.Errorf("%s %s: %w", hp, method, err)
+			}
+		}
+	}
+	for hp := range sc.AllowFunnel {
+		if _, err := hp.Port(); err != nil {
+			return fmt.Errorf("invalid Funnel HostPort %q: %w", hp, err)
+		}
+	}
+	for hp, prefixes := range sc.FunnelPaths {
+		if !sc.AllowFunnel[hp] {
+			return fmt.Errorf("%s: FunnelPaths given but Funnel isn't allowed", hp)
+		}
+		for _, p := range prefixes {
+			if !strings.HasPrefix(p, "/") {
+				return fmt.Errorf("%s: Funnel path %q must start with /", hp, p)
+			}
+		}
+	}
+	for id, fg := range sc.Foreground {
+		if err := ValidateServeConfig(fg); err != nil {
+			return fmt.Errorf("foreground session %q: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// FileFields returns the names of the fields of h, or of the settings
+// it holds, that are set and name a file for tailscaled to read, such
+// as OAuth2Config.ClientSecretFile. tailscaled reads them with its own
+// privileges and may send what's in them to the hosts of h, so only
+// clients with those privileges may set them; see
+// CheckServeConfigFiles.
+func (h *HTTPHandler) FileFields() []string {
+	var fields []string
+	if h.OAuth2Config != nil && h.OAuth2Config.ClientSecretFile != "" {
+		fields = append(fields, "OAuth2Config.ClientSecretFile")
+	}
+	if h.BearerTokenFile != "" {
+		fields = append(fields, "BearerTokenFile")
+	}
+	if h.OIDCUpstreamAuth != nil && h.OIDCUpstreamAuth.ClientSecretFile != "" {
+		fields = append(fields, "OIDCUpstreamAuth.ClientSecretFile")
+	}
+	if h.RequestSigningSecretFile != "" {
+		fields = append(fields, "RequestSigningSecretFile")
+	}
+	if h.RateLimitFile != "" {
+		fields = append(fields, "RateLimitFile")
+	}
+	return fields
+}
+
+// CheckServeConfigFiles returns an error wrapping ErrServeFilesDenied
+// if a web handler of sc sets any of its FileFields, unless cur, the
+// current serve config, has the same handler, with the same settings,
+// in the same place. That lets a client that can't have tailscaled read
+// files change the rest of a config set up by one that can.
+func CheckServeConfigFiles(sc *ServeConfig, cur ServeConfigView) error {
+	if sc == nil {
+		return nil
+	}
+	check := func(hp HostPort, where string, h *HTTPHandler, curH HTTPHandlerView) error {
+		if h == nil {
+			return nil
+		}
+		fields := h.FileFields()
+		if len(fields) == 0 {
+			return nil
+		}
+		if curH.Valid() {
+			a, err1 := json.Marshal(h)
+			b, err2 := json.Marshal(curH)
+			if err1 == nil && err2 == nil && bytes.Equal(a, b) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s%s: %s: %w", hp, where, strings.Join(fields, ", "), ErrServeFilesDenied)
+	}
+	for hp, wsc := range sc.Web {
+		if wsc == nil {
+			continue
+		}
+		var curWSC WebServerConfigView
+		if cur.Valid() {
+			curWSC, _ = cur.Web().GetOk(hp)
+		}
+		for mount, h := range wsc.Handlers {
+			var curH HTTPHandlerView
+			if curWSC.Valid() {
+				curH = curWSC.Handlers().Get(mount)
+			}
+			if err := check(hp, mount, h, curH); err != nil {
+				return err
+			}
+		}
+		for method, h := range wsc.MethodHandlers {
+			var curH HTTPHandlerView
+			if curWSC.Valid() {
+				curH = curWSC.MethodHandlers().Get(method)
+			}
+			if err := check(hp, " "+method, h, curH); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ErrServeFilesDenied is wrapped by the errors of CheckServeConfigFiles.
+var ErrServeFilesDenied = errors.New("only root, or the user tailscaled runs as, can set serve settings that name files for tailscaled to read")
+
+// validateHTTPHandler reports an error if h, mounted at mount, is
+// malformed.
+func validateHTTPHandler(mount string, h *HTTPHandler) error {
+	if !strings.HasPrefix(mount, "/") {
+		return errors.New("mount point must start with /")
+	}
+	if h == nil {
+		return errors.New("no handler")
+	}
+	n := 0
+	for _, s := range []string{h.Path, h.Proxy, h.Text} {
+		if s != "" {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("exactly one of Path, Proxy or Text must be set")
+	}
+	if h.ABTestBackend != "" && h.Proxy == "" {
+		return errors.New("ABTestBackend requires Proxy")
+	}
+	if h.PropagateRequestID && h.Proxy == "" {
+		return errors.New("PropagateRequestID requires Proxy")
+	}
+	if (h.CacheControlOverride != "" || h.StripPragma) && h.Proxy == "" {
+		return errors.New("CacheControlOverride and StripPragma require Proxy")
+	}
+	if !httpguts.ValidHeaderFieldValue(h.CacheControlOverride) {
+		return fmt.Errorf("invalid CacheControlOverride %q", h.CacheControlOverride)
+	}
+	if len(h.NoKeepaliveBackends) > 0 && h.Proxy == "" {
+		return errors.New("NoKeepaliveBackends requires Proxy")
+	}
+	for _, p := range h.NoKeepaliveBackends {
+		if !strings.HasPrefix(p, "http://") && !strings.HasPrefix(p, "https://") {
+			return fmt.Errorf("invalid NoKeepaliveBackends prefix %q; must start with http:// or https://", p)
+		}
+	}
+	if h.ABTestBackend == "" && (h.ABTestPercentage != 0 || h.ABTestCookie) {
+		return errors.New("ABTestPercentage and ABTestCookie require ABTestBackend")
+	}
+	if h.ABTestPercentage < 0 || h.ABTestPercentage > 100 {
+		return errors.New("ABTestPercentage must be between 0 and 100")
+	}
+	if _, err := ParseTLSVersion(h.TLSMinVersion); err != nil {
+		return err
+	}
+	if _, err := ParseTLSRenegotiation(h.TLSRenegotiation); err != nil {
+		return err
+	}
+	if h.UpstreamRootCA != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(h.UpstreamRootCA)) {
+		return errors.New("no valid certificates in UpstreamRootCA")
+	}
+	if fp := h.TLSCertFingerprint; fp != "" {
+		if b, err := hex.DecodeString(fp); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("invalid TLSCertFingerprint %q; must be a SHA-256 hash in hex", fp)
+		}
+	}
+	if a := h.OIDCUpstreamAuth; a != nil {
+		if h.BearerTokenFile != "" {
+			return errors.New("BearerTokenFile and OIDCUpstreamAuth can't both be set")
+		}
+		if u, err := url.Parse(a.DiscoveryURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("invalid OIDCUpstreamAuth DiscoveryURL %q", a.DiscoveryURL)
+		}
+		if a.ClientID == "" || a.ClientSecretFile == "" {
+			return errors.New("OIDCUpstreamAuth must have a ClientID and ClientSecretFile")
+		}
+	}
+	if a := h.OIDCAccessControl; a != nil {
+		if h.Proxy == "" {
+			return errors.New("OIDCAccessControl requires Proxy")
+		}
+		if u, err := url.Parse(a.DiscoveryURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("invalid OIDCAccessControl DiscoveryURL %q", a.DiscoveryURL)
+		}
+		if a.Audience == "" {
+			return errors.New("OIDCAccessControl must have an Audience")
+		}
+	}
+	if a := h.OAuth2Config; a != nil {
+		if h.BearerTokenFile != "" || h.OIDCUpstreamAuth != nil {
+			return errors.New("OAuth2Config can't be used with BearerTokenFile or OIDCUpstreamAuth")
+		}
+		if u, err := url.Parse(a.TokenURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("invalid OAuth2Config TokenURL %q", a.TokenURL)
+		}
+		if a.ClientID == "" || a.ClientSecretFile == "" {
+			return errors.New("OAuth2Config must have a ClientID and ClientSecretFile")
+		}
+	}
+	if h.UpstreamReadTimeout < 0 {
+		return errors.New("UpstreamReadTimeout must not be negative")
+	}
+	if h.UpstreamStallTimeout < 0 {
+		return errors.New("UpstreamStallTimeout must not be negative")
+	}
+	if h.MaxResponseBytes < 0 {
+		return errors.New("MaxResponseBytes must not be negative")
+	}
+	if h.SlowRequestThreshold < 0 {
+		return errors.New("SlowRequestThreshold must not be negative")
+	}
+	if h.IdempotencyCacheTTL < 0 {
+		return errors.New("IdempotencyCacheTTL must not be negative")
+	}
+	if h.PreheatConnections < 0 {
+		return errors.New("PreheatConnections must not be negative")
+	}
+	if h.PreheatConnections > 0 && h.UpstreamProxyProtocol != "" {
+		return errors.New("PreheatConnections can't be used with UpstreamProxyProtocol, whose connections aren't reused")
+	}
+	if h.PreheatPath != "" && !strings.HasPrefix(h.PreheatPath, "/") {
+		return fmt.Errorf("PreheatPath %q must start with '/'", h.PreheatPath)
+	}
+	if h.CircuitBreakerFailures < 0 || h.CircuitBreakerCooldown < 0 {
+		return errors.New("CircuitBreakerFailures and CircuitBreakerCooldown must not be negative")
+	}
+	if h.CircuitBreakerHalfOpenRequests < 0 {
+		return errors.New("CircuitBreakerHalfOpenRequests must not be negative")
+	}
+	if h.MaxConcurrentRequests < 0 || h.MaxQueueWait < 0 {
+		return errors.New("MaxConcurrentRequests and MaxQueueWait must not be negative")
+	}
+	if h.UpstreamMaxRetryAfter < 0 {
+		return errors.New("UpstreamMaxRetryAfter must not be negative")
+	}
+	switch h.UpstreamProxyProtocol {
+	case "", "v1", "v2":
+	default:
+		return fmt.Errorf("invalid UpstreamProxyProtocol %q; must be v1 or v2", h.UpstreamProxyProtocol)
+	}
+	switch h.ForwardedHeaders {
+	case "", "xff", "rfc7239", "both", "none":
+	default:
+		return fmt.Errorf("invalid ForwardedHeaders %q; must be xff, rfc7239, both or none", h.ForwardedHeaders)
+	}
+	for _, k := range h.PassThroughHeaders {
+		if err := checkPassThroughHeader(k); err != nil {
+			return err
+		}
+	}
+	for _, k := range h.StripRequestHeaders {
+		if !httpguts.ValidHeaderFieldName(k) {
+			return fmt.Errorf("invalid header name %q", k)
+		}
+		if slices.ContainsFunc(h.PassThroughHeaders, func(p string) bool { return strings.EqualFold(p, k) }) {
+			return fmt.Errorf("header %q can't be both passed through and stripped", k)
+		}
+		if h.PropagateRequestID && strings.EqualFold(k, "X-Request-ID") {
+			return errors.New("X-Request-ID can't be stripped with PropagateRequestID")
+		}
+	}
+	return nil
+}
+
+// checkPassThroughHeader reports whether the request header k can be in
+// HTTPHandler.PassThroughHeaders.
+func checkPassThroughHeader(k string) error {
+	if !httpguts.ValidHeaderFieldName(k) {
+		return fmt.Errorf("invalid header name %q", k)
+	}
+	lk := strings.ToLower(k)
+	if strings.HasPrefix(lk, "tailscale-") || strings.HasPrefix(lk, "x-forwarded-") ||
+		lk == "x-real-ip" || lk == "forwarded" ||
+		lk == "x-tailscale-session" || lk == "x-tailscale-session-label" ||
+		lk == "x-tailscale-edge-region" || lk == "x-tailscale-signature" {
+		return fmt.Errorf("header %q is set by serve and can't be passed through", k)
+	}
+	switch lk {
+	case "connection", "keep-alive", "proxy-connection", "te", "trailer", "transfer-encoding", "upgrade":
+		return fmt.Errorf("hop-by-hop header %q can't be passed through", k)
+	}
+	return nil
+}
+
+// ServeConfigETag returns the ETag of sc as served by the LocalAPI, the
+// quoted checksum of its JSON form. A serve config that isn't Valid has
+// the ETag of "null".
+func ServeConfigETag(sc ServeConfigView) string {
+	j, _ := json.Marshal(sc)
+	sum := sha256.Sum256(j)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// Merge returns a new ServeConfig combining sc and other, so that
+// multiple serve processes managing different ports or mount points
+// don't overwrite each other's config. It returns an error if sc and
+// other configure the same TCP port, the same HostPort and mount point,
+// or the same foreground session differently. AllowFunnel is the union
+// of both, as are the FunnelPaths of a HostPort, unless either allows
+// Funnel traffic to all of its paths. Neither sc nor other is modified.
+func (sc *ServeConfig) Merge(other *ServeConfig) (*ServeConfig, error) {
+	ret := sc.Clone()
+	if ret == nil {
+		ret = new(ServeConfig)
+	}
+	if other == nil {
+		return ret, nil
+	}
+	for port, h := range other.TCP {
+		if cur, ok := ret.TCP[port]; ok {
+			if !reflect.DeepEqual(cur, h) {
+				return nil, fmt.Errorf("conflicting handlers for TCP port %d", port)
+			}
+			continue
+		}
+		mak.Set(&ret.TCP, port, h.Clone())
+	}
+	for hp, wsc := range other.Web {
+		cur, ok := ret.Web[hp]
+		if !ok || cur == nil {
+			mak.Set(&ret.Web, hp, wsc.Clone())
+			continue
+		}
+		if wsc == nil {
+			continue
+		}
+		for mount, h := range wsc.Handlers {
+			if ch, ok := cur.Handlers[mount]; ok {
+				if !reflect.DeepEqual(ch, h) {
+					return nil, fmt.Errorf("conflicting handlers for %s%s", hp, mount)
+				}
+				continue
+			}
+			mak.Set(&cur.Handlers, mount, h.Clone())
+		}
+		for method, h := range wsc.MethodHandlers {
+			if ch, ok := cur.MethodHandlers[method]; ok {
+				if !reflect.DeepEqual(ch, h) {
+					return nil, fmt.Errorf("conflicting %s handlers for %s", method, hp)
+				}
+				continue
+			}
+			mak.Set(&cur.MethodHandlers, method, h.Clone())
+		}
+	}
+	for hp, on := range other.AllowFunnel {
+		if on {
+			paths := other.FunnelPaths[hp]
+			switch {
+			case !ret.AllowFunnel[hp]:
+				if len(paths) > 0 {
+					mak.Set(&ret.FunnelPaths, hp, slices.Clone(paths))
+				} else {
+					delete(ret.FunnelPaths, hp)
+				}
+			case len(paths) == 0 || len(ret.FunnelPaths[hp]) == 0:
+				delete(ret.FunnelPaths, hp)
+			default:
+				for _, p := range paths {
+					if !slices.Contains(ret.FunnelPaths[hp], p) {
+						ret.FunnelPaths[hp] = append(ret.FunnelPaths[hp], p)
+					}
+				}
+			}
+		}
+		mak.Set(&ret.AllowFunnel, hp, on || ret.AllowFunnel[hp])
+	}
+	if len(ret.FunnelPaths) == 0 {
+		ret.FunnelPaths = nil
+	}
+	for id, fg := range other.Foreground {
+		if cur, ok := ret.Foreground[id]; ok {
+			if !reflect.DeepEqual(cur, fg) {
+				return nil, fmt.Errorf("conflicting configs for foreground session %q", id)
+			}
+			continue
+		}
+		mak.Set(&ret.Foreground, id, fg.Clone())
+	}
+	return ret, nil
+}
+
 // WebHandlerExists reports whether if the ServeConfig Web handler exists for
 // the given host:port and mount point.
 func (sc *ServeConfig) WebHandlerExists(hp HostPort, mount string) bool {
@@ -265,6 +1607,38 @@ func (sc *ServeConfig) IsFunnelOn() bool {
 	return false
 }
 
+// AllowsFunnelPath reports whether Funnel traffic to hp is allowed for
+// a web request to urlPath.
+//
+// View version of ServeConfig.AllowsFunnelPath.
+func (v ServeConfigView) AllowsFunnelPath(hp HostPort, urlPath string) bool {
+	return v.ж.AllowsFunnelPath(hp, urlPath)
+}
+
+// AllowsFunnelPath reports whether Funnel traffic to hp is allowed for
+// a web request to urlPath: whether hp is in AllowFunnel and, if it has
+// FunnelPaths, whether urlPath is under one of them, both as is and
+// once cleaned.
+func (sc *ServeConfig) AllowsFunnelPath(hp HostPort, urlPath string) bool {
+	if sc == nil || !sc.AllowFunnel[hp] {
+		return false
+	}
+	prefixes := sc.FunnelPaths[hp]
+	if len(prefixes) == 0 {
+		return true
+	}
+	under := func(p string) bool {
+		for _, prefix := range prefixes {
+			dir := strings.TrimSuffix(prefix, "/")
+			if dir == "" || p == dir || strings.HasPrefix(p, dir+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	return under(urlPath) && under(path.Clean("/"+urlPath))
+}
+
 // CheckFunnelAccess checks whether Funnel access is allowed for the given node
 // and port.
 // It checks:
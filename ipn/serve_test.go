@@ -3,9 +3,16 @@
 package ipn
 
 import (
+	"errors"
+	"math/rand"
+	"reflect"
+	"strings"
 	"testing"
+	"testing/quick"
+	"time"
 
 	"tailscale.com/tailcfg"
+	"tailscale.com/util/mak"
 )
 
 func TestCheckFunnelAccess(t *testing.T) {
@@ -37,3 +44,397 @@ func TestCheckFunnelAccess(t *testing.T) {
 		}
 	}
 }
+
+func TestValidateServeConfig(t *testing.T) {
+	https := map[uint16]*TCPPortHandler{443: {HTTPS: true}}
+	web := func(mount string, h *HTTPHandler) map[HostPort]*WebServerConfig {
+		return map[HostPort]*WebServerConfig{
+			"foo.ts.net:443": {Handlers: map[string]*HTTPHandler{mount: h}},
+		}
+	}
+	tests := []struct {
+		name    string
+		sc      *ServeConfig
+		wantErr string
+	}{
+		{"nil", nil, ""},
+		{"proxy", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "http://127.0.0.1:3000"})}, ""},
+		{"tcp-forward", &ServeConfig{TCP: map[uint16]*TCPPortHandler{22: {TCPForward: "127.0.0.1:22"}}}, ""},
+		{"tcp-both", &ServeConfig{TCP: map[uint16]*TCPPortHandler{443: {HTTPS: true, TCPForward: "127.0.0.1:22"}}}, "TCP port 443: exactly one of HTTPS, HTTP or TCPForward must be set"},
+		{"terminate-tls-without-forward", &ServeConfig{TCP: map[uint16]*TCPPortHandler{443: {HTTPS: true, TerminateTLS: "foo.ts.net"}}}, "TCP port 443: TerminateTLS requires TCPForward"},
+		{"web-without-tcp", &ServeConfig{Web: web("/", &HTTPHandler{Text: "hi"})}, "foo.ts.net:443: port 443 is not served as HTTP or HTTPS"},
+		{"bad-mount", &ServeConfig{TCP: https, Web: web("foo", &HTTPHandler{Text: "hi"})}, "foo.ts.net:443foo: mount point must start with /"},
+		{"empty-handler", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{})}, "foo.ts.net:443/: exactly one of Path, Proxy or Text must be set"},
+		{"bad-tls-version", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", TLSMinVersion: "ssl3"})}, `foo.ts.net:443/: invalid TLS version "ssl3"; must be one of tls10, tls11, tls12 or tls13`},
+		{"bad-root-ca", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", UpstreamRootCA: "junk"})}, "foo.ts.net:443/: no valid certificates in UpstreamRootCA"},
+		{"bad-fingerprint", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", TLSCertFingerprint: "abcd"})}, `foo.ts.net:443/: invalid TLSCertFingerprint "abcd"; must be a SHA-256 hash in hex`},
+		{"ab-test", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", ABTestBackend: "3001", ABTestPercentage: 10, ABTestCookie: true})}, ""},
+		{"ab-test-without-proxy", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Text: "hi", ABTestBackend: "3001"})}, "foo.ts.net:443/: ABTestBackend requires Proxy"},
+		{"ab-test-percentage-without-backend", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", ABTestPercentage: 10})}, "foo.ts.net:443/: ABTestPercentage and ABTestCookie require ABTestBackend"},
+		{"ab-test-bad-percentage", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", ABTestBackend: "3001", ABTestPercentage: 101})}, "foo.ts.net:443/: ABTestPercentage must be between 0 and 100"},
+		{"method-handler", &ServeConfig{TCP: https, Web: map[HostPort]*WebServerConfig{"foo.ts.net:443": {MethodHandlers: map[string]*HTTPHandler{"OPTIONS": {Text: "ok"}, "*": {Proxy: "3000"}}}}}, ""},
+		{"bad-method", &ServeConfig{TCP: https, Web: map[HostPort]*WebServerConfig{"foo.ts.net:443": {MethodHandlers: map[string]*HTTPHandler{"get": {Text: "hi"}}}}}, `foo.ts.net:443: invalid method "get"; must be upper case or "*"`},
+		{"empty-method-handler", &ServeConfig{TCP: https, Web: map[HostPort]*WebServerConfig{"foo.ts.net:443": {MethodHandlers: map[string]*HTTPHandler{"POST": {}}}}}, "foo.ts.net:443 POST: exactly one of Path, Proxy or Text must be set"},
+		{"negative-stall-timeout", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", UpstreamStallTimeout: -1})}, "foo.ts.net:443/: UpstreamStallTimeout must not be negative"},
+		{"negative-max-response-bytes", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", MaxResponseBytes: -1})}, "foo.ts.net:443/: MaxResponseBytes must not be negative"},
+		{"negative-slow-threshold", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", SlowRequestThreshold: -1})}, "foo.ts.net:443/: SlowRequestThreshold must not be negative"},
+		{"negative-idempotency-cache-ttl", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", IdempotencyCacheTTL: -1})}, "foo.ts.net:443/: IdempotencyCacheTTL must not be negative"},
+		{"preheat", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", PreheatConnections: 4, PreheatPath: "/healthz"})}, ""},
+		{"negative-preheat", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", PreheatConnections: -1})}, "foo.ts.net:443/: PreheatConnections must not be negative"},
+		{"preheat-proxy-protocol", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", PreheatConnections: 4, UpstreamProxyProtocol: "v1"})}, "foo.ts.net:443/: PreheatConnections can't be used with UpstreamProxyProtocol, whose connections aren't reused"},
+		{"relative-preheat-path", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", PreheatConnections: 4, PreheatPath: "healthz"})}, `foo.ts.net:443/: PreheatPath "healthz" must start with '/'`},
+		{"funnel-paths", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Text: "hi"}), AllowFunnel: map[HostPort]bool{"foo.ts.net:443": true}, FunnelPaths: map[HostPort][]string{"foo.ts.net:443": {"/api/"}}}, ""},
+		{"funnel-paths-without-funnel", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Text: "hi"}), FunnelPaths: map[HostPort][]string{"foo.ts.net:443": {"/api/"}}}, "foo.ts.net:443: FunnelPaths given but Funnel isn't allowed"},
+		{"bad-funnel-path", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Text: "hi"}), AllowFunnel: map[HostPort]bool{"foo.ts.net:443": true}, FunnelPaths: map[HostPort][]string{"foo.ts.net:443": {"api"}}}, `foo.ts.net:443: Funnel path "api" must start with /`},
+		{"pass-through-signature", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", PassThroughHeaders: []string{"X-Tailscale-Signature"}})}, `foo.ts.net:443/: header "X-Tailscale-Signature" is set by serve and can't be passed through`},
+		{"bad-tls-renegotiation", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", TLSRenegotiation: "always"})}, `foo.ts.net:443/: invalid TLS renegotiation "always"; must be none, once or freely`},
+		{"negative-circuit-breaker", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", CircuitBreakerFailures: -1})}, "foo.ts.net:443/: CircuitBreakerFailures and CircuitBreakerCooldown must not be negative"},
+		{"negative-circuit-breaker-half-open", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", CircuitBreakerFailures: 1, CircuitBreakerHalfOpenRequests: -1})}, "foo.ts.net:443/: CircuitBreakerHalfOpenRequests must not be negative"},
+		{"bad-proxy-protocol", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", UpstreamProxyProtocol: "v3"})}, `foo.ts.net:443/: invalid UpstreamProxyProtocol "v3"; must be v1 or v2`},
+		{"oidc", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", OIDCUpstreamAuth: &OIDCUpstreamAuth{DiscoveryURL: "https://id.example.com/.well-known/openid-configuration", ClientID: "serve", ClientSecretFile: "/secret"}})}, ""},
+		{"oidc-bad-url", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", OIDCUpstreamAuth: &OIDCUpstreamAuth{DiscoveryURL: "id.example.com", ClientID: "serve", ClientSecretFile: "/secret"}})}, `foo.ts.net:443/: invalid OIDCUpstreamAuth DiscoveryURL "id.example.com"`},
+		{"oidc-no-client", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", OIDCUpstreamAuth: &OIDCUpstreamAuth{DiscoveryURL: "https://id.example.com"}})}, "foo.ts.net:443/: OIDCUpstreamAuth must have a ClientID and ClientSecretFile"},
+		{"oidc-access", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", OIDCAccessControl: &OIDCAccessControl{DiscoveryURL: "https://id.example.com/.well-known/openid-configuration", Audience: "app"}})}, ""},
+		{"oidc-access-no-proxy", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Text: "hi", OIDCAccessControl: &OIDCAccessControl{DiscoveryURL: "https://id.example.com/.well-known/openid-configuration", Audience: "app"}})}, "foo.ts.net:443/: OIDCAccessControl requires Proxy"},
+		{"oidc-access-bad-url", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", OIDCAccessControl: &OIDCAccessControl{DiscoveryURL: "id.example.com", Audience: "app"}})}, `foo.ts.net:443/: invalid OIDCAccessControl DiscoveryURL "id.example.com"`},
+		{"oidc-access-no-audience", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", OIDCAccessControl: &OIDCAccessControl{DiscoveryURL: "https://id.example.com/.well-known/openid-configuration"}})}, "foo.ts.net:443/: OIDCAccessControl must have an Audience"},
+		{"oidc-and-bearer", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", BearerTokenFile: "/token", OIDCUpstreamAuth: &OIDCUpstreamAuth{DiscoveryURL: "https://id.example.com", ClientID: "serve", ClientSecretFile: "/secret"}})}, "foo.ts.net:443/: BearerTokenFile and OIDCUpstreamAuth can't both be set"},
+		{"pass-through-headers", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", PassThroughHeaders: []string{"X-Request-ID", "x-trace-id"}})}, ""},
+		{"pass-through-bad-name", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", PassThroughHeaders: []string{"X Request"}})}, `foo.ts.net:443/: invalid header name "X Request"`},
+		{"pass-through-identity", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", PassThroughHeaders: []string{"Tailscale-User-Login"}})}, `foo.ts.net:443/: header "Tailscale-User-Login" is set by serve and can't be passed through`},
+		{"pass-through-session", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", PassThroughHeaders: []string{"X-Tailscale-Edge-Region"}})}, `foo.ts.net:443/: header "X-Tailscale-Edge-Region" is set by serve and can't be passed through`},
+		{"pass-through-hop-by-hop", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", PassThroughHeaders: []string{"Connection"}})}, `foo.ts.net:443/: hop-by-hop header "Connection" can't be passed through`},
+		{"pass-through-real-ip", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", PassThroughHeaders: []string{"X-Real-IP"}})}, `foo.ts.net:443/: header "X-Real-IP" is set by serve and can't be passed through`},
+		{"forwarded-headers", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", ForwardedHeaders: "rfc7239"})}, ""},
+		{"forwarded-headers-invalid", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", ForwardedHeaders: "x-forwarded"})}, `foo.ts.net:443/: invalid ForwardedHeaders "x-forwarded"; must be xff, rfc7239, both or none`},
+		{"pass-through-forwarded", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", PassThroughHeaders: []string{"Forwarded"}})}, `foo.ts.net:443/: header "Forwarded" is set by serve and can't be passed through`},
+		{"oauth2", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", OAuth2Config: &OAuth2ClientConfig{TokenURL: "https://auth.example.com/token", ClientID: "serve", ClientSecretFile: "/etc/secret", Scopes: []string{"read"}}})}, ""},
+		{"oauth2-bad-url", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", OAuth2Config: &OAuth2ClientConfig{TokenURL: "auth.example.com", ClientID: "serve", ClientSecretFile: "/etc/secret"}})}, `foo.ts.net:443/: invalid OAuth2Config TokenURL "auth.example.com"`},
+		{"oauth2-no-secret", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", OAuth2Config: &OAuth2ClientConfig{TokenURL: "https://auth.example.com/token", ClientID: "serve"}})}, "foo.ts.net:443/: OAuth2Config must have a ClientID and ClientSecretFile"},
+		{"oauth2-and-bearer", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", BearerTokenFile: "/etc/token", OAuth2Config: &OAuth2ClientConfig{TokenURL: "https://auth.example.com/token", ClientID: "serve", ClientSecretFile: "/etc/secret"}})}, "foo.ts.net:443/: OAuth2Config can't be used with BearerTokenFile or OIDCUpstreamAuth"},
+		{"max-concurrent-requests", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", MaxConcurrentRequests: 10, MaxQueueWait: time.Second})}, ""},
+		{"negative-max-queue-wait", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", MaxConcurrentRequests: 10, MaxQueueWait: -1})}, "foo.ts.net:443/: MaxConcurrentRequests and MaxQueueWait must not be negative"},
+		{"upstream-honor-retry-after", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", UpstreamHonorRetryAfter: true, UpstreamMaxRetryAfter: time.Minute})}, ""},
+		{"negative-upstream-max-retry-after", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", UpstreamHonorRetryAfter: true, UpstreamMaxRetryAfter: -1})}, "foo.ts.net:443/: UpstreamMaxRetryAfter must not be negative"},
+		{"strip-headers", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", PassThroughHeaders: []string{"X-Request-ID"}, StripRequestHeaders: []string{"X-Client-Cert"}})}, ""},
+		{"strip-bad-name", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", StripRequestHeaders: []string{"X Cert"}})}, `foo.ts.net:443/: invalid header name "X Cert"`},
+		{"strip-pass-through", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", PassThroughHeaders: []string{"X-Request-ID"}, StripRequestHeaders: []string{"x-request-id"}})}, `foo.ts.net:443/: header "x-request-id" can't be both passed through and stripped`},
+		{"propagate-request-id", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", PropagateRequestID: true})}, ""},
+		{"propagate-request-id-text", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Text: "hi", PropagateRequestID: true})}, "foo.ts.net:443/: PropagateRequestID requires Proxy"},
+		{"propagate-request-id-stripped", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", PropagateRequestID: true, StripRequestHeaders: []string{"x-request-id"}})}, "foo.ts.net:443/: X-Request-ID can't be stripped with PropagateRequestID"},
+		{"cache-control-override", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", CacheControlOverride: "public, max-age=60", StripPragma: true})}, ""},
+		{"cache-control-override-text", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Text: "hi", CacheControlOverride: "no-cache"})}, "foo.ts.net:443/: CacheControlOverride and StripPragma require Proxy"},
+		{"strip-pragma-path", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Path: "/tmp", StripPragma: true})}, "foo.ts.net:443/: CacheControlOverride and StripPragma require Proxy"},
+		{"cache-control-override-newline", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", CacheControlOverride: "max-age=60\r\nSet-Cookie: a=b"})}, `foo.ts.net:443/: invalid CacheControlOverride "max-age=60\r\nSet-Cookie: a=b"`},
+		{"no-keepalive-backends", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", NoKeepaliveBackends: []string{"http://127.0.0.1:3000", "https://php."}})}, ""},
+		{"no-keepalive-backends-text", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Text: "hi", NoKeepaliveBackends: []string{"http://127.0.0.1:3000"}})}, "foo.ts.net:443/: NoKeepaliveBackends requires Proxy"},
+		{"no-keepalive-backends-scheme", &ServeConfig{TCP: https, Web: web("/", &HTTPHandler{Proxy: "3000", NoKeepaliveBackends: []string{"127.0.0.1:3000"}})}, `foo.ts.net:443/: invalid NoKeepaliveBackends prefix "127.0.0.1:3000"; must start with http:// or https://`},
+		{"bad-foreground", &ServeConfig{Foreground: map[string]*ServeConfig{"s1": {TCP: map[uint16]*TCPPortHandler{443: {}}}}}, `foreground session "s1": TCP port 443: exactly one of HTTPS, HTTP or TCPForward must be set`},
+	}
+	for _, tt := range tests {
+		err := ValidateServeConfig(tt.sc)
+		var got string
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.wantErr {
+			t.Errorf("%s: got error %q; want %q", tt.name, got, tt.wantErr)
+		}
+	}
+}
+
+func TestParseRateLimits(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    map[string]RateLimit
+		wantErr string
+	}{
+		{
+			in:   `{"paths": [{"/api/expensive": {"rate": 10, "burst": 5}}, {"/": {"rate": 100, "burst": 50}}]}`,
+			want: map[string]RateLimit{"/api/expensive": {10, 5}, "/": {100, 50}},
+		},
+		{in: `{"paths": []}`, want: map[string]RateLimit{}},
+		{in: `{"paths": [{"api": {"rate": 1, "burst": 1}}]}`, wantErr: `rate limit path "api" must start with /`},
+		{in: `{"paths": [{"/a": {"rate": 0, "burst": 1}}]}`, wantErr: "rate limit for /a: rate must be positive and burst at least 1"},
+		{in: `{"paths": [{"/a": {"rate": 1, "burst": 1}}, {"/a": {"rate": 2, "burst": 1}}]}`, wantErr: "duplicate rate limit for /a"},
+		{in: `{"path": []}`, wantErr: `parsing rate limits: json: unknown field "path"`},
+	}
+	for _, tt := range tests {
+		got, err := ParseRateLimits([]byte(tt.in))
+		var gotErr string
+		if err != nil {
+			gotErr = err.Error()
+		}
+		if gotErr != tt.wantErr {
+			t.Errorf("ParseRateLimits(%s): got error %q; want %q", tt.in, gotErr, tt.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseRateLimits(%s) = %v; want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// randServeConfig returns a random ServeConfig drawn from a small set
+// of ports, hosts, mount points and backends, so that two random
+// configs are likely to overlap.
+func randServeConfig(r *rand.Rand) *ServeConfig {
+	pick := func(s ...string) string { return s[r.Intn(len(s))] }
+	sc := new(ServeConfig)
+	for i := r.Intn(3); i > 0; i-- {
+		port := uint16(443 + r.Intn(2))
+		if r.Intn(2) == 0 {
+			mak.Set(&sc.TCP, port, &TCPPortHandler{HTTPS: true})
+		} else {
+			mak.Set(&sc.TCP, port, &TCPPortHandler{TCPForward: pick("127.0.0.1:22", "127.0.0.1:23")})
+		}
+	}
+	for i := r.Intn(4); i > 0; i-- {
+		hp := HostPort(pick("a.ts.net:443", "b.ts.net:443"))
+		mak.Set(&sc.Web, hp, &WebServerConfig{})
+		for j := r.Intn(3); j > 0; j-- {
+			mak.Set(&sc.Web[hp].Handlers, pick("/", "/foo"), &HTTPHandler{
+				Proxy: pick("http://127.0.0.1:3000", "http://127.0.0.1:3001"),
+			})
+		}
+		if r.Intn(2) == 0 {
+			on := r.Intn(2) == 0
+			mak.Set(&sc.AllowFunnel, hp, on)
+			if on && r.Intn(2) == 0 {
+				mak.Set(&sc.FunnelPaths, hp, []string{pick("/foo/", "/bar")})
+			}
+		}
+	}
+	return sc
+}
+
+// serveConfigsConflict reports whether a and b configure the same TCP
+// port or mount point differently.
+func serveConfigsConflict(a, b *ServeConfig) bool {
+	for port, h := range a.TCP {
+		if bh, ok := b.TCP[port]; ok && *bh != *h {
+			return true
+		}
+	}
+	for hp, wsc := range a.Web {
+		for mount, h := range wsc.Handlers {
+			if bh := b.GetWebHandler(hp, mount); bh != nil && !reflect.DeepEqual(bh, h) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestAllowsFunnelPath(t *testing.T) {
+	sc := &ServeConfig{
+		AllowFunnel: map[HostPort]bool{
+			"foo.ts.net:443":  true,
+			"foo.ts.net:8443": true,
+			"foo.ts.net:1000": false,
+		},
+		FunnelPaths: map[HostPort][]string{
+			"foo.ts.net:443": {"/api/", "/hooks"},
+		},
+	}
+	tests := []struct {
+		hp   HostPort
+		path string
+		want bool
+	}{
+		{"foo.ts.net:443", "/api/users", true},
+		{"foo.ts.net:443", "/api", true},
+		{"foo.ts.net:443", "/hooks", true},
+		{"foo.ts.net:443", "/hooks/github", true},
+		{"foo.ts.net:443", "/", false},
+		{"foo.ts.net:443", "/admin", false},
+		{"foo.ts.net:443", "/apix", false},
+		{"foo.ts.net:443", "/hooksx", false},
+		{"foo.ts.net:443", "/api/../admin", false},
+		{"foo.ts.net:8443", "/admin", true}, // no FunnelPaths: all paths
+		{"foo.ts.net:1000", "/api/users", false},
+		{"bar.ts.net:443", "/api/users", false},
+	}
+	for _, tt := range tests {
+		if got := sc.AllowsFunnelPath(tt.hp, tt.path); got != tt.want {
+			t.Errorf("AllowsFunnelPath(%q, %q) = %v; want %v", tt.hp, tt.path, got, tt.want)
+		}
+	}
+	var nilSC *ServeConfig
+	if nilSC.AllowsFunnelPath("foo.ts.net:443", "/") {
+		t.Error("nil ServeConfig allows Funnel")
+	}
+}
+
+func TestCheckSessionLabel(t *testing.T) {
+	for _, label := range []string{"a", "tenant1", "ACME", strings.Repeat("x", 64)} {
+		if err := CheckSessionLabel(label); err != nil {
+			t.Errorf("CheckSessionLabel(%q) = %v; want nil", label, err)
+		}
+	}
+	for _, label := range []string{"", "tenant-1", "a b", "ünï", "a\r\nX-Evil: 1", strings.Repeat("x", 65)} {
+		if err := CheckSessionLabel(label); err == nil {
+			t.Errorf("CheckSessionLabel(%q) = nil; want error", label)
+		}
+	}
+}
+
+func TestRequestSignature(t *testing.T) {
+	secret := []byte("s3cret")
+	now := time.Unix(1700000000, 0)
+	sig := RequestSignature(secret, "POST", "/hooks?x=1", now)
+	if !strings.HasPrefix(sig, "ts=1700000000,v1=") {
+		t.Fatalf("signature = %q; want ts=1700000000,v1=...", sig)
+	}
+	tests := []struct {
+		name    string
+		sig     string
+		secret  string
+		method  string
+		uri     string
+		now     time.Time
+		wantErr bool
+	}{
+		{"valid", sig, "s3cret", "POST", "/hooks?x=1", now, false},
+		{"within-drift", sig, "s3cret", "POST", "/hooks?x=1", now.Add(5 * time.Second), false},
+		{"before-drift", sig, "s3cret", "POST", "/hooks?x=1", now.Add(-5 * time.Second), false},
+		{"replayed", sig, "s3cret", "POST", "/hooks?x=1", now.Add(6 * time.Second), true},
+		{"wrong-secret", sig, "other", "POST", "/hooks?x=1", now, true},
+		{"wrong-method", sig, "s3cret", "GET", "/hooks?x=1", now, true},
+		{"wrong-uri", sig, "s3cret", "POST", "/hooks?x=2", now, true},
+		{"changed-ts", strings.Replace(sig, "ts=1700000000", "ts=1700000001", 1), "s3cret", "POST", "/hooks?x=1", now, true},
+		{"malformed", "garbage", "s3cret", "POST", "/hooks?x=1", now, true},
+		{"empty", "", "s3cret", "POST", "/hooks?x=1", now, true},
+	}
+	for _, tt := range tests {
+		err := VerifyRequestSignature(tt.sig, []byte(tt.secret), tt.method, tt.uri, DefaultRequestSignatureMaxDrift, tt.now)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: VerifyRequestSignature = %v; want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestServeConfigMerge(t *testing.T) {
+	check := func(seedA, seedB int64) bool {
+		a := randServeConfig(rand.New(rand.NewSource(seedA)))
+		b := randServeConfig(rand.New(rand.NewSource(seedB)))
+		origA, origB := a.Clone(), b.Clone()
+
+		m, err := a.Merge(b)
+		if !reflect.DeepEqual(a, origA) || !reflect.DeepEqual(b, origB) {
+			t.Logf("Merge modified its inputs")
+			return false
+		}
+		if _, rerr := b.Merge(a); (err == nil) != (rerr == nil) {
+			t.Logf("Merge not symmetric: %v vs %v", err, rerr)
+			return false
+		}
+		if want := serveConfigsConflict(a, b); (err != nil) != want {
+			t.Logf("Merge error = %v; want conflict = %v", err, want)
+			return false
+		}
+		if err != nil {
+			return true
+		}
+		for _, in := range []*ServeConfig{a, b} {
+			for port, h := range in.TCP {
+				if !reflect.DeepEqual(m.TCP[port], h) {
+					t.Logf("port %d: got %+v; want %+v", port, m.TCP[port], h)
+					return false
+				}
+			}
+			for hp, wsc := range in.Web {
+				for mount, h := range wsc.Handlers {
+					if got := m.GetWebHandler(hp, mount); !reflect.DeepEqual(got, h) {
+						t.Logf("%s%s: got %+v; want %+v", hp, mount, got, h)
+						return false
+					}
+				}
+			}
+			for hp, on := range in.AllowFunnel {
+				if on && !m.AllowFunnel[hp] {
+					t.Logf("%s: lost AllowFunnel", hp)
+					return false
+				}
+				for _, p := range []string{"/", "/foo/x", "/bar"} {
+					if in.AllowsFunnelPath(hp, p) && !m.AllowsFunnelPath(hp, p) {
+						t.Logf("%s: lost Funnel path %s", hp, p)
+						return false
+					}
+				}
+			}
+		}
+		self, err := a.Merge(a)
+		if err != nil || !reflect.DeepEqual(self, a) {
+			t.Logf("a.Merge(a) = %+v, %v; want a", self, err)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(check, &quick.Config{MaxCount: 1000}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckServeConfigFiles(t *testing.T) {
+	withFile := func(tokenURL string) *HTTPHandler {
+		return &HTTPHandler{
+			Proxy: "http://127.0.0.1:3000",
+			OAuth2Config: &OAuth2ClientConfig{
+				TokenURL:         tokenURL,
+				ClientID:         "serve",
+				ClientSecretFile: "/etc/serve/secret",
+			},
+		}
+	}
+	config := func(handlers map[string]*HTTPHandler) *ServeConfig {
+		return &ServeConfig{
+			Web: map[HostPort]*WebServerConfig{
+				"foo.test.ts.net:443": {Handlers: handlers},
+			},
+		}
+	}
+	cur := config(map[string]*HTTPHandler{"/": withFile("https://id.example.com/token")})
+
+	tests := []struct {
+		name    string
+		sc      *ServeConfig
+		cur     *ServeConfig
+		wantErr bool
+	}{
+		{name: "nil", sc: nil},
+		{name: "no-files", sc: config(map[string]*HTTPHandler{"/": {Proxy: "http://127.0.0.1:3000"}})},
+		{name: "new-file", sc: cur, cur: nil, wantErr: true},
+		{name: "unchanged", sc: cur, cur: cur},
+		{name: "unchanged-others-added", cur: cur, sc: config(map[string]*HTTPHandler{
+			"/":    withFile("https://id.example.com/token"),
+			"/api": {Proxy: "http://127.0.0.1:4000"},
+		})},
+		{name: "token-url-changed", cur: cur, wantErr: true, sc: config(map[string]*HTTPHandler{
+			"/": withFile("https://evil.example.com/token"),
+		})},
+		{name: "moved", cur: cur, wantErr: true, sc: config(map[string]*HTTPHandler{
+			"/other": withFile("https://id.example.com/token"),
+		})},
+		{name: "bearer-token-file", wantErr: true, sc: config(map[string]*HTTPHandler{"/": {Proxy: "http://127.0.0.1:3000", BearerTokenFile: "/etc/shadow"}})},
+		{name: "oidc-client-secret-file", wantErr: true, sc: config(map[string]*HTTPHandler{"/": {Proxy: "http://127.0.0.1:3000", OIDCUpstreamAuth: &OIDCUpstreamAuth{DiscoveryURL: "https://id.example.com/.well-known/openid-configuration", ClientID: "serve", ClientSecretFile: "/etc/shadow"}}})},
+		{name: "request-signing-secret-file", wantErr: true, sc: config(map[string]*HTTPHandler{"/": {Proxy: "http://127.0.0.1:3000", RequestSigningSecretFile: "/etc/shadow"}})},
+		{name: "rate-limit-file", wantErr: true, sc: config(map[string]*HTTPHandler{"/": {Proxy: "http://127.0.0.1:3000", RateLimitFile: "/etc/shadow"}})},
+		{name: "method-handler", cur: cur, wantErr: true, sc: &ServeConfig{
+			Web: map[HostPort]*WebServerConfig{
+				"foo.test.ts.net:443": {MethodHandlers: map[string]*HTTPHandler{"POST": withFile("https://id.example.com/token")}},
+			},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckServeConfigFiles(tt.sc, tt.cur.View())
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("got error %v; want error: %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrServeFilesDenied) {
+				t.Errorf("error %v doesn't wrap ErrServeFilesDenied", err)
+			}
+		})
+	}
+}
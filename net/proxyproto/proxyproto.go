@@ -0,0 +1,190 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package proxyproto implements the header of the PROXY protocol, versions
+// 1 (text) and 2 (binary), which a proxy sends at the start of a TCP
+// connection to tell the server the address of the original client.
+//
+// See https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// v2Signature starts every version 2 header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Version 2 command and address family bytes.
+const (
+	v2Local = 0x20 // version 2, LOCAL command
+	v2Proxy = 0x21 // version 2, PROXY command
+	v2TCP4  = 0x11 // TCP over IPv4
+	v2TCP6  = 0x21 // TCP over IPv6
+)
+
+// maxV1Len is the longest a version 1 header can be, including the CRLF.
+const maxV1Len = 107
+
+// Header is a PROXY protocol header for a TCP connection.
+type Header struct {
+	Version int // 1 or 2
+
+	// Src and Dst are the addresses of the client and of the server it
+	// connected to. They must be of the same family. If both are zero,
+	// the header doesn't describe a proxied connection (an UNKNOWN
+	// connection in version 1, or the LOCAL command in version 2).
+	Src, Dst netip.AddrPort
+}
+
+// Format returns h in the wire format of h.Version.
+func (h Header) Format() ([]byte, error) {
+	src := netip.AddrPortFrom(h.Src.Addr().Unmap(), h.Src.Port())
+	dst := netip.AddrPortFrom(h.Dst.Addr().Unmap(), h.Dst.Port())
+	local := !src.IsValid() && !dst.IsValid()
+	if !local && (!src.IsValid() || !dst.IsValid() || src.Addr().Is4() != dst.Addr().Is4()) {
+		return nil, fmt.Errorf("proxyproto: source %v and destination %v must be valid and of the same family", h.Src, h.Dst)
+	}
+	switch h.Version {
+	case 1:
+		if local {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		proto := "TCP4"
+		if src.Addr().Is6() {
+			proto = "TCP6"
+		}
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", proto, src.Addr(), dst.Addr(), src.Port(), dst.Port()), nil
+	case 2:
+		b := append([]byte(nil), v2Signature...)
+		if local {
+			return append(b, v2Local, 0, 0, 0), nil
+		}
+		fam, n := byte(v2TCP4), 12
+		if src.Addr().Is6() {
+			fam, n = v2TCP6, 36
+		}
+		b = append(b, v2Proxy, fam)
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+		b = append(b, src.Addr().AsSlice()...)
+		b = append(b, dst.Addr().AsSlice()...)
+		b = binary.BigEndian.AppendUint16(b, src.Port())
+		b = binary.BigEndian.AppendUint16(b, dst.Port())
+		return b, nil
+	}
+	return nil, fmt.Errorf("proxyproto: unsupported version %d", h.Version)
+}
+
+// Read reads a version 1 or 2 header from the start of a connection.
+// Data after the header is left in r.
+func Read(r *bufio.Reader) (Header, error) {
+	// Both versions' headers are at least as long as the signature.
+	start, err := r.Peek(len(v2Signature))
+	if err != nil {
+		return Header{}, fmt.Errorf("proxyproto: reading header: %w", err)
+	}
+	if bytes.Equal(start, v2Signature) {
+		return readV2(r)
+	}
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readV1(r)
+	}
+	return Header{}, errors.New("proxyproto: no PROXY protocol header")
+}
+
+func readV1(r *bufio.Reader) (Header, error) {
+	var line []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return Header{}, fmt.Errorf("proxyproto: reading header: %w", err)
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) >= maxV1Len {
+			return Header{}, errors.New("proxyproto: version 1 header too long")
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return Header{}, errors.New("proxyproto: version 1 header doesn't end in CRLF")
+	}
+	f := strings.Split(s, " ")
+	h := Header{Version: 1}
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return Header{}, fmt.Errorf("proxyproto: malformed version 1 header %q", s)
+	}
+	src, err1 := parseAddrPort(f[2], f[4])
+	dst, err2 := parseAddrPort(f[3], f[5])
+	if err := errors.Join(err1, err2); err != nil {
+		return Header{}, fmt.Errorf("proxyproto: malformed version 1 header %q: %w", s, err)
+	}
+	if src.Addr().Is4() != (f[1] == "TCP4") || dst.Addr().Is4() != (f[1] == "TCP4") {
+		return Header{}, fmt.Errorf("proxyproto: addresses in version 1 header %q don't match %s", s, f[1])
+	}
+	h.Src, h.Dst = src, dst
+	return h, nil
+}
+
+func parseAddrPort(ip, port string) (netip.AddrPort, error) {
+	a, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(a, uint16(p)), nil
+}
+
+func readV2(r *bufio.Reader) (Header, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return Header{}, fmt.Errorf("proxyproto: reading header: %w", err)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return Header{}, fmt.Errorf("proxyproto: reading header: %w", err)
+	}
+	h := Header{Version: 2}
+	switch hdr[12] {
+	case v2Local:
+		return h, nil
+	case v2Proxy:
+	default:
+		return Header{}, fmt.Errorf("proxyproto: unsupported version 2 command 0x%02x", hdr[12])
+	}
+	var n int
+	switch hdr[13] {
+	case v2TCP4:
+		n = 4
+	case v2TCP6:
+		n = 16
+	default:
+		// Other families, such as UDP and Unix sockets, don't have a
+		// source address we can represent.
+		return h, nil
+	}
+	if len(body) < 2*n+4 {
+		return Header{}, errors.New("proxyproto: version 2 header too short for its addresses")
+	}
+	srcIP, _ := netip.AddrFromSlice(body[:n])
+	dstIP, _ := netip.AddrFromSlice(body[n : 2*n])
+	h.Src = netip.AddrPortFrom(srcIP, binary.BigEndian.Uint16(body[2*n:]))
+	h.Dst = netip.AddrPortFrom(dstIP, binary.BigEndian.Uint16(body[2*n+2:]))
+	return h, nil
+}
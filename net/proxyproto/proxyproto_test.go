@@ -0,0 +1,103 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	v4 := Header{
+		Src: netip.MustParseAddrPort("203.0.113.7:51234"),
+		Dst: netip.MustParseAddrPort("100.64.0.1:443"),
+	}
+	v6 := Header{
+		Src: netip.MustParseAddrPort("[2001:db8::7]:51234"),
+		Dst: netip.MustParseAddrPort("[fd7a:115c:a1e0::1]:443"),
+	}
+	tests := []struct {
+		name    string
+		h       Header
+		version int
+		want    string
+	}{
+		{"v1-tcp4", v4, 1, "PROXY TCP4 203.0.113.7 100.64.0.1 51234 443\r\n"},
+		{"v1-tcp6", v6, 1, "PROXY TCP6 2001:db8::7 fd7a:115c:a1e0::1 51234 443\r\n"},
+		{"v1-unknown", Header{}, 1, "PROXY UNKNOWN\r\n"},
+		{"v2-tcp4", v4, 2, "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c" +
+			"\xcb\x00\x71\x07" + "\x64\x40\x00\x01" + "\xc8\x22" + "\x01\xbb"},
+		{"v2-local", Header{}, 2, "\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := tt.h
+			h.Version = tt.version
+			got, err := h.Format()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatErrors(t *testing.T) {
+	for _, h := range []Header{
+		{Version: 3},
+		{Version: 1, Src: netip.MustParseAddrPort("203.0.113.7:1"), Dst: netip.MustParseAddrPort("[::1]:2")},
+		{Version: 2, Src: netip.MustParseAddrPort("203.0.113.7:1")},
+	} {
+		if _, err := h.Format(); err == nil {
+			t.Errorf("Format(%+v) succeeded; want error", h)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		for _, h := range []Header{
+			{Src: netip.MustParseAddrPort("203.0.113.7:51234"), Dst: netip.MustParseAddrPort("100.64.0.1:443")},
+			{Src: netip.MustParseAddrPort("[2001:db8::7]:51234"), Dst: netip.MustParseAddrPort("[::]:443")},
+			{},
+		} {
+			h.Version = version
+			b, err := h.Format()
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := bufio.NewReader(bytes.NewReader(append(b, "GET / HTTP/1.1\r\n"...)))
+			got, err := Read(r)
+			if err != nil {
+				t.Fatalf("Read(%q): %v", b, err)
+			}
+			if got != h {
+				t.Errorf("Read(%q) = %+v; want %+v", b, got, h)
+			}
+			if rest, _ := r.ReadString('\n'); rest != "GET / HTTP/1.1\r\n" {
+				t.Errorf("after header, got %q; want the request line", rest)
+			}
+		}
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	for _, in := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1\r\n",
+		"PROXY TCP4 1.2.3.4 ::1 1 2\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1 2\n",
+		"PROXY " + strings.Repeat("x", 200) + "\r\n",
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x04\x01\x02\x03\x04",
+	} {
+		if h, err := Read(bufio.NewReader(strings.NewReader(in))); err == nil {
+			t.Errorf("Read(%q) = %+v; want error", in, h)
+		}
+	}
+}
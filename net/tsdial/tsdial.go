@@ -76,6 +76,9 @@ func (c sysConn) Close() error {
 	return nil
 }
 
+// NetConn returns the underlying connection that is wrapped by c.
+func (c sysConn) NetConn() net.Conn { return c.Conn }
+
 // SetTUNName sets the name of the tun device in use ("tailscale0", "utun6",
 // etc). This is needed on some platforms to set sockopts to bind
 // to the same interface index.
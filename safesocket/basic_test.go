@@ -14,6 +14,13 @@
 var downgradeSDDL = func() func() { return func() {} }
 
 func TestBasics(t *testing.T) {
+	useTransport(t, NewInProcessTransport())
+	testBasics(t, "/test/tailscaled.sock")
+}
+
+// TestBasicsPlatform is like TestBasics, but uses the platform's OS
+// sockets or named pipes.
+func TestBasicsPlatform(t *testing.T) {
 	// Make the socket in a temp dir rather than the cwd
 	// so that the test can be run from a mounted filesystem (#2367).
 	dir := t.TempDir()
@@ -24,7 +31,12 @@ func TestBasics(t *testing.T) {
 		sock = fmt.Sprintf(`\\.\pipe\tailscale-test`)
 		t.Cleanup(downgradeSDDL())
 	}
+	testBasics(t, sock)
+}
 
+// testBasics tests a connection to a listener on sock, made with
+// Connect and Listen.
+func testBasics(t *testing.T, sock string) {
 	l, err := Listen(sock)
 	if err != nil {
 		t.Fatal(err)
@@ -39,8 +51,9 @@ func TestBasics(t *testing.T) {
 			return
 		}
 		l.Close()
-		s.Write([]byte("hello"))
 
+		// Read before writing, as the in-process transport's
+		// writes block until the other end reads them.
 		b := make([]byte, 1024)
 		n, err := s.Read(b)
 		if err != nil {
@@ -52,6 +65,7 @@ func TestBasics(t *testing.T) {
 			errs <- fmt.Errorf("got %#v, expected %#v\n", string(b[:n]), "world")
 			return
 		}
+		s.Write([]byte("hello"))
 		s.Close()
 		errs <- nil
 	}()
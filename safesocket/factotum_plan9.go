@@ -0,0 +1,208 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build plan9
+
+package safesocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/plan9"
+)
+
+// factotumRPCMax is the largest message exchanged with factotum's rpc
+// file, as AuthRpcMax in libauth.
+const factotumRPCMax = 4096
+
+// factotumRPC is a conversation with factotum(4) over its rpc file.
+type factotumRPC struct {
+	f *os.File
+}
+
+// startFactotum starts a conversation with factotum using params, such
+// as "proto=p9any role=client".
+func startFactotum(params string) (*factotumRPC, error) {
+	f, err := os.OpenFile("/mnt/factotum/rpc", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	rpc := &factotumRPC{f: f}
+	if _, _, err := rpc.call("start", []byte(params), "ok"); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return rpc, nil
+}
+
+// call sends factotum the request verb with arg, and returns the status
+// and the argument of its reply. Replies whose status isn't in want are
+// returned as errors.
+func (rpc *factotumRPC) call(verb string, arg []byte, want ...string) (status string, rarg []byte, err error) {
+	req := []byte(verb)
+	if len(arg) > 0 {
+		req = append(append(req, ' '), arg...)
+	}
+	if _, err := rpc.f.Write(req); err != nil {
+		return "", nil, fmt.Errorf("factotum %s: %w", verb, err)
+	}
+	buf := make([]byte, factotumRPCMax)
+	n, err := rpc.f.Read(buf)
+	if err != nil {
+		return "", nil, fmt.Errorf("factotum %s: %w", verb, err)
+	}
+	st, rest, _ := bytes.Cut(buf[:n], []byte(" "))
+	for _, w := range want {
+		if string(st) == w {
+			return w, rest, nil
+		}
+	}
+	return "", nil, fmt.Errorf("factotum %s: %s %s", verb, st, rest)
+}
+
+func (rpc *factotumRPC) close() error {
+	return rpc.f.Close()
+}
+
+// proxy relays the conversation between factotum and the other side of
+// the authentication, on rw, until factotum is done, as auth_proxy in
+// libauth.
+func (rpc *factotumRPC) proxy(rw io.ReadWriter) error {
+	buf := make([]byte, factotumRPCMax)
+	for {
+		status, arg, err := rpc.call("read", nil, "ok", "done", "phase")
+		if err != nil {
+			return err
+		}
+		switch status {
+		case "done":
+			return nil
+		case "ok":
+			if _, err := rw.Write(arg); err != nil {
+				return err
+			}
+			continue
+		}
+		// It's the other side's turn: read as much as factotum needs.
+		n := 0
+		for {
+			status, arg, err := rpc.call("write", buf[:n], "ok", "toosmall")
+			if err != nil {
+				return err
+			}
+			if status == "ok" {
+				break
+			}
+			need, err := strconv.Atoi(strings.TrimSpace(string(arg)))
+			if err != nil || need > len(buf) || need <= n {
+				return fmt.Errorf("factotum write: toosmall %s", arg)
+			}
+			m, err := rw.Read(buf[n:need])
+			if err != nil {
+				return err
+			}
+			n += m
+		}
+	}
+}
+
+// factotumAuthConv returns the server's side of a p9any authentication
+// conversation with factotum, for srv9p.
+func factotumAuthConv() (authConv9p, error) {
+	rpc, err := startFactotum("proto=p9any role=server")
+	if err != nil {
+		return nil, err
+	}
+	return &factotumConv{rpc: rpc}, nil
+}
+
+// factotumConv is an authConv9p held with factotum.
+type factotumConv struct {
+	rpc *factotumRPC
+}
+
+func (c *factotumConv) write(p []byte) error {
+	_, _, err := c.rpc.call("write", p, "ok")
+	return err
+}
+
+func (c *factotumConv) read(n uint32) ([]byte, string, error) {
+	status, arg, err := c.rpc.call("read", nil, "ok", "done")
+	if err != nil {
+		return nil, "", err
+	}
+	if status == "ok" {
+		if uint32(len(arg)) > n {
+			return nil, "", errors.New("auth read too small")
+		}
+		return arg, "", nil
+	}
+	_, info, err := c.rpc.call("authinfo", nil, "ok")
+	if err != nil {
+		return nil, "", err
+	}
+	// The AuthInfo starts with the client's user name, as a string
+	// with a 2-byte length.
+	if len(info) < 2 || len(info) < 2+int(binary.LittleEndian.Uint16(info)) {
+		return nil, "", errors.New("factotum authinfo: short reply")
+	}
+	user := string(info[2 : 2+binary.LittleEndian.Uint16(info)])
+	if user == "" {
+		return nil, "", errors.New("factotum authinfo: no user")
+	}
+	return nil, user, nil
+}
+
+func (c *factotumConv) close() error {
+	return c.rpc.close()
+}
+
+// authenticateMount authenticates with the 9P server on fd as the
+// current user, using factotum, and returns the auth file descriptor to
+// pass to plan9.Mount.
+func authenticateMount(fd int) (afd int, err error) {
+	aname, err := plan9.BytePtrFromString("")
+	if err != nil {
+		return -1, err
+	}
+	r0, _, e1 := plan9.Syscall(plan9.SYS_FAUTH, uintptr(fd), uintptr(unsafe.Pointer(aname)), 0)
+	if int32(r0) == -1 {
+		return -1, fmt.Errorf("fauth: %w", e1)
+	}
+	afd = int(r0)
+	rpc, err := startFactotum("proto=p9any role=client")
+	if err != nil {
+		plan9.Close(afd)
+		return -1, err
+	}
+	defer rpc.close()
+	if err := rpc.proxy(fdReadWriter(afd)); err != nil {
+		plan9.Close(afd)
+		return -1, err
+	}
+	return afd, nil
+}
+
+// fdReadWriter is an io.ReadWriter on a file descriptor that it doesn't
+// own.
+type fdReadWriter int
+
+func (fd fdReadWriter) Read(p []byte) (int, error) {
+	n, err := plan9.Read(int(fd), p)
+	if n == 0 && err == nil {
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+func (fd fdReadWriter) Write(p []byte) (int, error) {
+	return plan9.Write(int(fd), p)
+}
@@ -0,0 +1,116 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package safesocket
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// NewInProcessTransport returns a Transport whose connections are
+// in-memory net.Pipe pairs rather than OS sockets, for tests. Listen
+// registers a listener under its path in a registry private to the
+// returned Transport, and Connect connects to the listener registered
+// under the ConnectionStrategy's path.
+//
+// As with net.Pipe, writes to its connections block until the other end
+// reads them; there's no buffering as with OS sockets.
+func NewInProcessTransport() Transport {
+	return &inProcessTransport{listeners: make(map[string]*inProcessListener)}
+}
+
+// inProcess is the Transport used by InProcessConnect and
+// InProcessListen.
+var inProcess = NewInProcessTransport()
+
+// InProcessConnect is like Connect, but connects to a listener created
+// by InProcessListen in the same process, without using OS sockets.
+// Unlike Connect, it does not retry if there's no listener on the path.
+func InProcessConnect(s *ConnectionStrategy) (net.Conn, error) {
+	return inProcess.Connect(s)
+}
+
+// InProcessListen is like Listen, but returns an in-memory listener
+// for InProcessConnect, without using OS sockets.
+func InProcessListen(path string) (net.Listener, error) {
+	return inProcess.Listen(path)
+}
+
+type inProcessTransport struct {
+	mu        sync.Mutex
+	listeners map[string]*inProcessListener // by path
+}
+
+func (t *inProcessTransport) Connect(s *ConnectionStrategy) (net.Conn, error) {
+	t.mu.Lock()
+	ln := t.listeners[s.path]
+	t.mu.Unlock()
+	if ln == nil {
+		return nil, fmt.Errorf("safesocket: no in-process listener on %q", s.path)
+	}
+	c, sc := net.Pipe()
+	select {
+	case ln.conns <- sc:
+		return c, nil
+	case <-ln.done:
+		c.Close()
+		sc.Close()
+		return nil, fmt.Errorf("safesocket: in-process listener on %q closed", s.path)
+	}
+}
+
+func (t *inProcessTransport) Listen(path string) (net.Listener, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.listeners[path]; ok {
+		return nil, fmt.Errorf("safesocket: in-process listener on %q already exists", path)
+	}
+	ln := &inProcessListener{
+		t:     t,
+		path:  path,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	t.listeners[path] = ln
+	return ln, nil
+}
+
+// inProcessListener is a net.Listener for an inProcessTransport. Each
+// Connect blocks until its connection is accepted or the listener is
+// closed.
+type inProcessListener struct {
+	t         *inProcessTransport
+	path      string
+	conns     chan net.Conn // server ends of new connections
+	done      chan struct{} // closed by Close
+	closeOnce sync.Once
+}
+
+func (ln *inProcessListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ln.conns:
+		return c, nil
+	case <-ln.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *inProcessListener) Close() error {
+	ln.closeOnce.Do(func() {
+		ln.t.mu.Lock()
+		delete(ln.t.listeners, ln.path)
+		ln.t.mu.Unlock()
+		close(ln.done)
+	})
+	return nil
+}
+
+func (ln *inProcessListener) Addr() net.Addr { return inProcessAddr(ln.path) }
+
+// inProcessAddr is the net.Addr of an inProcessListener: its path.
+type inProcessAddr string
+
+func (a inProcessAddr) Network() string { return "inprocess" }
+func (a inProcessAddr) String() string  { return string(a) }
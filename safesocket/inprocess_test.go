@@ -0,0 +1,92 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package safesocket
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestInProcessTransport(t *testing.T) {
+	tr := NewInProcessTransport()
+	s := DefaultConnectionStrategy("/a")
+
+	if _, err := tr.Connect(s); err == nil {
+		t.Fatal("Connect with no listener succeeded")
+	}
+	ln, err := tr.Listen("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ln.Addr().String(); got != "/a" {
+		t.Errorf("Addr = %q; want /a", got)
+	}
+	if _, err := tr.Listen("/a"); err == nil {
+		t.Error("second Listen on /a succeeded")
+	}
+	if _, err := NewInProcessTransport().Connect(s); err == nil {
+		t.Error("Connect on another transport succeeded")
+	}
+
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+	c, err := tr.Connect(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hi" {
+		t.Errorf("read %q; want hi", b)
+	}
+	c.Close()
+
+	ln.Close()
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Close = %v; want net.ErrClosed", err)
+	}
+	if _, err := tr.Connect(s); err == nil {
+		t.Error("Connect after Close succeeded")
+	}
+	// The path can be reused once its listener is closed.
+	ln, err = tr.Listen("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+}
+
+func TestInProcessListenConnect(t *testing.T) {
+	ln, err := InProcessListen("/test/in-process")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+	c, err := InProcessConnect(DefaultConnectionStrategy("/test/in-process"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	(<-accepted).Close()
+}
@@ -11,7 +11,10 @@
 	"github.com/Microsoft/go-winio"
 )
 
-func connect(s *ConnectionStrategy) (net.Conn, error) {
+// platformTransport is the Transport for Windows named pipes.
+type platformTransport struct{}
+
+func (platformTransport) Connect(s *ConnectionStrategy) (net.Conn, error) {
 	return winio.DialPipe(s.path, nil)
 }
 
@@ -27,7 +30,7 @@ func setFlags(network, address string, c syscall.RawConn) error {
 // It is a var for testing, do not change this value.
 var windowsSDDL = "O:BAG:BAD:PAI(A;OICI;GWGR;;;BU)(A;OICI;GWGR;;;SY)"
 
-func listen(path string) (net.Listener, error) {
+func (platformTransport) Listen(path string) (net.Listener, error) {
 	lc, err := winio.ListenPipe(
 		path,
 		&winio.PipeConfig{
@@ -65,6 +65,14 @@ type ConnectionStrategy struct {
 	path string // unix socket path
 	port uint16 // TCP port
 
+	// AuthenticateWithFactotum, on Plan 9, makes Connect authenticate
+	// with the server by running the p9any protocol through factotum(4)
+	// when mounting the /srv entry, rather than trusting whoever posted
+	// it. The server proves its identity to factotum too, and the mount
+	// fails if either side can't authenticate, including if the server
+	// didn't listen with ListenWithFactotum. It's ignored elsewhere.
+	AuthenticateWithFactotum bool
+
 	// Longer term, a ConnectionStrategy should be an ordered list of things to attempt,
 	// with just the information required to connection for each.
 	//
@@ -94,10 +102,29 @@ func DefaultConnectionStrategy(path string) *ConnectionStrategy {
 	return &ConnectionStrategy{path: path}
 }
 
+// String returns where s connects to, for logging: "unix://" and the
+// socket path on Unix, "npipe://" and the pipe name on Windows, and the
+// /srv entry on Plan 9.
+func (s *ConnectionStrategy) String() string {
+	return s.stringForGOOS(runtime.GOOS)
+}
+
+// stringForGOOS is like String but takes a runtime.GOOS value instead
+// of using the current one.
+func (s *ConnectionStrategy) stringForGOOS(goos string) string {
+	switch goos {
+	case "windows":
+		return "npipe://" + s.path
+	case "plan9":
+		return s.path
+	}
+	return "unix://" + s.path
+}
+
 // Connect connects to tailscaled using s
 func Connect(s *ConnectionStrategy) (net.Conn, error) {
 	for {
-		c, err := connect(s)
+		c, err := defaultTransport.Connect(s)
 		if err != nil && tailscaledStillStarting() {
 			time.Sleep(250 * time.Millisecond)
 			continue
@@ -109,7 +136,20 @@ func Connect(s *ConnectionStrategy) (net.Conn, error) {
 // Listen returns a listener either on Unix socket path (on Unix), or
 // the NamedPipe path (on Windows).
 func Listen(path string) (net.Listener, error) {
-	return listen(path)
+	return defaultTransport.Listen(path)
+}
+
+// ListenWithFactotum is like Listen, but on Plan 9, clients must
+// authenticate with factotum(4), as Connect does with
+// ConnectionStrategy.AuthenticateWithFactotum, before they can use the
+// /srv entry. Only the user the process runs as, and users for which
+// allowUser (if non-nil) reports true, are let in. Elsewhere, it's the
+// same as Listen.
+func ListenWithFactotum(path string, allowUser func(user string) bool) (net.Listener, error) {
+	if t, ok := defaultTransport.(factotumTransport); ok {
+		return t.listenWithFactotum(path, allowUser)
+	}
+	return defaultTransport.Listen(path)
 }
 
 var (
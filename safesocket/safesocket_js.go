@@ -11,10 +11,14 @@
 
 const memName = "Tailscale-IPN"
 
-func listen(path string) (net.Listener, error) {
+// platformTransport is the Transport for js/wasm, using an in-memory
+// connection. The path and ConnectionStrategy are ignored.
+type platformTransport struct{}
+
+func (platformTransport) Listen(path string) (net.Listener, error) {
 	return memconn.Listen("memu", memName)
 }
 
-func connect(_ *ConnectionStrategy) (net.Conn, error) {
+func (platformTransport) Connect(_ *ConnectionStrategy) (net.Conn, error) {
 	return memconn.Dial("memu", memName)
 }
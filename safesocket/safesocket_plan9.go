@@ -9,6 +9,8 @@
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
@@ -22,6 +24,12 @@
 // a pipe to "/srv/tailscale.sock" and use the other
 // end for communication with a requestor. Plan 9 pipes
 // are bidirectional.
+//
+// A pipe is a single stream, so rather than talking to
+// requestors over it directly, we serve 9P on it (see
+// srv9p). Requestors mount the /srv entry on /mnt, and
+// each open of the file it serves, /mnt/tailscaled.sock,
+// is a separate connection.
 
 type plan9SrvAddr string
 
@@ -37,17 +45,15 @@ func (sl plan9SrvAddr) String() string {
 type plan9SrvListener struct {
 	name string
 	srvf *os.File
-	file *os.File
+	srv  *srv9p // serving the server end of the pipe
 }
 
 func (sl *plan9SrvListener) Accept() (net.Conn, error) {
-	// sl.file is the server end of the pipe that's
-	// connected to /srv/tailscale.sock
-	return plan9FileConn{name: sl.name, file: sl.file}, nil
+	return sl.srv.accept()
 }
 
 func (sl *plan9SrvListener) Close() error {
-	sl.file.Close()
+	sl.srv.close()
 	return sl.srvf.Close()
 }
 
@@ -55,6 +61,15 @@ func (sl *plan9SrvListener) Addr() net.Addr {
 	return plan9SrvAddr(sl.name)
 }
 
+// SetDeadline sets the deadline for Accept, which then returns
+// os.ErrDeadlineExceeded if no connection arrives in time. The zero
+// time means no deadline. net.Listener doesn't include SetDeadline,
+// but it's usually found by a type assertion, as for *net.TCPListener.
+func (sl *plan9SrvListener) SetDeadline(t time.Time) error {
+	sl.srv.setAcceptDeadline(t)
+	return nil
+}
+
 type plan9FileConn struct {
 	name string
 	file *os.File
@@ -85,8 +100,18 @@ func (fc plan9FileConn) SetWriteDeadline(t time.Time) error {
 	return syscall.EPLAN9
 }
 
-func connect(s *ConnectionStrategy) (net.Conn, error) {
-	f, err := os.OpenFile(s.path, os.O_RDWR, 0666)
+// platformTransport is the Transport for Plan 9, using /srv entries.
+type platformTransport struct{}
+
+// mountMu serializes mounting /srv entries in Connect.
+var mountMu sync.Mutex
+
+func (platformTransport) Connect(s *ConnectionStrategy) (net.Conn, error) {
+	name := filepath.Join("/mnt", filepath.Base(s.path))
+	if err := mountSrv(s.path, name, s.AuthenticateWithFactotum); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(name, os.O_RDWR, 0666)
 	if err != nil {
 		return nil, err
 	}
@@ -94,12 +119,52 @@ func connect(s *ConnectionStrategy) (net.Conn, error) {
 	return plan9FileConn{name: s.path, file: f}, nil
 }
 
+// mountSrv mounts the /srv entry path after /mnt, unless
+// name, the file it serves, is already in the namespace.
+// If auth, it authenticates with the server using factotum
+// first.
+func mountSrv(path, name string, auth bool) error {
+	mountMu.Lock()
+	defer mountMu.Unlock()
+	if _, err := os.Stat(name); err == nil {
+		return nil
+	}
+	fd, err := plan9.Open(path, plan9.O_RDWR)
+	if err != nil {
+		return err
+	}
+	defer plan9.Close(fd)
+	afd := -1
+	if auth {
+		afd, err = authenticateMount(fd)
+		if err != nil {
+			return fmt.Errorf("authenticating to %s: %w", path, err)
+		}
+		defer plan9.Close(afd)
+	}
+	return plan9.Mount(fd, afd, "/mnt", plan9.MAFTER, "")
+}
+
 // Create an entry in /srv, open a pipe, write the
-// client end to the entry and return the server
-// end of the pipe to the caller. When the server
-// end of the pipe is closed, /srv name associated
-// with it will be removed (controlled by ORCLOSE flag)
-func listen(path string) (net.Listener, error) {
+// client end to the entry and serve 9P on the server
+// end of the pipe. When the listener is closed, the
+// /srv name associated with it will be removed
+// (controlled by ORCLOSE flag).
+func (platformTransport) Listen(path string) (net.Listener, error) {
+	return listenSrv(path, nil, nil)
+}
+
+// listenWithFactotum is like Listen, but clients must authenticate
+// with factotum (see ConnectionStrategy.AuthenticateWithFactotum) as
+// $user or a user allowUser permits.
+func (platformTransport) listenWithFactotum(path string, allowUser func(string) bool) (net.Listener, error) {
+	return listenSrv(path, factotumAuthConv, allowUser)
+}
+
+// listenSrv listens on the /srv entry path, authenticating clients
+// with auth if it's non-nil, and letting in those allowUser permits
+// (see newSrv9p).
+func listenSrv(path string, auth func() (authConv9p, error), allowUser func(string) bool) (net.Listener, error) {
 	const O_RCLOSE = 64 // remove on close; should be in plan9 package
 	var pip [2]int
 
@@ -120,5 +185,10 @@ func listen(path string) (net.Listener, error) {
 		return nil, err
 	}
 
-	return &plan9SrvListener{name: path, srvf: srv, file: os.NewFile(uintptr(pip[0]), path)}, nil
+	file := os.NewFile(uintptr(pip[0]), path)
+	return &plan9SrvListener{
+		name: path,
+		srvf: srv,
+		srv:  newSrv9p(file, filepath.Base(path), os.Getenv("user"), auth, allowUser),
+	}, nil
 }
@@ -3,10 +3,38 @@
 
 package safesocket
 
-import "testing"
+import (
+	"fmt"
+	"testing"
+)
 
 func TestLocalTCPPortAndToken(t *testing.T) {
 	// Just test that it compiles for now (is available on all platforms).
 	port, token, err := LocalTCPPortAndToken()
 	t.Logf("got %v, %s, %v", port, token, err)
 }
+
+func TestConnectionStrategyString(t *testing.T) {
+	tests := []struct {
+		goos string
+		path string
+		want string
+	}{
+		{"linux", "/var/run/tailscale/tailscaled.sock", "unix:///var/run/tailscale/tailscaled.sock"},
+		{"darwin", "/var/run/tailscaled.socket", "unix:///var/run/tailscaled.socket"},
+		{"windows", `\\.\pipe\ProtectedPrefix\Administrators\Tailscale\tailscaled`, `npipe://\\.\pipe\ProtectedPrefix\Administrators\Tailscale\tailscaled`},
+		{"plan9", "/srv/tailscaled.sock", "/srv/tailscaled.sock"},
+	}
+	for _, tt := range tests {
+		s := DefaultConnectionStrategy(tt.path)
+		if got := s.stringForGOOS(tt.goos); got != tt.want {
+			t.Errorf("%s: got %q; want %q", tt.goos, got, tt.want)
+		}
+	}
+
+	// Formatting with %s and %v uses String.
+	s := DefaultConnectionStrategy("/srv/tailscaled.sock")
+	if got, want := fmt.Sprintf("%v", s), s.String(); got != want {
+		t.Errorf("%%v: got %q; want %q", got, want)
+	}
+}
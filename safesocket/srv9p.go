@@ -0,0 +1,717 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package safesocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// srv9p is a minimal 9P2000 file server, used by the Plan 9 listener
+// to multiplex connections over the channel posted in /srv.
+//
+// It serves a directory holding a single file. Each fid opened on the
+// file is a separate connection: writes to the fid are read from the
+// net.Conn returned by accept, and reads from the fid return what's
+// written to it. Reads and writes are handled concurrently, so one
+// blocked connection doesn't hold up the others.
+//
+// If it has an auth func, clients must authenticate before attaching,
+// by a conversation on an auth fid (see authConv9p), and then attach
+// only as the user they authenticated as, which must be the owner or
+// a user allowUser permits. Without one, clients attach without
+// authenticating.
+type srv9p struct {
+	name      string // of the file
+	user      string // owner in stat results
+	auth      func() (authConv9p, error)
+	allowUser func(user string) bool // or nil; see newSrv9p
+	rw        io.ReadWriteCloser
+	conns     chan net.Conn
+	done      chan struct{}
+
+	closeOnce sync.Once
+	wmu       sync.Mutex // guards writes to rw
+
+	dmu     sync.Mutex
+	dtimer  *time.Timer   // closes expired at the accept deadline, if any
+	expired chan struct{} // closed once the accept deadline has passed
+
+	mu      sync.Mutex
+	msize   uint32
+	fids    map[uint32]*fid9p
+	pending map[uint16]*op9p // reads and writes being handled, by tag
+}
+
+// fid9p is the state of a fid: the directory or the file, and if the
+// file has been opened, the connection it's for. An auth fid has an
+// auth conversation instead.
+type fid9p struct {
+	dir  bool
+	open bool
+	conn net.Conn // our end of the connection, if !dir && open
+
+	auth     authConv9p // if an auth fid
+	authUser string     // who auth authenticated, once it's done
+}
+
+// authConv9p is the server's side of an authentication conversation,
+// such as with factotum(4), held on an auth fid. Writes to the fid are
+// passed to write, and reads from it are answered by read.
+type authConv9p interface {
+	// write passes p, from the client, to the conversation.
+	write(p []byte) error
+	// read returns up to n bytes for the client. Once the client has
+	// authenticated, it returns no data and the client's user name.
+	read(n uint32) (data []byte, user string, err error)
+	close() error
+}
+
+// close closes f's connection or auth conversation, if any.
+func (f *fid9p) close() {
+	if f.conn != nil {
+		f.conn.Close()
+	}
+	if f.auth != nil {
+		f.auth.close()
+	}
+}
+
+// op9p is a read or write being handled in its own goroutine.
+type op9p struct {
+	conn    net.Conn
+	write   bool // a Twrite, rather than a Tread
+	flushed bool // guarded by srv9p.mu; if true, don't reply
+	done    chan struct{}
+}
+
+// setDeadline sets the deadline of op's direction of its connection,
+// so that flushing a read doesn't interrupt a write, or the reverse.
+func (op *op9p) setDeadline(t time.Time) {
+	if op.write {
+		op.conn.SetWriteDeadline(t)
+	} else {
+		op.conn.SetReadDeadline(t)
+	}
+}
+
+// 9P2000 message types. The R-message for each T-message is one more.
+const (
+	msgTversion = 100
+	msgTauth    = 102
+	msgTattach  = 104
+	msgRerror   = 107
+	msgTflush   = 108
+	msgTwalk    = 110
+	msgTopen    = 112
+	msgTcreate  = 114
+	msgTread    = 116
+	msgTwrite   = 118
+	msgTclunk   = 120
+	msgTremove  = 122
+	msgTstat    = 124
+	msgTwstat   = 126
+)
+
+const noFid9p = ^uint32(0)
+
+const (
+	maxMsize9p  = 8192 + ioHdrSize9p
+	ioHdrSize9p = 24 // size of a Twrite or Rread header
+	qtDir9p     = 0x80
+	qtAuth9p    = 0x08
+	dmDir9p     = 0x80000000
+	oRead9p     = 0
+)
+
+var (
+	errBadMessage9p = errors.New("bad 9P message")
+	errNoFile9p     = errors.New("file does not exist")
+	errUnknownFid9p = errors.New("unknown fid")
+	errFidInUse9p   = errors.New("fid in use")
+	errPerm9p       = errors.New("permission denied")
+	errAuthFid9p    = errors.New("fid is an auth fid")
+)
+
+// newSrv9p returns a server for the file name on the 9P channel rw,
+// and starts serving it. The file is owned by user. If auth is non-nil,
+// it starts the conversations of clients that authenticate, and only
+// user, or users for which allowUser (if non-nil) reports true, may
+// attach.
+func newSrv9p(rw io.ReadWriteCloser, name, user string, auth func() (authConv9p, error), allowUser func(string) bool) *srv9p {
+	s := &srv9p{
+		name:      name,
+		user:      user,
+		auth:      auth,
+		allowUser: allowUser,
+		rw:        rw,
+		conns:     make(chan net.Conn),
+		done:      make(chan struct{}),
+		expired:   make(chan struct{}),
+		msize:     maxMsize9p,
+		fids:      make(map[uint32]*fid9p),
+		pending:   make(map[uint16]*op9p),
+	}
+	go s.serve()
+	return s
+}
+
+// accept returns the next connection, made by opening the file. It
+// returns os.ErrDeadlineExceeded if the deadline set by
+// setAcceptDeadline passes first.
+func (s *srv9p) accept() (net.Conn, error) {
+	s.dmu.Lock()
+	expired := s.expired
+	s.dmu.Unlock()
+	select {
+	case c := <-s.conns:
+		return c, nil
+	case <-s.done:
+		return nil, net.ErrClosed
+	case <-expired:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+// setAcceptDeadline sets the deadline for accept calls, including ones
+// already waiting. The zero time means no deadline.
+func (s *srv9p) setAcceptDeadline(t time.Time) {
+	s.dmu.Lock()
+	defer s.dmu.Unlock()
+	if s.dtimer != nil && !s.dtimer.Stop() {
+		<-s.expired // the timer fired, or is about to close expired
+	}
+	s.dtimer = nil
+	closed := false
+	select {
+	case <-s.expired:
+		closed = true
+	default:
+	}
+	if t.IsZero() || time.Until(t) > 0 {
+		if closed {
+			s.expired = make(chan struct{})
+		}
+		if !t.IsZero() {
+			expired := s.expired
+			s.dtimer = time.AfterFunc(time.Until(t), func() { close(expired) })
+		}
+		return
+	}
+	if !closed {
+		close(s.expired)
+	}
+}
+
+// close stops the server and closes the 9P channel and all connections.
+func (s *srv9p) close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = s.rw.Close()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, f := range s.fids {
+			f.close()
+		}
+	})
+	return err
+}
+
+func (s *srv9p) serve() {
+	defer s.close()
+	var size [4]byte
+	for {
+		if _, err := io.ReadFull(s.rw, size[:]); err != nil {
+			return
+		}
+		n := binary.LittleEndian.Uint32(size[:])
+		if n < 7 || n > maxMsize9p {
+			return
+		}
+		msg := make([]byte, n-4)
+		if _, err := io.ReadFull(s.rw, msg); err != nil {
+			return
+		}
+		s.handle(msg)
+	}
+}
+
+// handle handles a T-message, without its size. Reads and writes of
+// connections are handed off to goroutines.
+func (s *srv9p) handle(msg []byte) {
+	d := &dec9p{b: msg}
+	typ, tag := d.u8(), d.u16()
+	reply := func(args ...any) { s.reply(typ+1, tag, args...) }
+	fail := func(err error) { s.reply(msgRerror, tag, err.Error()) }
+
+	switch typ {
+	case msgTversion:
+		msize, version := d.u32(), d.str()
+		if d.err != nil {
+			fail(errBadMessage9p)
+			return
+		}
+		// A version message starts a new session.
+		s.mu.Lock()
+		for fid, f := range s.fids {
+			f.close()
+			delete(s.fids, fid)
+		}
+		s.msize = min(msize, maxMsize9p)
+		msize = s.msize
+		s.mu.Unlock()
+		if !strings.HasPrefix(version, "9P2000") {
+			version = "unknown"
+		} else {
+			version = "9P2000"
+		}
+		reply(msize, version)
+	case msgTauth:
+		s.startAuth(d, reply, fail)
+	case msgTattach:
+		fid, afid, uname := d.u32(), d.u32(), d.str()
+		if d.err != nil {
+			fail(errBadMessage9p)
+			return
+		}
+		s.mu.Lock()
+		_, inUse := s.fids[fid]
+		var err error
+		if inUse {
+			err = errFidInUse9p
+		} else if s.auth != nil || afid != noFid9p {
+			// With auth, attaching without an auth fid (NOFID)
+			// finds none, and fails like an unfinished one.
+			af := s.fids[afid]
+			if af == nil || af.auth == nil || af.authUser == "" || af.authUser != uname {
+				err = errors.New("authentication failed")
+			} else if !s.userAllowed(uname) {
+				err = errPerm9p
+			}
+		}
+		if err == nil {
+			s.fids[fid] = &fid9p{dir: true}
+		}
+		s.mu.Unlock()
+		if err != nil {
+			fail(err)
+			return
+		}
+		reply(s.qid(true))
+	case msgTflush:
+		oldtag := d.u16()
+		s.mu.Lock()
+		op := s.pending[oldtag]
+		if op != nil {
+			op.flushed = true
+			op.setDeadline(time.Now())
+		}
+		s.mu.Unlock()
+		if op != nil {
+			<-op.done
+			op.setDeadline(time.Time{})
+		}
+		reply()
+	case msgTwalk:
+		s.walk(d, reply, fail)
+	case msgTopen:
+		fid, mode := d.u32(), d.u8()
+		if d.err != nil {
+			fail(errBadMessage9p)
+			return
+		}
+		s.mu.Lock()
+		f := s.fids[fid]
+		var err error
+		var srvEnd net.Conn
+		switch {
+		case f == nil:
+			err = errUnknownFid9p
+		case f.auth != nil:
+			err = errAuthFid9p
+		case f.open:
+			err = errors.New("fid already open")
+		case f.dir && mode&3 != oRead9p:
+			err = errPerm9p
+		case !f.dir:
+			srvEnd, f.conn = net.Pipe()
+		}
+		if err == nil {
+			f.open = true
+		}
+		iounit := s.msize - ioHdrSize9p
+		s.mu.Unlock()
+		if err != nil {
+			fail(err)
+			return
+		}
+		if srvEnd != nil {
+			go func() {
+				select {
+				case s.conns <- srvEnd:
+				case <-s.done:
+					srvEnd.Close()
+				}
+			}()
+		}
+		reply(s.qid(f.dir), iounit)
+	case msgTread, msgTwrite:
+		fid, offset := d.u32(), d.u64()
+		var count uint32
+		var data []byte
+		if typ == msgTread {
+			count = d.u32()
+		} else {
+			data = d.bytes()
+		}
+		if d.err != nil {
+			fail(errBadMessage9p)
+			return
+		}
+		s.mu.Lock()
+		f := s.fids[fid]
+		var conn net.Conn
+		if f != nil && f.open {
+			conn = f.conn
+		}
+		count = min(count, s.msize-ioHdrSize9p)
+		s.mu.Unlock()
+		switch {
+		case f != nil && f.auth != nil:
+			s.startAuthIO(typ, tag, f, count, data)
+		case f == nil || !f.open:
+			fail(errors.New("fid not open"))
+		case f.dir && typ == msgTwrite:
+			fail(errPerm9p)
+		case f.dir:
+			// The directory's contents are the file's stat, which
+			// is read whole or not at all.
+			st := s.stat(false)
+			if offset != 0 || uint32(len(st)) > count {
+				st = nil
+			}
+			reply([]byte(st))
+		default:
+			s.startIO(typ, tag, conn, count, data)
+		}
+	case msgTclunk, msgTremove:
+		fid := d.u32()
+		s.mu.Lock()
+		f := s.fids[fid]
+		delete(s.fids, fid)
+		s.mu.Unlock()
+		if f != nil {
+			f.close()
+		}
+		switch {
+		case f == nil:
+			fail(errUnknownFid9p)
+		case typ == msgTremove:
+			fail(errPerm9p)
+		default:
+			reply()
+		}
+	case msgTstat:
+		fid := d.u32()
+		s.mu.Lock()
+		f := s.fids[fid]
+		s.mu.Unlock()
+		if f == nil {
+			fail(errUnknownFid9p)
+			return
+		}
+		if f.auth != nil {
+			fail(errAuthFid9p)
+			return
+		}
+		st := s.stat(f.dir)
+		reply(uint16(len(st)), st)
+	case msgTcreate, msgTwstat:
+		fail(errPerm9p)
+	default:
+		fail(errBadMessage9p)
+	}
+}
+
+// userAllowed reports whether user, who has authenticated, may attach.
+func (s *srv9p) userAllowed(user string) bool {
+	if user == s.user {
+		return true
+	}
+	return s.allowUser != nil && s.allowUser(user)
+}
+
+func (s *srv9p) walk(d *dec9p, reply func(...any), fail func(error)) {
+	fid, newfid, n := d.u32(), d.u32(), d.u16()
+	names := make([]string, 0, n)
+	for i := 0; i < int(n); i++ {
+		names = append(names, d.str())
+	}
+	if d.err != nil {
+		fail(errBadMessage9p)
+		return
+	}
+	nqid, qids, err := s.walkFid(fid, newfid, names)
+	if err != nil {
+		fail(err)
+		return
+	}
+	reply(nqid, raw9p(qids))
+}
+
+// walkFid walks fid to newfid along names, and returns the qids of the
+// elements walked. If not all of names could be walked, newfid isn't
+// created, and the error is only returned if the first couldn't.
+func (s *srv9p) walkFid(fid, newfid uint32, names []string) (uint16, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.fids[fid]
+	switch {
+	case f == nil:
+		return 0, nil, errUnknownFid9p
+	case f.auth != nil:
+		return 0, nil, errAuthFid9p
+	case f.open:
+		return 0, nil, errors.New("can't walk an open fid")
+	case s.fids[newfid] != nil && newfid != fid:
+		return 0, nil, errFidInUse9p
+	}
+	dir := f.dir
+	var qids []byte
+	for i, name := range names {
+		switch {
+		case name == "..":
+			// The parent of the file is the directory, and the
+			// parent of the directory is itself.
+			dir = true
+		case dir && name == s.name:
+			dir = false
+		case i == 0:
+			return 0, nil, errNoFile9p
+		default:
+			return uint16(i), qids, nil
+		}
+		qids = append(qids, s.qid(dir)...)
+	}
+	s.fids[newfid] = &fid9p{dir: dir}
+	return uint16(len(names)), qids, nil
+}
+
+// startAuth handles a Tauth, creating an auth fid with a new auth
+// conversation.
+func (s *srv9p) startAuth(d *dec9p, reply func(...any), fail func(error)) {
+	afid := d.u32()
+	d.str() // uname, checked at attach
+	d.str() // aname
+	if d.err != nil {
+		fail(errBadMessage9p)
+		return
+	}
+	if s.auth == nil {
+		fail(errors.New("authentication not required"))
+		return
+	}
+	s.mu.Lock()
+	_, inUse := s.fids[afid]
+	s.mu.Unlock()
+	if inUse {
+		fail(errFidInUse9p)
+		return
+	}
+	conv, err := s.auth()
+	if err != nil {
+		fail(err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, inUse := s.fids[afid]; inUse {
+		conv.close()
+		fail(errFidInUse9p)
+		return
+	}
+	s.fids[afid] = &fid9p{open: true, auth: conv}
+	reply(raw9p(le9p(nil, uint8(qtAuth9p), uint32(0), uint64(2))))
+}
+
+// startAuthIO starts reading up to count bytes from, or writing data
+// to, the auth conversation of the auth fid f for the request tag,
+// replying when done. The conversation may have to wait on factotum,
+// so it's not done in the serve loop.
+func (s *srv9p) startAuthIO(typ uint8, tag uint16, f *fid9p, count uint32, data []byte) {
+	go func() {
+		if typ == msgTwrite {
+			if err := f.auth.write(data); err != nil {
+				s.reply(msgRerror, tag, err.Error())
+				return
+			}
+			s.reply(typ+1, tag, uint32(len(data)))
+			return
+		}
+		data, user, err := f.auth.read(count)
+		if err != nil {
+			s.reply(msgRerror, tag, err.Error())
+			return
+		}
+		if user != "" {
+			s.mu.Lock()
+			f.authUser = user
+			s.mu.Unlock()
+		}
+		s.reply(typ+1, tag, data)
+	}()
+}
+
+// startIO starts reading up to count bytes from, or writing data to,
+// the connection conn for the request tag, replying when done.
+func (s *srv9p) startIO(typ uint8, tag uint16, conn net.Conn, count uint32, data []byte) {
+	op := &op9p{conn: conn, write: typ == msgTwrite, done: make(chan struct{})}
+	s.mu.Lock()
+	s.pending[tag] = op
+	s.mu.Unlock()
+	go func() {
+		defer close(op.done)
+		var args []any
+		var err error
+		if typ == msgTread {
+			buf := make([]byte, count)
+			var n int
+			n, err = conn.Read(buf)
+			if err == io.EOF {
+				err = nil
+			}
+			args = []any{buf[:n]}
+		} else {
+			var n int
+			n, err = conn.Write(data)
+			args = []any{uint32(n)}
+		}
+		s.mu.Lock()
+		delete(s.pending, tag)
+		flushed := op.flushed
+		s.mu.Unlock()
+		switch {
+		case flushed:
+			// Interrupted by a Tflush, which is the only reply.
+		case errors.Is(err, io.ErrClosedPipe):
+			s.reply(msgRerror, tag, "connection closed")
+		case err != nil:
+			s.reply(msgRerror, tag, err.Error())
+		default:
+			s.reply(typ+1, tag, args...)
+		}
+	}()
+}
+
+// qid returns the qid of the directory or the file.
+func (s *srv9p) qid(dir bool) raw9p {
+	if dir {
+		return le9p(nil, uint8(qtDir9p), uint32(0), uint64(0))
+	}
+	return le9p(nil, uint8(0), uint32(0), uint64(1))
+}
+
+// stat returns the stat of the directory or the file.
+func (s *srv9p) stat(dir bool) raw9p {
+	mode, name := uint32(0600), s.name
+	if dir {
+		mode, name = dmDir9p|0500, "/"
+	}
+	now := uint32(time.Now().Unix())
+	st := le9p(nil,
+		uint16(0), // type
+		uint32(0), // dev
+		s.qid(dir),
+		mode,
+		now,       // atime
+		now,       // mtime
+		uint64(0), // length
+		name, s.user, s.user, s.user,
+	)
+	return le9p(nil, uint16(len(st)), raw9p(st))
+}
+
+// reply sends an R-message with the given fields.
+func (s *srv9p) reply(typ uint8, tag uint16, args ...any) {
+	b := le9p(make([]byte, 4, 64), typ, tag)
+	b = le9p(b, args...)
+	binary.LittleEndian.PutUint32(b, uint32(len(b)))
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.rw.Write(b)
+}
+
+// raw9p is appended by le9p as is, without a length.
+type raw9p []byte
+
+// le9p appends the 9P encoding of each of args to b. Strings are
+// encoded with a 2-byte length and []byte with a 4-byte length.
+func le9p(b []byte, args ...any) []byte {
+	for _, a := range args {
+		switch v := a.(type) {
+		case uint8:
+			b = append(b, v)
+		case uint16:
+			b = binary.LittleEndian.AppendUint16(b, v)
+		case uint32:
+			b = binary.LittleEndian.AppendUint32(b, v)
+		case uint64:
+			b = binary.LittleEndian.AppendUint64(b, v)
+		case string:
+			b = binary.LittleEndian.AppendUint16(b, uint16(len(v)))
+			b = append(b, v...)
+		case []byte:
+			b = binary.LittleEndian.AppendUint32(b, uint32(len(v)))
+			b = append(b, v...)
+		case raw9p:
+			b = append(b, v...)
+		default:
+			panic("le9p: unsupported type")
+		}
+	}
+	return b
+}
+
+// dec9p decodes the fields of a 9P message. After the first error,
+// all fields are zero.
+type dec9p struct {
+	b   []byte
+	err error
+}
+
+func (d *dec9p) next(n int) []byte {
+	if d.err != nil || len(d.b) < n {
+		d.err = errBadMessage9p
+		return make([]byte, n)
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *dec9p) u8() uint8   { return d.next(1)[0] }
+func (d *dec9p) u16() uint16 { return binary.LittleEndian.Uint16(d.next(2)) }
+func (d *dec9p) u32() uint32 { return binary.LittleEndian.Uint32(d.next(4)) }
+func (d *dec9p) u64() uint64 { return binary.LittleEndian.Uint64(d.next(8)) }
+
+func (d *dec9p) str() string {
+	n := d.u16()
+	return string(d.next(int(n)))
+}
+
+func (d *dec9p) bytes() []byte {
+	n := d.u32()
+	if n > maxMsize9p {
+		d.err = errBadMessage9p
+		return nil
+	}
+	return d.next(int(n))
+}
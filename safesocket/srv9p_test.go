@@ -0,0 +1,372 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package safesocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// client9p sends T-messages to a srv9p and reads its replies.
+type client9p struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func (c *client9p) send(typ uint8, tag uint16, args ...any) {
+	c.t.Helper()
+	b := le9p(make([]byte, 4), typ, tag)
+	b = le9p(b, args...)
+	binary.LittleEndian.PutUint32(b, uint32(len(b)))
+	if _, err := c.conn.Write(b); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// recv reads a reply and returns its type, tag and a decoder for the
+// rest of it.
+func (c *client9p) recv() (uint8, uint16, *dec9p) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var size [4]byte
+	if _, err := io.ReadFull(c.conn, size[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	msg := make([]byte, binary.LittleEndian.Uint32(size[:])-4)
+	if _, err := io.ReadFull(c.conn, msg); err != nil {
+		c.t.Fatal(err)
+	}
+	d := &dec9p{b: msg}
+	return d.u8(), d.u16(), d
+}
+
+// call sends a T-message and checks that the reply is its R-message.
+func (c *client9p) call(typ uint8, tag uint16, args ...any) *dec9p {
+	c.t.Helper()
+	c.send(typ, tag, args...)
+	rtyp, rtag, d := c.recv()
+	if rtyp == msgRerror {
+		c.t.Fatalf("message %d: error %q", typ, d.str())
+	}
+	if rtyp != typ+1 || rtag != tag {
+		c.t.Fatalf("message %d tag %d: got reply %d tag %d", typ, tag, rtyp, rtag)
+	}
+	return d
+}
+
+func newTestSrv9p(t *testing.T) (*srv9p, *client9p) {
+	cc, sc := net.Pipe()
+	s := newSrv9p(sc, "tailscaled.sock", "glenda", nil, nil)
+	t.Cleanup(func() {
+		s.close()
+		cc.Close()
+	})
+	c := &client9p{t: t, conn: cc}
+	d := c.call(msgTversion, ^uint16(0), uint32(65536), "9P2000")
+	if msize, version := d.u32(), d.str(); msize != maxMsize9p || version != "9P2000" {
+		t.Fatalf("Rversion = %d, %q", msize, version)
+	}
+	c.call(msgTattach, 1, uint32(0), noFid9p, "glenda", "")
+	return s, c
+}
+
+func TestSrv9pConnections(t *testing.T) {
+	s, c := newTestSrv9p(t)
+
+	// Open the file twice, as two connections.
+	var conns [2]net.Conn
+	for i := range conns {
+		fid := uint32(i + 1)
+		d := c.call(msgTwalk, 1, uint32(0), fid, uint16(1), "tailscaled.sock")
+		if n := d.u16(); n != 1 {
+			t.Fatalf("walked %d elements", n)
+		}
+		c.call(msgTopen, 1, fid, uint8(2))
+		conn, err := s.accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+
+	// A read on the first connection that's still waiting for data
+	// doesn't hold up the second.
+	c.send(msgTread, 10, uint32(1), uint64(0), uint32(100))
+	go conns[1].Write([]byte("second"))
+	c.send(msgTread, 11, uint32(2), uint64(0), uint32(100))
+	typ, tag, d := c.recv()
+	if typ != msgTread+1 || tag != 11 {
+		t.Fatalf("got reply %d tag %d; want Rread tag 11", typ, tag)
+	}
+	if got := string(d.bytes()); got != "second" {
+		t.Errorf("read %q; want %q", got, "second")
+	}
+
+	go conns[0].Write([]byte("first"))
+	typ, tag, d = c.recv()
+	if typ != msgTread+1 || tag != 10 {
+		t.Fatalf("got reply %d tag %d; want Rread tag 10", typ, tag)
+	}
+	if got := string(d.bytes()); got != "first" {
+		t.Errorf("read %q; want %q", got, "first")
+	}
+
+	// Writes go to the connection of their fid.
+	got := make(chan string)
+	go func() {
+		b := make([]byte, 100)
+		n, _ := conns[1].Read(b)
+		got <- string(b[:n])
+	}()
+	d = c.call(msgTwrite, 12, uint32(2), uint64(0), []byte("hello"))
+	if n := d.u32(); n != 5 {
+		t.Errorf("wrote %d bytes; want 5", n)
+	}
+	if s := <-got; s != "hello" {
+		t.Errorf("connection read %q; want %q", s, "hello")
+	}
+
+	// Clunking the fid closes its connection.
+	c.call(msgTclunk, 13, uint32(1))
+	if _, err := conns[0].Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read after clunk: %v; want EOF", err)
+	}
+}
+
+func TestSrv9pFlush(t *testing.T) {
+	s, c := newTestSrv9p(t)
+	c.call(msgTwalk, 1, uint32(0), uint32(1), uint16(1), "tailscaled.sock")
+	c.call(msgTopen, 1, uint32(1), uint8(2))
+	conn, err := s.accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The flushed read gets no reply, just the Rflush.
+	c.send(msgTread, 10, uint32(1), uint64(0), uint32(100))
+	c.call(msgTflush, 11, uint16(10))
+
+	// The connection still works.
+	c.send(msgTread, 12, uint32(1), uint64(0), uint32(100))
+	go conn.Write([]byte("ok"))
+	typ, tag, d := c.recv()
+	if typ != msgTread+1 || tag != 12 {
+		t.Fatalf("got reply %d tag %d; want Rread tag 12", typ, tag)
+	}
+	if got := string(d.bytes()); got != "ok" {
+		t.Errorf("read %q; want %q", got, "ok")
+	}
+
+	// Flushing a read doesn't interrupt a write waiting on the same
+	// connection.
+	c.send(msgTwrite, 20, uint32(1), uint64(0), []byte("hi"))
+	c.send(msgTread, 21, uint32(1), uint64(0), uint32(100))
+	c.call(msgTflush, 22, uint16(21))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hi" {
+		t.Fatalf("read %q, %v; want %q", buf, err, "hi")
+	}
+	typ, tag, d = c.recv()
+	if typ != msgTwrite+1 || tag != 20 {
+		t.Fatalf("got reply %d tag %d; want Rwrite tag 20", typ, tag)
+	}
+	if n := d.u32(); n != 2 {
+		t.Errorf("wrote %d bytes; want 2", n)
+	}
+}
+
+func TestSrv9pAcceptDeadline(t *testing.T) {
+	s, c := newTestSrv9p(t)
+
+	s.setAcceptDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := s.accept(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("accept past deadline: %v; want ErrDeadlineExceeded", err)
+	}
+	s.setAcceptDeadline(time.Now().Add(-time.Second))
+	if _, err := s.accept(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("accept with deadline in the past: %v; want ErrDeadlineExceeded", err)
+	}
+
+	// Clearing the deadline lets accept wait for a connection again,
+	// and a deadline set while it's waiting interrupts it.
+	s.setAcceptDeadline(time.Time{})
+	c.call(msgTwalk, 1, uint32(0), uint32(1), uint16(1), "tailscaled.sock")
+	c.send(msgTopen, 1, uint32(1), uint8(2))
+	conn, err := s.accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if typ, _, _ := c.recv(); typ != msgTopen+1 {
+		t.Fatalf("got reply %d; want Ropen", typ)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := s.accept()
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	s.setAcceptDeadline(time.Now())
+	if err := <-errc; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("waiting accept: %v; want ErrDeadlineExceeded", err)
+	}
+}
+
+func TestSrv9pDirectory(t *testing.T) {
+	_, c := newTestSrv9p(t)
+
+	// Only the one file exists.
+	c.send(msgTwalk, 1, uint32(0), uint32(1), uint16(1), "other")
+	if typ, _, _ := c.recv(); typ != msgRerror {
+		t.Errorf("walk to missing file: got reply %d; want Rerror", typ)
+	}
+
+	// Reading the directory gives the file's stat.
+	c.call(msgTwalk, 1, uint32(0), uint32(1), uint16(0))
+	c.call(msgTopen, 1, uint32(1), uint8(0))
+	d := c.call(msgTread, 1, uint32(1), uint64(0), uint32(1000))
+	st := &dec9p{b: d.bytes()}
+	st.u16()                      // size
+	st.next(2 + 4 + 13 + 4*3 + 8) // type, dev, qid, mode, atime, mtime, length
+	if name := st.str(); name != "tailscaled.sock" || st.err != nil {
+		t.Errorf("directory entry %q, %v; want tailscaled.sock", name, st.err)
+	}
+	if d := c.call(msgTread, 1, uint32(1), uint64(len(st.b)), uint32(1000)); len(d.bytes()) != 0 {
+		t.Errorf("second directory read isn't empty")
+	}
+
+	c.send(msgTcreate, 1, uint32(1), "new", uint32(0600), uint8(0))
+	if typ, _, _ := c.recv(); typ != msgRerror {
+		t.Errorf("create: got reply %d; want Rerror", typ)
+	}
+}
+
+// testAuthConv is an authConv9p that authenticates user once the
+// client has written "secret".
+type testAuthConv struct {
+	user   string
+	got    []byte
+	closed bool
+}
+
+func (c *testAuthConv) write(p []byte) error {
+	c.got = append(c.got, p...)
+	return nil
+}
+
+func (c *testAuthConv) read(n uint32) ([]byte, string, error) {
+	if string(c.got) == "secret" {
+		return nil, c.user, nil
+	}
+	return []byte("say secret"), "", nil
+}
+
+func (c *testAuthConv) close() error {
+	c.closed = true
+	return nil
+}
+
+func TestSrv9pAuth(t *testing.T) {
+	// Without an auth func, there's nothing to authenticate with.
+	_, c := newTestSrv9p(t)
+	c.send(msgTauth, 1, uint32(5), "glenda", "")
+	if typ, _, _ := c.recv(); typ != msgRerror {
+		t.Errorf("auth without auth func: got reply %d; want Rerror", typ)
+	}
+
+	cc, sc := net.Pipe()
+	conv := &testAuthConv{user: "glenda"}
+	s := newSrv9p(sc, "tailscaled.sock", "glenda", func() (authConv9p, error) {
+		return conv, nil
+	}, nil)
+	t.Cleanup(func() {
+		s.close()
+		cc.Close()
+	})
+	c = &client9p{t: t, conn: cc}
+	c.call(msgTversion, ^uint16(0), uint32(65536), "9P2000")
+	d := c.call(msgTauth, 1, uint32(5), "glenda", "")
+	if qtype := d.u8(); qtype != qtAuth9p {
+		t.Errorf("aqid type %#x; want %#x", qtype, qtAuth9p)
+	}
+
+	// Attaching without authenticating fails.
+	c.send(msgTattach, 1, uint32(0), noFid9p, "glenda", "")
+	if typ, _, _ := c.recv(); typ != msgRerror {
+		t.Errorf("attach with NOFID: got reply %d; want Rerror", typ)
+	}
+
+	// So does attaching before the conversation is done.
+	c.send(msgTattach, 1, uint32(0), uint32(5), "glenda", "")
+	if typ, _, _ := c.recv(); typ != msgRerror {
+		t.Errorf("attach before authenticating: got reply %d; want Rerror", typ)
+	}
+
+	d = c.call(msgTread, 1, uint32(5), uint64(0), uint32(100))
+	if got := string(d.bytes()); got != "say secret" {
+		t.Errorf("auth read %q; want %q", got, "say secret")
+	}
+	c.call(msgTwrite, 1, uint32(5), uint64(0), []byte("secret"))
+	if d := c.call(msgTread, 1, uint32(5), uint64(0), uint32(100)); len(d.bytes()) != 0 {
+		t.Errorf("auth read after authenticating isn't empty")
+	}
+
+	// The auth fid can only attach the user it authenticated.
+	c.send(msgTattach, 1, uint32(0), uint32(5), "other", "")
+	if typ, _, _ := c.recv(); typ != msgRerror {
+		t.Errorf("attach as another user: got reply %d; want Rerror", typ)
+	}
+	c.call(msgTattach, 1, uint32(0), uint32(5), "glenda", "")
+
+	// The auth fid is no file.
+	c.send(msgTwalk, 1, uint32(5), uint32(6), uint16(0))
+	if typ, _, _ := c.recv(); typ != msgRerror {
+		t.Errorf("walk of auth fid: got reply %d; want Rerror", typ)
+	}
+	c.call(msgTclunk, 1, uint32(5))
+	if !conv.closed {
+		t.Errorf("clunking the auth fid didn't close its conversation")
+	}
+}
+
+func TestSrv9pAuthAllowUser(t *testing.T) {
+	// attach authenticates as user on a new server owned by glenda
+	// that also allows "operator", and reports whether it could attach.
+	attach := func(user string) bool {
+		cc, sc := net.Pipe()
+		s := newSrv9p(sc, "tailscaled.sock", "glenda", func() (authConv9p, error) {
+			return &testAuthConv{user: user}, nil
+		}, func(user string) bool {
+			return user == "operator"
+		})
+		defer func() {
+			s.close()
+			cc.Close()
+		}()
+		c := &client9p{t: t, conn: cc}
+		c.call(msgTversion, ^uint16(0), uint32(65536), "9P2000")
+		c.call(msgTauth, 1, uint32(5), user, "")
+		c.call(msgTwrite, 1, uint32(5), uint64(0), []byte("secret"))
+		c.call(msgTread, 1, uint32(5), uint64(0), uint32(100))
+		c.send(msgTattach, 1, uint32(0), uint32(5), user, "")
+		typ, _, _ := c.recv()
+		return typ == msgTattach+1
+	}
+	for user, want := range map[string]bool{
+		"glenda":   true,
+		"operator": true,
+		"other":    false,
+	} {
+		if got := attach(user); got != want {
+			t.Errorf("attach as %q after authenticating = %v; want %v", user, got, want)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package safesocket
+
+import "net"
+
+// Transport is a way of connecting to, and listening for connections
+// from, tailscaled. Each platform provides its own implementation.
+type Transport interface {
+	// Connect connects to tailscaled using s. It does not retry.
+	Connect(s *ConnectionStrategy) (net.Conn, error)
+
+	// Listen listens for connections on path, whose meaning
+	// is platform-specific.
+	Listen(path string) (net.Listener, error)
+}
+
+// factotumTransport is a Transport that can require clients to
+// authenticate with factotum(4), for ListenWithFactotum.
+type factotumTransport interface {
+	listenWithFactotum(path string, allowUser func(string) bool) (net.Listener, error)
+}
+
+// defaultTransport is the Transport used by Connect and Listen.
+// It is a var for testing.
+var defaultTransport Transport = platformTransport{}
@@ -0,0 +1,54 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package safesocket
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// useTransport sets the defaultTransport to tr for the duration of t.
+func useTransport(t *testing.T, tr Transport) {
+	orig := defaultTransport
+	defaultTransport = tr
+	t.Cleanup(func() { defaultTransport = orig })
+}
+
+type fakeTransport struct {
+	connectPath string
+	listenPath  string
+}
+
+func (t *fakeTransport) Connect(s *ConnectionStrategy) (net.Conn, error) {
+	t.connectPath = s.path
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func (t *fakeTransport) Listen(path string) (net.Listener, error) {
+	t.listenPath = path
+	return nil, errors.New("fake listen")
+}
+
+func TestDefaultTransport(t *testing.T) {
+	ft := new(fakeTransport)
+	useTransport(t, ft)
+
+	c, err := Connect(DefaultConnectionStrategy("/fake/connect"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if ft.connectPath != "/fake/connect" {
+		t.Errorf("Connect used path %q; want %q", ft.connectPath, "/fake/connect")
+	}
+
+	if _, err := Listen("/fake/listen"); err == nil || err.Error() != "fake listen" {
+		t.Errorf("Listen error = %v; want fake listen", err)
+	}
+	if ft.listenPath != "/fake/listen" {
+		t.Errorf("Listen used path %q; want %q", ft.listenPath, "/fake/listen")
+	}
+}
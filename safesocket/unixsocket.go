@@ -16,14 +16,17 @@
 	"runtime"
 )
 
-func connect(s *ConnectionStrategy) (net.Conn, error) {
+// platformTransport is the Transport for Unix domain sockets.
+type platformTransport struct{}
+
+func (platformTransport) Connect(s *ConnectionStrategy) (net.Conn, error) {
 	if runtime.GOOS == "js" {
 		return nil, errors.New("safesocket.Connect not yet implemented on js/wasm")
 	}
 	return net.Dial("unix", s.path)
 }
 
-func listen(path string) (net.Listener, error) {
+func (platformTransport) Listen(path string) (net.Listener, error) {
 	// Unix sockets hang around in the filesystem even after nobody
 	// is listening on them. (Which is really unfortunate but long-
 	// entrenched semantics.) Try connecting first; if it works, then
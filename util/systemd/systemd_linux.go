@@ -9,7 +9,9 @@
 	"errors"
 	"log"
 	"os"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/mdlayher/sdnotify"
 )
@@ -30,8 +32,9 @@ func (l *logOnce) logf(format string, args ...any) {
 }
 
 var (
-	readyOnce  = &logOnce{}
-	statusOnce = &logOnce{}
+	readyOnce    = &logOnce{}
+	statusOnce   = &logOnce{}
+	watchdogOnce = &logOnce{}
 )
 
 func notifier() *sdnotify.Notifier {
@@ -75,3 +78,25 @@ func Status(format string, args ...any) {
 		statusOnce.logf("systemd: error notifying: %v", err)
 	}
 }
+
+// WatchdogInterval returns the watchdog timeout systemd has set for
+// this process (WatchdogSec= in the unit), or 0 if the watchdog is not
+// enabled. Watchdog should be called well within this interval.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Watchdog sends a watchdog keep-alive to systemd.
+func Watchdog() {
+	err := notifier().Notify("WATCHDOG=1")
+	if err != nil {
+		watchdogOnce.logf("systemd: error notifying: %v", err)
+	}
+}
@@ -5,5 +5,9 @@
 
 package systemd
 
-func Ready()                {}
-func Status(string, ...any) {}
+import "time"
+
+func Ready()                          {}
+func Status(string, ...any)           {}
+func WatchdogInterval() time.Duration { return 0 }
+func Watchdog()                       {}